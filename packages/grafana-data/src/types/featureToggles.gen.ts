@@ -47,4 +47,7 @@ export interface FeatureToggles {
   annotationComments?: boolean;
   migrationLocking?: boolean;
   fileStoreApi?: boolean;
+  queryServiceExpressions?: boolean;
+  promQueryBuilder?: boolean;
+  lokiQueryBuilder?: boolean;
 }
@@ -2,12 +2,16 @@ package api
 
 import (
 	"context"
+	"errors"
 	"net/http"
 
+	"github.com/grafana/grafana/pkg/api/dtos"
 	"github.com/grafana/grafana/pkg/api/response"
 	"github.com/grafana/grafana/pkg/models"
 	ac "github.com/grafana/grafana/pkg/services/accesscontrol"
+	"github.com/grafana/grafana/pkg/services/featuremgmt"
 	"github.com/grafana/grafana/pkg/setting"
+	"github.com/grafana/grafana/pkg/web"
 )
 
 func (hs *HTTPServer) AdminGetSettings(c *models.ReqContext) response.Response {
@@ -28,6 +32,123 @@ func (hs *HTTPServer) AdminGetStats(c *models.ReqContext) response.Response {
 	return response.JSON(200, statsQuery.Result)
 }
 
+// AdminGetQueryCircuitBreakers returns the state of the circuit breakers of
+// the data sources queried since startup.
+// GET /api/admin/query/circuit-breakers
+func (hs *HTTPServer) AdminGetQueryCircuitBreakers(c *models.ReqContext) response.Response {
+	return response.JSON(http.StatusOK, hs.queryDataService.CircuitBreakerStatuses())
+}
+
+// AdminGetQueryHealth returns the result of the last health check of the data
+// sources queried since startup.
+// GET /api/admin/query/health
+func (hs *HTTPServer) AdminGetQueryHealth(c *models.ReqContext) response.Response {
+	return response.JSON(http.StatusOK, hs.queryDataService.HealthStatuses())
+}
+
+// AdminGetFeatureToggles returns the flags of the feature registry with their
+// state in this instance, optionally filtered by stage.
+// GET /api/admin/feature-toggles
+func (hs *HTTPServer) AdminGetFeatureToggles(c *models.ReqContext) response.Response {
+	toggles := hs.Features.GetToggleStates()
+
+	stageName := c.Query("stage")
+	if stageName == "" {
+		return response.JSON(http.StatusOK, toggles)
+	}
+	stage, ok := featuremgmt.ParseFeatureFlagState(stageName)
+	if !ok {
+		return response.Error(http.StatusBadRequest, "Invalid feature toggle stage", nil)
+	}
+	filtered := make([]featuremgmt.FeatureToggleState, 0, len(toggles))
+	for _, toggle := range toggles {
+		if toggle.Stage == stage {
+			filtered = append(filtered, toggle)
+		}
+	}
+	return response.JSON(http.StatusOK, filtered)
+}
+
+// AdminUpdateFeatureToggle toggles a flag without a restart, the change is
+// persisted. Only the flags allowed to be toggled at runtime can be updated.
+// PUT /api/admin/feature-toggles/:name
+func (hs *HTTPServer) AdminUpdateFeatureToggle(c *models.ReqContext) response.Response {
+	form := dtos.AdminUpdateFeatureToggleForm{}
+	if err := web.Bind(c.Req, &form); err != nil {
+		return response.Error(http.StatusBadRequest, "bad request data", err)
+	}
+
+	name := web.Params(c.Req)[":name"]
+	if err := hs.FeatureOverrides.SetEnabled(c.Req.Context(), c.SignedInUser, name, *form.Enabled); err != nil {
+		return featureToggleErrorResponse(err)
+	}
+	return hs.featureToggleStateResponse(name)
+}
+
+// AdminUpdateFeatureToggleRollout sets the rule enabling a flag for a part of
+// the users only, the change is persisted. Only the flags allowed to be
+// toggled at runtime can have a rule.
+// PUT /api/admin/feature-toggles/:name/rollout
+func (hs *HTTPServer) AdminUpdateFeatureToggleRollout(c *models.ReqContext) response.Response {
+	rule := featuremgmt.RolloutRule{}
+	if err := web.Bind(c.Req, &rule); err != nil {
+		return response.Error(http.StatusBadRequest, "bad request data", err)
+	}
+
+	name := web.Params(c.Req)[":name"]
+	if err := hs.FeatureOverrides.SetRolloutRule(c.Req.Context(), name, &rule); err != nil {
+		return featureToggleErrorResponse(err)
+	}
+	return hs.featureToggleStateResponse(name)
+}
+
+// AdminDeleteFeatureToggleRollout removes the rollout rule of a flag.
+// DELETE /api/admin/feature-toggles/:name/rollout
+func (hs *HTTPServer) AdminDeleteFeatureToggleRollout(c *models.ReqContext) response.Response {
+	name := web.Params(c.Req)[":name"]
+	if err := hs.FeatureOverrides.SetRolloutRule(c.Req.Context(), name, nil); err != nil {
+		return featureToggleErrorResponse(err)
+	}
+	return hs.featureToggleStateResponse(name)
+}
+
+// AdminGetFeatureToggleHistory returns the changes of the state of a flag, the
+// most recent first.
+// GET /api/admin/feature-toggles/:name/history
+func (hs *HTTPServer) AdminGetFeatureToggleHistory(c *models.ReqContext) response.Response {
+	history, err := hs.FeatureOverrides.History(c.Req.Context(), web.Params(c.Req)[":name"])
+	if err != nil {
+		if errors.Is(err, featuremgmt.ErrFeatureToggleNotFound) {
+			return response.Error(http.StatusNotFound, "Feature toggle not found", err)
+		}
+		return response.Error(http.StatusInternalServerError, "Failed to get feature toggle history", err)
+	}
+	return response.JSON(http.StatusOK, history)
+}
+
+func (hs *HTTPServer) featureToggleStateResponse(name string) response.Response {
+	for _, toggle := range hs.Features.GetToggleStates() {
+		if toggle.Name == name {
+			return response.JSON(http.StatusOK, toggle)
+		}
+	}
+	return response.Error(http.StatusNotFound, "Feature toggle not found", nil)
+}
+
+func featureToggleErrorResponse(err error) response.Response {
+	switch {
+	case errors.Is(err, featuremgmt.ErrFeatureToggleNotFound):
+		return response.Error(http.StatusNotFound, "Feature toggle not found", err)
+	case errors.Is(err, featuremgmt.ErrFeatureToggleRequiresRestart):
+		return response.Error(http.StatusBadRequest, "Feature toggle can not be changed without a restart", err)
+	case errors.Is(err, featuremgmt.ErrFeatureToggleDependencies):
+		return response.Error(http.StatusBadRequest, err.Error(), err)
+	case errors.Is(err, featuremgmt.ErrInvalidRolloutRule):
+		return response.Error(http.StatusBadRequest, "Rollout percentage must be between 0 and 100", err)
+	}
+	return response.Error(http.StatusInternalServerError, "Failed to update feature toggle", err)
+}
+
 func (hs *HTTPServer) getAuthorizedSettings(ctx context.Context, user *models.SignedInUser, bag setting.SettingsBag) (setting.SettingsBag, error) {
 	if hs.AccessControl.IsDisabled() {
 		return bag, nil
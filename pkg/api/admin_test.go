@@ -1,14 +1,21 @@
 package api
 
 import (
+	"context"
+	"encoding/json"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 
+	"github.com/grafana/grafana/pkg/infra/kvstore"
 	"github.com/grafana/grafana/pkg/services/accesscontrol"
+	"github.com/grafana/grafana/pkg/services/featuremgmt"
+	featureoverrides "github.com/grafana/grafana/pkg/services/featuremgmt/overrides"
 	"github.com/grafana/grafana/pkg/services/sqlstore/mockstore"
 	"github.com/grafana/grafana/pkg/setting"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 type getSettingsTestCase struct {
@@ -159,3 +166,168 @@ func TestAdmin_AccessControl(t *testing.T) {
 		})
 	}
 }
+
+func TestAdminGetFeatureToggles(t *testing.T) {
+	sc := setupHTTPServer(t, true, false)
+
+	t.Run("it is only available to server admins", func(t *testing.T) {
+		setInitCtxSignedInOrgAdmin(sc.initCtx)
+		resp := callAPI(sc.server, http.MethodGet, "/api/admin/feature-toggles", nil, t)
+		assert.Equal(t, http.StatusForbidden, resp.Code)
+	})
+
+	sc.initCtx.SignedInUser.IsGrafanaAdmin = true
+	featuremgmt.WithFeaturesForTest(t, sc.hs.Features, featuremgmt.FlagDashboardPreviews, featuremgmt.FlagDatabaseMetrics, false)
+
+	getToggles := func(t *testing.T, url string) map[string]featuremgmt.FeatureToggleState {
+		resp := callAPI(sc.server, http.MethodGet, url, nil, t)
+		require.Equal(t, http.StatusOK, resp.Code)
+		var toggles []featuremgmt.FeatureToggleState
+		require.NoError(t, json.Unmarshal(resp.Body.Bytes(), &toggles))
+		byName := map[string]featuremgmt.FeatureToggleState{}
+		for _, toggle := range toggles {
+			byName[toggle.Name] = toggle
+		}
+		return byName
+	}
+
+	t.Run("it returns the state of every registered toggle", func(t *testing.T) {
+		toggles := getToggles(t, "/api/admin/feature-toggles")
+
+		require.Equal(t, len(sc.hs.Features.GetToggleStates()), len(toggles))
+		require.True(t, toggles[featuremgmt.FlagDashboardPreviews].Enabled)
+		require.Equal(t, featuremgmt.FeatureStateAlpha, toggles[featuremgmt.FlagDashboardPreviews].Stage)
+		require.False(t, toggles[featuremgmt.FlagDatabaseMetrics].Enabled)
+		require.False(t, toggles[featuremgmt.FlagDatabaseMetrics].EnabledByDefault)
+		require.NotEmpty(t, toggles[featuremgmt.FlagDatabaseMetrics].Description)
+	})
+
+	t.Run("it filters the toggles by stage", func(t *testing.T) {
+		toggles := getToggles(t, "/api/admin/feature-toggles?stage=stable")
+
+		require.Contains(t, toggles, featuremgmt.FlagDatabaseMetrics)
+		require.NotContains(t, toggles, featuremgmt.FlagDashboardPreviews)
+		for _, toggle := range toggles {
+			require.Equal(t, featuremgmt.FeatureStateStable, toggle.Stage)
+		}
+	})
+
+	t.Run("it rejects unknown stages", func(t *testing.T) {
+		resp := callAPI(sc.server, http.MethodGet, "/api/admin/feature-toggles?stage=ga", nil, t)
+		assert.Equal(t, http.StatusBadRequest, resp.Code)
+	})
+}
+
+func TestAdminUpdateFeatureToggle(t *testing.T) {
+	sc := setupHTTPServer(t, true, false)
+	setInitCtxSignedInOrgAdmin(sc.initCtx)
+	sc.initCtx.SignedInUser.IsGrafanaAdmin = true
+	sc.hs.Features = featuremgmt.WithFeatures()
+	overrides, err := featureoverrides.ProvideService(sc.hs.Features, kvstore.ProvideService(sc.db), sc.db)
+	require.NoError(t, err)
+	sc.hs.FeatureOverrides = overrides
+
+	t.Run("it toggles a flag allowed to be toggled at runtime", func(t *testing.T) {
+		resp := callAPI(sc.server, http.MethodPut, "/api/admin/feature-toggles/"+featuremgmt.FlagQueryServiceExpressions, strings.NewReader(`{"enabled": true}`), t)
+		require.Equal(t, http.StatusOK, resp.Code)
+		var toggle featuremgmt.FeatureToggleState
+		require.NoError(t, json.Unmarshal(resp.Body.Bytes(), &toggle))
+		require.True(t, toggle.Enabled)
+		require.True(t, sc.hs.Features.IsEnabled(featuremgmt.FlagQueryServiceExpressions))
+	})
+
+	t.Run("it rejects the flags requiring a restart", func(t *testing.T) {
+		resp := callAPI(sc.server, http.MethodPut, "/api/admin/feature-toggles/"+featuremgmt.FlagDashboardPreviews, strings.NewReader(`{"enabled": true}`), t)
+		require.Equal(t, http.StatusBadRequest, resp.Code)
+		require.False(t, sc.hs.Features.IsEnabled(featuremgmt.FlagDashboardPreviews))
+	})
+
+	t.Run("it returns 404 for unknown flags", func(t *testing.T) {
+		resp := callAPI(sc.server, http.MethodPut, "/api/admin/feature-toggles/unknown", strings.NewReader(`{"enabled": true}`), t)
+		require.Equal(t, http.StatusNotFound, resp.Code)
+	})
+
+	t.Run("it requires the state of the flag", func(t *testing.T) {
+		resp := callAPI(sc.server, http.MethodPut, "/api/admin/feature-toggles/"+featuremgmt.FlagQueryServiceExpressions, strings.NewReader(`{}`), t)
+		require.Equal(t, http.StatusBadRequest, resp.Code)
+	})
+}
+
+func TestAdminGetFeatureToggleHistory(t *testing.T) {
+	sc := setupHTTPServer(t, true, false)
+	setInitCtxSignedInOrgAdmin(sc.initCtx)
+	sc.initCtx.SignedInUser.IsGrafanaAdmin = true
+	sc.hs.Features = featuremgmt.WithFeatures()
+	overrides, err := featureoverrides.ProvideService(sc.hs.Features, kvstore.ProvideService(sc.db), sc.db)
+	require.NoError(t, err)
+	sc.hs.FeatureOverrides = overrides
+
+	t.Run("it returns the changes made through the API", func(t *testing.T) {
+		for _, enabled := range []string{"true", "false"} {
+			resp := callAPI(sc.server, http.MethodPut, "/api/admin/feature-toggles/"+featuremgmt.FlagTempoSearch, strings.NewReader(`{"enabled": `+enabled+`}`), t)
+			require.Equal(t, http.StatusOK, resp.Code)
+		}
+
+		resp := callAPI(sc.server, http.MethodGet, "/api/admin/feature-toggles/"+featuremgmt.FlagTempoSearch+"/history", nil, t)
+		require.Equal(t, http.StatusOK, resp.Code)
+		var history []featureoverrides.HistoryEntry
+		require.NoError(t, json.Unmarshal(resp.Body.Bytes(), &history))
+		require.Len(t, history, 2)
+		for i, newValue := range []bool{false, true} {
+			require.Equal(t, featuremgmt.FlagTempoSearch, history[i].Flag)
+			require.Equal(t, sc.initCtx.SignedInUser.UserId, history[i].UserID)
+			require.Equal(t, sc.initCtx.SignedInUser.Login, history[i].Actor)
+			require.Equal(t, featureoverrides.HistoryScopeGlobal, history[i].Scope)
+			require.Equal(t, !newValue, history[i].OldValue)
+			require.Equal(t, newValue, history[i].NewValue)
+		}
+	})
+
+	t.Run("it returns an empty history for unchanged flags", func(t *testing.T) {
+		resp := callAPI(sc.server, http.MethodGet, "/api/admin/feature-toggles/"+featuremgmt.FlagDashboardPreviews+"/history", nil, t)
+		require.Equal(t, http.StatusOK, resp.Code)
+		require.JSONEq(t, `[]`, resp.Body.String())
+	})
+
+	t.Run("it returns 404 for unknown flags", func(t *testing.T) {
+		resp := callAPI(sc.server, http.MethodGet, "/api/admin/feature-toggles/unknown/history", nil, t)
+		require.Equal(t, http.StatusNotFound, resp.Code)
+	})
+}
+
+func TestAdminUpdateFeatureToggleRollout(t *testing.T) {
+	sc := setupHTTPServer(t, true, false)
+	setInitCtxSignedInOrgAdmin(sc.initCtx)
+	sc.initCtx.SignedInUser.IsGrafanaAdmin = true
+	sc.hs.Features = featuremgmt.WithFeatures()
+	overrides, err := featureoverrides.ProvideService(sc.hs.Features, kvstore.ProvideService(sc.db), sc.db)
+	require.NoError(t, err)
+	sc.hs.FeatureOverrides = overrides
+	url := "/api/admin/feature-toggles/" + featuremgmt.FlagValidatedQueries + "/rollout"
+
+	t.Run("it sets the rollout rule of a flag", func(t *testing.T) {
+		resp := callAPI(sc.server, http.MethodPut, url, strings.NewReader(`{"percentage": 100, "userIds": [3]}`), t)
+		require.Equal(t, http.StatusOK, resp.Code)
+		var toggle featuremgmt.FeatureToggleState
+		require.NoError(t, json.Unmarshal(resp.Body.Bytes(), &toggle))
+		require.Equal(t, &featuremgmt.RolloutRule{Percentage: 100, UserIDs: []int64{3}}, toggle.Rollout)
+		require.True(t, sc.hs.Features.IsEnabledForUser(context.Background(), sc.initCtx.SignedInUser, featuremgmt.FlagValidatedQueries))
+	})
+
+	t.Run("it rejects invalid percentages", func(t *testing.T) {
+		resp := callAPI(sc.server, http.MethodPut, url, strings.NewReader(`{"percentage": 150}`), t)
+		require.Equal(t, http.StatusBadRequest, resp.Code)
+	})
+
+	t.Run("it rejects the flags requiring a restart", func(t *testing.T) {
+		resp := callAPI(sc.server, http.MethodPut, "/api/admin/feature-toggles/"+featuremgmt.FlagDashboardPreviews+"/rollout", strings.NewReader(`{"percentage": 5}`), t)
+		require.Equal(t, http.StatusBadRequest, resp.Code)
+	})
+
+	t.Run("it removes the rollout rule of a flag", func(t *testing.T) {
+		resp := callAPI(sc.server, http.MethodDelete, url, nil, t)
+		require.Equal(t, http.StatusOK, resp.Code)
+		_, ok := sc.hs.Features.GetRolloutRule(featuremgmt.FlagValidatedQueries)
+		require.False(t, ok)
+	})
+}
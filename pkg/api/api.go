@@ -334,6 +334,7 @@ func (hs *HTTPServer) registerRoutes() {
 		apiRoute.Group("/dashboards", func(dashboardRoute routing.RouteRegister) {
 			dashboardRoute.Get("/uid/:uid", authorize(reqSignedIn, ac.EvalPermission(ac.ActionDashboardsRead)), routing.Wrap(hs.GetDashboard))
 			dashboardRoute.Delete("/uid/:uid", authorize(reqSignedIn, ac.EvalPermission(ac.ActionDashboardsDelete)), routing.Wrap(hs.DeleteDashboardByUID))
+			dashboardRoute.Get("/uid/:uid/validate-queries", authorize(reqSignedIn, ac.EvalPermission(ac.ActionDashboardsRead)), routing.Wrap(hs.ValidateDashboardQueries))
 
 			if hs.ThumbService != nil {
 				dashboardRoute.Get("/uid/:uid/img/:kind/:theme", hs.ThumbService.GetImage)
@@ -477,7 +478,14 @@ func (hs *HTTPServer) registerRoutes() {
 			adminRoute.Get("/settings/features", authorize(reqGrafanaAdmin, ac.EvalPermission(ac.ActionSettingsRead)), hs.Features.HandleGetSettings)
 		}
 		adminRoute.Get("/stats", authorize(reqGrafanaAdmin, ac.EvalPermission(ac.ActionServerStatsRead)), routing.Wrap(hs.AdminGetStats))
+		adminRoute.Get("/feature-toggles", reqGrafanaAdmin, routing.Wrap(hs.AdminGetFeatureToggles))
+		adminRoute.Put("/feature-toggles/:name", reqGrafanaAdmin, routing.Wrap(hs.AdminUpdateFeatureToggle))
+		adminRoute.Put("/feature-toggles/:name/rollout", reqGrafanaAdmin, routing.Wrap(hs.AdminUpdateFeatureToggleRollout))
+		adminRoute.Delete("/feature-toggles/:name/rollout", reqGrafanaAdmin, routing.Wrap(hs.AdminDeleteFeatureToggleRollout))
+		adminRoute.Get("/feature-toggles/:name/history", reqGrafanaAdmin, routing.Wrap(hs.AdminGetFeatureToggleHistory))
 		adminRoute.Post("/pause-all-alerts", reqGrafanaAdmin, routing.Wrap(hs.PauseAllAlerts))
+		adminRoute.Get("/query/circuit-breakers", reqGrafanaAdmin, routing.Wrap(hs.AdminGetQueryCircuitBreakers))
+		adminRoute.Get("/query/health", reqGrafanaAdmin, routing.Wrap(hs.AdminGetQueryHealth))
 
 		if hs.ThumbService != nil && hs.Features.IsEnabled(featuremgmt.FlagDashboardPreviewsAdmin) {
 			adminRoute.Post("/crawler/start", reqGrafanaAdmin, routing.Wrap(hs.ThumbService.StartCrawler))
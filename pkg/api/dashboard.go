@@ -217,6 +217,23 @@ func (hs *HTTPServer) getDashboardHelper(ctx context.Context, orgID int64, id in
 	return query.Result, nil
 }
 
+// ValidateDashboardQueries reports for every panel of the dashboard whether
+// its queries can be run, without running them.
+// GET /api/dashboards/uid/:uid/validate-queries
+func (hs *HTTPServer) ValidateDashboardQueries(c *models.ReqContext) response.Response {
+	dash, rsp := hs.getDashboardHelper(c.Req.Context(), c.OrgId, 0, web.Params(c.Req)[":uid"])
+	if rsp != nil {
+		return rsp
+	}
+	guardian := guardian.New(c.Req.Context(), dash.Id, c.OrgId, c.SignedInUser)
+	if canView, err := guardian.CanView(); err != nil || !canView {
+		return dashboardGuardianResponse(err)
+	}
+
+	report := hs.queryDataService.ValidateDashboard(c.Req.Context(), c.SignedInUser, c.SkipCache, dash.Data)
+	return response.JSON(http.StatusOK, report)
+}
+
 func (hs *HTTPServer) DeleteDashboardByUID(c *models.ReqContext) response.Response {
 	return hs.deleteDashboard(c)
 }
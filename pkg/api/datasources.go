@@ -15,9 +15,11 @@ import (
 	"github.com/grafana/grafana/pkg/api/datasource"
 	"github.com/grafana/grafana/pkg/api/dtos"
 	"github.com/grafana/grafana/pkg/api/response"
+	"github.com/grafana/grafana/pkg/components/simplejson"
 	"github.com/grafana/grafana/pkg/infra/log"
 	"github.com/grafana/grafana/pkg/models"
 	"github.com/grafana/grafana/pkg/plugins/adapters"
+	"github.com/grafana/grafana/pkg/services/query"
 	"github.com/grafana/grafana/pkg/util"
 	"github.com/grafana/grafana/pkg/web"
 )
@@ -241,6 +243,14 @@ func validateURL(cmdType string, url string) response.Response {
 	return nil
 }
 
+func validateJSONData(jsonData *simplejson.Json) response.Response {
+	if err := query.ValidateOAuthPassThruHeader(&models.DataSource{JsonData: jsonData}); err != nil {
+		return response.Error(400, fmt.Sprintf("Validation error, %s", err), err)
+	}
+
+	return nil
+}
+
 // POST /api/datasources/
 func (hs *HTTPServer) AddDataSource(c *models.ReqContext) response.Response {
 	cmd := models.AddDataSourceCommand{}
@@ -255,6 +265,9 @@ func (hs *HTTPServer) AddDataSource(c *models.ReqContext) response.Response {
 			return resp
 		}
 	}
+	if resp := validateJSONData(cmd.JsonData); resp != nil {
+		return resp
+	}
 
 	if err := hs.DataSourcesService.AddDataSource(c.Req.Context(), &cmd); err != nil {
 		if errors.Is(err, models.ErrDataSourceNameExists) || errors.Is(err, models.ErrDataSourceUidExists) {
@@ -288,6 +301,9 @@ func (hs *HTTPServer) UpdateDataSource(c *models.ReqContext) response.Response {
 	if resp := validateURL(cmd.Type, cmd.Url); resp != nil {
 		return resp
 	}
+	if resp := validateJSONData(cmd.JsonData); resp != nil {
+		return resp
+	}
 
 	ds, err := hs.getRawDataSourceById(c.Req.Context(), cmd.Id, cmd.OrgId)
 	if err != nil {
@@ -453,7 +469,7 @@ func (hs *HTTPServer) CallDatasourceResource(c *models.ReqContext) {
 		return
 	}
 
-	hs.callPluginResource(c, plugin.ID, ds.Uid)
+	hs.callPluginResource(c, plugin.ID, ds)
 }
 
 func convertModelToDtos(ds *models.DataSource) dtos.DataSource {
@@ -12,6 +12,7 @@ import (
 
 	"github.com/grafana/grafana/pkg/api/response"
 	"github.com/grafana/grafana/pkg/api/routing"
+	"github.com/grafana/grafana/pkg/components/simplejson"
 	"github.com/grafana/grafana/pkg/models"
 	"github.com/grafana/grafana/pkg/services/accesscontrol"
 	"github.com/grafana/grafana/pkg/services/datasources"
@@ -98,6 +99,29 @@ func TestAddDataSource_InvalidURL(t *testing.T) {
 	assert.Equal(t, 400, sc.resp.Code)
 }
 
+// Adding data sources forwarding the OAuth token in a reserved header should lead to an error.
+func TestAddDataSource_ReservedOAuthPassThruHeader(t *testing.T) {
+	sc := setupScenarioContext(t, "/api/datasources")
+	hs := &HTTPServer{
+		DataSourcesService: &dataSourcesServiceMock{},
+	}
+
+	sc.m.Post(sc.url, routing.Wrap(func(c *models.ReqContext) response.Response {
+		c.Req.Body = mockRequestBody(models.AddDataSourceCommand{
+			Name:     "Test",
+			Url:      "http://localhost:5432",
+			Access:   "proxy",
+			Type:     "test",
+			JsonData: simplejson.NewFromAny(map[string]interface{}{"oauthPassThruHeaderName": "X-Grafana-User-Login"}),
+		})
+		return hs.AddDataSource(c)
+	}))
+
+	sc.fakeReqWithParams("POST", sc.url, map[string]string{}).exec()
+
+	assert.Equal(t, 400, sc.resp.Code)
+}
+
 // Adding data sources with URLs not specifying protocol should work.
 func TestAddDataSource_URLWithoutProtocol(t *testing.T) {
 	const name = "Test"
@@ -0,0 +1,5 @@
+package dtos
+
+type AdminUpdateFeatureToggleForm struct {
+	Enabled *bool `json:"enabled" binding:"Required"`
+}
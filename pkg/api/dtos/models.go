@@ -58,6 +58,10 @@ type MetricRequest struct {
 	// required: true
 	// example: now
 	To string `json:"to"`
+	// Timezone IANA name of the time zone relative times like now/d are resolved in. Defaults to UTC.
+	// required: false
+	// example: Europe/Stockholm
+	Timezone string `json:"timezone"`
 	// queries.refId – Specifies an identifier of the query. Is optional and default to “A”.
 	// queries.datasourceId – Specifies the data source to be queried. Each query in the request must have an unique datasourceId.
 	// queries.maxDataPoints - Species maximum amount of data points that dashboard panel can render. Is optional and default to 100.
@@ -65,6 +69,16 @@ type MetricRequest struct {
 	// required: true
 	// example: [ { "refId": "A", "intervalMs": 86400000, "maxDataPoints": 1092, "datasourceId": 86, "rawSql": "SELECT 1 as valueOne, 2 as valueTwo", "format": "table" } ]
 	Queries []*simplejson.Json `json:"queries"`
+	// DatasourceUID replaces the data source of every query, except expressions, with the data source of that uid.
+	// The data source must be of the same type as the data sources of the queries.
+	// required: false
+	// example: PD8C576611E62080A
+	DatasourceUID string `json:"datasourceUid"`
+	// PluginContextAttrs are forwarded to the data source plugins in X-Grafana-Ctx-<name> headers.
+	// Each attribute must be listed in the allowedPluginContextAttrs of the JSON data of the data source.
+	// required: false
+	// example: { "samplingLevel": "low" }
+	PluginContextAttrs map[string]string `json:"pluginContextAttrs"`
 	// required: false
 	Debug bool `json:"debug"`
 }
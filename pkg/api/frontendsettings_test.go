@@ -136,3 +136,32 @@ func TestHTTPServer_GetFrontendSettings_hideVersionAnonymous(t *testing.T) {
 		})
 	}
 }
+
+func TestHTTPServer_GetFrontendSettings_featureToggles(t *testing.T) {
+	type settings struct {
+		FeatureToggles map[string]bool `json:"featureToggles"`
+	}
+
+	features := featuremgmt.WithFeatures(featuremgmt.FlagAccesscontrol, featuremgmt.FlagEnvelopeEncryption, featuremgmt.FlagTempoSearch)
+	m, _ := setupTestEnvironment(t, setting.NewCfg(), features)
+
+	getFeatureToggles := func(t *testing.T) map[string]bool {
+		recorder := httptest.NewRecorder()
+		m.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/api/frontend/settings", nil))
+		require.Equal(t, http.StatusOK, recorder.Code)
+		got := settings{}
+		require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &got))
+		return got.FeatureToggles
+	}
+
+	assert.Equal(t, map[string]bool{
+		featuremgmt.FlagAccesscontrol: true,
+		featuremgmt.FlagTempoSearch:   true,
+	}, getFeatureToggles(t))
+
+	require.NoError(t, features.SetEnabled(featuremgmt.FlagTempoSearch, false))
+	require.NoError(t, features.SetEnabled(featuremgmt.FlagQueryServiceExpressions, true))
+	assert.Equal(t, map[string]bool{
+		featuremgmt.FlagAccesscontrol: true,
+	}, getFeatureToggles(t))
+}
@@ -1,8 +1,13 @@
 package api
 
 import (
+	"context"
 	"errors"
+	"fmt"
+	"math"
 	"net/http"
+	"strconv"
+	"time"
 
 	"github.com/grafana/grafana-plugin-sdk-go/backend"
 	"github.com/grafana/grafana/pkg/api/dtos"
@@ -14,7 +19,10 @@ import (
 	"github.com/grafana/grafana/pkg/web"
 )
 
-func (hs *HTTPServer) handleQueryMetricsError(err error) *response.NormalResponse {
+func (hs *HTTPServer) handleQueryMetricsError(err error) response.Response {
+	if errors.Is(err, context.Canceled) {
+		return response.ClientClosed()
+	}
 	if errors.Is(err, models.ErrDataSourceAccessDenied) {
 		return response.Error(http.StatusForbidden, "Access denied to data source", err)
 	}
@@ -22,24 +30,88 @@ func (hs *HTTPServer) handleQueryMetricsError(err error) *response.NormalRespons
 	if errors.As(err, &badQuery) {
 		return response.Error(http.StatusBadRequest, util.Capitalize(badQuery.Message), err)
 	}
+	var decryptionErr *query.ErrDatasourceSecretsDecryption
+	if errors.As(err, &decryptionErr) {
+		message := fmt.Sprintf("Could not decrypt the secrets of data source %s, check that the secret_key setting matches the one used when the data source was saved", decryptionErr.DatasourceName)
+		return response.Error(http.StatusBadGateway, message, err)
+	}
+	var quotaExceeded *query.ErrQuotaExceeded
+	if errors.As(err, &quotaExceeded) {
+		return response.Error(http.StatusTooManyRequests, "Query quota exceeded for data source", err).SetHeader("Retry-After", retryAfterHeader(quotaExceeded.RetryAfter))
+	}
+	var queueFull *query.ErrQueryQueueFull
+	if errors.As(err, &queueFull) {
+		return response.Error(http.StatusTooManyRequests, "Too many queries in flight, try again later", err).SetHeader("Retry-After", retryAfterHeader(queueFull.RetryAfter))
+	}
 	return response.Error(http.StatusInternalServerError, "Query data error", err)
 }
 
+// withDownsampling returns a copy of ctx downsampling the time series of the
+// responses to the maxSeriesPoints query parameter, using the algorithm of the
+// downsampleMethod parameter.
+func withDownsampling(ctx context.Context, c *models.ReqContext) (context.Context, error) {
+	maxPoints := c.QueryInt("maxSeriesPoints")
+	if maxPoints == 0 {
+		return ctx, nil
+	}
+	opts, err := query.NewDownsampleOptions(maxPoints, c.Query("downsampleMethod"))
+	if err != nil {
+		return ctx, err
+	}
+	return query.WithDownsampling(ctx, opts), nil
+}
+
 // QueryMetricsV2 returns query metrics.
 // POST /api/ds/query   DataSource query w/ expressions
+// The responses are streamed as newline delimited JSON when requested with
+// stream=true or an Accept: application/x-ndjson header.
 func (hs *HTTPServer) QueryMetricsV2(c *models.ReqContext) response.Response {
 	reqDTO := dtos.MetricRequest{}
 	if err := web.Bind(c.Req, &reqDTO); err != nil {
 		return response.Error(http.StatusBadRequest, "bad request data", err)
 	}
 
-	resp, err := hs.queryDataService.QueryData(c.Req.Context(), c.SignedInUser, c.SkipCache, reqDTO, true)
+	ctx := query.WithRequestID(c.Req.Context(), c.Req.Header.Get("X-Request-Id"))
+	if c.QueryBool("ignoreHealth") {
+		ctx = query.WithIgnoreHealth(ctx)
+	}
+	if c.QueryBool("includeHidden") {
+		ctx = query.WithIncludeHidden(ctx)
+	}
+	ctx, err := withDownsampling(ctx, c)
+	if err != nil {
+		return hs.handleQueryMetricsError(err)
+	}
+	if c.QueryBool("validateOnly") {
+		return hs.validateQueries(ctx, c, reqDTO)
+	}
+	if wantsQueryStream(c) {
+		return &queryStreamResponse{
+			hs:    hs,
+			order: refIDOrder(reqDTO),
+			run: func(send func(backend.Responses) error) error {
+				return hs.queryDataService.QueryDataStream(ctx, c.SignedInUser, c.SkipCache, reqDTO, true, send)
+			},
+		}
+	}
+
+	resp, err := hs.queryDataService.QueryData(ctx, c.SignedInUser, c.SkipCache, reqDTO, true)
 	if err != nil {
 		return hs.handleQueryMetricsError(err)
 	}
 	return toJsonStreamingResponse(resp)
 }
 
+// validateQueries reports whether the queries of the request could be run,
+// without sending them to the data sources.
+func (hs *HTTPServer) validateQueries(ctx context.Context, c *models.ReqContext, reqDTO dtos.MetricRequest) response.Response {
+	report, err := hs.queryDataService.ValidateQueries(ctx, c.SignedInUser, c.SkipCache, reqDTO)
+	if err != nil {
+		return hs.handleQueryMetricsError(err)
+	}
+	return response.JSON(http.StatusOK, report)
+}
+
 // QueryMetrics returns query metrics
 // POST /api/tsdb/query
 //nolint: staticcheck // legacydata.DataResponse deprecated
@@ -50,7 +122,21 @@ func (hs *HTTPServer) QueryMetrics(c *models.ReqContext) response.Response {
 		return response.Error(http.StatusBadRequest, "bad request data", err)
 	}
 
-	sdkResp, err := hs.queryDataService.QueryData(c.Req.Context(), c.SignedInUser, c.SkipCache, reqDto, false)
+	ctx := query.WithRequestID(c.Req.Context(), c.Req.Header.Get("X-Request-Id"))
+	if c.QueryBool("ignoreHealth") {
+		ctx = query.WithIgnoreHealth(ctx)
+	}
+	if c.QueryBool("includeHidden") {
+		ctx = query.WithIncludeHidden(ctx)
+	}
+	ctx, err := withDownsampling(ctx, c)
+	if err != nil {
+		return hs.handleQueryMetricsError(err)
+	}
+	if c.QueryBool("validateOnly") {
+		return hs.validateQueries(ctx, c, reqDto)
+	}
+	sdkResp, err := hs.queryDataService.QueryData(ctx, c.SignedInUser, c.SkipCache, reqDto, false)
 	if err != nil {
 		return hs.handleQueryMetricsError(err)
 	}
@@ -76,24 +162,100 @@ func (hs *HTTPServer) QueryMetrics(c *models.ReqContext) response.Response {
 	}
 
 	statusCode := http.StatusOK
+	var retryAfter time.Duration
 	for _, res := range legacyResp.Results {
 		if res.Error != nil {
 			res.ErrorString = res.Error.Error()
 			legacyResp.Message = res.ErrorString
-			statusCode = http.StatusBadRequest
+			statusCode = queryErrorStatus(statusCode, res.Error)
+			retryAfter = queryRetryAfter(retryAfter, res.Error)
 		}
 	}
 
-	return response.JSON(statusCode, &legacyResp)
+	resp := response.JSON(statusCode, &legacyResp)
+	if retryAfter > 0 {
+		resp.SetHeader("Retry-After", retryAfterHeader(retryAfter))
+	}
+	return resp
 }
 
 func toJsonStreamingResponse(qdr *backend.QueryDataResponse) response.Response {
 	statusCode := http.StatusOK
+	var retryAfter time.Duration
 	for _, res := range qdr.Responses {
 		if res.Error != nil {
-			statusCode = http.StatusBadRequest
+			statusCode = queryErrorStatus(statusCode, res.Error)
+			retryAfter = queryRetryAfter(retryAfter, res.Error)
 		}
 	}
 
-	return response.JSONStreaming(statusCode, qdr)
+	resp := response.JSONStreaming(statusCode, qdr)
+	if retryAfter > 0 {
+		resp = resp.SetHeader("Retry-After", retryAfterHeader(retryAfter))
+	}
+	return resp
+}
+
+// queryErrorStatus returns the status code for a response containing the
+// given per-query error, keeping the most severe one seen so far.
+func queryErrorStatus(current int, err error) int {
+	statusCode := http.StatusBadRequest
+
+	var timeout *query.ErrQueryTimeout
+	var rateLimited *query.ErrRateLimited
+	var quotaExceeded *query.ErrQuotaExceeded
+	var queueFull *query.ErrQueryQueueFull
+	var decryptionErr *query.ErrDatasourceSecretsDecryption
+	var unavailable *query.ErrDatasourceUnavailable
+	var unhealthy *query.ErrDatasourceUnhealthy
+	var identityRequired *query.ErrOAuthIdentityRequired
+	var scopesMissing *query.ErrOAuthScopesMissing
+	switch {
+	case errors.As(err, &timeout):
+		statusCode = http.StatusGatewayTimeout
+	case errors.As(err, &decryptionErr):
+		statusCode = http.StatusBadGateway
+	case errors.As(err, &rateLimited), errors.As(err, &quotaExceeded), errors.As(err, &queueFull):
+		statusCode = http.StatusTooManyRequests
+	case errors.As(err, &unavailable), errors.As(err, &unhealthy):
+		statusCode = http.StatusServiceUnavailable
+	case errors.As(err, &identityRequired), errors.As(err, &scopesMissing):
+		statusCode = http.StatusForbidden
+	}
+
+	if statusCode > current {
+		return statusCode
+	}
+	return current
+}
+
+// queryRetryAfter returns when the throttled queries of a response may be
+// retried, keeping the longest hint of the per-query errors seen so far.
+func queryRetryAfter(current time.Duration, err error) time.Duration {
+	var retryAfter time.Duration
+
+	var rateLimited *query.ErrRateLimited
+	var quotaExceeded *query.ErrQuotaExceeded
+	var queueFull *query.ErrQueryQueueFull
+	switch {
+	case errors.As(err, &rateLimited):
+		retryAfter = rateLimited.RetryAfter
+	// The quota and the queue of the data sources of a mixed request are
+	// reported for each of their queries.
+	case errors.As(err, &quotaExceeded):
+		retryAfter = quotaExceeded.RetryAfter
+	case errors.As(err, &queueFull):
+		retryAfter = queueFull.RetryAfter
+	}
+
+	if retryAfter > current {
+		return retryAfter
+	}
+	return current
+}
+
+// retryAfterHeader returns the Retry-After header value of a retry hint, in
+// seconds rounded up.
+func retryAfterHeader(retryAfter time.Duration) string {
+	return strconv.Itoa(int(math.Ceil(retryAfter.Seconds())))
 }
@@ -0,0 +1,134 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana/pkg/api/dtos"
+	"github.com/grafana/grafana/pkg/models"
+)
+
+const ndjsonContentType = "application/x-ndjson"
+
+// wantsQueryStream reports whether the client asked for the responses of a
+// query request to be streamed, with the stream=true parameter or by accepting
+// newline delimited JSON.
+func wantsQueryStream(c *models.ReqContext) bool {
+	return c.QueryBool("stream") || strings.Contains(c.Req.Header.Get("Accept"), ndjsonContentType)
+}
+
+// queryStreamSummary is the last object of a streamed query response. Status
+// is the status code the buffered response would have had.
+type queryStreamSummary struct {
+	Status int               `json:"status"`
+	Errors map[string]string `json:"errors"`
+	Error  string            `json:"error,omitempty"`
+}
+
+// queryStreamResponse writes the responses of a query request as newline
+// delimited JSON. Every refId is written as a query data response of its own
+// as soon as its data source answered, followed by a summary object.
+type queryStreamResponse struct {
+	hs *HTTPServer
+	// order is the position of the refIds in the request, responses of the
+	// same data source are written in that order.
+	order map[string]int
+	run   func(send func(backend.Responses) error) error
+}
+
+func (r *queryStreamResponse) Status() int {
+	return http.StatusOK
+}
+
+func (r *queryStreamResponse) Body() []byte {
+	return nil
+}
+
+func (r *queryStreamResponse) WriteTo(c *models.ReqContext) {
+	enc := json.NewEncoder(c.Resp)
+	summary := queryStreamSummary{Status: http.StatusOK, Errors: map[string]string{}}
+
+	started := false
+	start := func() {
+		if !started {
+			c.Resp.Header().Set("Content-Type", ndjsonContentType)
+			c.Resp.WriteHeader(http.StatusOK)
+			started = true
+		}
+	}
+
+	err := r.run(func(responses backend.Responses) error {
+		start()
+		for _, refID := range r.sortedRefIDs(responses) {
+			res := responses[refID]
+			if res.Error != nil {
+				summary.Errors[refID] = res.Error.Error()
+				summary.Status = queryErrorStatus(summary.Status, res.Error)
+			}
+			if err := enc.Encode(&backend.QueryDataResponse{Responses: backend.Responses{refID: res}}); err != nil {
+				return err
+			}
+		}
+		c.Resp.Flush()
+		return nil
+	})
+
+	// Nothing was written yet, the error can be reported as usual.
+	if err != nil && !started {
+		r.hs.handleQueryMetricsError(err).WriteTo(c)
+		return
+	}
+	if errors.Is(err, context.Canceled) {
+		return
+	}
+
+	// The status is already sent when a late error occurs, report it in the
+	// summary instead.
+	start()
+	if err != nil {
+		c.Logger.Warn("Streamed query request failed", "error", err)
+		summary.Error = err.Error()
+		if status := r.hs.handleQueryMetricsError(err).Status(); status > summary.Status {
+			summary.Status = status
+		}
+	}
+	if err := enc.Encode(map[string]queryStreamSummary{"summary": summary}); err != nil {
+		c.Logger.Error("Error writing to response", "err", err)
+	}
+}
+
+// refIDOrder returns the position of every refId in the request.
+func refIDOrder(reqDTO dtos.MetricRequest) map[string]int {
+	order := map[string]int{}
+	for i, q := range reqDTO.Queries {
+		refID := q.Get("refId").MustString("A")
+		if _, ok := order[refID]; !ok {
+			order[refID] = i
+		}
+	}
+	return order
+}
+
+func (r *queryStreamResponse) sortedRefIDs(responses backend.Responses) []string {
+	refIDs := make([]string, 0, len(responses))
+	for refID := range responses {
+		refIDs = append(refIDs, refID)
+	}
+	sort.Slice(refIDs, func(i, j int) bool {
+		oi, iok := r.order[refIDs[i]]
+		oj, jok := r.order[refIDs[j]]
+		if iok != jok {
+			return iok
+		}
+		if oi != oj {
+			return oi < oj
+		}
+		return refIDs[i] < refIDs[j]
+	})
+	return refIDs
+}
@@ -0,0 +1,118 @@
+package api
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana/pkg/infra/log"
+	"github.com/grafana/grafana/pkg/models"
+	"github.com/grafana/grafana/pkg/services/query"
+	"github.com/grafana/grafana/pkg/web"
+	"github.com/stretchr/testify/require"
+)
+
+func TestQueryStreamResponse(t *testing.T) {
+	serve := func(t *testing.T, run func(send func(backend.Responses) error) error) *http.Response {
+		t.Helper()
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			c := &models.ReqContext{
+				Context: &web.Context{Req: r, Resp: web.NewResponseWriter(r.Method, w)},
+				Logger:  log.New("test"),
+			}
+			resp := &queryStreamResponse{
+				hs:    &HTTPServer{},
+				order: map[string]int{"B": 0, "A": 1, "C": 2},
+				run:   run,
+			}
+			resp.WriteTo(c)
+		}))
+		t.Cleanup(server.Close)
+
+		resp, err := http.Get(server.URL)
+		require.NoError(t, err)
+		t.Cleanup(func() { _ = resp.Body.Close() })
+		return resp
+	}
+
+	readLine := func(t *testing.T, r *bufio.Reader) map[string]json.RawMessage {
+		t.Helper()
+		line, err := r.ReadBytes('\n')
+		require.NoError(t, err)
+		var obj map[string]json.RawMessage
+		require.NoError(t, json.Unmarshal(line, &obj))
+		return obj
+	}
+
+	resultRefIDs := func(t *testing.T, obj map[string]json.RawMessage) []string {
+		t.Helper()
+		var results map[string]json.RawMessage
+		require.NoError(t, json.Unmarshal(obj["results"], &results))
+		refIDs := []string{}
+		for refID := range results {
+			refIDs = append(refIDs, refID)
+		}
+		return refIDs
+	}
+
+	readSummary := func(t *testing.T, r *bufio.Reader) queryStreamSummary {
+		t.Helper()
+		var summary queryStreamSummary
+		require.NoError(t, json.Unmarshal(readLine(t, r)["summary"], &summary))
+		return summary
+	}
+
+	t.Run("it flushes every data source before the next one answered", func(t *testing.T) {
+		proceed := make(chan struct{})
+		resp := serve(t, func(send func(backend.Responses) error) error {
+			if err := send(backend.Responses{"A": {}, "B": {}}); err != nil {
+				return err
+			}
+			<-proceed
+			return send(backend.Responses{"C": {Error: errors.New("syntax error")}})
+		})
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		require.Equal(t, ndjsonContentType, resp.Header.Get("Content-Type"))
+
+		r := bufio.NewReader(resp.Body)
+		require.Equal(t, []string{"B"}, resultRefIDs(t, readLine(t, r)))
+		require.Equal(t, []string{"A"}, resultRefIDs(t, readLine(t, r)))
+
+		close(proceed)
+		require.Equal(t, []string{"C"}, resultRefIDs(t, readLine(t, r)))
+
+		summary := readSummary(t, r)
+		require.Equal(t, http.StatusBadRequest, summary.Status)
+		require.Equal(t, map[string]string{"C": "syntax error"}, summary.Errors)
+		require.Empty(t, summary.Error)
+	})
+
+	t.Run("it reports late errors in the summary", func(t *testing.T) {
+		resp := serve(t, func(send func(backend.Responses) error) error {
+			if err := send(backend.Responses{"A": {}}); err != nil {
+				return err
+			}
+			return errors.New("plugin crashed")
+		})
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+
+		r := bufio.NewReader(resp.Body)
+		require.Equal(t, []string{"A"}, resultRefIDs(t, readLine(t, r)))
+
+		summary := readSummary(t, r)
+		require.Equal(t, http.StatusInternalServerError, summary.Status)
+		require.Equal(t, "plugin crashed", summary.Error)
+	})
+
+	t.Run("it writes a regular error response when nothing was sent", func(t *testing.T) {
+		resp := serve(t, func(send func(backend.Responses) error) error {
+			return query.NewErrBadQuery("no queries found")
+		})
+		require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+		require.NotEqual(t, ndjsonContentType, resp.Header.Get("Content-Type"))
+	})
+}
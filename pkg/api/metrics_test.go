@@ -0,0 +1,108 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana/pkg/api/response"
+	"github.com/grafana/grafana/pkg/models"
+	"github.com/grafana/grafana/pkg/services/query"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandleQueryMetricsError(t *testing.T) {
+	hs := &HTTPServer{}
+
+	tests := []struct {
+		desc   string
+		err    error
+		status int
+	}{
+		{desc: "access denied", err: models.ErrDataSourceAccessDenied, status: http.StatusForbidden},
+		{desc: "bad query", err: query.NewErrBadQuery("no queries found"), status: http.StatusBadRequest},
+		{desc: "quota exceeded", err: &query.ErrQuotaExceeded{DatasourceUID: "ds", RetryAfter: time.Second}, status: http.StatusTooManyRequests},
+		{desc: "query queue full", err: &query.ErrQueryQueueFull{Waited: time.Second, RetryAfter: time.Second}, status: http.StatusTooManyRequests},
+		{desc: "query queue full", err: &query.ErrQueryQueueFull{Waited: time.Second, RetryAfter: time.Second}, status: http.StatusTooManyRequests},
+		{desc: "secrets decryption", err: &query.ErrDatasourceSecretsDecryption{DatasourceUID: "ds", DatasourceName: "Broken", Err: errors.New("wrong key")}, status: http.StatusBadGateway},
+		{desc: "client closed request", err: context.Canceled, status: response.StatusClientClosedRequest},
+		{desc: "other errors", err: errors.New("boom"), status: http.StatusInternalServerError},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			resp := hs.handleQueryMetricsError(tt.err)
+			require.Equal(t, tt.status, resp.Status())
+		})
+	}
+
+	t.Run("secrets decryption errors tell which data source is affected", func(t *testing.T) {
+		resp := hs.handleQueryMetricsError(&query.ErrDatasourceSecretsDecryption{DatasourceUID: "ds", DatasourceName: "Broken", Err: errors.New("wrong key")})
+		require.Contains(t, string(resp.Body()), "Could not decrypt the secrets of data source Broken")
+	})
+}
+
+func TestQueryErrorStatus(t *testing.T) {
+	tests := []struct {
+		desc   string
+		err    error
+		status int
+	}{
+		{desc: "query errors", err: errors.New("syntax error"), status: http.StatusBadRequest},
+		{desc: "timeouts", err: &query.ErrQueryTimeout{RefID: "A", Timeout: time.Second}, status: http.StatusGatewayTimeout},
+		{desc: "rate limits", err: &query.ErrRateLimited{RefID: "A", DatasourceUID: "ds"}, status: http.StatusTooManyRequests},
+		{desc: "quota exceeded", err: &query.ErrQuotaExceeded{DatasourceUID: "ds", RetryAfter: time.Second}, status: http.StatusTooManyRequests},
+		{desc: "unavailable data sources", err: &query.ErrDatasourceUnavailable{RefID: "A", DatasourceUID: "ds"}, status: http.StatusServiceUnavailable},
+		{desc: "unhealthy data sources", err: &query.ErrDatasourceUnhealthy{RefID: "A", DatasourceUID: "ds"}, status: http.StatusServiceUnavailable},
+		{desc: "principals without OAuth identity", err: &query.ErrOAuthIdentityRequired{DatasourceName: "ds", Principal: "an API key"}, status: http.StatusForbidden},
+		{desc: "missing OAuth scopes", err: &query.ErrOAuthScopesMissing{DatasourceName: "ds", MissingScopes: []string{"openid"}}, status: http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			require.Equal(t, tt.status, queryErrorStatus(http.StatusOK, tt.err))
+		})
+	}
+}
+
+func TestQueryDataResponseRetryAfter(t *testing.T) {
+	t.Run("throttled queries tell when to retry", func(t *testing.T) {
+		resp := toJsonStreamingResponse(&backend.QueryDataResponse{Responses: backend.Responses{
+			"A": {Error: &query.ErrRateLimited{RefID: "A", DatasourceUID: "ds", RetryAfter: 1500 * time.Millisecond}},
+			"B": {Error: &query.ErrRateLimited{RefID: "B", DatasourceUID: "ds", RetryAfter: 3 * time.Second}},
+			"C": {},
+		}})
+		require.Equal(t, http.StatusTooManyRequests, resp.Status())
+		require.Equal(t, "3", resp.(response.StreamingResponse).Header().Get("Retry-After"))
+	})
+
+	t.Run("the quota of a data source of a mixed request tells when to retry", func(t *testing.T) {
+		resp := toJsonStreamingResponse(&backend.QueryDataResponse{Responses: backend.Responses{
+			"A": {},
+			"B": {Error: &query.ErrQuotaExceeded{DatasourceUID: "ds-b", RetryAfter: 20 * time.Second}},
+			"C": {Error: &query.ErrRateLimited{RefID: "C", DatasourceUID: "ds-c", RetryAfter: 5 * time.Second}},
+		}})
+		require.Equal(t, http.StatusTooManyRequests, resp.Status())
+		require.Equal(t, "20", resp.(response.StreamingResponse).Header().Get("Retry-After"))
+	})
+
+	t.Run("the queue timeout of a data source of a mixed request tells when to retry", func(t *testing.T) {
+		resp := toJsonStreamingResponse(&backend.QueryDataResponse{Responses: backend.Responses{
+			"A": {},
+			"B": {Error: &query.ErrQueryQueueFull{Waited: time.Second, RetryAfter: time.Second}},
+		}})
+		require.Equal(t, http.StatusTooManyRequests, resp.Status())
+		require.Equal(t, "1", resp.(response.StreamingResponse).Header().Get("Retry-After"))
+	})
+
+	t.Run("other errors don't tell when to retry", func(t *testing.T) {
+		resp := toJsonStreamingResponse(&backend.QueryDataResponse{Responses: backend.Responses{
+			"A": {Error: errors.New("syntax error")},
+		}})
+		require.Equal(t, http.StatusBadRequest, resp.Status())
+		require.Empty(t, resp.(response.StreamingResponse).Header().Get("Retry-After"))
+	})
+}
@@ -1045,6 +1045,18 @@ func (m *mockOAuthTokenService) GetCurrentOAuthToken(ctx context.Context, user *
 	return m.token
 }
 
+func (m *mockOAuthTokenService) GetValidOAuthToken(ctx context.Context, user *models.SignedInUser) (*oauth2.Token, error) {
+	return m.token, nil
+}
+
+func (m *mockOAuthTokenService) TryTokenRefresh(ctx context.Context, user *models.SignedInUser) (*oauth2.Token, error) {
+	return m.token, nil
+}
+
+func (m *mockOAuthTokenService) HasExpired(token *oauth2.Token) bool {
+	return false
+}
+
 func (m *mockOAuthTokenService) IsOAuthPassThruEnabled(ds *models.DataSource) bool {
 	return m.oAuthEnabled
 }
@@ -24,6 +24,8 @@ import (
 	"github.com/grafana/grafana/pkg/plugins"
 	"github.com/grafana/grafana/pkg/plugins/backendplugin"
 	"github.com/grafana/grafana/pkg/plugins/manager/installer"
+	"github.com/grafana/grafana/pkg/services/oauthtoken"
+	"github.com/grafana/grafana/pkg/services/query"
 	"github.com/grafana/grafana/pkg/setting"
 	"github.com/grafana/grafana/pkg/util/errutil"
 	"github.com/grafana/grafana/pkg/util/proxyutil"
@@ -353,7 +355,7 @@ func (hs *HTTPServer) CheckHealth(c *models.ReqContext) response.Response {
 //
 // /api/plugins/:pluginId/resources/*
 func (hs *HTTPServer) CallResource(c *models.ReqContext) {
-	hs.callPluginResource(c, web.Params(c.Req)[":pluginId"], "")
+	hs.callPluginResource(c, web.Params(c.Req)[":pluginId"], nil)
 }
 
 func (hs *HTTPServer) GetPluginErrorsList(_ *models.ReqContext) response.Response {
@@ -475,7 +477,13 @@ func mdFilepath(mdFilename string) string {
 	return filepath.Clean(filepath.Join("/", fmt.Sprintf("%s.md", mdFilename)))
 }
 
-func (hs *HTTPServer) callPluginResource(c *models.ReqContext, pluginID, dsUID string) {
+// callPluginResource passes a resource call to the backend plugin, on behalf of
+// the data source ds when it's not nil.
+func (hs *HTTPServer) callPluginResource(c *models.ReqContext, pluginID string, ds *models.DataSource) {
+	var dsUID string
+	if ds != nil {
+		dsUID = ds.Uid
+	}
 	pCtx, found, err := hs.PluginContextProvider.Get(c.Req.Context(), pluginID, dsUID, c.SignedInUser, false)
 	if err != nil {
 		c.JsonApiErr(500, "Failed to get plugin settings", err)
@@ -509,6 +517,28 @@ func (hs *HTTPServer) callPluginResource(c *models.ReqContext, pluginID, dsUID s
 	}
 	clonedReq.URL = urlPath
 
+	if ds != nil {
+		ctx := query.WithRequestID(c.Req.Context(), c.Req.Header.Get("X-Request-Id"))
+		headers, err := hs.queryDataService.OAuthPassThruHeaders(ctx, c.SignedInUser, ds, query.OAuthPassThruEndpointResource)
+		if errors.Is(err, oauthtoken.ErrTokenRefreshFailed) {
+			c.JsonApiErr(http.StatusUnauthorized, query.ErrOAuthTokenRefresh{Err: err}.Error(), err)
+			return
+		}
+		var identityErr *query.ErrOAuthIdentityRequired
+		var scopesErr *query.ErrOAuthScopesMissing
+		if errors.As(err, &identityErr) || errors.As(err, &scopesErr) {
+			c.JsonApiErr(http.StatusForbidden, err.Error(), err)
+			return
+		}
+		if err != nil {
+			c.JsonApiErr(http.StatusInternalServerError, "Invalid OAuth pass-thru configuration", err)
+			return
+		}
+		for k, v := range headers {
+			clonedReq.Header.Set(k, v)
+		}
+	}
+
 	if err = hs.makePluginResourceRequest(c.Resp, clonedReq, pCtx); err != nil {
 		handleCallResourceError(err, c)
 	}
@@ -15,11 +15,25 @@ import (
 	"github.com/stretchr/testify/require"
 
 	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana/pkg/api/response"
 	"github.com/grafana/grafana/pkg/bus"
+	"github.com/grafana/grafana/pkg/components/simplejson"
+	"github.com/grafana/grafana/pkg/infra/localcache"
 	"github.com/grafana/grafana/pkg/infra/log"
+	"github.com/grafana/grafana/pkg/infra/tracing"
 	"github.com/grafana/grafana/pkg/models"
 	"github.com/grafana/grafana/pkg/plugins"
+	"github.com/grafana/grafana/pkg/plugins/plugincontext"
+	"github.com/grafana/grafana/pkg/services/datasources"
+	"github.com/grafana/grafana/pkg/services/featuremgmt"
+	"github.com/grafana/grafana/pkg/services/oauthtoken"
+	"github.com/grafana/grafana/pkg/services/pluginsettings"
+	"github.com/grafana/grafana/pkg/services/query"
+	"github.com/grafana/grafana/pkg/services/secrets/fakes"
+	"github.com/grafana/grafana/pkg/services/sqlstore/mockstore"
+	"github.com/grafana/grafana/pkg/services/validations"
 	"github.com/grafana/grafana/pkg/setting"
+	"golang.org/x/oauth2"
 )
 
 func Test_GetPluginAssets(t *testing.T) {
@@ -211,6 +225,58 @@ func TestMakePluginResourceRequest(t *testing.T) {
 	require.Equal(t, "sandbox", resp.Header().Get("Content-Security-Policy"))
 }
 
+func TestCallDatasourceResource_OAuthPassThru(t *testing.T) {
+	for _, passThru := range []bool{true, false} {
+		loggedInUserScenario(t, fmt.Sprintf("When calling a resource of a data source with oauthPassThru %t", passThru),
+			"/api/datasources/1/resources/values", "/api/datasources/:id/resources/*", func(sc *scenarioContext) {
+				ds := &models.DataSource{
+					Id:       1,
+					Uid:      "ds-uid",
+					OrgId:    testOrgID,
+					Type:     "test",
+					JsonData: simplejson.NewFromAny(map[string]interface{}{"oauthPassThru": passThru}),
+				}
+				dsCache := &fakeDataSourceCache{ds: ds}
+				pluginStore := &fakePluginStore{plugins: map[string]plugins.PluginDTO{
+					"test": {JSONData: plugins.JSONData{ID: "test", Type: plugins.DataSource, Backend: true}},
+				}}
+				secretsService := fakes.NewFakeSecretsService()
+				pluginClient := &fakePluginClient{}
+				oauthTokenService := &fakeOAuthTokenService{token: &oauth2.Token{AccessToken: "access-token", TokenType: "Bearer"}}
+				tracer, err := tracing.InitializeTracerForTest()
+				require.NoError(t, err)
+
+				hs := &HTTPServer{
+					Cfg:                    setting.NewCfg(),
+					log:                    log.New(),
+					pluginStore:            pluginStore,
+					pluginClient:           pluginClient,
+					DataSourceCache:        dsCache,
+					PluginRequestValidator: &validations.OSSPluginRequestValidator{},
+					PluginContextProvider: plugincontext.ProvideService(bus.New(), localcache.ProvideService(), pluginStore,
+						dsCache, secretsService, &fakePluginSettings{}),
+					queryDataService: query.ProvideService(setting.NewCfg(), dsCache, nil, &validations.OSSPluginRequestValidator{},
+						secretsService, pluginClient, pluginStore, nil, nil, oauthTokenService, tracer, featuremgmt.WithFeatures()),
+				}
+				sc.handlerFunc = func(c *models.ReqContext) response.Response {
+					hs.CallDatasourceResource(c)
+					return nil
+				}
+				sc.fakeReqWithParams("GET", sc.url, map[string]string{})
+				sc.req.Body = http.NoBody
+				sc.exec()
+
+				require.Equal(t, 200, sc.resp.Code)
+				require.NotNil(t, pluginClient.req)
+				if passThru {
+					require.Equal(t, []string{"Bearer access-token"}, pluginClient.req.Headers["Authorization"])
+				} else {
+					require.NotContains(t, pluginClient.req.Headers, "Authorization")
+				}
+			}, mockstore.NewSQLStoreMock())
+	}
+}
+
 func callGetPluginAsset(sc *scenarioContext) {
 	sc.fakeReqWithParams("GET", sc.url, map[string]string{}).exec()
 }
@@ -269,3 +335,39 @@ func (c *fakePluginClient) CallResource(ctx context.Context, req *backend.CallRe
 		Body:    bytes,
 	})
 }
+
+type fakeDataSourceCache struct {
+	datasources.CacheService
+
+	ds *models.DataSource
+}
+
+func (c *fakeDataSourceCache) GetDatasource(context.Context, int64, *models.SignedInUser, bool) (*models.DataSource, error) {
+	return c.ds, nil
+}
+
+func (c *fakeDataSourceCache) GetDatasourceByUID(context.Context, string, *models.SignedInUser, bool) (*models.DataSource, error) {
+	return c.ds, nil
+}
+
+type fakePluginSettings struct {
+	pluginsettings.Service
+}
+
+func (s *fakePluginSettings) GetPluginSettingById(context.Context, *models.GetPluginSettingByIdQuery) error {
+	return models.ErrPluginSettingNotFound
+}
+
+type fakeOAuthTokenService struct {
+	oauthtoken.OAuthTokenService
+
+	token *oauth2.Token
+}
+
+func (s *fakeOAuthTokenService) GetValidOAuthToken(context.Context, *models.SignedInUser) (*oauth2.Token, error) {
+	return s.token, nil
+}
+
+func (s *fakeOAuthTokenService) IsOAuthPassThruEnabled(ds *models.DataSource) bool {
+	return ds.JsonData != nil && ds.JsonData.Get("oauthPassThru").MustBool()
+}
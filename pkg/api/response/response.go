@@ -151,12 +151,48 @@ func (r *RedirectResponse) Body() []byte {
 	return nil
 }
 
+// StatusClientClosedRequest is the non-standard status code used when the
+// client closed the connection before the response was ready.
+const StatusClientClosedRequest = 499
+
+// ClientClosedResponse represents a response to a client that went away.
+type ClientClosedResponse struct{}
+
+// WriteTo only records the status so that it is reported by the request
+// logs and metrics, the body could not be delivered anyway.
+func (ClientClosedResponse) WriteTo(ctx *models.ReqContext) {
+	ctx.Resp.WriteHeader(StatusClientClosedRequest)
+}
+
+// Status gets the response's status.
+// Required to implement api.Response.
+func (ClientClosedResponse) Status() int {
+	return StatusClientClosedRequest
+}
+
+// Body gets the response's body.
+// Required to implement api.Response.
+func (ClientClosedResponse) Body() []byte {
+	return nil
+}
+
 // JSON creates a JSON response.
 func JSON(status int, body interface{}) *NormalResponse {
 	return Respond(status, body).SetHeader("Content-Type", "application/json")
 }
 
 // JSONStreaming creates a streaming JSON response.
+// Header gets the response's header.
+func (r StreamingResponse) Header() http.Header {
+	return r.header
+}
+
+// SetHeader sets a header of the response.
+func (r StreamingResponse) SetHeader(key, value string) StreamingResponse {
+	r.header.Set(key, value)
+	return r
+}
+
 func JSONStreaming(status int, body interface{}) StreamingResponse {
 	header := make(http.Header)
 	header.Set("Content-Type", "application/json")
@@ -176,6 +212,19 @@ func Success(message string) *NormalResponse {
 
 // Error creates an error response.
 func Error(status int, message string, err error) *NormalResponse {
+	return errorResponse(status, message, err, nil)
+}
+
+// ErrorWithMessageID creates an error response that also includes the status
+// code and a stable message ID that clients can switch on.
+func ErrorWithMessageID(status int, messageID string, message string, err error) *NormalResponse {
+	return errorResponse(status, message, err, map[string]interface{}{
+		"statusCode": status,
+		"messageId":  messageID,
+	})
+}
+
+func errorResponse(status int, message string, err error, fields map[string]interface{}) *NormalResponse {
 	data := make(map[string]interface{})
 
 	switch status {
@@ -195,6 +244,10 @@ func Error(status int, message string, err error) *NormalResponse {
 		}
 	}
 
+	for k, v := range fields {
+		data[k] = v
+	}
+
 	resp := JSON(status, data)
 
 	if err != nil {
@@ -232,6 +285,11 @@ func Respond(status int, body interface{}) *NormalResponse {
 	}
 }
 
+// ClientClosed creates a response for a request cancelled by the client.
+func ClientClosed() ClientClosedResponse {
+	return ClientClosedResponse{}
+}
+
 func Redirect(location string) *RedirectResponse {
 	return &RedirectResponse{location: location}
 }
@@ -27,6 +27,12 @@ type UserCreated struct {
 	Email     string    `json:"email"`
 }
 
+type UserDeleted struct {
+	Timestamp time.Time `json:"timestamp"`
+	Id        int64     `json:"id"`
+	Login     string    `json:"login"`
+}
+
 type SignUpStarted struct {
 	Timestamp time.Time `json:"timestamp"`
 	Email     string    `json:"email"`
@@ -62,3 +68,9 @@ type DataSourceCreated struct {
 	UID       string    `json:"uid"`
 	OrgID     int64     `json:"org_id"`
 }
+
+type UserLoggedOut struct {
+	Timestamp time.Time `json:"timestamp"`
+	Id        int64     `json:"id"`
+	Login     string    `json:"login"`
+}
@@ -197,35 +197,7 @@ func (s *Service) buildDSNode(dp *simple.DirectedGraph, rn *rawNode, req *Reques
 // other nodes they must have already been executed and their results must
 // already by in vars.
 func (dn *DSNode) Execute(ctx context.Context, vars mathexp.Vars, s *Service) (mathexp.Results, error) {
-	dsInstanceSettings, err := adapters.ModelToInstanceSettings(dn.datasource, s.decryptSecureJsonDataFn(ctx))
-	if err != nil {
-		return mathexp.Results{}, errutil.Wrap("failed to convert datasource instance settings", err)
-	}
-	pc := backend.PluginContext{
-		OrgID:                      dn.orgID,
-		DataSourceInstanceSettings: dsInstanceSettings,
-		PluginID:                   dn.datasource.Type,
-	}
-
-	q := []backend.DataQuery{
-		{
-			RefID:         dn.refID,
-			MaxDataPoints: dn.maxDP,
-			Interval:      time.Duration(int64(time.Millisecond) * dn.intervalMS),
-			JSON:          dn.query,
-			TimeRange: backend.TimeRange{
-				From: dn.timeRange.From,
-				To:   dn.timeRange.To,
-			},
-			QueryType: dn.queryType,
-		},
-	}
-
-	resp, err := s.dataService.QueryData(ctx, &backend.QueryDataRequest{
-		PluginContext: pc,
-		Queries:       q,
-		Headers:       dn.request.Headers,
-	})
+	resp, err := dn.queryData(ctx, s)
 	if err != nil {
 		return mathexp.Results{}, err
 	}
@@ -278,6 +250,46 @@ func (dn *DSNode) Execute(ctx context.Context, vars mathexp.Vars, s *Service) (m
 	}, nil
 }
 
+// queryData returns the data source response for the node, using the result
+// provided with the request when there is one.
+func (dn *DSNode) queryData(ctx context.Context, s *Service) (*backend.QueryDataResponse, error) {
+	if res, ok := dn.request.Responses[dn.refID]; ok {
+		return &backend.QueryDataResponse{
+			Responses: backend.Responses{dn.refID: res},
+		}, nil
+	}
+
+	dsInstanceSettings, err := adapters.ModelToInstanceSettings(dn.datasource, s.decryptSecureJsonDataFn(ctx))
+	if err != nil {
+		return nil, errutil.Wrap("failed to convert datasource instance settings", err)
+	}
+	pc := backend.PluginContext{
+		OrgID:                      dn.orgID,
+		DataSourceInstanceSettings: dsInstanceSettings,
+		PluginID:                   dn.datasource.Type,
+	}
+
+	q := []backend.DataQuery{
+		{
+			RefID:         dn.refID,
+			MaxDataPoints: dn.maxDP,
+			Interval:      time.Duration(int64(time.Millisecond) * dn.intervalMS),
+			JSON:          dn.query,
+			TimeRange: backend.TimeRange{
+				From: dn.timeRange.From,
+				To:   dn.timeRange.To,
+			},
+			QueryType: dn.queryType,
+		},
+	}
+
+	return s.dataService.QueryData(ctx, &backend.QueryDataRequest{
+		PluginContext: pc,
+		Queries:       q,
+		Headers:       dn.request.Headers,
+	})
+}
+
 func isNumberTable(frame *data.Frame) bool {
 	if frame == nil || frame.Fields == nil {
 		return false
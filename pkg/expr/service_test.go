@@ -98,6 +98,47 @@ func TestService(t *testing.T) {
 	}
 }
 
+func TestServiceWithProvidedResponses(t *testing.T) {
+	dsDF := data.NewFrame("test",
+		data.NewField("time", nil, []time.Time{time.Unix(1, 0)}),
+		data.NewField("value", nil, []*float64{fp(3)}))
+
+	s := Service{
+		cfg:            setting.NewCfg(),
+		dataService:    &failingEndpoint{t: t},
+		secretsService: secretsManager.SetupTestService(t, fakes.NewFakeSecretsStore()),
+	}
+
+	req := &Request{
+		Queries: []Query{
+			{
+				RefID:      "A",
+				DataSource: &models.DataSource{OrgId: 1, Uid: "test", Type: "test"},
+				JSON:       json.RawMessage(`{ "datasource": { "uid": "test" } }`),
+			},
+			{
+				RefID:      "B",
+				DataSource: DataSourceModel(),
+				JSON:       json.RawMessage(`{ "datasource": { "uid": "__expr__", "type": "__expr__"}, "type": "math", "expression": "$A * 2" }`),
+			},
+		},
+		Responses: map[string]backend.DataResponse{
+			"A": {Frames: data.Frames{dsDF}},
+		},
+	}
+
+	pl, err := s.BuildPipeline(req)
+	require.NoError(t, err)
+
+	res, err := s.ExecutePipeline(context.Background(), pl)
+	require.NoError(t, err)
+
+	require.Len(t, res.Responses["B"].Frames, 1)
+	val, ok := res.Responses["B"].Frames[0].At(1, 0).(*float64)
+	require.True(t, ok)
+	require.Equal(t, 6.0, *val)
+}
+
 func fp(f float64) *float64 {
 	return &f
 }
@@ -113,3 +154,12 @@ func (me *mockEndpoint) QueryData(ctx context.Context, req *backend.QueryDataReq
 	}
 	return resp, nil
 }
+
+type failingEndpoint struct {
+	t *testing.T
+}
+
+func (fe *failingEndpoint) QueryData(ctx context.Context, req *backend.QueryDataRequest) (*backend.QueryDataResponse, error) {
+	fe.t.Error("data source should not be queried when a response is provided")
+	return backend.NewQueryDataResponse(), nil
+}
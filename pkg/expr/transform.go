@@ -34,6 +34,10 @@ type Request struct {
 	Debug   bool
 	OrgId   int64
 	Queries []Query
+
+	// Responses holds data source results already queried by the caller,
+	// keyed by refId. Data source nodes with a response are not queried again.
+	Responses map[string]backend.DataResponse
 }
 
 // Query is like plugins.DataSubQuery, but with a a time range, and only the UID
@@ -180,9 +180,12 @@ type SignedInUser struct {
 	OrgCount       int
 	IsGrafanaAdmin bool
 	IsAnonymous    bool
-	HelpFlags1     HelpFlags1
-	LastSeenAt     time.Time
-	Teams          []int64
+	// IsServiceAccount is set when the user is a service account, signed in
+	// with one of its tokens.
+	IsServiceAccount bool
+	HelpFlags1       HelpFlags1
+	LastSeenAt       time.Time
+	Teams            []int64
 	// Permissions grouped by orgID and actions
 	Permissions map[int64]map[string][]string
 }
@@ -1,7 +1,10 @@
 package models
 
 import (
+	"context"
 	"net/http"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
 )
 
 type PluginRequestValidator interface {
@@ -10,3 +13,31 @@ type PluginRequestValidator interface {
 	// attributes (headers, cookies, etc).
 	Validate(dsURL string, req *http.Request) error
 }
+
+// QueryRequestValidator is implemented by the plugin request validators that
+// also validate the queries sent to a data source, whose effective target can
+// differ from the data source URL when the queries override the URL, the path
+// or the HTTP method.
+type QueryRequestValidator interface {
+	// ValidateQueries performs a validation of the queries
+	// sent in a single request to the data source.
+	ValidateQueries(ctx context.Context, ds *DataSource, queries []backend.DataQuery) error
+}
+
+// AsQueryRequestValidator returns the validator as a QueryRequestValidator.
+// Validators that only implement PluginRequestValidator validate the data
+// source URL, ignoring the queries.
+func AsQueryRequestValidator(validator PluginRequestValidator) QueryRequestValidator {
+	if qv, ok := validator.(QueryRequestValidator); ok {
+		return qv
+	}
+	return legacyQueryRequestValidator{validator: validator}
+}
+
+type legacyQueryRequestValidator struct {
+	validator PluginRequestValidator
+}
+
+func (v legacyQueryRequestValidator) ValidateQueries(_ context.Context, ds *DataSource, _ []backend.DataQuery) error {
+	return v.validator.Validate(ds.Url, nil)
+}
@@ -59,4 +59,10 @@ type CacheService interface {
 
 	// GetDatasourceByUID gets a datasource identified by datasource unique identifier (UID).
 	GetDatasourceByUID(ctx context.Context, datasourceUID string, user *models.SignedInUser, skipCache bool) (*models.DataSource, error)
+
+	// GetDatasourceByName gets a datasource identified by its name within the organization of the user.
+	GetDatasourceByName(ctx context.Context, name string, user *models.SignedInUser, skipCache bool) (*models.DataSource, error)
+
+	// GetDefaultDatasource gets the default datasource of the organization of the user.
+	GetDefaultDatasource(ctx context.Context, user *models.SignedInUser, skipCache bool) (*models.DataSource, error)
 }
@@ -2,7 +2,9 @@ package service
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"strings"
 	"time"
 
 	"github.com/grafana/grafana/pkg/infra/localcache"
@@ -96,6 +98,104 @@ func (dc *CacheServiceImpl) GetDatasourceByUID(
 	return ds, nil
 }
 
+// GetDatasourceByName gets a datasource by name. Names are unique within an
+// organization, but when there is no exact match the name is compared case
+// insensitively, which may match more than one data source.
+func (dc *CacheServiceImpl) GetDatasourceByName(
+	ctx context.Context,
+	name string,
+	user *models.SignedInUser,
+	skipCache bool,
+) (*models.DataSource, error) {
+	if name == "" {
+		return nil, fmt.Errorf("can not get data source by name, name is empty")
+	}
+	if user.OrgId == 0 {
+		return nil, fmt.Errorf("can not get data source by name, orgId is missing")
+	}
+	nameCacheKey := nameKey(user.OrgId, name)
+
+	if !skipCache {
+		if cached, found := dc.CacheService.Get(nameCacheKey); found {
+			ds := cached.(*models.DataSource)
+			if ds.OrgId == user.OrgId {
+				return ds, nil
+			}
+		}
+	}
+
+	dc.logger.Debug("Querying for data source via SQL store", "name", name, "orgId", user.OrgId)
+	query := &models.GetDataSourceQuery{Name: name, OrgId: user.OrgId}
+	err := dc.SQLStore.GetDataSource(ctx, query)
+	if err != nil && !errors.Is(err, models.ErrDataSourceNotFound) {
+		return nil, err
+	}
+
+	ds := query.Result
+	if ds == nil {
+		ds, err = dc.getDatasourceByFoldedName(ctx, name, user.OrgId)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	dc.CacheService.Set(nameCacheKey, ds, time.Second*5)
+	dc.CacheService.Set(idKey(ds.Id), ds, time.Second*5)
+	return ds, nil
+}
+
+func (dc *CacheServiceImpl) getDatasourceByFoldedName(ctx context.Context, name string, orgID int64) (*models.DataSource, error) {
+	query := &models.GetDataSourcesQuery{OrgId: orgID}
+	if err := dc.SQLStore.GetDataSources(ctx, query); err != nil {
+		return nil, err
+	}
+
+	var found *models.DataSource
+	for _, ds := range query.Result {
+		if !strings.EqualFold(ds.Name, name) {
+			continue
+		}
+		if found != nil {
+			return nil, models.ErrDataSourceNameAmbiguous
+		}
+		found = ds
+	}
+	if found == nil {
+		return nil, models.ErrDataSourceNotFound
+	}
+	return found, nil
+}
+
+func (dc *CacheServiceImpl) GetDefaultDatasource(
+	ctx context.Context,
+	user *models.SignedInUser,
+	skipCache bool,
+) (*models.DataSource, error) {
+	if user.OrgId == 0 {
+		return nil, fmt.Errorf("can not get default data source, orgId is missing")
+	}
+	defaultCacheKey := defaultKey(user.OrgId)
+
+	if !skipCache {
+		if cached, found := dc.CacheService.Get(defaultCacheKey); found {
+			return cached.(*models.DataSource), nil
+		}
+	}
+
+	dc.logger.Debug("Querying for default data source via SQL store", "orgId", user.OrgId)
+	query := &models.GetDefaultDataSourceQuery{OrgId: user.OrgId}
+	err := dc.SQLStore.GetDefaultDataSource(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+
+	ds := query.Result
+
+	dc.CacheService.Set(defaultCacheKey, ds, time.Second*5)
+	dc.CacheService.Set(idKey(ds.Id), ds, time.Second*5)
+	return ds, nil
+}
+
 func idKey(id int64) string {
 	return fmt.Sprintf("ds-%d", id)
 }
@@ -103,3 +203,11 @@ func idKey(id int64) string {
 func uidKey(orgID int64, uid string) string {
 	return fmt.Sprintf("ds-orgid-uid-%d-%s", orgID, uid)
 }
+
+func nameKey(orgID int64, name string) string {
+	return fmt.Sprintf("ds-orgid-name-%d-%s", orgID, name)
+}
+
+func defaultKey(orgID int64) string {
+	return fmt.Sprintf("ds-orgid-default-%d", orgID)
+}
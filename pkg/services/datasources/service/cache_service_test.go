@@ -0,0 +1,66 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/grafana/grafana/pkg/infra/localcache"
+	"github.com/grafana/grafana/pkg/models"
+	"github.com/grafana/grafana/pkg/services/sqlstore"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCacheService_GetDatasourceByName(t *testing.T) {
+	sqlStore := sqlstore.InitTestDB(t)
+	dc := ProvideCacheService(localcache.ProvideService(), sqlStore)
+	user := &models.SignedInUser{OrgId: 1}
+
+	addDataSource := func(t *testing.T, name string, isDefault bool) *models.DataSource {
+		t.Helper()
+		cmd := &models.AddDataSourceCommand{OrgId: 1, Name: name, Type: "prometheus", Access: models.DS_ACCESS_PROXY, IsDefault: isDefault}
+		require.NoError(t, sqlStore.AddDataSource(context.Background(), cmd))
+		return cmd.Result
+	}
+
+	prometheus := addDataSource(t, "Prometheus", true)
+	loki := addDataSource(t, "Loki", false)
+
+	t.Run("should find data source by exact name", func(t *testing.T) {
+		ds, err := dc.GetDatasourceByName(context.Background(), "Loki", user, true)
+		require.NoError(t, err)
+		require.Equal(t, loki.Uid, ds.Uid)
+	})
+
+	t.Run("should find data source by name ignoring case", func(t *testing.T) {
+		ds, err := dc.GetDatasourceByName(context.Background(), "loki", user, true)
+		require.NoError(t, err)
+		require.Equal(t, loki.Uid, ds.Uid)
+	})
+
+	t.Run("should return not found for unknown name", func(t *testing.T) {
+		_, err := dc.GetDatasourceByName(context.Background(), "Graphite", user, true)
+		require.True(t, errors.Is(err, models.ErrDataSourceNotFound))
+	})
+
+	t.Run("should return not found for other organizations", func(t *testing.T) {
+		_, err := dc.GetDatasourceByName(context.Background(), "Loki", &models.SignedInUser{OrgId: 2}, true)
+		require.True(t, errors.Is(err, models.ErrDataSourceNotFound))
+	})
+
+	t.Run("should return the default data source", func(t *testing.T) {
+		ds, err := dc.GetDefaultDatasource(context.Background(), user, true)
+		require.NoError(t, err)
+		require.Equal(t, prometheus.Uid, ds.Uid)
+	})
+
+	t.Run("should return ambiguous error when name matches several data sources ignoring case", func(t *testing.T) {
+		cmd := &models.AddDataSourceCommand{OrgId: 1, Name: "LOKI", Type: "loki", Access: models.DS_ACCESS_PROXY}
+		if err := sqlStore.AddDataSource(context.Background(), cmd); err != nil {
+			t.Skip("database does not allow data source names that only differ by case")
+		}
+
+		_, err := dc.GetDatasourceByName(context.Background(), "loki", user, true)
+		require.True(t, errors.Is(err, models.ErrDataSourceNameAmbiguous))
+	})
+}
@@ -0,0 +1,173 @@
+package featuremgmt
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var (
+	ErrFeatureToggleDependencyCycle = errors.New("feature toggle dependency cycle")
+	ErrFeatureToggleDependencies    = errors.New("feature toggle requires disabled feature toggles")
+)
+
+// resolveDependencies resolves the flags required by each flag, directly or
+// through other flags, so that the dependencies are applied without walking
+// the dependency graph on each update. It returns an error wrapping
+// ErrFeatureToggleDependencyCycle when flags require each other, or
+// ErrUnknownFeatureToggle when a flag requires an unknown one.
+func (fm *FeatureManager) resolveDependencies() error {
+	requires, err := resolveDependencies(fm.flags)
+	if err != nil {
+		return err
+	}
+	fm.requires = requires
+	fm.update()
+	return nil
+}
+
+func resolveDependencies(flags map[string]*FeatureFlag) (map[string][]string, error) {
+	resolved := make(map[string][]string, len(flags))
+	visiting := make(map[string]bool)
+
+	var visit func(name string, path []string) ([]string, error)
+	visit = func(name string, path []string) ([]string, error) {
+		if deps, ok := resolved[name]; ok {
+			return deps, nil
+		}
+		path = append(path[:len(path):len(path)], name)
+		if visiting[name] {
+			for i, step := range path {
+				if step == name {
+					return nil, fmt.Errorf("%w: %s", ErrFeatureToggleDependencyCycle, strings.Join(path[i:], " -> "))
+				}
+			}
+		}
+		flag, ok := flags[name]
+		if !ok {
+			return nil, fmt.Errorf("%w %q, required by %q", ErrUnknownFeatureToggle, name, path[len(path)-2])
+		}
+
+		visiting[name] = true
+		seen := make(map[string]bool)
+		deps := []string{}
+		for _, dep := range flag.RequiresFlags {
+			depDeps, err := visit(dep, path)
+			if err != nil {
+				return nil, err
+			}
+			for _, d := range append([]string{dep}, depDeps...) {
+				if !seen[d] {
+					seen[d] = true
+					deps = append(deps, d)
+				}
+			}
+		}
+		visiting[name] = false
+
+		sort.Strings(deps)
+		resolved[name] = deps
+		return deps, nil
+	}
+
+	names := make([]string, 0, len(flags))
+	for name := range flags {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	requires := make(map[string][]string)
+	for _, name := range names {
+		deps, err := visit(name, nil)
+		if err != nil {
+			return nil, err
+		}
+		if len(deps) > 0 {
+			requires[name] = deps
+		}
+	}
+	return requires, nil
+}
+
+// applyDependencies returns the enabled flags once their dependencies are
+// applied: a flag is only enabled along with all the flags it requires, which
+// are enabled with it in the auto-enable mode.
+func (fm *FeatureManager) applyDependencies(evaluated map[string]bool) map[string]bool {
+	if len(fm.requires) == 0 {
+		return evaluated
+	}
+
+	enabled := make(map[string]bool, len(evaluated))
+	for name := range evaluated {
+		if len(fm.missingDependencies(name, evaluated)) == 0 {
+			enabled[name] = true
+		}
+	}
+	if fm.autoEnableDependencies {
+		for name := range enabled {
+			for _, dep := range fm.requires[name] {
+				enabled[dep] = true
+			}
+		}
+	}
+	return enabled
+}
+
+// missingDependencies returns the flags required by the flag that are not
+// enabled, or that can't be enabled in the auto-enable mode because they're
+// unknown or they require the development mode or a license.
+func (fm *FeatureManager) missingDependencies(name string, evaluated map[string]bool) []string {
+	var missing []string
+	for _, dep := range fm.requires[name] {
+		if evaluated[dep] {
+			continue
+		}
+		if flag, ok := fm.flags[dep]; ok && fm.autoEnableDependencies && fm.isAvailable(flag) {
+			continue
+		}
+		missing = append(missing, dep)
+	}
+	return missing
+}
+
+// checkDependencies returns an error wrapping ErrFeatureToggleDependencies
+// for the first flag enabled without the flags it requires.
+func (fm *FeatureManager) checkDependencies() error {
+	evaluated := fm.evaluateAll()
+	names := make([]string, 0, len(evaluated))
+	for name := range evaluated {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if missing := fm.missingDependencies(name, evaluated); len(missing) > 0 {
+			return dependenciesError(name, missing)
+		}
+	}
+	return nil
+}
+
+func dependenciesError(name string, missing []string) error {
+	return fmt.Errorf("%w: %q requires %s", ErrFeatureToggleDependencies, name, quoteFlags(missing))
+}
+
+// quoteFlags returns the quoted names of the flags, separated by commas.
+func quoteFlags(names []string) string {
+	quoted := make([]string, 0, len(names))
+	for _, name := range names {
+		quoted = append(quoted, strconv.Quote(name))
+	}
+	return strings.Join(quoted, ", ")
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,189 @@
+package featuremgmt
+
+import (
+	"testing"
+
+	"github.com/grafana/grafana/pkg/setting"
+	"github.com/stretchr/testify/require"
+)
+
+func newDependenciesManager(t *testing.T, auto bool, flags ...FeatureFlag) *FeatureManager {
+	t.Helper()
+	fm := &FeatureManager{
+		flags:                  map[string]*FeatureFlag{},
+		autoEnableDependencies: auto,
+	}
+	fm.registerFlags(flags...)
+	require.NoError(t, fm.resolveDependencies())
+	return fm
+}
+
+func TestResolveDependencies(t *testing.T) {
+	flagsOf := func(flags ...FeatureFlag) map[string]*FeatureFlag {
+		m := make(map[string]*FeatureFlag, len(flags))
+		for i := range flags {
+			m[flags[i].Name] = &flags[i]
+		}
+		return m
+	}
+
+	t.Run("chains are resolved to all the required flags", func(t *testing.T) {
+		requires, err := resolveDependencies(flagsOf(
+			FeatureFlag{Name: "a", RequiresFlags: []string{"b"}},
+			FeatureFlag{Name: "b", RequiresFlags: []string{"c", "d"}},
+			FeatureFlag{Name: "c", RequiresFlags: []string{"d"}},
+			FeatureFlag{Name: "d"},
+		))
+		require.NoError(t, err)
+		require.Equal(t, map[string][]string{
+			"a": {"b", "c", "d"},
+			"b": {"c", "d"},
+			"c": {"d"},
+		}, requires)
+	})
+
+	t.Run("cycles are rejected", func(t *testing.T) {
+		_, err := resolveDependencies(flagsOf(
+			FeatureFlag{Name: "a", RequiresFlags: []string{"b"}},
+			FeatureFlag{Name: "b", RequiresFlags: []string{"c"}},
+			FeatureFlag{Name: "c", RequiresFlags: []string{"a"}},
+		))
+		require.ErrorIs(t, err, ErrFeatureToggleDependencyCycle)
+		require.EqualError(t, err, "feature toggle dependency cycle: a -> b -> c -> a")
+
+		_, err = resolveDependencies(flagsOf(
+			FeatureFlag{Name: "a", RequiresFlags: []string{"b"}},
+			FeatureFlag{Name: "b", RequiresFlags: []string{"b"}},
+		))
+		require.EqualError(t, err, "feature toggle dependency cycle: b -> b")
+	})
+
+	t.Run("unknown flags are rejected", func(t *testing.T) {
+		_, err := resolveDependencies(flagsOf(
+			FeatureFlag{Name: "a", RequiresFlags: []string{"b"}},
+		))
+		require.ErrorIs(t, err, ErrUnknownFeatureToggle)
+		require.EqualError(t, err, `unknown feature toggle "b", required by "a"`)
+	})
+
+	t.Run("the registry is valid", func(t *testing.T) {
+		flags := make([]FeatureFlag, len(standardFeatureFlags))
+		copy(flags, standardFeatureFlags)
+		_, err := resolveDependencies(flagsOf(flags...))
+		require.NoError(t, err)
+	})
+}
+
+func TestFeatureDependencies(t *testing.T) {
+	t.Run("flags are disabled without the flags they require", func(t *testing.T) {
+		fm := newDependenciesManager(t, false,
+			FeatureFlag{Name: "a", Expression: "true", RequiresFlags: []string{"b"}},
+			FeatureFlag{Name: "b", Expression: "true", RequiresFlags: []string{"c"}},
+			FeatureFlag{Name: "c"},
+		)
+		require.False(t, fm.IsEnabled("a"))
+		require.False(t, fm.IsEnabled("b"))
+		require.EqualError(t, fm.checkDependencies(), `feature toggle requires disabled feature toggles: "a" requires "c"`)
+
+		fm.registerFlags(FeatureFlag{Name: "c", Expression: "true"})
+		require.True(t, fm.IsEnabled("a"))
+		require.True(t, fm.IsEnabled("b"))
+		require.NoError(t, fm.checkDependencies())
+	})
+
+	t.Run("required flags are enabled in the auto-enable mode", func(t *testing.T) {
+		fm := newDependenciesManager(t, true,
+			FeatureFlag{Name: "a", Expression: "true", RequiresFlags: []string{"b"}},
+			FeatureFlag{Name: "b", Expression: "false", RequiresFlags: []string{"c"}},
+			FeatureFlag{Name: "c"},
+			FeatureFlag{Name: "d"},
+		)
+		require.Equal(t, map[string]bool{"a": true, "b": true, "c": true}, fm.enabledFlags())
+		require.NoError(t, fm.checkDependencies())
+	})
+
+	t.Run("required flags that are not available are not enabled in the auto-enable mode", func(t *testing.T) {
+		fm := newDependenciesManager(t, true,
+			FeatureFlag{Name: "a", Expression: "true", RequiresFlags: []string{"b", "c"}},
+			FeatureFlag{Name: "b"},
+			FeatureFlag{Name: "c", RequiresDevMode: true},
+		)
+		require.Empty(t, fm.enabledFlags())
+		require.ErrorIs(t, fm.checkDependencies(), ErrFeatureToggleDependencies)
+	})
+
+	t.Run("flags are checked at startup", func(t *testing.T) {
+		newCfg := func(t *testing.T, auto bool) *setting.Cfg {
+			cfg := setting.NewCfg()
+			section, err := cfg.Raw.NewSection("feature_toggles")
+			require.NoError(t, err)
+			_, err = section.NewKey(FlagDashboardPreviewsAdmin, "true")
+			require.NoError(t, err)
+			if auto {
+				_, err = section.NewKey("auto_enable_dependencies", "true")
+				require.NoError(t, err)
+			}
+			return cfg
+		}
+
+		_, err := ProvideManagerService(newCfg(t, false), nil)
+		require.EqualError(t, err, `feature toggle requires disabled feature toggles: "dashboardPreviewsAdmin" requires "dashboardPreviews"`)
+
+		fm, err := ProvideManagerService(newCfg(t, true), nil)
+		require.NoError(t, err)
+		require.True(t, fm.IsEnabled(FlagDashboardPreviewsAdmin))
+		require.True(t, fm.IsEnabled(FlagDashboardPreviews))
+		require.False(t, fm.IsEnabled(FlagDashboardPreviewsScheduler))
+	})
+}
+
+func TestSetEnabledDependencies(t *testing.T) {
+	flags := []FeatureFlag{
+		{Name: FlagTempoSearch},
+		{Name: FlagTempoServiceGraph, RequiresFlags: []string{FlagTempoSearch}},
+		{Name: FlagDashboardPreviews},
+		{Name: FlagQueryServiceExpressions, RequiresFlags: []string{FlagDashboardPreviews}},
+	}
+
+	t.Run("flags can't be enabled without the flags they require", func(t *testing.T) {
+		fm := newDependenciesManager(t, false, flags...)
+		err := fm.SetEnabled(FlagTempoServiceGraph, true)
+		require.EqualError(t, err, `feature toggle requires disabled feature toggles: "tempoServiceGraph" requires "tempoSearch"`)
+		require.NotContains(t, fm.overrides, FlagTempoServiceGraph)
+
+		require.NoError(t, fm.SetEnabled(FlagTempoSearch, true))
+		require.NoError(t, fm.SetEnabled(FlagTempoServiceGraph, true))
+		require.True(t, fm.IsEnabled(FlagTempoServiceGraph))
+	})
+
+	t.Run("disabling a flag disables the flags requiring it", func(t *testing.T) {
+		fm := newDependenciesManager(t, false, flags...)
+		require.NoError(t, fm.SetEnabled(FlagTempoSearch, true))
+		require.NoError(t, fm.SetEnabled(FlagTempoServiceGraph, true))
+
+		changed := map[string]bool{}
+		fm.OnChange(func(flag string, enabled bool) {
+			changed[flag] = enabled
+		})
+		require.NoError(t, fm.SetEnabled(FlagTempoSearch, false))
+		require.False(t, fm.IsEnabled(FlagTempoServiceGraph))
+		require.Equal(t, map[string]bool{FlagTempoSearch: false, FlagTempoServiceGraph: false}, changed)
+	})
+
+	t.Run("required flags are enabled along with the flag in the auto-enable mode", func(t *testing.T) {
+		fm := newDependenciesManager(t, true, flags...)
+		require.NoError(t, fm.SetEnabled(FlagTempoServiceGraph, true))
+		require.True(t, fm.IsEnabled(FlagTempoSearch))
+
+		require.NoError(t, fm.SetEnabled(FlagTempoServiceGraph, false))
+		require.False(t, fm.IsEnabled(FlagTempoSearch))
+	})
+
+	t.Run("required flags are only enabled at runtime when they can be toggled at runtime", func(t *testing.T) {
+		fm := newDependenciesManager(t, true, flags...)
+		err := fm.SetEnabled(FlagQueryServiceExpressions, true)
+		require.ErrorIs(t, err, ErrFeatureToggleRequiresRestart)
+		require.False(t, fm.IsEnabled(FlagQueryServiceExpressions))
+		require.False(t, fm.IsEnabled(FlagDashboardPreviews))
+	})
+}
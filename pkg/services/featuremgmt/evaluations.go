@@ -0,0 +1,44 @@
+package featuremgmt
+
+import (
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var featureToggleEvaluations = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name:      "feature_toggle_evaluations_total",
+	Help:      "number of times the feature toggles are checked, by result, estimated from the sampled checks",
+	Namespace: "grafana",
+}, []string{"name", "result"})
+
+// evaluationCounter counts the checks of the flags in the
+// feature_toggle_evaluations_total metric. Only one check in sampling is
+// counted, with a weight of sampling, to keep the overhead low on hot paths.
+// The sampling is rounded up to a power of two, so that the sampled checks
+// are selected with a mask rather than a division.
+type evaluationCounter struct {
+	sampling uint64
+	mask     uint64
+	checks   uint64 // accessed atomically
+}
+
+func newEvaluationCounter(sampling int) *evaluationCounter {
+	rounded := uint64(1)
+	for rounded < uint64(sampling) {
+		rounded <<= 1
+	}
+	return &evaluationCounter{sampling: rounded, mask: rounded - 1}
+}
+
+func (c *evaluationCounter) observe(flag string, enabled bool) {
+	if c.mask != 0 && atomic.AddUint64(&c.checks, 1)&c.mask != 0 {
+		return
+	}
+	result := "disabled"
+	if enabled {
+		result = "enabled"
+	}
+	featureToggleEvaluations.WithLabelValues(flag, result).Add(float64(c.sampling))
+}
@@ -0,0 +1,122 @@
+package featuremgmt
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/grafana/grafana/pkg/models"
+	"github.com/grafana/grafana/pkg/setting"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func evaluationsOf(flag string, result string) float64 {
+	return testutil.ToFloat64(featureToggleEvaluations.WithLabelValues(flag, result))
+}
+
+func TestFeatureToggleEvaluationMetrics(t *testing.T) {
+	newManager := func(t *testing.T, enabled bool, sampling int) *FeatureManager {
+		cfg := setting.NewCfg()
+		section, err := cfg.Raw.NewSection("feature_toggles")
+		require.NoError(t, err)
+		_, err = section.NewKey("enable", FlagTempoSearch)
+		require.NoError(t, err)
+		_, err = section.NewKey("evaluation_metrics", strconv.FormatBool(enabled))
+		require.NoError(t, err)
+		_, err = section.NewKey("evaluation_metrics_sampling", strconv.Itoa(sampling))
+		require.NoError(t, err)
+		mgmt, err := ProvideManagerService(cfg, nil)
+		require.NoError(t, err)
+		return mgmt
+	}
+
+	guarded := func(mgmt *FeatureManager) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if mgmt.IsEnabled(FlagTempoSearch) && !mgmt.IsEnabled(FlagTempoServiceGraph) {
+				w.WriteHeader(http.StatusOK)
+				return
+			}
+			w.WriteHeader(http.StatusNotFound)
+		})
+	}
+
+	t.Run("the checks of the guarded handlers are counted by result", func(t *testing.T) {
+		handler := guarded(newManager(t, true, 1))
+		enabledBefore := evaluationsOf(FlagTempoSearch, "enabled")
+		disabledBefore := evaluationsOf(FlagTempoServiceGraph, "disabled")
+
+		for i := 0; i < 3; i++ {
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+			require.Equal(t, http.StatusOK, rec.Code)
+		}
+
+		require.Equal(t, 3.0, evaluationsOf(FlagTempoSearch, "enabled")-enabledBefore)
+		require.Equal(t, 3.0, evaluationsOf(FlagTempoServiceGraph, "disabled")-disabledBefore)
+	})
+
+	t.Run("the sampled checks are weighted by the sampling", func(t *testing.T) {
+		// The sampling is rounded up to 16.
+		mgmt := newManager(t, true, 10)
+		before := evaluationsOf(FlagTempoSearch, "enabled")
+
+		for i := 0; i < 95; i++ {
+			mgmt.IsEnabled(FlagTempoSearch)
+		}
+
+		require.Equal(t, 80.0, evaluationsOf(FlagTempoSearch, "enabled")-before)
+	})
+
+	t.Run("the checks for a user are counted with their result for the user", func(t *testing.T) {
+		mgmt := newManager(t, true, 1)
+		require.NoError(t, mgmt.SetRolloutRule(FlagTempoServiceGraph, &RolloutRule{UserIDs: []int64{1}}))
+		before := evaluationsOf(FlagTempoServiceGraph, "enabled")
+
+		require.True(t, mgmt.IsEnabledForUser(context.Background(), &models.SignedInUser{UserId: 1}, FlagTempoServiceGraph))
+
+		require.Equal(t, 1.0, evaluationsOf(FlagTempoServiceGraph, "enabled")-before)
+	})
+
+	t.Run("the listing of the toggle states is not counted", func(t *testing.T) {
+		mgmt := newManager(t, true, 1)
+		enabledBefore := evaluationsOf(FlagTempoSearch, "enabled")
+		disabledBefore := evaluationsOf(FlagTempoServiceGraph, "disabled")
+
+		require.NotEmpty(t, mgmt.GetToggleStates())
+
+		require.Equal(t, enabledBefore, evaluationsOf(FlagTempoSearch, "enabled"))
+		require.Equal(t, disabledBefore, evaluationsOf(FlagTempoServiceGraph, "disabled"))
+	})
+
+	t.Run("the checks are not counted by default", func(t *testing.T) {
+		handler := guarded(newManager(t, false, 1))
+		before := evaluationsOf(FlagTempoSearch, "enabled")
+
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+		require.Equal(t, http.StatusOK, rec.Code)
+
+		require.Equal(t, before, evaluationsOf(FlagTempoSearch, "enabled"))
+	})
+}
+
+func BenchmarkIsEnabledWithEvaluationMetrics(b *testing.B) {
+	for _, sampling := range []int{1, 100, 1000} {
+		b.Run("sampling "+strconv.Itoa(sampling), func(b *testing.B) {
+			ft := WithFeatures(FlagValidatedQueries)
+			ft.evaluations = newEvaluationCounter(sampling)
+			for i := 0; i < b.N; i++ {
+				ft.IsEnabled(FlagValidatedQueries)
+			}
+		})
+	}
+	b.Run("disabled", func(b *testing.B) {
+		ft := WithFeatures(FlagValidatedQueries)
+		for i := 0; i < b.N; i++ {
+			ft.IsEnabled(FlagValidatedQueries)
+		}
+	})
+}
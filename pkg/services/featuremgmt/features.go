@@ -44,6 +44,17 @@ func (s FeatureFlagState) String() string {
 	return "unknown"
 }
 
+// ParseFeatureFlagState returns the state with the given name, as returned by
+// String.
+func ParseFeatureFlagState(name string) (FeatureFlagState, bool) {
+	for s := FeatureStateUnknown; s <= FeatureStateDeprecated; s++ {
+		if s.String() == name {
+			return s, true
+		}
+	}
+	return FeatureStateUnknown, false
+}
+
 // MarshalJSON marshals the enum as a quoted json string
 func (s FeatureFlagState) MarshalJSON() ([]byte, error) {
 	buffer := bytes.NewBufferString(`"`)
@@ -93,4 +104,8 @@ type FeatureFlag struct {
 	RequiresRestart bool `json:"requiresRestart,omitempty"` // The server must be initialized with the value
 	RequiresLicense bool `json:"requiresLicense,omitempty"` // Must be enabled in the license
 	FrontendOnly    bool `json:"frontend,omitempty"`        // change is only seen in the frontend
+	Frontend        bool `json:"frontendVisible,omitempty"` // the frontend reads the flag, it's sent to the browsers
+
+	// The flags that must be enabled along with this one
+	RequiresFlags []string `json:"requiresFlags,omitempty"`
 }
@@ -4,6 +4,11 @@ import (
 	"context"
 	"fmt"
 	"reflect"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/grafana/grafana/pkg/infra/log"
 
@@ -19,10 +24,30 @@ type FeatureManager struct {
 	isDevMod  bool
 	licensing models.Licensing
 	flags     map[string]*FeatureFlag
-	enabled   map[string]bool // only the "on" values
-	config    string          // path to config file
+	enabled   atomic.Value // map[string]bool of only the "on" values, replaced on every update
+	config    string       // path to config file
 	vars      map[string]interface{}
 	log       log.Logger
+
+	// requires are the flags required by each flag, directly or not, and
+	// autoEnableDependencies enables them along with the flag.
+	requires               map[string][]string
+	autoEnableDependencies bool
+
+	// evaluations counts the checks of the flags, when enabled.
+	evaluations *evaluationCounter
+
+	// provider is the remote provider refreshed at pollInterval, if any.
+	provider     Provider
+	pollInterval time.Duration
+
+	// mu serializes the runtime changes of the flags.
+	mu             sync.Mutex
+	overrides      map[string]bool     // flags toggled at runtime
+	provided       map[string]bool     // flags of the remote provider, replaced on every refresh
+	rollouts       atomic.Value        // map[string]RolloutRule, replaced on every change
+	metricLabels   map[string][]string // labels of the info metric of each flag
+	changeHandlers []ChangeHandler
 }
 
 // This will merge the flags with the current configuration
@@ -66,6 +91,12 @@ func (fm *FeatureManager) registerFlags(flags ...FeatureFlag) {
 		if add.RequiresRestart {
 			flag.RequiresRestart = true
 		}
+
+		for _, dep := range add.RequiresFlags {
+			if !containsString(flag.RequiresFlags, dep) {
+				flag.RequiresFlags = append(flag.RequiresFlags, dep)
+			}
+		}
 	}
 
 	// This will evaluate all flags
@@ -73,6 +104,27 @@ func (fm *FeatureManager) registerFlags(flags ...FeatureFlag) {
 }
 
 func (fm *FeatureManager) evaluate(ff *FeatureFlag) bool {
+	if !fm.isAvailable(ff) {
+		return false
+	}
+
+	// The flags toggled at runtime take precedence over the remote provider,
+	// which takes precedence over the configuration.
+	expression := ff.Expression
+	if enabled, ok := fm.provided[ff.Name]; ok {
+		expression = strconv.FormatBool(enabled)
+	}
+	if enabled, ok := fm.overrides[ff.Name]; ok {
+		expression = strconv.FormatBool(enabled)
+	}
+
+	// TODO: CEL - expression
+	return expression == "true"
+}
+
+// isAvailable returns whether the development mode or license required by the
+// flag are available.
+func (fm *FeatureManager) isAvailable(ff *FeatureFlag) bool {
 	if ff.RequiresDevMode && !fm.isDevMod {
 		return false
 	}
@@ -80,31 +132,56 @@ func (fm *FeatureManager) evaluate(ff *FeatureFlag) bool {
 	if ff.RequiresLicense && (fm.licensing == nil || !fm.licensing.FeatureEnabled(ff.Name)) {
 		return false
 	}
+	return true
+}
 
-	// TODO: CEL - expression
-	return ff.Expression == "true"
+// evaluateAll returns the flags whose expression is enabled, before their
+// dependencies are applied.
+func (fm *FeatureManager) evaluateAll() map[string]bool {
+	evaluated := make(map[string]bool)
+	for _, flag := range fm.flags {
+		if fm.evaluate(flag) {
+			evaluated[flag.Name] = true
+		}
+	}
+	// The managers created by WithFeatures only register the flags they're
+	// given, the overrides of the other flags apply as is.
+	for name, enabled := range fm.overrides {
+		if _, ok := fm.flags[name]; !ok && enabled {
+			evaluated[name] = true
+		}
+	}
+	return evaluated
 }
 
 // Update
 func (fm *FeatureManager) update() {
-	enabled := make(map[string]bool)
+	enabled := fm.applyDependencies(fm.evaluateAll())
 	for _, flag := range fm.flags {
-		val := fm.evaluate(flag)
+		val := enabled[flag.Name]
 
 		// Update the registry
 		track := 0.0
 		if val {
 			track = 1
-			enabled[flag.Name] = true
 		}
 
-		// Register value with prometheus metric
-		featureToggleInfo.WithLabelValues(flag.Name).Set(track)
+		// Register value with prometheus metric, the series with the previous
+		// labels of the flag are removed.
+		labels := []string{flag.Name, flag.State.String(), strconv.FormatBool(val)}
+		if previous, ok := fm.metricLabels[flag.Name]; ok && (previous[1] != labels[1] || previous[2] != labels[2]) {
+			featureToggleInfo.DeleteLabelValues(previous...)
+		}
+		featureToggleInfo.WithLabelValues(labels...).Set(track)
+		if fm.metricLabels == nil {
+			fm.metricLabels = make(map[string][]string)
+		}
+		fm.metricLabels[flag.Name] = labels
 	}
-	fm.enabled = enabled
+	fm.enabled.Store(enabled)
 }
 
-// Run is called by background services
+// readFile registers the flags of the features.yaml file
 func (fm *FeatureManager) readFile() error {
 	if fm.config == "" {
 		return nil // not configured
@@ -118,18 +195,35 @@ func (fm *FeatureManager) readFile() error {
 	fm.registerFlags(cfg.Flags...)
 	fm.vars = cfg.Vars
 
-	return nil
+	return fm.resolveDependencies()
 }
 
 // IsEnabled checks if a feature is enabled
 func (fm *FeatureManager) IsEnabled(flag string) bool {
-	return fm.enabled[flag]
+	enabled := fm.enabledFlags()[flag]
+	fm.observe(flag, enabled)
+	return enabled
+}
+
+// observe counts the check of the flag when the evaluation metrics are enabled.
+func (fm *FeatureManager) observe(flag string, enabled bool) {
+	if fm.evaluations != nil {
+		fm.evaluations.observe(flag, enabled)
+	}
+}
+
+// enabledFlags returns the flags that are enabled, the map must not be
+// modified as it's shared by all readers.
+func (fm *FeatureManager) enabledFlags() map[string]bool {
+	enabled, _ := fm.enabled.Load().(map[string]bool)
+	return enabled
 }
 
 // GetEnabled returns a map contaning only the features that are enabled
 func (fm *FeatureManager) GetEnabled(ctx context.Context) map[string]bool {
-	enabled := make(map[string]bool, len(fm.enabled))
-	for key, val := range fm.enabled {
+	current := fm.enabledFlags()
+	enabled := make(map[string]bool, len(current))
+	for key, val := range current {
 		if val {
 			enabled[key] = true
 		}
@@ -137,6 +231,30 @@ func (fm *FeatureManager) GetEnabled(ctx context.Context) map[string]bool {
 	return enabled
 }
 
+// GetEnabledFrontendFlags returns a map containing only the features that are
+// enabled and visible in the frontend, to be sent to the browsers. It reflects
+// the flags toggled at runtime, the backend-only flags are never included.
+func (fm *FeatureManager) GetEnabledFrontendFlags(ctx context.Context) map[string]bool {
+	enabled := fm.GetEnabled(ctx)
+	for key := range enabled {
+		if !fm.isFrontendVisible(key) {
+			delete(enabled, key)
+		}
+	}
+	return enabled
+}
+
+func (fm *FeatureManager) isFrontendVisible(name string) bool {
+	flag, ok := fm.flags[name]
+	if !ok {
+		// Managers created by WithFeatures have no definition of the flags
+		// toggled at runtime.
+		registered, _ := registeredFlag(name)
+		flag = &registered
+	}
+	return flag.Frontend || flag.FrontendOnly
+}
+
 // GetFlags returns all flag definitions
 func (fm *FeatureManager) GetFlags() []FeatureFlag {
 	v := make([]FeatureFlag, 0, len(fm.flags))
@@ -146,6 +264,57 @@ func (fm *FeatureManager) GetFlags() []FeatureFlag {
 	return v
 }
 
+// FeatureToggleState is a flag of the feature registry with its effective
+// state in this instance.
+type FeatureToggleState struct {
+	Name             string           `json:"name"`
+	Description      string           `json:"description"`
+	Stage            FeatureFlagState `json:"stage"`
+	EnabledByDefault bool             `json:"enabledByDefault"`
+	Enabled          bool             `json:"enabled"`
+	// RuntimeToggleable is whether the flag can be toggled without a restart.
+	RuntimeToggleable bool `json:"runtimeToggleable"`
+	// Rollout is the rule enabling the flag for a part of the users.
+	Rollout *RolloutRule `json:"rollout,omitempty"`
+}
+
+// GetToggleStates returns every flag of the feature registry, sorted by name,
+// with whether it is enabled by default and in this instance.
+func (fm *FeatureManager) GetToggleStates() []FeatureToggleState {
+	// The states are read without observing them, listing the flags doesn't
+	// count as checks in the evaluation metrics.
+	enabled := fm.enabledFlags()
+	states := make([]FeatureToggleState, 0, len(standardFeatureFlags))
+	for _, flag := range standardFeatureFlags {
+		state := FeatureToggleState{
+			Name:             flag.Name,
+			Description:      flag.Description,
+			Stage:            flag.State,
+			EnabledByDefault: flag.Expression == "true",
+			Enabled:          enabled[flag.Name],
+
+			RuntimeToggleable: IsRuntimeToggleable(flag.Name),
+		}
+		if rule, ok := fm.GetRolloutRule(flag.Name); ok {
+			state.Rollout = &rule
+		}
+		// The config file may update the description and stage of the flags.
+		if registered, ok := fm.flags[flag.Name]; ok {
+			if registered.Description != "" {
+				state.Description = registered.Description
+			}
+			if registered.State != FeatureStateUnknown {
+				state.Stage = registered.State
+			}
+		}
+		states = append(states, state)
+	}
+	sort.Slice(states, func(i, j int) bool {
+		return states[i].Name < states[j].Name
+	})
+	return states
+}
+
 func (fm *FeatureManager) HandleGetSettings(c *models.ReqContext) {
 	res := make(map[string]interface{}, 3)
 	res["enabled"] = fm.GetEnabled(c.Req.Context())
@@ -162,24 +331,49 @@ func (fm *FeatureManager) HandleGetSettings(c *models.ReqContext) {
 
 // WithFeatures is used to define feature toggles for testing.
 // The arguments are a list of strings that are optionally followed by a boolean value
+// and by a FeatureFlagState, e.g. to simulate deprecated flags.
+// It panics on the flags not in the feature registry, unless they have a state, to catch typos.
 func WithFeatures(spec ...interface{}) *FeatureManager {
 	count := len(spec)
-	enabled := make(map[string]bool, count)
+	flags := make(map[string]*FeatureFlag, count)
 
 	idx := 0
 	for idx < count {
 		key := fmt.Sprintf("%v", spec[idx])
 		val := true
+		state := FeatureStateUnknown
+		hasState := false
 		idx++
 		if idx < count && reflect.TypeOf(spec[idx]).Kind() == reflect.Bool {
 			val = spec[idx].(bool)
 			idx++
 		}
+		if idx < count {
+			if s, ok := spec[idx].(FeatureFlagState); ok {
+				state = s
+				hasState = true
+				idx++
+			}
+		}
+		if !hasState {
+			if err := ValidateFlagName(key); err != nil {
+				panic(err)
+			}
+		}
 
-		if val {
-			enabled[key] = true
+		// Only the visibility of the registered flags is kept, the other
+		// attributes would change whether they can be enabled.
+		registered, _ := registeredFlag(key)
+		flags[key] = &FeatureFlag{
+			Name:         key,
+			State:        state,
+			Expression:   strconv.FormatBool(val),
+			Frontend:     registered.Frontend,
+			FrontendOnly: registered.FrontendOnly,
 		}
 	}
 
-	return &FeatureManager{enabled: enabled}
+	fm := &FeatureManager{flags: flags, log: log.New("featuremgmt")}
+	fm.update()
+	return fm
 }
@@ -9,19 +9,27 @@ import (
 
 func TestFeatureManager(t *testing.T) {
 	t.Run("check testing stubs", func(t *testing.T) {
-		ft := WithFeatures("a", "b", "c")
-		require.True(t, ft.IsEnabled("a"))
-		require.True(t, ft.IsEnabled("b"))
-		require.True(t, ft.IsEnabled("c"))
-		require.False(t, ft.IsEnabled("d"))
+		ft := WithFeatures(FlagTrimDefaults, FlagEnvelopeEncryption, FlagLiveConfig)
+		require.True(t, ft.IsEnabled(FlagTrimDefaults))
+		require.True(t, ft.IsEnabled(FlagEnvelopeEncryption))
+		require.True(t, ft.IsEnabled(FlagLiveConfig))
+		require.False(t, ft.IsEnabled(FlagLivePipeline))
 
-		require.Equal(t, map[string]bool{"a": true, "b": true, "c": true}, ft.GetEnabled(context.Background()))
+		require.Equal(t, map[string]bool{FlagTrimDefaults: true, FlagEnvelopeEncryption: true, FlagLiveConfig: true}, ft.GetEnabled(context.Background()))
 
 		// Explicit values
-		ft = WithFeatures("a", true, "b", false)
+		ft = WithFeatures(FlagTrimDefaults, true, FlagEnvelopeEncryption, false)
+		require.True(t, ft.IsEnabled(FlagTrimDefaults))
+		require.False(t, ft.IsEnabled(FlagEnvelopeEncryption))
+		require.Equal(t, map[string]bool{FlagTrimDefaults: true}, ft.GetEnabled(context.Background()))
+	})
+
+	t.Run("check testing stubs with stages", func(t *testing.T) {
+		ft := WithFeatures("a", FeatureStateDeprecated, "b", false, FeatureStateBeta)
 		require.True(t, ft.IsEnabled("a"))
 		require.False(t, ft.IsEnabled("b"))
-		require.Equal(t, map[string]bool{"a": true}, ft.GetEnabled(context.Background()))
+		require.Equal(t, FeatureStateDeprecated, ft.flags["a"].State)
+		require.Equal(t, FeatureStateBeta, ft.flags["b"].State)
 	})
 
 	t.Run("check license validation", func(t *testing.T) {
@@ -75,3 +83,172 @@ func TestFeatureManager(t *testing.T) {
 		require.Equal(t, "http://something", flag.DocsURL)
 	})
 }
+
+func TestGetToggleStates(t *testing.T) {
+	ft := WithFeatures(FlagDashboardPreviews, FlagTrimDefaults, false, "notRegistered", FeatureStateAlpha)
+	states := ft.GetToggleStates()
+
+	require.Len(t, states, len(standardFeatureFlags))
+	for i := 1; i < len(states); i++ {
+		require.Less(t, states[i-1].Name, states[i].Name)
+	}
+	for _, state := range states {
+		require.NotEqual(t, "notRegistered", state.Name)
+		switch state.Name {
+		case FlagDashboardPreviews:
+			require.True(t, state.Enabled)
+			require.Equal(t, FeatureStateAlpha, state.Stage)
+			require.NotEmpty(t, state.Description)
+		case FlagTrimDefaults:
+			require.False(t, state.Enabled)
+		}
+	}
+}
+
+func TestSetEnabled(t *testing.T) {
+	t.Run("overrides keep the development mode requirement", func(t *testing.T) {
+		ft := FeatureManager{
+			flags: map[string]*FeatureFlag{},
+		}
+		ft.registerFlags(FeatureFlag{
+			Name:            FlagValidatedQueries,
+			RequiresDevMode: true,
+		}, FeatureFlag{
+			Name: FlagQueryServiceExpressions,
+		})
+
+		require.NoError(t, ft.SetEnabled(FlagValidatedQueries, true))
+		require.NoError(t, ft.SetEnabled(FlagQueryServiceExpressions, true))
+		require.False(t, ft.IsEnabled(FlagValidatedQueries))
+		require.True(t, ft.IsEnabled(FlagQueryServiceExpressions))
+
+		require.NoError(t, ft.SetEnabled(FlagQueryServiceExpressions, false))
+		require.False(t, ft.IsEnabled(FlagQueryServiceExpressions))
+	})
+
+	t.Run("only the allowed flags can be toggled", func(t *testing.T) {
+		ft := WithFeatures()
+		require.ErrorIs(t, ft.SetEnabled(FlagDashboardPreviews, true), ErrFeatureToggleRequiresRestart)
+		require.ErrorIs(t, ft.SetEnabled("unknown", true), ErrFeatureToggleNotFound)
+		require.Empty(t, ft.GetEnabled(context.Background()))
+	})
+}
+
+func TestOverride(t *testing.T) {
+	t.Run("overrides are restored in the reverse order", func(t *testing.T) {
+		ft := WithFeatures(FlagDashboardPreviews)
+		var changes []bool
+		ft.OnChange(func(flag string, enabled bool) {
+			require.Equal(t, FlagLiveConfig, flag)
+			changes = append(changes, enabled)
+		})
+
+		restoreFirst := ft.Override(FlagLiveConfig, true)
+		restoreSecond := ft.Override(FlagLiveConfig, false)
+		restoreThird := ft.Override(FlagLiveConfig, true)
+		require.True(t, ft.IsEnabled(FlagLiveConfig))
+
+		restoreThird()
+		require.False(t, ft.IsEnabled(FlagLiveConfig))
+		restoreSecond()
+		require.True(t, ft.IsEnabled(FlagLiveConfig))
+		restoreFirst()
+		require.False(t, ft.IsEnabled(FlagLiveConfig))
+		require.True(t, ft.IsEnabled(FlagDashboardPreviews))
+		require.Equal(t, []bool{true, false, true, false, true, false}, changes)
+	})
+
+	t.Run("flags that require a restart can be overridden", func(t *testing.T) {
+		ft := WithFeatures(FlagDashboardPreviews, false)
+		restore := ft.Override(FlagDashboardPreviews, true)
+		require.True(t, ft.IsEnabled(FlagDashboardPreviews))
+		restore()
+		require.False(t, ft.IsEnabled(FlagDashboardPreviews))
+	})
+
+	t.Run("the runtime overrides are restored", func(t *testing.T) {
+		ft := WithFeatures()
+		require.NoError(t, ft.SetEnabled(FlagTempoSearch, true))
+		restore := ft.Override(FlagTempoSearch, false)
+		require.False(t, ft.IsEnabled(FlagTempoSearch))
+		restore()
+		require.True(t, ft.IsEnabled(FlagTempoSearch))
+	})
+}
+
+func TestWithFeaturesForTest(t *testing.T) {
+	ft := WithFeatures(FlagDashboardPreviews)
+
+	t.Run("nested overrides", func(t *testing.T) {
+		WithFeaturesForTest(t, ft, FlagDashboardPreviews, false, FlagLiveConfig)
+		require.False(t, ft.IsEnabled(FlagDashboardPreviews))
+		require.True(t, ft.IsEnabled(FlagLiveConfig))
+
+		t.Run("override the same flags again", func(t *testing.T) {
+			WithFeaturesForTest(t, ft, FlagDashboardPreviews, FlagLiveConfig, false)
+			WithFeaturesForTest(t, ft, FlagLiveConfig)
+			require.True(t, ft.IsEnabled(FlagDashboardPreviews))
+			require.True(t, ft.IsEnabled(FlagLiveConfig))
+		})
+
+		require.False(t, ft.IsEnabled(FlagDashboardPreviews))
+		require.True(t, ft.IsEnabled(FlagLiveConfig))
+	})
+
+	require.True(t, ft.IsEnabled(FlagDashboardPreviews))
+	require.False(t, ft.IsEnabled(FlagLiveConfig))
+}
+
+func TestGetEnabledFrontendFlags(t *testing.T) {
+	t.Run("only the flags visible in the frontend are included", func(t *testing.T) {
+		ft := WithFeatures(
+			FlagAccesscontrol,
+			FlagTempoSearch,
+			FlagEnvelopeEncryption,
+			FlagDashboardPreviews, false,
+			"notRegistered", FeatureStateAlpha,
+		)
+		require.Equal(t, map[string]bool{
+			FlagAccesscontrol: true,
+			FlagTempoSearch:   true,
+		}, ft.GetEnabledFrontendFlags(context.Background()))
+	})
+
+	t.Run("the flags toggled at runtime are reflected", func(t *testing.T) {
+		ft := WithFeatures(FlagTempoSearch)
+		require.NoError(t, ft.SetEnabled(FlagTempoSearch, false))
+		require.NoError(t, ft.SetEnabled(FlagTempoServiceGraph, true))
+		require.NoError(t, ft.SetEnabled(FlagQueryServiceExpressions, true))
+
+		require.True(t, ft.IsEnabled(FlagQueryServiceExpressions))
+		require.Equal(t, map[string]bool{
+			FlagTempoServiceGraph: true,
+		}, ft.GetEnabledFrontendFlags(context.Background()))
+	})
+
+	t.Run("the registered flags are filtered by their definition", func(t *testing.T) {
+		ft := FeatureManager{
+			flags: map[string]*FeatureFlag{},
+		}
+		ft.registerFlags(
+			FeatureFlag{Name: "backend", Expression: "true"},
+			FeatureFlag{Name: "frontend", Expression: "true", Frontend: true},
+			FeatureFlag{Name: "frontendOnly", Expression: "true", FrontendOnly: true},
+		)
+		require.NoError(t, ft.SetEnabled(FlagQueryServiceExpressions, true))
+
+		require.Equal(t, map[string]bool{
+			"frontend":     true,
+			"frontendOnly": true,
+		}, ft.GetEnabledFrontendFlags(context.Background()))
+	})
+}
+
+func BenchmarkIsEnabled(b *testing.B) {
+	ft := WithFeatures(FlagValidatedQueries)
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			ft.IsEnabled(FlagValidatedQueries)
+		}
+	})
+}
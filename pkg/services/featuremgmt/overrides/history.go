@@ -0,0 +1,117 @@
+package overrides
+
+import (
+	"context"
+	"time"
+
+	"github.com/grafana/grafana/pkg/models"
+	"github.com/grafana/grafana/pkg/services/featuremgmt"
+	"github.com/grafana/grafana/pkg/services/sqlstore"
+)
+
+const (
+	// HistoryScopeGlobal is the scope of the changes applying to all the
+	// organizations.
+	HistoryScopeGlobal = "global"
+	// configActor is the actor of the changes made in the configuration.
+	configActor = "config"
+)
+
+// HistoryEntry is a change of the state of a flag.
+type HistoryEntry struct {
+	ID       int64     `json:"id" xorm:"pk autoincr 'id'"`
+	OrgID    int64     `json:"orgId" xorm:"org_id"`
+	Scope    string    `json:"scope"`
+	Flag     string    `json:"flag"`
+	UserID   int64     `json:"userId" xorm:"user_id"`
+	Actor    string    `json:"actor"`
+	OldValue bool      `json:"oldValue"`
+	NewValue bool      `json:"newValue"`
+	Created  time.Time `json:"created"`
+}
+
+func (e HistoryEntry) TableName() string {
+	return "feature_toggle_history"
+}
+
+// History returns the changes of the state of a flag, the most recent first.
+func (s *Service) History(ctx context.Context, flag string) ([]HistoryEntry, error) {
+	if err := featuremgmt.ValidateFlagName(flag); err != nil {
+		return nil, featuremgmt.ErrFeatureToggleNotFound
+	}
+	entries := []HistoryEntry{}
+	err := s.sqlStore.WithDbSession(ctx, func(session *sqlstore.DBSession) error {
+		return session.Where("flag = ?", flag).Desc("id").Find(&entries)
+	})
+	return entries, err
+}
+
+// recordChange records a change of the state of a flag made by user.
+func (s *Service) recordChange(ctx context.Context, user *models.SignedInUser, flag string, oldValue, newValue bool) error {
+	entry := HistoryEntry{
+		Scope:    HistoryScopeGlobal,
+		Flag:     flag,
+		UserID:   user.UserId,
+		Actor:    user.Login,
+		OldValue: oldValue,
+		NewValue: newValue,
+		Created:  time.Now(),
+	}
+	return s.insertHistory(ctx, entry)
+}
+
+// recordConfigChanges records the flags whose state differs from their last
+// recorded state, or from their default state when they have no history, as
+// changed by the configuration.
+func (s *Service) recordConfigChanges(ctx context.Context) error {
+	recorded, err := s.lastRecordedValues(ctx)
+	if err != nil {
+		return err
+	}
+	for _, toggle := range s.features.GetToggleStates() {
+		previous, ok := recorded[toggle.Name]
+		if !ok {
+			previous = toggle.EnabledByDefault
+		}
+		if toggle.Enabled == previous {
+			continue
+		}
+		entry := HistoryEntry{
+			Scope:    HistoryScopeGlobal,
+			Flag:     toggle.Name,
+			Actor:    configActor,
+			OldValue: previous,
+			NewValue: toggle.Enabled,
+			Created:  time.Now(),
+		}
+		if err := s.insertHistory(ctx, entry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// lastRecordedValues returns the state of the flags in their most recent
+// change.
+func (s *Service) lastRecordedValues(ctx context.Context) (map[string]bool, error) {
+	var entries []HistoryEntry
+	err := s.sqlStore.WithDbSession(ctx, func(session *sqlstore.DBSession) error {
+		return session.SQL(`SELECT flag, new_value FROM feature_toggle_history
+			WHERE id IN (SELECT MAX(id) FROM feature_toggle_history GROUP BY flag)`).Find(&entries)
+	})
+	if err != nil {
+		return nil, err
+	}
+	values := make(map[string]bool, len(entries))
+	for _, entry := range entries {
+		values[entry.Flag] = entry.NewValue
+	}
+	return values, nil
+}
+
+func (s *Service) insertHistory(ctx context.Context, entry HistoryEntry) error {
+	return s.sqlStore.WithDbSession(ctx, func(session *sqlstore.DBSession) error {
+		_, err := session.Insert(&entry)
+		return err
+	})
+}
@@ -0,0 +1,186 @@
+package overrides
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+
+	"github.com/grafana/grafana/pkg/infra/kvstore"
+	"github.com/grafana/grafana/pkg/infra/log"
+	"github.com/grafana/grafana/pkg/models"
+	"github.com/grafana/grafana/pkg/services/featuremgmt"
+	"github.com/grafana/grafana/pkg/services/sqlstore"
+)
+
+const (
+	kvNamespace        = "featuremgmt.overrides"
+	rolloutKVNamespace = "featuremgmt.rollouts"
+)
+
+// Service persists the flags toggled at runtime and their rollout rules in the
+// key/value store, so that they are kept after a restart. The changes of the
+// state of the flags are recorded in their history.
+type Service struct {
+	features *featuremgmt.FeatureManager
+	kv       *kvstore.NamespacedKVStore
+	rollouts *kvstore.NamespacedKVStore
+	sqlStore *sqlstore.SQLStore
+	log      log.Logger
+}
+
+// ProvideService applies the persisted overrides and rollout rules to the
+// feature manager, and records the flags changed in the configuration since
+// the last start.
+func ProvideService(features *featuremgmt.FeatureManager, kv kvstore.KVStore, sqlStore *sqlstore.SQLStore) (*Service, error) {
+	s := &Service{
+		features: features,
+		kv:       kvstore.WithNamespace(kv, 0, kvNamespace),
+		rollouts: kvstore.WithNamespace(kv, 0, rolloutKVNamespace),
+		sqlStore: sqlStore,
+		log:      log.New("featuremgmt.overrides"),
+	}
+	if err := s.load(context.Background()); err != nil {
+		return nil, err
+	}
+	if err := s.loadRollouts(context.Background()); err != nil {
+		return nil, err
+	}
+	if err := s.recordConfigChanges(context.Background()); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *Service) load(ctx context.Context) error {
+	keys, err := s.kv.Keys(ctx, "")
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		value, ok, err := s.kv.Get(ctx, key.Key)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+		enabled, err := strconv.ParseBool(value)
+		if err != nil {
+			s.log.Warn("Ignoring invalid feature toggle override", "flag", key.Key, "value", value)
+			continue
+		}
+		// Flags may have been removed from the allow-list since they were
+		// toggled, their configured state applies.
+		if err := s.features.SetEnabled(key.Key, enabled); err != nil {
+			s.log.Warn("Ignoring feature toggle override", "flag", key.Key, "error", err)
+		}
+	}
+	return nil
+}
+
+// SetEnabled toggles a flag at runtime, persists the override and records the
+// change made by user in the history of the flag. The flag and its override
+// are restored when the change cannot be persisted or recorded.
+func (s *Service) SetEnabled(ctx context.Context, user *models.SignedInUser, flag string, enabled bool) error {
+	// The flag is toggled before the override is persisted, so that the
+	// changes rejected by the feature manager, e.g. for their dependencies,
+	// are not persisted.
+	// The state is read from the enabled flags, recording the change is not a
+	// check of the flag for the evaluation metrics.
+	oldValue := s.features.GetEnabled(ctx)[flag]
+	oldOverride, overridden, err := s.kv.Get(ctx, flag)
+	if err != nil {
+		return err
+	}
+	if err := s.features.SetEnabled(flag, enabled); err != nil {
+		return err
+	}
+	if err := s.kv.Set(ctx, flag, strconv.FormatBool(enabled)); err != nil {
+		// The flag is restored, its state would differ from the persisted one
+		// after a restart otherwise.
+		s.restoreFlag(flag, oldValue)
+		return err
+	}
+	if err := s.recordChange(ctx, user, flag, oldValue, s.features.GetEnabled(ctx)[flag]); err != nil {
+		// The change is undone, it would be missing from the history of the
+		// flag otherwise.
+		s.restoreOverride(ctx, flag, oldOverride, overridden)
+		s.restoreFlag(flag, oldValue)
+		return err
+	}
+	s.log.Info("Feature toggle changed at runtime", "flag", flag, "enabled", enabled, "user", user.Login)
+	return nil
+}
+
+func (s *Service) restoreFlag(flag string, enabled bool) {
+	if err := s.features.SetEnabled(flag, enabled); err != nil {
+		s.log.Error("Failed to restore feature toggle", "flag", flag, "error", err)
+	}
+}
+
+// restoreOverride restores the override of a flag to value, or removes it
+// when the flag was not overridden.
+func (s *Service) restoreOverride(ctx context.Context, flag string, value string, overridden bool) {
+	var err error
+	if overridden {
+		err = s.kv.Set(ctx, flag, value)
+	} else {
+		err = s.kv.Del(ctx, flag)
+	}
+	if err != nil {
+		s.log.Error("Failed to restore feature toggle override", "flag", flag, "error", err)
+	}
+}
+
+func (s *Service) loadRollouts(ctx context.Context) error {
+	keys, err := s.rollouts.Keys(ctx, "")
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		value, ok, err := s.rollouts.Get(ctx, key.Key)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+		var rule featuremgmt.RolloutRule
+		if err := json.Unmarshal([]byte(value), &rule); err != nil {
+			s.log.Warn("Ignoring invalid feature toggle rollout rule", "flag", key.Key, "error", err)
+			continue
+		}
+		if err := s.features.SetRolloutRule(key.Key, &rule); err != nil {
+			s.log.Warn("Ignoring feature toggle rollout rule", "flag", key.Key, "error", err)
+		}
+	}
+	return nil
+}
+
+// SetRolloutRule sets the rollout rule of a flag and persists it, or removes
+// it when rule is nil.
+func (s *Service) SetRolloutRule(ctx context.Context, flag string, rule *featuremgmt.RolloutRule) error {
+	if err := featuremgmt.CheckRuntimeToggle(flag); err != nil {
+		return err
+	}
+	if rule == nil {
+		if err := s.rollouts.Del(ctx, flag); err != nil {
+			return err
+		}
+		s.log.Info("Feature toggle rollout rule removed", "flag", flag)
+		return s.features.SetRolloutRule(flag, nil)
+	}
+
+	if err := rule.Validate(); err != nil {
+		return err
+	}
+	value, err := json.Marshal(rule)
+	if err != nil {
+		return err
+	}
+	if err := s.rollouts.Set(ctx, flag, string(value)); err != nil {
+		return err
+	}
+	s.log.Info("Feature toggle rollout rule changed", "flag", flag, "percentage", rule.Percentage)
+	return s.features.SetRolloutRule(flag, rule)
+}
@@ -0,0 +1,222 @@
+package overrides
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/grafana/grafana/pkg/infra/kvstore"
+	"github.com/grafana/grafana/pkg/models"
+	"github.com/grafana/grafana/pkg/services/featuremgmt"
+	"github.com/grafana/grafana/pkg/services/sqlstore"
+	"github.com/stretchr/testify/require"
+)
+
+var testUser = &models.SignedInUser{UserId: 1, Login: "admin"}
+
+// failingKVStore fails to set the values once setErr is set.
+type failingKVStore struct {
+	kvstore.KVStore
+	setErr error
+}
+
+func (kv *failingKVStore) Set(ctx context.Context, orgId int64, namespace string, key string, value string) error {
+	if kv.setErr != nil {
+		return kv.setErr
+	}
+	return kv.KVStore.Set(ctx, orgId, namespace, key, value)
+}
+
+func TestOverrides(t *testing.T) {
+	db := sqlstore.InitTestDB(t)
+	kv := kvstore.ProvideService(db)
+	features := featuremgmt.WithFeatures()
+	s, err := ProvideService(features, kv, db)
+	require.NoError(t, err)
+
+	t.Run("toggling a flag enables it and notifies the change handlers", func(t *testing.T) {
+		changed := map[string]bool{}
+		features.OnChange(func(flag string, enabled bool) {
+			changed[flag] = enabled
+		})
+
+		err := s.SetEnabled(context.Background(), testUser, featuremgmt.FlagValidatedQueries, true)
+		require.NoError(t, err)
+		require.True(t, features.IsEnabled(featuremgmt.FlagValidatedQueries))
+		require.Equal(t, map[string]bool{featuremgmt.FlagValidatedQueries: true}, changed)
+	})
+
+	t.Run("toggled flags are kept after a restart", func(t *testing.T) {
+		err := s.SetEnabled(context.Background(), testUser, featuremgmt.FlagQueryServiceExpressions, true)
+		require.NoError(t, err)
+		err = s.SetEnabled(context.Background(), testUser, featuremgmt.FlagQueryServiceExpressions, false)
+		require.NoError(t, err)
+
+		restarted := featuremgmt.WithFeatures(featuremgmt.FlagQueryServiceExpressions)
+		_, err = ProvideService(restarted, kv, db)
+		require.NoError(t, err)
+		require.True(t, restarted.IsEnabled(featuremgmt.FlagValidatedQueries))
+		require.False(t, restarted.IsEnabled(featuremgmt.FlagQueryServiceExpressions))
+	})
+
+	t.Run("rollout rules are kept after a restart", func(t *testing.T) {
+		rule := &featuremgmt.RolloutRule{Percentage: 5, UserIDs: []int64{1}, TeamIDs: []int64{2}}
+		err := s.SetRolloutRule(context.Background(), featuremgmt.FlagTempoSearch, rule)
+		require.NoError(t, err)
+		err = s.SetRolloutRule(context.Background(), featuremgmt.FlagTempoServiceGraph, rule)
+		require.NoError(t, err)
+		err = s.SetRolloutRule(context.Background(), featuremgmt.FlagTempoServiceGraph, nil)
+		require.NoError(t, err)
+
+		restarted := featuremgmt.WithFeatures()
+		_, err = ProvideService(restarted, kv, db)
+		require.NoError(t, err)
+		restored, ok := restarted.GetRolloutRule(featuremgmt.FlagTempoSearch)
+		require.True(t, ok)
+		require.Equal(t, *rule, restored)
+		_, ok = restarted.GetRolloutRule(featuremgmt.FlagTempoServiceGraph)
+		require.False(t, ok)
+	})
+
+	t.Run("flags not allowed to be toggled at runtime are rejected", func(t *testing.T) {
+		err := s.SetEnabled(context.Background(), testUser, featuremgmt.FlagDashboardPreviews, true)
+		require.ErrorIs(t, err, featuremgmt.ErrFeatureToggleRequiresRestart)
+		require.False(t, features.IsEnabled(featuremgmt.FlagDashboardPreviews))
+
+		err = s.SetEnabled(context.Background(), testUser, "unknown", true)
+		require.ErrorIs(t, err, featuremgmt.ErrFeatureToggleNotFound)
+
+		_, ok, err := kv.Get(context.Background(), 0, kvNamespace, featuremgmt.FlagDashboardPreviews)
+		require.NoError(t, err)
+		require.False(t, ok)
+	})
+}
+
+func TestOverridesWithFailingStore(t *testing.T) {
+	db := sqlstore.InitTestDB(t)
+	kv := &failingKVStore{KVStore: kvstore.ProvideService(db)}
+	features := featuremgmt.WithFeatures()
+	s, err := ProvideService(features, kv, db)
+	require.NoError(t, err)
+
+	t.Run("flags are restored when their override cannot be persisted", func(t *testing.T) {
+		changed := []bool{}
+		features.OnChange(func(flag string, enabled bool) {
+			changed = append(changed, enabled)
+		})
+		kv.setErr = errors.New("kvstore unavailable")
+
+		err := s.SetEnabled(context.Background(), testUser, featuremgmt.FlagValidatedQueries, true)
+		require.ErrorIs(t, err, kv.setErr)
+		require.False(t, features.IsEnabled(featuremgmt.FlagValidatedQueries))
+		require.Equal(t, []bool{true, false}, changed)
+
+		entries, err := s.History(context.Background(), featuremgmt.FlagValidatedQueries)
+		require.NoError(t, err)
+		require.Empty(t, entries)
+	})
+
+	t.Run("flags and their overrides are restored when their change cannot be recorded", func(t *testing.T) {
+		kv.setErr = nil
+		require.NoError(t, s.SetEnabled(context.Background(), testUser, featuremgmt.FlagTempoSearch, true))
+
+		renameHistory := func(from, to string) {
+			err := db.WithDbSession(context.Background(), func(session *sqlstore.DBSession) error {
+				_, err := session.Exec("ALTER TABLE " + from + " RENAME TO " + to)
+				return err
+			})
+			require.NoError(t, err)
+		}
+		renameHistory("feature_toggle_history", "feature_toggle_history_unavailable")
+		t.Cleanup(func() {
+			renameHistory("feature_toggle_history_unavailable", "feature_toggle_history")
+		})
+
+		err := s.SetEnabled(context.Background(), testUser, featuremgmt.FlagTempoSearch, false)
+		require.Error(t, err)
+		require.True(t, features.IsEnabled(featuremgmt.FlagTempoSearch))
+		value, ok, err := kv.Get(context.Background(), 0, kvNamespace, featuremgmt.FlagTempoSearch)
+		require.NoError(t, err)
+		require.True(t, ok)
+		require.Equal(t, "true", value)
+
+		err = s.SetEnabled(context.Background(), testUser, featuremgmt.FlagTempoServiceGraph, true)
+		require.Error(t, err)
+		require.False(t, features.IsEnabled(featuremgmt.FlagTempoServiceGraph))
+		_, ok, err = kv.Get(context.Background(), 0, kvNamespace, featuremgmt.FlagTempoServiceGraph)
+		require.NoError(t, err)
+		require.False(t, ok)
+	})
+}
+
+func TestHistory(t *testing.T) {
+	db := sqlstore.InitTestDB(t)
+	kv := kvstore.ProvideService(db)
+	s, err := ProvideService(featuremgmt.WithFeatures(), kv, db)
+	require.NoError(t, err)
+
+	type change struct {
+		Actor    string
+		OldValue bool
+		NewValue bool
+	}
+	getHistory := func(t *testing.T, s *Service, flag string) []change {
+		t.Helper()
+		entries, err := s.History(context.Background(), flag)
+		require.NoError(t, err)
+		changes := make([]change, 0, len(entries))
+		for _, entry := range entries {
+			require.Equal(t, HistoryScopeGlobal, entry.Scope)
+			require.False(t, entry.Created.IsZero())
+			changes = append(changes, change{Actor: entry.Actor, OldValue: entry.OldValue, NewValue: entry.NewValue})
+		}
+		return changes
+	}
+
+	t.Run("flags with their default state have no history", func(t *testing.T) {
+		require.Empty(t, getHistory(t, s, featuremgmt.FlagTempoSearch))
+		require.Empty(t, getHistory(t, s, featuremgmt.FlagDashboardPreviews))
+	})
+
+	t.Run("runtime changes are recorded with their actor", func(t *testing.T) {
+		require.NoError(t, s.SetEnabled(context.Background(), testUser, featuremgmt.FlagTempoSearch, true))
+		require.NoError(t, s.SetEnabled(context.Background(), testUser, featuremgmt.FlagTempoSearch, false))
+
+		entries, err := s.History(context.Background(), featuremgmt.FlagTempoSearch)
+		require.NoError(t, err)
+		require.Len(t, entries, 2)
+		require.Equal(t, testUser.UserId, entries[0].UserID)
+		require.Equal(t, []change{
+			{Actor: "admin", OldValue: true, NewValue: false},
+			{Actor: "admin", OldValue: false, NewValue: true},
+		}, getHistory(t, s, featuremgmt.FlagTempoSearch))
+	})
+
+	t.Run("configuration changes are recorded at startup", func(t *testing.T) {
+		restarted, err := ProvideService(featuremgmt.WithFeatures(featuremgmt.FlagDashboardPreviews), kv, db)
+		require.NoError(t, err)
+		require.Equal(t, []change{
+			{Actor: "config", OldValue: false, NewValue: true},
+		}, getHistory(t, restarted, featuremgmt.FlagDashboardPreviews))
+
+		// The state is unchanged since the last start.
+		restarted, err = ProvideService(featuremgmt.WithFeatures(featuremgmt.FlagDashboardPreviews), kv, db)
+		require.NoError(t, err)
+		require.Len(t, getHistory(t, restarted, featuremgmt.FlagDashboardPreviews), 1)
+
+		restarted, err = ProvideService(featuremgmt.WithFeatures(), kv, db)
+		require.NoError(t, err)
+		require.Equal(t, []change{
+			{Actor: "config", OldValue: true, NewValue: false},
+			{Actor: "config", OldValue: false, NewValue: true},
+		}, getHistory(t, restarted, featuremgmt.FlagDashboardPreviews))
+
+		// The runtime overrides are applied before comparing the states.
+		require.Len(t, getHistory(t, restarted, featuremgmt.FlagTempoSearch), 2)
+	})
+
+	t.Run("unknown flags have no history", func(t *testing.T) {
+		_, err := s.History(context.Background(), "unknown")
+		require.ErrorIs(t, err, featuremgmt.ErrFeatureToggleNotFound)
+	})
+}
@@ -0,0 +1,127 @@
+package featuremgmt
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/grafana/grafana/pkg/setting"
+	"gopkg.in/ini.v1"
+)
+
+var ErrRemoteFlagsUnavailable = errors.New("remote feature toggles unavailable")
+
+// Provider provides the configured state of the flags.
+type Provider interface {
+	// GetFlags returns the state of the configured flags by name.
+	GetFlags(ctx context.Context) (map[string]bool, error)
+}
+
+// iniProvider provides the flags of the [feature_toggles] section of the
+// configuration, they're read once at startup.
+type iniProvider struct {
+	section *ini.Section
+}
+
+func (p iniProvider) GetFlags(ctx context.Context) (map[string]bool, error) {
+	return setting.ReadFeatureTogglesFromInitFile(p.section)
+}
+
+// RemoteProvider provides the flags served as a JSON object of flag names to
+// their state by an HTTP endpoint, e.g. {"tempoSearch": true}.
+type RemoteProvider struct {
+	url        string
+	authHeader string
+	httpClient http.Client
+}
+
+// NewRemoteProvider returns a provider fetching the flags from url, sending
+// authHeader in the Authorization header when it's set.
+func NewRemoteProvider(url, authHeader string, timeout time.Duration) *RemoteProvider {
+	return &RemoteProvider{
+		url:        url,
+		authHeader: authHeader,
+		httpClient: http.Client{Timeout: timeout},
+	}
+}
+
+func (p *RemoteProvider) GetFlags(ctx context.Context) (map[string]bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	if p.authHeader != "" {
+		req.Header.Set("Authorization", p.authHeader)
+	}
+
+	resp, err := p.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrRemoteFlagsUnavailable, err)
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%w: unexpected status %d", ErrRemoteFlagsUnavailable, resp.StatusCode)
+	}
+
+	var flags map[string]bool
+	if err := json.NewDecoder(resp.Body).Decode(&flags); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrRemoteFlagsUnavailable, err)
+	}
+	return flags, nil
+}
+
+// Run refreshes the flags from the remote provider at the poll interval. The
+// flags keep their last state when they can't be fetched.
+func (fm *FeatureManager) Run(ctx context.Context) error {
+	ticker := time.NewTicker(fm.pollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			_ = fm.refresh(ctx)
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// IsDisabled returns whether the flags are only read from the configuration.
+func (fm *FeatureManager) IsDisabled() bool {
+	return fm.provider == nil || fm.pollInterval <= 0
+}
+
+// refresh fetches the flags from the remote provider and applies them at
+// once, calling the change handlers of the flags whose state changed. The
+// flags keep their last state on errors.
+func (fm *FeatureManager) refresh(ctx context.Context) error {
+	flags, err := fm.provider.GetFlags(ctx)
+	if err != nil {
+		fm.log.Warn("Failed to refresh the feature toggles, keeping their last state", "error", err)
+		return err
+	}
+
+	fm.mu.Lock()
+	for name := range flags {
+		if _, ok := fm.flags[name]; !ok {
+			fm.log.Debug("Ignoring unknown remote feature toggle", "flag", name)
+		}
+	}
+	fm.provided = flags
+	before := fm.enabledFlags()
+	fm.update()
+	after := fm.enabledFlags()
+	if err := fm.checkDependencies(); err != nil {
+		fm.log.Warn("Remote feature toggles are disabled without the toggles they require", "error", err)
+	}
+	handlers := append([]ChangeHandler(nil), fm.changeHandlers...)
+	fm.mu.Unlock()
+
+	notifyChanges(handlers, changedFlags(before, after), after)
+	return nil
+}
@@ -0,0 +1,145 @@
+package featuremgmt
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana/pkg/infra/log"
+	"github.com/grafana/grafana/pkg/setting"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeFlagsServer struct {
+	*httptest.Server
+	status     int32
+	body       atomic.Value
+	authHeader atomic.Value
+}
+
+func newFakeFlagsServer(t *testing.T, body string) *fakeFlagsServer {
+	t.Helper()
+	s := &fakeFlagsServer{status: http.StatusOK}
+	s.body.Store(body)
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.authHeader.Store(r.Header.Get("Authorization"))
+		w.WriteHeader(int(atomic.LoadInt32(&s.status)))
+		_, _ = w.Write([]byte(s.body.Load().(string)))
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *fakeFlagsServer) respond(status int, body string) {
+	atomic.StoreInt32(&s.status, int32(status))
+	s.body.Store(body)
+}
+
+func TestRemoteProvider(t *testing.T) {
+	server := newFakeFlagsServer(t, `{"a": true, "b": false}`)
+	provider := NewRemoteProvider(server.URL, "Bearer token", time.Second)
+
+	flags, err := provider.GetFlags(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, map[string]bool{"a": true, "b": false}, flags)
+	require.Equal(t, "Bearer token", server.authHeader.Load())
+
+	server.respond(http.StatusInternalServerError, `{}`)
+	_, err = provider.GetFlags(context.Background())
+	require.ErrorIs(t, err, ErrRemoteFlagsUnavailable)
+
+	server.respond(http.StatusOK, `{"a": "yes"}`)
+	_, err = provider.GetFlags(context.Background())
+	require.ErrorIs(t, err, ErrRemoteFlagsUnavailable)
+}
+
+func TestRefreshRemoteFlags(t *testing.T) {
+	server := newFakeFlagsServer(t, `{"a": true, "unknown": true}`)
+	fm := &FeatureManager{
+		flags:    map[string]*FeatureFlag{},
+		provider: NewRemoteProvider(server.URL, "", time.Second),
+		log:      log.New("featuremgmt"),
+	}
+	fm.registerFlags(
+		FeatureFlag{Name: "a"},
+		FeatureFlag{Name: "b", Expression: "true"},
+	)
+	require.NoError(t, fm.resolveDependencies())
+
+	var mu sync.Mutex
+	changes := map[string]bool{}
+	fm.OnChange(func(flag string, enabled bool) {
+		mu.Lock()
+		defer mu.Unlock()
+		changes[flag] = enabled
+	})
+
+	require.NoError(t, fm.refresh(context.Background()))
+	require.True(t, fm.IsEnabled("a"))
+	require.True(t, fm.IsEnabled("b"))
+	require.False(t, fm.IsEnabled("unknown"))
+	require.Equal(t, map[string]bool{"a": true}, changes)
+
+	t.Run("the remote flags are applied at once", func(t *testing.T) {
+		changes = map[string]bool{}
+		server.respond(http.StatusOK, `{"a": false, "b": false}`)
+		require.NoError(t, fm.refresh(context.Background()))
+		require.False(t, fm.IsEnabled("a"))
+		require.False(t, fm.IsEnabled("b"))
+		require.Equal(t, map[string]bool{"a": false, "b": false}, changes)
+	})
+
+	t.Run("the flags keep their last state on errors", func(t *testing.T) {
+		changes = map[string]bool{}
+		server.respond(http.StatusInternalServerError, `{"a": true}`)
+		require.ErrorIs(t, fm.refresh(context.Background()), ErrRemoteFlagsUnavailable)
+		server.respond(http.StatusOK, `not json`)
+		require.ErrorIs(t, fm.refresh(context.Background()), ErrRemoteFlagsUnavailable)
+		require.False(t, fm.IsEnabled("a"))
+		require.False(t, fm.IsEnabled("b"))
+		require.Empty(t, changes)
+	})
+
+	t.Run("the flags toggled at runtime take precedence", func(t *testing.T) {
+		fm.overrides = map[string]bool{"a": true}
+		server.respond(http.StatusOK, `{"a": false}`)
+		require.NoError(t, fm.refresh(context.Background()))
+		require.True(t, fm.IsEnabled("a"))
+		require.True(t, fm.IsEnabled("b"))
+	})
+}
+
+func TestFeatureServiceRemoteProvider(t *testing.T) {
+	server := newFakeFlagsServer(t, `{"tempoSearch": true}`)
+	cfg := setting.NewCfg()
+	section, err := cfg.Raw.NewSection("feature_toggles.remote")
+	require.NoError(t, err)
+	_, err = section.NewKey("url", server.URL)
+	require.NoError(t, err)
+	_, err = section.NewKey("poll_interval", "10ms")
+	require.NoError(t, err)
+
+	mgmt, err := ProvideManagerService(cfg, nil)
+	require.NoError(t, err)
+	require.False(t, mgmt.IsDisabled())
+	require.True(t, mgmt.IsEnabled(FlagTempoSearch))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan error)
+	go func() {
+		done <- mgmt.Run(ctx)
+	}()
+
+	server.respond(http.StatusOK, `{"tempoSearch": false}`)
+	require.Eventually(t, func() bool {
+		return !mgmt.IsEnabled(FlagTempoSearch)
+	}, time.Second, 10*time.Millisecond)
+
+	cancel()
+	require.ErrorIs(t, <-done, context.Canceled)
+}
@@ -7,6 +7,7 @@ var (
 			Name:        "trimDefaults",
 			Description: "Use cue schema to remove values that will be applied automatically",
 			State:       FeatureStateBeta,
+			Frontend:    true,
 		},
 		{
 			Name:        "envelopeEncryption",
@@ -32,16 +33,20 @@ var (
 			Name:        "dashboardPreviews",
 			Description: "Create and show thumbnails for dashboard search results",
 			State:       FeatureStateAlpha,
+			Frontend:    true,
 		},
 		{
-			Name:        "dashboardPreviewsScheduler",
-			Description: "Schedule automatic updates to dashboard previews",
-			State:       FeatureStateAlpha,
+			Name:          "dashboardPreviewsScheduler",
+			Description:   "Schedule automatic updates to dashboard previews",
+			State:         FeatureStateAlpha,
+			RequiresFlags: []string{"dashboardPreviews"},
 		},
 		{
-			Name:        "dashboardPreviewsAdmin",
-			Description: "Manage the dashboard previews crawler process from the UI",
-			State:       FeatureStateAlpha,
+			Name:          "dashboardPreviewsAdmin",
+			Description:   "Manage the dashboard previews crawler process from the UI",
+			State:         FeatureStateAlpha,
+			Frontend:      true,
+			RequiresFlags: []string{"dashboardPreviews"},
 		},
 		{
 			Name:        "live-config",
@@ -52,6 +57,7 @@ var (
 			Name:        "live-pipeline",
 			Description: "enable a generic live processing pipeline",
 			State:       FeatureStateAlpha,
+			Frontend:    true,
 		},
 		{
 			Name:         "live-service-web-worker",
@@ -70,6 +76,7 @@ var (
 			Description:     "Search for dashboards using panel title",
 			State:           FeatureStateAlpha,
 			RequiresDevMode: true, // only supported in dev mode right now
+			Frontend:        true,
 		},
 		{
 			Name:         "tempoSearch",
@@ -81,6 +88,7 @@ var (
 			Name:        "tempoBackendSearch",
 			Description: "Use backend for tempo search",
 			State:       FeatureStateBeta,
+			Frontend:    true,
 		},
 		{
 			Name:         "tempoServiceGraph",
@@ -98,11 +106,13 @@ var (
 			Name:        "accesscontrol",
 			Description: "Support robust access control",
 			State:       FeatureStateBeta,
+			Frontend:    true,
 		},
 		{
 			Name:        "prometheus_azure_auth",
 			Description: "Use azure authentication for prometheus datasource",
 			State:       FeatureStateBeta,
+			Frontend:    true,
 		},
 		{
 			Name:         "influxdbBackendMigration",
@@ -114,6 +124,7 @@ var (
 			Name:        "newNavigation",
 			Description: "Try the next gen navigation model",
 			State:       FeatureStateAlpha,
+			Frontend:    true,
 		},
 		{
 			Name:            "showFeatureFlagsInUI",
@@ -136,6 +147,7 @@ var (
 			Name:        "lokiLive",
 			Description: "support websocket streaming for loki (early prototype)",
 			State:       FeatureStateAlpha,
+			Frontend:    true,
 		},
 		{
 			Name:        "swaggerUi",
@@ -146,16 +158,19 @@ var (
 			Name:        "featureHighlights",
 			Description: "Highlight Enterprise features",
 			State:       FeatureStateStable,
+			Frontend:    true,
 		},
 		{
 			Name:        "dashboardComments",
 			Description: "Enable dashboard-wide comments",
 			State:       FeatureStateAlpha,
+			Frontend:    true,
 		},
 		{
 			Name:        "annotationComments",
 			Description: "Enable annotation comments",
 			State:       FeatureStateAlpha,
+			Frontend:    true,
 		},
 		{
 			Name:        "migrationLocking",
@@ -168,5 +183,22 @@ var (
 			State:           FeatureStateAlpha,
 			RequiresDevMode: true,
 		},
+		{
+			Name:        "queryServiceExpressions",
+			Description: "Run server side expression data source queries through the query service",
+			State:       FeatureStateAlpha,
+		},
+		{
+			Name:         "promQueryBuilder",
+			Description:  "Show the query builder in the Prometheus query editor",
+			State:        FeatureStateAlpha,
+			FrontendOnly: true,
+		},
+		{
+			Name:         "lokiQueryBuilder",
+			Description:  "Show the query builder in the Loki query editor",
+			State:        FeatureStateAlpha,
+			FrontendOnly: true,
+		},
 	}
 )
@@ -0,0 +1,127 @@
+package featuremgmt
+
+import (
+	"context"
+	"errors"
+	"hash/fnv"
+	"strconv"
+
+	"github.com/grafana/grafana/pkg/models"
+)
+
+var ErrInvalidRolloutRule = errors.New("rollout percentage must be between 0 and 100")
+
+// RolloutRule enables a flag for a part of the users only: the users and the
+// members of the teams allowed explicitly, and a percentage of the others.
+type RolloutRule struct {
+	Percentage int     `json:"percentage"`
+	UserIDs    []int64 `json:"userIds,omitempty"`
+	TeamIDs    []int64 `json:"teamIds,omitempty"`
+}
+
+// Validate returns ErrInvalidRolloutRule when the percentage is out of range.
+func (r RolloutRule) Validate() error {
+	if r.Percentage < 0 || r.Percentage > 100 {
+		return ErrInvalidRolloutRule
+	}
+	return nil
+}
+
+// includes returns whether the rule enables the flag for the user. The users
+// are assigned to a percentage bucket by hashing the flag and their ID, so a
+// user keeps the same bucket across restarts and instances, and is still
+// included when the percentage is raised.
+func (r RolloutRule) includes(flag string, user *models.SignedInUser) bool {
+	for _, id := range r.UserIDs {
+		if id == user.UserId {
+			return true
+		}
+	}
+	for _, id := range r.TeamIDs {
+		for _, team := range user.Teams {
+			if team == id {
+				return true
+			}
+		}
+	}
+	// Anonymous users share the same ID, they are only included at 100%.
+	if user.UserId <= 0 {
+		return r.Percentage >= 100
+	}
+	return rolloutBucket(flag, user.UserId) < r.Percentage
+}
+
+// rolloutBucket returns the percentage bucket, from 0 to 99, of the user for
+// the flag. Hashing the flag along with the user ID rolls out the flags to
+// different users.
+func rolloutBucket(flag string, userID int64) int {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(flag + "/" + strconv.FormatInt(userID, 10)))
+	return int(h.Sum32() % 100)
+}
+
+// IsEnabledForUser checks if a feature is enabled for the user. A flag with
+// a rollout rule is enabled for the users included by the rule, unless it
+// requires the development mode or a license that are not available. Flags
+// without a rule behave like IsEnabled.
+func (fm *FeatureManager) IsEnabledForUser(ctx context.Context, user *models.SignedInUser, flag string) bool {
+	enabled := fm.isEnabledForUser(user, flag)
+	fm.observe(flag, enabled)
+	return enabled
+}
+
+func (fm *FeatureManager) isEnabledForUser(user *models.SignedInUser, flag string) bool {
+	if fm.enabledFlags()[flag] {
+		return true
+	}
+	rule, ok := fm.rolloutRules()[flag]
+	if !ok || user == nil {
+		return false
+	}
+	if registered, ok := fm.flags[flag]; ok && !fm.isAvailable(registered) {
+		return false
+	}
+	return rule.includes(flag, user)
+}
+
+// GetRolloutRule returns the rollout rule of the flag, if any.
+func (fm *FeatureManager) GetRolloutRule(flag string) (RolloutRule, bool) {
+	rule, ok := fm.rolloutRules()[flag]
+	return rule, ok
+}
+
+// SetRolloutRule sets the rollout rule of a flag that can be toggled at
+// runtime, or removes it when rule is nil. The change is kept in memory only,
+// see the overrides service to persist it.
+func (fm *FeatureManager) SetRolloutRule(flag string, rule *RolloutRule) error {
+	if err := CheckRuntimeToggle(flag); err != nil {
+		return err
+	}
+	if rule != nil {
+		if err := rule.Validate(); err != nil {
+			return err
+		}
+	}
+
+	fm.mu.Lock()
+	defer fm.mu.Unlock()
+	current := fm.rolloutRules()
+	updated := make(map[string]RolloutRule, len(current)+1)
+	for key, val := range current {
+		updated[key] = val
+	}
+	if rule != nil {
+		updated[flag] = *rule
+	} else {
+		delete(updated, flag)
+	}
+	fm.rollouts.Store(updated)
+	return nil
+}
+
+// rolloutRules returns the rollout rules by flag, the map must not be
+// modified as it's shared by all readers.
+func (fm *FeatureManager) rolloutRules() map[string]RolloutRule {
+	rules, _ := fm.rollouts.Load().(map[string]RolloutRule)
+	return rules
+}
@@ -0,0 +1,113 @@
+package featuremgmt
+
+import (
+	"context"
+	"testing"
+
+	"github.com/grafana/grafana/pkg/models"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIsEnabledForUser(t *testing.T) {
+	ctx := context.Background()
+	user := &models.SignedInUser{UserId: 42, Teams: []int64{7}}
+
+	t.Run("flags without rules keep their state", func(t *testing.T) {
+		ft := WithFeatures(FlagQueryServiceExpressions)
+		require.True(t, ft.IsEnabledForUser(ctx, user, FlagQueryServiceExpressions))
+		require.False(t, ft.IsEnabledForUser(ctx, user, FlagValidatedQueries))
+	})
+
+	t.Run("the allowed users and teams are included", func(t *testing.T) {
+		ft := WithFeatures()
+		require.NoError(t, ft.SetRolloutRule(FlagValidatedQueries, &RolloutRule{UserIDs: []int64{42}}))
+		require.NoError(t, ft.SetRolloutRule(FlagQueryServiceExpressions, &RolloutRule{TeamIDs: []int64{7}}))
+		require.NoError(t, ft.SetRolloutRule(FlagTempoSearch, &RolloutRule{UserIDs: []int64{1}, TeamIDs: []int64{2}}))
+
+		require.True(t, ft.IsEnabledForUser(ctx, user, FlagValidatedQueries))
+		require.True(t, ft.IsEnabledForUser(ctx, user, FlagQueryServiceExpressions))
+		require.False(t, ft.IsEnabledForUser(ctx, user, FlagTempoSearch))
+		require.False(t, ft.IsEnabled(FlagValidatedQueries))
+	})
+
+	t.Run("removing the rule restores the state of the flag", func(t *testing.T) {
+		ft := WithFeatures()
+		require.NoError(t, ft.SetRolloutRule(FlagValidatedQueries, &RolloutRule{Percentage: 100}))
+		require.True(t, ft.IsEnabledForUser(ctx, user, FlagValidatedQueries))
+		require.NoError(t, ft.SetRolloutRule(FlagValidatedQueries, nil))
+		require.False(t, ft.IsEnabledForUser(ctx, user, FlagValidatedQueries))
+	})
+
+	t.Run("rules keep the development mode requirement", func(t *testing.T) {
+		ft := FeatureManager{
+			flags: map[string]*FeatureFlag{},
+		}
+		ft.registerFlags(FeatureFlag{
+			Name:            FlagValidatedQueries,
+			RequiresDevMode: true,
+		})
+		require.NoError(t, ft.SetRolloutRule(FlagValidatedQueries, &RolloutRule{Percentage: 100}))
+		require.False(t, ft.IsEnabledForUser(ctx, user, FlagValidatedQueries))
+	})
+
+	t.Run("anonymous users are only included at 100%", func(t *testing.T) {
+		ft := WithFeatures()
+		anonymous := &models.SignedInUser{}
+		require.NoError(t, ft.SetRolloutRule(FlagValidatedQueries, &RolloutRule{Percentage: 99}))
+		require.False(t, ft.IsEnabledForUser(ctx, anonymous, FlagValidatedQueries))
+		require.NoError(t, ft.SetRolloutRule(FlagValidatedQueries, &RolloutRule{Percentage: 100}))
+		require.True(t, ft.IsEnabledForUser(ctx, anonymous, FlagValidatedQueries))
+	})
+
+	t.Run("invalid rules and flags requiring a restart are rejected", func(t *testing.T) {
+		ft := WithFeatures()
+		require.ErrorIs(t, ft.SetRolloutRule(FlagValidatedQueries, &RolloutRule{Percentage: 101}), ErrInvalidRolloutRule)
+		require.ErrorIs(t, ft.SetRolloutRule(FlagValidatedQueries, &RolloutRule{Percentage: -1}), ErrInvalidRolloutRule)
+		require.ErrorIs(t, ft.SetRolloutRule(FlagDashboardPreviews, &RolloutRule{Percentage: 5}), ErrFeatureToggleRequiresRestart)
+		_, ok := ft.GetRolloutRule(FlagValidatedQueries)
+		require.False(t, ok)
+	})
+}
+
+func TestRolloutDistribution(t *testing.T) {
+	const users = 100000
+	ctx := context.Background()
+	ft := WithFeatures()
+
+	enabledAt := func(percentage int) map[int64]bool {
+		require.NoError(t, ft.SetRolloutRule(FlagValidatedQueries, &RolloutRule{Percentage: percentage}))
+		enabled := map[int64]bool{}
+		for id := int64(1); id <= users; id++ {
+			if ft.IsEnabledForUser(ctx, &models.SignedInUser{UserId: id}, FlagValidatedQueries) {
+				enabled[id] = true
+			}
+		}
+		return enabled
+	}
+
+	previous := map[int64]bool{}
+	for _, percentage := range []int{0, 5, 50, 100} {
+		enabled := enabledAt(percentage)
+		require.InDelta(t, float64(percentage)/100, float64(len(enabled))/users, 0.01, "percentage %d", percentage)
+
+		// Raising the percentage keeps the users already included.
+		for id := range previous {
+			require.True(t, enabled[id], "user %d is no longer included at %d%%", id, percentage)
+		}
+		previous = enabled
+	}
+
+	t.Run("the buckets are stable and differ between flags", func(t *testing.T) {
+		// The buckets must not change between versions, or the users would
+		// switch between the enabled and disabled states on upgrade.
+		require.Equal(t, 86, rolloutBucket(FlagValidatedQueries, 42))
+		require.Equal(t, 43, rolloutBucket(FlagValidatedQueries, 1))
+		different := 0
+		for id := int64(1); id <= 100; id++ {
+			if rolloutBucket(FlagValidatedQueries, id) != rolloutBucket(FlagQueryServiceExpressions, id) {
+				different++
+			}
+		}
+		require.Greater(t, different, 50)
+	})
+}
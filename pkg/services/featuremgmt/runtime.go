@@ -0,0 +1,179 @@
+package featuremgmt
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	ErrFeatureToggleNotFound        = errors.New("feature toggle not found")
+	ErrFeatureToggleRequiresRestart = errors.New("feature toggle can not be changed without a restart")
+)
+
+// runtimeToggleableFlags are the flags that are read each time they are used,
+// so that toggling them at runtime takes effect without a restart.
+var runtimeToggleableFlags = map[string]bool{
+	FlagDisableHttpRequestHistogram: true,
+	FlagQueryServiceExpressions:     true,
+	FlagTempoSearch:                 true,
+	FlagTempoServiceGraph:           true,
+	FlagValidatedQueries:            true,
+}
+
+// ChangeHandler is called with the new state of a flag toggled at runtime.
+type ChangeHandler func(flag string, enabled bool)
+
+// IsRuntimeToggleable returns whether the flag can be toggled at runtime.
+func IsRuntimeToggleable(flag string) bool {
+	return runtimeToggleableFlags[flag]
+}
+
+// CheckRuntimeToggle returns an error when the flag can't be toggled at
+// runtime: ErrFeatureToggleNotFound when it's not in the feature registry, or
+// ErrFeatureToggleRequiresRestart when it's not allowed to be toggled at
+// runtime.
+func CheckRuntimeToggle(flag string) error {
+	if IsRuntimeToggleable(flag) {
+		return nil
+	}
+	if isRegisteredFlag(flag) {
+		return ErrFeatureToggleRequiresRestart
+	}
+	return ErrFeatureToggleNotFound
+}
+
+// OnChange registers a handler called each time a flag is toggled at runtime,
+// or changed by the remote provider, for the services caching the state of a
+// flag.
+func (fm *FeatureManager) OnChange(handler ChangeHandler) {
+	fm.mu.Lock()
+	defer fm.mu.Unlock()
+	fm.changeHandlers = append(fm.changeHandlers, handler)
+}
+
+// SetEnabled toggles a flag at runtime. The flag is still disabled when it
+// requires the development mode or a license that are not available. Enabling
+// a flag whose required flags are disabled fails with an error wrapping
+// ErrFeatureToggleDependencies, unless they're enabled along with it in the
+// auto-enable mode, and disabling a flag disables the flags requiring it. The
+// change is kept in memory only, see the overrides service to persist it.
+func (fm *FeatureManager) SetEnabled(flag string, enabled bool) error {
+	if err := CheckRuntimeToggle(flag); err != nil {
+		return err
+	}
+
+	fm.mu.Lock()
+	if fm.overrides == nil {
+		fm.overrides = make(map[string]bool)
+	}
+	previous, overridden := fm.overrides[flag]
+	fm.overrides[flag] = enabled
+	if enabled {
+		if err := fm.checkRuntimeDependencies(flag); err != nil {
+			if overridden {
+				fm.overrides[flag] = previous
+			} else {
+				delete(fm.overrides, flag)
+			}
+			fm.mu.Unlock()
+			return err
+		}
+	}
+	before := fm.enabledFlags()
+	fm.update()
+	after := fm.enabledFlags()
+	handlers := append([]ChangeHandler(nil), fm.changeHandlers...)
+	fm.mu.Unlock()
+
+	// The flags requiring the flag, or required by it, may change too.
+	changed := []string{flag}
+	for _, name := range changedFlags(before, after) {
+		if name != flag {
+			changed = append(changed, name)
+		}
+	}
+	notifyChanges(handlers, changed, after)
+	return nil
+}
+
+// Override sets the state of a flag, even one that can't be toggled at runtime,
+// and returns a function restoring its previous state. The overrides of a flag
+// must be restored in the reverse order. It's meant for the tests, see
+// WithFeaturesForTest.
+func (fm *FeatureManager) Override(flag string, enabled bool) (restore func()) {
+	fm.mu.Lock()
+	previous, overridden := fm.overrides[flag]
+	fm.mu.Unlock()
+
+	fm.override(flag, enabled, false)
+	return func() {
+		fm.override(flag, previous, !overridden)
+	}
+}
+
+// override sets the override of the flag, or removes it, and calls the change
+// handlers of the flags whose state changed.
+func (fm *FeatureManager) override(flag string, enabled bool, remove bool) {
+	fm.mu.Lock()
+	if fm.overrides == nil {
+		fm.overrides = make(map[string]bool)
+	}
+	if remove {
+		delete(fm.overrides, flag)
+	} else {
+		fm.overrides[flag] = enabled
+	}
+	before := fm.enabledFlags()
+	fm.update()
+	after := fm.enabledFlags()
+	handlers := append([]ChangeHandler(nil), fm.changeHandlers...)
+	fm.mu.Unlock()
+
+	notifyChanges(handlers, changedFlags(before, after), after)
+}
+
+// changedFlags returns the flags whose state differs between before and after,
+// which only hold the enabled flags.
+func changedFlags(before, after map[string]bool) []string {
+	var changed []string
+	for name := range before {
+		if !after[name] {
+			changed = append(changed, name)
+		}
+	}
+	for name := range after {
+		if !before[name] {
+			changed = append(changed, name)
+		}
+	}
+	return changed
+}
+
+// notifyChanges calls the handlers with the state in enabled of each changed flag.
+func notifyChanges(handlers []ChangeHandler, changed []string, enabled map[string]bool) {
+	for _, handler := range handlers {
+		for _, name := range changed {
+			handler(name, enabled[name])
+		}
+	}
+}
+
+// checkRuntimeDependencies returns an error when the flag, just overridden to
+// be enabled, requires flags that are disabled. In the auto-enable mode, the
+// flags enabled along with it must be allowed to be toggled at runtime too.
+func (fm *FeatureManager) checkRuntimeDependencies(flag string) error {
+	evaluated := fm.evaluateAll()
+	if missing := fm.missingDependencies(flag, evaluated); len(missing) > 0 {
+		return dependenciesError(flag, missing)
+	}
+	var restart []string
+	for _, dep := range fm.requires[flag] {
+		if !evaluated[dep] && !IsRuntimeToggleable(dep) {
+			restart = append(restart, dep)
+		}
+	}
+	if len(restart) > 0 {
+		return fmt.Errorf("%w: %q requires %s", ErrFeatureToggleRequiresRestart, flag, quoteFlags(restart))
+	}
+	return nil
+}
@@ -1,9 +1,12 @@
 package featuremgmt
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"path/filepath"
+	"sort"
+	"time"
 
 	"github.com/grafana/grafana/pkg/infra/log"
 
@@ -17,9 +20,9 @@ var (
 	// The values are updated each time
 	featureToggleInfo = promauto.NewGaugeVec(prometheus.GaugeOpts{
 		Name:      "feature_toggles_info",
-		Help:      "info metric that exposes what feature toggles are enabled or not",
+		Help:      "info metric that exposes what feature toggles are enabled or not, and their stage",
 		Namespace: "grafana",
-	}, []string{"name"})
+	}, []string{"name", "stage", "enabled"})
 )
 
 func ProvideManagerService(cfg *setting.Cfg, licensing models.Licensing) (*FeatureManager, error) {
@@ -27,7 +30,6 @@ func ProvideManagerService(cfg *setting.Cfg, licensing models.Licensing) (*Featu
 		isDevMod:  setting.Env != setting.Prod,
 		licensing: licensing,
 		flags:     make(map[string]*FeatureFlag, 30),
-		enabled:   make(map[string]bool),
 		log:       log.New("featuremgmt"),
 	}
 
@@ -35,10 +37,18 @@ func ProvideManagerService(cfg *setting.Cfg, licensing models.Licensing) (*Featu
 	mgmt.registerFlags(standardFeatureFlags...)
 
 	// Load the flags from `custom.ini` files
-	flags, err := setting.ReadFeatureTogglesFromInitFile(cfg.Raw.Section("feature_toggles"))
+	section := cfg.Raw.Section("feature_toggles")
+	flags, err := iniProvider{section: section}.GetFlags(context.Background())
 	if err != nil {
 		return mgmt, err
 	}
+	if err := mgmt.checkConfiguredFlags(flags, section.Key("strict_validation").MustBool(false)); err != nil {
+		return mgmt, err
+	}
+	mgmt.autoEnableDependencies = section.Key("auto_enable_dependencies").MustBool(false)
+	if section.Key("evaluation_metrics").MustBool(false) {
+		mgmt.evaluations = newEvaluationCounter(section.Key("evaluation_metrics_sampling").MustInt(128))
+	}
 	for key, val := range flags {
 		flag, ok := mgmt.flags[key]
 		if !ok {
@@ -63,13 +73,56 @@ func ProvideManagerService(cfg *setting.Cfg, licensing models.Licensing) (*Featu
 	}
 
 	// update the values
-	mgmt.update()
+	if err := mgmt.resolveDependencies(); err != nil {
+		return mgmt, err
+	}
+	if err := mgmt.checkDependencies(); err != nil {
+		return mgmt, err
+	}
+
+	// Load the flags of the remote provider, refreshed in the background
+	remote := cfg.Raw.Section("feature_toggles.remote")
+	if url := remote.Key("url").MustString(""); url != "" {
+		timeout := remote.Key("timeout").MustDuration(10 * time.Second)
+		mgmt.provider = NewRemoteProvider(url, remote.Key("auth_header").MustString(""), timeout)
+		mgmt.pollInterval = remote.Key("poll_interval").MustDuration(time.Minute)
+		// The flags of the configuration apply until the provider is reachable.
+		_ = mgmt.refresh(context.Background())
+	}
 
 	// Minimum approach to avoid circular dependency
 	cfg.IsFeatureToggleEnabled = mgmt.IsEnabled
 	return mgmt, nil
 }
 
+// checkConfiguredFlags logs a warning for each flag of the configuration that
+// is enabled while deprecated, or that is not in the feature registry. In
+// strict mode, it returns an error for the first flag not in the registry.
+func (fm *FeatureManager) checkConfiguredFlags(configured map[string]bool, strict bool) error {
+	names := make([]string, 0, len(configured))
+	for name := range configured {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		flag, ok := fm.flags[name]
+		switch {
+		case !ok && strict:
+			return ValidateFlagName(name)
+		case !ok:
+			if suggestion, ok := closestFlagName(name); ok {
+				fm.log.Warn("Unknown feature toggle in the configuration", "flag", name, "suggestion", suggestion)
+			} else {
+				fm.log.Warn("Unknown feature toggle in the configuration", "flag", name)
+			}
+		case configured[name] && flag.State == FeatureStateDeprecated:
+			fm.log.Warn("Deprecated feature toggle is enabled", "flag", name, "stage", flag.State.String())
+		}
+	}
+	return nil
+}
+
 // ProvideToggles allows read-only access to the feature state
 func ProvideToggles(mgmt *FeatureManager) FeatureToggles {
 	return mgmt
@@ -1,10 +1,13 @@
 package featuremgmt
 
 import (
+	"strconv"
 	"testing"
 
+	"github.com/grafana/grafana/pkg/infra/log"
 	"github.com/grafana/grafana/pkg/models"
 	"github.com/grafana/grafana/pkg/setting"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/require"
 )
 
@@ -46,6 +49,83 @@ func TestFeatureService(t *testing.T) {
 	require.False(t, mgmt.IsEnabled("a.yes")) // licensed, but not enabled
 }
 
+func TestWarnConfiguredFlags(t *testing.T) {
+	mgmt := WithFeatures("old", true, FeatureStateDeprecated, "older", false, FeatureStateDeprecated, "current", true, FeatureStateStable)
+	logger := &fakeLogger{}
+	mgmt.log = logger
+
+	err := mgmt.checkConfiguredFlags(map[string]bool{
+		"old":              true,
+		"older":            false,
+		"current":          true,
+		"typo":             true,
+		"validatedqueries": true,
+	}, false)
+	require.NoError(t, err)
+
+	require.Equal(t, []fakeLogEntry{
+		{msg: "Deprecated feature toggle is enabled", ctx: []interface{}{"flag", "old", "stage", "deprecated"}},
+		{msg: "Unknown feature toggle in the configuration", ctx: []interface{}{"flag", "typo"}},
+		{msg: "Unknown feature toggle in the configuration", ctx: []interface{}{"flag", "validatedqueries", "suggestion", FlagValidatedQueries}},
+	}, logger.warnings)
+}
+
+func TestFeatureServiceStrictValidation(t *testing.T) {
+	newCfg := func(t *testing.T, strict bool, flag string) *setting.Cfg {
+		cfg := setting.NewCfg()
+		section, err := cfg.Raw.NewSection("feature_toggles")
+		require.NoError(t, err)
+		_, err = section.NewKey("strict_validation", strconv.FormatBool(strict))
+		require.NoError(t, err)
+		_, err = section.NewKey("enable", flag)
+		require.NoError(t, err)
+		return cfg
+	}
+
+	t.Run("registered flags are accepted", func(t *testing.T) {
+		mgmt, err := ProvideManagerService(newCfg(t, true, FlagValidatedQueries), nil)
+		require.NoError(t, err)
+		require.NotContains(t, mgmt.flags, "strict_validation")
+	})
+
+	t.Run("unknown flags are rejected in strict mode", func(t *testing.T) {
+		_, err := ProvideManagerService(newCfg(t, true, "validatedqueries"), nil)
+		require.ErrorIs(t, err, ErrUnknownFeatureToggle)
+		require.Contains(t, err.Error(), `did you mean "validatedQueries"?`)
+	})
+
+	t.Run("unknown flags are accepted otherwise", func(t *testing.T) {
+		_, err := ProvideManagerService(newCfg(t, false, "validatedqueries"), nil)
+		require.NoError(t, err)
+	})
+}
+
+func TestFeatureToggleInfoMetric(t *testing.T) {
+	mgmt := WithFeatures("metric.old", true, FeatureStateDeprecated, "metric.off", false, FeatureStateUnknown)
+
+	require.Equal(t, 1.0, testutil.ToFloat64(featureToggleInfo.WithLabelValues("metric.old", "deprecated", "true")))
+	require.Equal(t, 0.0, testutil.ToFloat64(featureToggleInfo.WithLabelValues("metric.off", "unknown", "false")))
+
+	// The series of the previous state are removed.
+	mgmt.registerFlags(FeatureFlag{Name: "metric.off", State: FeatureStateBeta, Expression: "true"})
+	require.Equal(t, 1.0, testutil.ToFloat64(featureToggleInfo.WithLabelValues("metric.off", "beta", "true")))
+	require.False(t, featureToggleInfo.DeleteLabelValues("metric.off", "unknown", "false"))
+}
+
+type fakeLogEntry struct {
+	msg string
+	ctx []interface{}
+}
+
+type fakeLogger struct {
+	log.Logger
+	warnings []fakeLogEntry
+}
+
+func (l *fakeLogger) Warn(msg string, ctx ...interface{}) {
+	l.warnings = append(l.warnings, fakeLogEntry{msg: msg, ctx: ctx})
+}
+
 var (
 	_ models.Licensing = (*stubLicenseServier)(nil)
 )
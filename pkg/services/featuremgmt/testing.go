@@ -0,0 +1,33 @@
+package featuremgmt
+
+import (
+	"fmt"
+	"testing"
+)
+
+// WithFeaturesForTest overrides the flags of fm until the end of the test. The
+// arguments are a list of flag names that are optionally followed by a boolean
+// value, like WithFeatures. The previous state of the flags is restored when
+// the test completes, in the reverse order of the overrides, so that a test
+// can override the same flag several times.
+func WithFeaturesForTest(t testing.TB, fm *FeatureManager, spec ...interface{}) *FeatureManager {
+	t.Helper()
+	count := len(spec)
+	idx := 0
+	for idx < count {
+		flag := fmt.Sprintf("%v", spec[idx])
+		enabled := true
+		idx++
+		if idx < count {
+			if val, ok := spec[idx].(bool); ok {
+				enabled = val
+				idx++
+			}
+		}
+		if err := ValidateFlagName(flag); err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(fm.Override(flag, enabled))
+	}
+	return fm
+}
@@ -126,4 +126,16 @@ const (
 	// FlagFileStoreApi
 	// Simple API for managing files
 	FlagFileStoreApi = "fileStoreApi"
+
+	// FlagQueryServiceExpressions
+	// Run server side expression data source queries through the query service
+	FlagQueryServiceExpressions = "queryServiceExpressions"
+
+	// FlagPromQueryBuilder
+	// Show the query builder in the Prometheus query editor
+	FlagPromQueryBuilder = "promQueryBuilder"
+
+	// FlagLokiQueryBuilder
+	// Show the query builder in the Loki query editor
+	FlagLokiQueryBuilder = "lokiQueryBuilder"
 )
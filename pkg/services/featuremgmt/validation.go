@@ -0,0 +1,88 @@
+package featuremgmt
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var ErrUnknownFeatureToggle = errors.New("unknown feature toggle")
+
+// maxSuggestionDistance is the largest edit distance between an unknown flag
+// name and the registered flag suggested instead.
+const maxSuggestionDistance = 3
+
+// isRegisteredFlag returns whether the flag is in the feature registry.
+func isRegisteredFlag(name string) bool {
+	_, ok := registeredFlag(name)
+	return ok
+}
+
+// registeredFlag returns the definition of the flag in the feature registry.
+func registeredFlag(name string) (FeatureFlag, bool) {
+	for _, flag := range standardFeatureFlags {
+		if flag.Name == name {
+			return flag, true
+		}
+	}
+	return FeatureFlag{}, false
+}
+
+// ValidateFlagName returns an error wrapping ErrUnknownFeatureToggle when the
+// flag is not in the feature registry, suggesting the closest registered flag.
+func ValidateFlagName(name string) error {
+	if isRegisteredFlag(name) {
+		return nil
+	}
+	if suggestion, ok := closestFlagName(name); ok {
+		return fmt.Errorf("%w %q, did you mean %q?", ErrUnknownFeatureToggle, name, suggestion)
+	}
+	return fmt.Errorf("%w %q", ErrUnknownFeatureToggle, name)
+}
+
+// closestFlagName returns the registered flag with the smallest edit distance
+// to name, ignoring the case, if it's close enough to be a typo.
+func closestFlagName(name string) (string, bool) {
+	closest := ""
+	closestDistance := maxSuggestionDistance + 1
+	for _, flag := range standardFeatureFlags {
+		distance := editDistance(strings.ToLower(name), strings.ToLower(flag.Name))
+		if distance < closestDistance {
+			closest = flag.Name
+			closestDistance = distance
+		}
+	}
+	return closest, closest != ""
+}
+
+// editDistance returns the Levenshtein distance between a and b.
+func editDistance(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	previous := make([]int, len(rb)+1)
+	current := make([]int, len(rb)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		current[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			current[j] = min3(previous[j]+1, current[j-1]+1, previous[j-1]+cost)
+		}
+		previous, current = current, previous
+	}
+	return previous[len(rb)]
+}
+
+func min3(a, b, c int) int {
+	if b < a {
+		a = b
+	}
+	if c < a {
+		a = c
+	}
+	return a
+}
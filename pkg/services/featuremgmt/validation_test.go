@@ -0,0 +1,41 @@
+package featuremgmt
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidateFlagName(t *testing.T) {
+	t.Run("registered flags are valid", func(t *testing.T) {
+		require.NoError(t, ValidateFlagName(FlagValidatedQueries))
+	})
+
+	t.Run("flags with the wrong case suggest the registered flag", func(t *testing.T) {
+		err := ValidateFlagName("validatedqueries")
+		require.ErrorIs(t, err, ErrUnknownFeatureToggle)
+		require.EqualError(t, err, `unknown feature toggle "validatedqueries", did you mean "validatedQueries"?`)
+	})
+
+	t.Run("flags with a typo suggest the closest registered flag", func(t *testing.T) {
+		err := ValidateFlagName("validatedQuerys")
+		require.EqualError(t, err, `unknown feature toggle "validatedQuerys", did you mean "validatedQueries"?`)
+	})
+
+	t.Run("entirely unknown flags have no suggestion", func(t *testing.T) {
+		err := ValidateFlagName("somethingElseEntirely")
+		require.ErrorIs(t, err, ErrUnknownFeatureToggle)
+		require.EqualError(t, err, `unknown feature toggle "somethingElseEntirely"`)
+	})
+}
+
+func TestWithFeaturesValidation(t *testing.T) {
+	require.NotPanics(t, func() { WithFeatures(FlagValidatedQueries) })
+	require.PanicsWithError(t, `unknown feature toggle "validatedqueries", did you mean "validatedQueries"?`, func() {
+		WithFeatures("validatedqueries")
+	})
+	require.Panics(t, func() { WithFeatures("somethingElseEntirely", false) })
+
+	// Flags with a state simulate flags missing from the registry.
+	require.NotPanics(t, func() { WithFeatures("somethingElseEntirely", FeatureStateDeprecated) })
+}
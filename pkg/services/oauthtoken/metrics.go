@@ -0,0 +1,13 @@
+package oauthtoken
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var tokenCacheRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "grafana",
+	Subsystem: "oauth",
+	Name:      "token_cache_requests_total",
+	Help:      "Number of OAuth token cache lookups by result (hit or miss).",
+}, []string{"result"})
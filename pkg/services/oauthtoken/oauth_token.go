@@ -3,62 +3,159 @@ package oauthtoken
 import (
 	"context"
 	"errors"
+	"fmt"
+	"strconv"
+	"time"
 
 	"github.com/grafana/grafana/pkg/bus"
+	"github.com/grafana/grafana/pkg/events"
 	"github.com/grafana/grafana/pkg/infra/log"
 	"github.com/grafana/grafana/pkg/login/social"
 	"github.com/grafana/grafana/pkg/models"
+	"github.com/grafana/grafana/pkg/setting"
 	"golang.org/x/oauth2"
+	"golang.org/x/sync/singleflight"
 )
 
 var (
 	logger = log.New("oauthtoken")
+
+	// ErrTokenRefreshFailed is returned when the OAuth token of the user has expired
+	// and could not be refreshed, the user needs to sign in again.
+	ErrTokenRefreshFailed = errors.New("failed to refresh OAuth token")
 )
 
 type Service struct {
 	SocialService social.Service
+	Cfg           *setting.Cfg
+
+	singleFlightGroup singleflight.Group
+	// tokenCache caches the tokens per user, it's nil when the cache is
+	// disabled.
+	tokenCache *tokenCache
 }
 
 type OAuthTokenService interface {
 	GetCurrentOAuthToken(context.Context, *models.SignedInUser) *oauth2.Token
+	GetValidOAuthToken(context.Context, *models.SignedInUser) (*oauth2.Token, error)
+	TryTokenRefresh(context.Context, *models.SignedInUser) (*oauth2.Token, error)
+	HasExpired(*oauth2.Token) bool
 	IsOAuthPassThruEnabled(*models.DataSource) bool
 }
 
-func ProvideService(socialService social.Service) *Service {
-	return &Service{
+func ProvideService(socialService social.Service, cfg *setting.Cfg) *Service {
+	s := &Service{
 		SocialService: socialService,
+		Cfg:           cfg,
+	}
+
+	if cfg != nil {
+		tokenCache, err := newTokenCache(cfg.OAuthTokenCacheTTL, cfg.OAuthTokenCacheMaxEntries)
+		if err != nil {
+			logger.Error("failed to create the OAuth token cache, tokens are not cached", "error", err)
+		}
+		s.tokenCache = tokenCache
 	}
+
+	bus.AddEventListener(s.handleUserLoggedOut)
+
+	return s
 }
 
 // GetCurrentOAuthToken returns the OAuth token, if any, for the authenticated user. Will try to refresh the token if it has expired.
 func (o *Service) GetCurrentOAuthToken(ctx context.Context, user *models.SignedInUser) *oauth2.Token {
+	token, err := o.GetValidOAuthToken(ctx, user)
+	if err != nil {
+		return nil
+	}
+	return token
+}
+
+// GetValidOAuthToken returns the OAuth token, if any, for the authenticated user. The token is
+// refreshed when it has expired or expires within the configured skew, concurrent calls for the
+// same user share a single load and refresh. Tokens are served from the token cache until they
+// expire within the skew. ErrTokenRefreshFailed is returned when the refresh fails.
+func (o *Service) GetValidOAuthToken(ctx context.Context, user *models.SignedInUser) (*oauth2.Token, error) {
 	if user == nil {
 		// No user, therefore no token
-		return nil
+		return nil, nil
+	}
+
+	if token, _, ok := o.tokenCache.get(user.UserId, o.HasExpired); ok {
+		return token, nil
+	}
+
+	token, err, _ := o.singleFlightGroup.Do(strconv.FormatInt(user.UserId, 10), func() (interface{}, error) {
+		// Another call may have cached the token while this one was waiting.
+		cached, generation, ok := o.tokenCache.get(user.UserId, o.HasExpired)
+		if ok {
+			return cached, nil
+		}
+		token, err := o.getOAuthToken(ctx, user, false)
+		if err != nil {
+			o.tokenCache.invalidate(user.UserId)
+			return nil, err
+		}
+		o.tokenCache.set(user.UserId, generation, token)
+		return token, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return token.(*oauth2.Token), nil
+}
+
+// TryTokenRefresh refreshes the OAuth token of the authenticated user, whether it has expired or
+// not, and persists the refreshed token. Concurrent calls for the same user share a single
+// refresh. ErrTokenRefreshFailed is returned when the refresh fails.
+func (o *Service) TryTokenRefresh(ctx context.Context, user *models.SignedInUser) (*oauth2.Token, error) {
+	if user == nil {
+		// No user, therefore no token
+		return nil, nil
+	}
+
+	token, err, _ := o.singleFlightGroup.Do("refresh/"+strconv.FormatInt(user.UserId, 10), func() (interface{}, error) {
+		// The refreshed token replaces the cached one.
+		o.tokenCache.invalidate(user.UserId)
+		generation := o.tokenCache.currentGeneration()
+		token, err := o.getOAuthToken(ctx, user, true)
+		if err != nil {
+			return nil, err
+		}
+		o.tokenCache.set(user.UserId, generation, token)
+		return token, nil
+	})
+	if err != nil {
+		return nil, err
 	}
+	return token.(*oauth2.Token), nil
+}
 
+// getOAuthToken returns the stored OAuth token of the user, refreshed when it has expired or
+// when force is set.
+func (o *Service) getOAuthToken(ctx context.Context, user *models.SignedInUser, force bool) (*oauth2.Token, error) {
 	authInfoQuery := &models.GetAuthInfoQuery{UserId: user.UserId}
 	if err := bus.Dispatch(ctx, authInfoQuery); err != nil {
 		if errors.Is(err, models.ErrUserNotFound) {
 			// Not necessarily an error.  User may be logged in another way.
 			logger.Debug("no OAuth token for user found", "userId", user.UserId, "username", user.Login)
-		} else {
-			logger.Error("failed to get OAuth token for user", "userId", user.UserId, "username", user.Login, "error", err)
+			return nil, nil
 		}
-		return nil
+		logger.Error("failed to get OAuth token for user", "userId", user.UserId, "username", user.Login, "error", err)
+		return nil, err
 	}
 
 	authProvider := authInfoQuery.Result.AuthModule
 	connect, err := o.SocialService.GetConnector(authProvider)
 	if err != nil {
 		logger.Error("failed to get OAuth connector", "provider", authProvider, "error", err)
-		return nil
+		return nil, err
 	}
 
 	client, err := o.SocialService.GetOAuthHttpClient(authProvider)
 	if err != nil {
 		logger.Error("failed to get OAuth http client", "provider", authProvider, "error", err)
-		return nil
+		return nil, err
 	}
 	ctx = context.WithValue(ctx, oauth2.HTTPClient, client)
 
@@ -73,15 +170,23 @@ func (o *Service) GetCurrentOAuthToken(ctx context.Context, user *models.SignedI
 		persistedToken = persistedToken.WithExtra(map[string]interface{}{"id_token": authInfoQuery.Result.OAuthIdToken})
 	}
 
-	// TokenSource handles refreshing the token if it has expired
-	token, err := connect.TokenSource(ctx, persistedToken).Token()
+	// TokenSource handles refreshing the token if it has expired. Tokens about to expire
+	// are handed over as expired so that they are refreshed ahead of time.
+	sourceToken := persistedToken
+	if force || o.HasExpired(persistedToken) {
+		expired := *persistedToken
+		expired.Expiry = time.Now().Add(-time.Second)
+		sourceToken = &expired
+	}
+
+	token, err := connect.TokenSource(ctx, sourceToken).Token()
 	if err != nil {
 		logger.Error("failed to retrieve OAuth access token", "provider", authInfoQuery.Result.AuthModule, "userId", user.UserId, "username", user.Login, "error", err)
-		return nil
+		return nil, fmt.Errorf("%w: %v", ErrTokenRefreshFailed, err)
 	}
 
 	// If the tokens are not the same, update the entry in the DB
-	if !tokensEq(persistedToken, token) {
+	if !tokensEq(persistedToken, token) && !tokensEq(sourceToken, token) {
 		updateAuthCommand := &models.UpdateAuthInfoCommand{
 			UserId:     authInfoQuery.Result.UserId,
 			AuthModule: authInfoQuery.Result.AuthModule,
@@ -90,11 +195,30 @@ func (o *Service) GetCurrentOAuthToken(ctx context.Context, user *models.SignedI
 		}
 		if err := bus.Dispatch(ctx, updateAuthCommand); err != nil {
 			logger.Error("failed to update auth info during token refresh", "userId", user.UserId, "username", user.Login, "error", err)
-			return nil
+			return nil, err
 		}
 		logger.Debug("updated OAuth info for user", "userId", user.UserId, "username", user.Login)
 	}
-	return token
+	return token, nil
+}
+
+// handleUserLoggedOut removes the cached token of users logging out.
+func (o *Service) handleUserLoggedOut(_ context.Context, evt *events.UserLoggedOut) error {
+	o.tokenCache.invalidate(evt.Id)
+	return nil
+}
+
+// HasExpired returns true if the token has expired or expires within the configured skew.
+// Tokens without expiry never expire.
+func (o *Service) HasExpired(token *oauth2.Token) bool {
+	if token == nil || token.Expiry.IsZero() {
+		return false
+	}
+	var skew time.Duration
+	if o.Cfg != nil && o.Cfg.OAuthTokenExpirySkew > 0 {
+		skew = o.Cfg.OAuthTokenExpirySkew
+	}
+	return time.Until(token.Expiry) < skew
 }
 
 // IsOAuthPassThruEnabled returns true if Forward OAuth Identity (oauthPassThru) is enabled for the provided data source.
@@ -102,6 +226,12 @@ func (o *Service) IsOAuthPassThruEnabled(ds *models.DataSource) bool {
 	return ds.JsonData != nil && ds.JsonData.Get("oauthPassThru").MustBool()
 }
 
+// IDToken returns the OpenID Connect ID token issued along with the token, if any.
+func IDToken(token *oauth2.Token) (string, bool) {
+	idToken, ok := token.Extra("id_token").(string)
+	return idToken, ok && idToken != ""
+}
+
 // tokensEq checks for OAuth2 token equivalence given the fields of the struct Grafana is interested in
 func tokensEq(t1, t2 *oauth2.Token) bool {
 	return t1.AccessToken == t2.AccessToken &&
@@ -0,0 +1,382 @@
+package oauthtoken
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana/pkg/bus"
+	"github.com/grafana/grafana/pkg/events"
+	"github.com/grafana/grafana/pkg/login/social"
+	"github.com/grafana/grafana/pkg/models"
+	"github.com/grafana/grafana/pkg/setting"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/oauth2"
+)
+
+func TestGetValidOAuthToken(t *testing.T) {
+	user := &models.SignedInUser{UserId: 1}
+
+	setup := func(t *testing.T, expiry time.Time, refresh func() (*oauth2.Token, error)) (*Service, *fakeConnector, *models.UserAuth) {
+		t.Cleanup(bus.ClearBusHandlers)
+
+		var mu sync.Mutex
+		authInfo := &models.UserAuth{
+			UserId:            1,
+			AuthModule:        "generic_oauth",
+			OAuthAccessToken:  "access-token",
+			OAuthRefreshToken: "refresh-token",
+			OAuthTokenType:    "Bearer",
+			OAuthExpiry:       expiry,
+		}
+		bus.AddHandler("test", func(ctx context.Context, query *models.GetAuthInfoQuery) error {
+			mu.Lock()
+			defer mu.Unlock()
+			info := *authInfo
+			query.Result = &info
+			return nil
+		})
+		bus.AddHandler("test", func(ctx context.Context, cmd *models.UpdateAuthInfoCommand) error {
+			mu.Lock()
+			defer mu.Unlock()
+			authInfo.OAuthAccessToken = cmd.OAuthToken.AccessToken
+			authInfo.OAuthExpiry = cmd.OAuthToken.Expiry
+			return nil
+		})
+
+		connector := &fakeConnector{refresh: refresh}
+		cfg := setting.NewCfg()
+		cfg.OAuthTokenExpirySkew = time.Minute
+		return ProvideService(&fakeSocialService{connector: connector}, cfg), connector, authInfo
+	}
+
+	refreshed := func() (*oauth2.Token, error) {
+		return &oauth2.Token{AccessToken: "new-access-token", TokenType: "Bearer", Expiry: time.Now().Add(time.Hour)}, nil
+	}
+
+	t.Run("it returns the stored token when it is valid", func(t *testing.T) {
+		s, connector, _ := setup(t, time.Now().Add(time.Hour), refreshed)
+
+		token, err := s.GetValidOAuthToken(context.Background(), user)
+		require.NoError(t, err)
+		require.Equal(t, "access-token", token.AccessToken)
+		require.Equal(t, int32(0), atomic.LoadInt32(&connector.refreshes))
+	})
+
+	t.Run("it refreshes and persists a token expiring within the skew", func(t *testing.T) {
+		s, connector, authInfo := setup(t, time.Now().Add(30*time.Second), refreshed)
+
+		token, err := s.GetValidOAuthToken(context.Background(), user)
+		require.NoError(t, err)
+		require.Equal(t, "new-access-token", token.AccessToken)
+		require.Equal(t, int32(1), atomic.LoadInt32(&connector.refreshes))
+		require.Equal(t, "new-access-token", authInfo.OAuthAccessToken)
+	})
+
+	t.Run("it refreshes the token once for concurrent requests", func(t *testing.T) {
+		s, connector, _ := setup(t, time.Now().Add(-time.Minute), func() (*oauth2.Token, error) {
+			time.Sleep(50 * time.Millisecond)
+			return refreshed()
+		})
+
+		tokens := make([]*oauth2.Token, 10)
+		errs := make([]error, 10)
+		var wg sync.WaitGroup
+		for i := range tokens {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				tokens[i], errs[i] = s.GetValidOAuthToken(context.Background(), user)
+			}(i)
+		}
+		wg.Wait()
+
+		for i := range tokens {
+			require.NoError(t, errs[i])
+			require.Equal(t, "new-access-token", tokens[i].AccessToken)
+		}
+
+		require.Equal(t, int32(1), atomic.LoadInt32(&connector.refreshes))
+	})
+
+	t.Run("it returns ErrTokenRefreshFailed when the refresh fails", func(t *testing.T) {
+		s, _, _ := setup(t, time.Now().Add(-time.Minute), func() (*oauth2.Token, error) {
+			return nil, errors.New("invalid_grant")
+		})
+
+		token, err := s.GetValidOAuthToken(context.Background(), user)
+		require.Nil(t, token)
+		require.True(t, errors.Is(err, ErrTokenRefreshFailed))
+		require.Nil(t, s.GetCurrentOAuthToken(context.Background(), user))
+	})
+
+	t.Run("it refreshes and persists a valid token on demand", func(t *testing.T) {
+		s, connector, authInfo := setup(t, time.Now().Add(time.Hour), refreshed)
+
+		token, err := s.TryTokenRefresh(context.Background(), user)
+		require.NoError(t, err)
+		require.Equal(t, "new-access-token", token.AccessToken)
+		require.Equal(t, int32(1), atomic.LoadInt32(&connector.refreshes))
+		require.Equal(t, "new-access-token", authInfo.OAuthAccessToken)
+		require.Equal(t, token.Expiry, authInfo.OAuthExpiry)
+
+		token, err = s.GetValidOAuthToken(context.Background(), user)
+		require.NoError(t, err)
+		require.Equal(t, "new-access-token", token.AccessToken)
+		require.Equal(t, int32(1), atomic.LoadInt32(&connector.refreshes))
+	})
+
+	t.Run("it returns ErrTokenRefreshFailed when the refresh on demand fails", func(t *testing.T) {
+		s, _, authInfo := setup(t, time.Now().Add(time.Hour), func() (*oauth2.Token, error) {
+			return nil, errors.New("invalid_grant")
+		})
+
+		token, err := s.TryTokenRefresh(context.Background(), user)
+		require.Nil(t, token)
+		require.True(t, errors.Is(err, ErrTokenRefreshFailed))
+		require.Equal(t, "access-token", authInfo.OAuthAccessToken)
+	})
+}
+
+func TestGetValidOAuthToken_Cache(t *testing.T) {
+	user := &models.SignedInUser{UserId: 1}
+
+	setup := func(t *testing.T, expiry time.Time) (*Service, *int32) {
+		t.Cleanup(bus.ClearBusHandlers)
+
+		var loads int32
+		bus.AddHandler("test", func(ctx context.Context, query *models.GetAuthInfoQuery) error {
+			atomic.AddInt32(&loads, 1)
+			time.Sleep(20 * time.Millisecond)
+			query.Result = &models.UserAuth{
+				UserId:            1,
+				AuthModule:        "generic_oauth",
+				OAuthAccessToken:  "access-token",
+				OAuthRefreshToken: "refresh-token",
+				OAuthTokenType:    "Bearer",
+				OAuthExpiry:       expiry,
+			}
+			return nil
+		})
+		bus.AddHandler("test", func(ctx context.Context, cmd *models.UpdateAuthInfoCommand) error {
+			return nil
+		})
+
+		cfg := setting.NewCfg()
+		cfg.OAuthTokenExpirySkew = time.Minute
+		cfg.OAuthTokenCacheTTL = time.Minute
+		cfg.OAuthTokenCacheMaxEntries = 10
+		connector := &fakeConnector{refresh: func() (*oauth2.Token, error) {
+			return &oauth2.Token{AccessToken: "new-access-token", TokenType: "Bearer", Expiry: time.Now().Add(time.Hour)}, nil
+		}}
+		return ProvideService(&fakeSocialService{connector: connector}, cfg), &loads
+	}
+
+	t.Run("it loads the token once for concurrent requests and serves it from the cache", func(t *testing.T) {
+		s, loads := setup(t, time.Now().Add(time.Hour))
+
+		tokens := make([]*oauth2.Token, 10)
+		errs := make([]error, 10)
+		var wg sync.WaitGroup
+		for i := range tokens {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				tokens[i], errs[i] = s.GetValidOAuthToken(context.Background(), user)
+			}(i)
+		}
+		wg.Wait()
+
+		for i := range tokens {
+			require.NoError(t, errs[i])
+			require.Equal(t, "access-token", tokens[i].AccessToken)
+		}
+		require.Equal(t, int32(1), atomic.LoadInt32(loads))
+
+		token, err := s.GetValidOAuthToken(context.Background(), user)
+		require.NoError(t, err)
+		require.Equal(t, "access-token", token.AccessToken)
+		require.Equal(t, int32(1), atomic.LoadInt32(loads))
+	})
+
+	t.Run("it doesn't serve cached tokens expiring within the skew", func(t *testing.T) {
+		s, loads := setup(t, time.Now().Add(time.Hour))
+		s.tokenCache.set(user.UserId, 0, &oauth2.Token{AccessToken: "expiring-token", Expiry: time.Now().Add(30 * time.Second)})
+
+		token, err := s.GetValidOAuthToken(context.Background(), user)
+		require.NoError(t, err)
+		require.Equal(t, "access-token", token.AccessToken)
+		require.Equal(t, int32(1), atomic.LoadInt32(loads))
+	})
+
+	t.Run("it expires the cached tokens after the TTL", func(t *testing.T) {
+		s, loads := setup(t, time.Now().Add(time.Hour))
+		now := time.Now()
+		s.tokenCache.now = func() time.Time { return now }
+
+		_, err := s.GetValidOAuthToken(context.Background(), user)
+		require.NoError(t, err)
+		now = now.Add(time.Minute)
+		_, err = s.GetValidOAuthToken(context.Background(), user)
+		require.NoError(t, err)
+		require.Equal(t, int32(2), atomic.LoadInt32(loads))
+	})
+
+	t.Run("it caches the token refreshed on demand", func(t *testing.T) {
+		s, loads := setup(t, time.Now().Add(time.Hour))
+
+		_, err := s.GetValidOAuthToken(context.Background(), user)
+		require.NoError(t, err)
+		_, err = s.TryTokenRefresh(context.Background(), user)
+		require.NoError(t, err)
+
+		token, err := s.GetValidOAuthToken(context.Background(), user)
+		require.NoError(t, err)
+		require.Equal(t, "new-access-token", token.AccessToken)
+		require.Equal(t, int32(2), atomic.LoadInt32(loads))
+	})
+
+	t.Run("it removes the cached token when the user logs out", func(t *testing.T) {
+		s, loads := setup(t, time.Now().Add(time.Hour))
+
+		_, err := s.GetValidOAuthToken(context.Background(), user)
+		require.NoError(t, err)
+		err = bus.Publish(context.Background(), &events.UserLoggedOut{Id: user.UserId})
+		require.NoError(t, err)
+
+		_, err = s.GetValidOAuthToken(context.Background(), user)
+		require.NoError(t, err)
+		require.Equal(t, int32(2), atomic.LoadInt32(loads))
+	})
+
+	t.Run("it keeps the tokens of a bounded number of users", func(t *testing.T) {
+		c, err := newTokenCache(time.Minute, 2)
+		require.NoError(t, err)
+		notExpired := func(*oauth2.Token) bool { return false }
+
+		for userID := int64(1); userID <= 3; userID++ {
+			c.set(userID, 0, &oauth2.Token{AccessToken: "token"})
+		}
+		_, _, ok := c.get(1, notExpired)
+		require.False(t, ok)
+		_, _, ok = c.get(3, notExpired)
+		require.True(t, ok)
+	})
+}
+
+func TestHasExpired(t *testing.T) {
+	cfg := setting.NewCfg()
+	cfg.OAuthTokenExpirySkew = time.Minute
+	s := ProvideService(&fakeSocialService{}, cfg)
+
+	require.False(t, s.HasExpired(&oauth2.Token{AccessToken: "no-expiry"}))
+	require.False(t, s.HasExpired(&oauth2.Token{Expiry: time.Now().Add(time.Hour)}))
+	require.True(t, s.HasExpired(&oauth2.Token{Expiry: time.Now().Add(30 * time.Second)}))
+	require.True(t, s.HasExpired(&oauth2.Token{Expiry: time.Now().Add(-time.Second)}))
+
+	cfg.OAuthTokenExpirySkew = 0
+	require.False(t, s.HasExpired(&oauth2.Token{Expiry: time.Now().Add(30 * time.Second)}))
+	require.True(t, s.HasExpired(&oauth2.Token{Expiry: time.Now().Add(-time.Second)}))
+}
+
+func TestMissingScopes(t *testing.T) {
+	// jwtWithClaims returns an access token in JWT format, with a signature
+	// that is never verified.
+	jwtWithClaims := func(claims string) string {
+		return base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"RS256","typ":"JWT"}`)) + "." +
+			base64.RawURLEncoding.EncodeToString([]byte(claims)) + ".c2lnbmF0dXJl"
+	}
+
+	tests := []struct {
+		desc     string
+		token    *oauth2.Token
+		required []string
+		missing  []string
+	}{
+		{
+			desc:  "no scopes are required",
+			token: &oauth2.Token{AccessToken: "opaque"},
+		},
+		{
+			desc:     "the scope returned with the token grants the scopes",
+			token:    (&oauth2.Token{AccessToken: "opaque"}).WithExtra(map[string]interface{}{"scope": "openid  logs:read metrics:read"}),
+			required: []string{"metrics:read", "logs:read"},
+		},
+		{
+			desc:     "the scope claim of the access token grants the scopes",
+			token:    &oauth2.Token{AccessToken: jwtWithClaims(`{"sub":"alice","scope":"openid metrics:read"}`)},
+			required: []string{"metrics:read"},
+		},
+		{
+			desc:     "the scp claim of the access token grants the scopes",
+			token:    &oauth2.Token{AccessToken: jwtWithClaims(`{"sub":"alice","scp":["openid","metrics:read"]}`)},
+			required: []string{"metrics:read"},
+		},
+		{
+			desc:     "scopes are missing",
+			token:    (&oauth2.Token{AccessToken: "opaque"}).WithExtra(map[string]interface{}{"scope": "openid metrics:read"}),
+			required: []string{"metrics:read", "logs:read", "traces:read"},
+			missing:  []string{"logs:read", "traces:read"},
+		},
+		{
+			desc:     "scopes are case-sensitive",
+			token:    &oauth2.Token{AccessToken: jwtWithClaims(`{"scope":"Metrics:Read"}`)},
+			required: []string{"metrics:read"},
+			missing:  []string{"metrics:read"},
+		},
+		{
+			desc:     "all scopes are missing when the scopes of the token are unknown",
+			token:    &oauth2.Token{AccessToken: "opaque"},
+			required: []string{"openid", "metrics:read"},
+			missing:  []string{"openid", "metrics:read"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			require.Equal(t, tt.missing, MissingScopes(tt.token, tt.required))
+		})
+	}
+}
+
+type fakeSocialService struct {
+	social.Service
+
+	connector social.SocialConnector
+}
+
+func (s *fakeSocialService) GetConnector(string) (social.SocialConnector, error) {
+	return s.connector, nil
+}
+
+func (s *fakeSocialService) GetOAuthHttpClient(string) (*http.Client, error) {
+	return http.DefaultClient, nil
+}
+
+type fakeConnector struct {
+	social.SocialConnector
+
+	refresh   func() (*oauth2.Token, error)
+	refreshes int32
+}
+
+func (c *fakeConnector) TokenSource(ctx context.Context, t *oauth2.Token) oauth2.TokenSource {
+	return tokenSourceFunc(func() (*oauth2.Token, error) {
+		if t.Valid() {
+			return t, nil
+		}
+		atomic.AddInt32(&c.refreshes, 1)
+		return c.refresh()
+	})
+}
+
+type tokenSourceFunc func() (*oauth2.Token, error)
+
+func (f tokenSourceFunc) Token() (*oauth2.Token, error) {
+	return f()
+}
@@ -0,0 +1,66 @@
+package oauthtoken
+
+import (
+	"strings"
+
+	"golang.org/x/oauth2"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+// TokenScopes returns the scopes granted to the token. They are read from the
+// scope returned along with the token, or else from the scope or scp claim of
+// the access token when it's a JWT, as Grafana doesn't persist the scopes in
+// the auth info of the user. The returned bool is false when the scopes of
+// the token can't be determined.
+func TokenScopes(token *oauth2.Token) ([]string, bool) {
+	if scope, ok := token.Extra("scope").(string); ok && scope != "" {
+		return strings.Fields(scope), true
+	}
+
+	parsed, err := jwt.ParseSigned(token.AccessToken)
+	if err != nil {
+		return nil, false
+	}
+	var claims map[string]interface{}
+	if err := parsed.UnsafeClaimsWithoutVerification(&claims); err != nil {
+		return nil, false
+	}
+	for _, claim := range []string{"scope", "scp"} {
+		switch value := claims[claim].(type) {
+		case string:
+			return strings.Fields(value), true
+		case []interface{}:
+			var scopes []string
+			for _, v := range value {
+				if s, ok := v.(string); ok {
+					scopes = append(scopes, strings.Fields(s)...)
+				}
+			}
+			return scopes, true
+		}
+	}
+	return nil, false
+}
+
+// MissingScopes returns the required scopes that were not granted to the
+// token, in the order they are required. Scopes are case-sensitive, all of
+// them are missing when the scopes of the token can't be determined.
+func MissingScopes(token *oauth2.Token, required []string) []string {
+	if len(required) == 0 {
+		return nil
+	}
+	granted := map[string]bool{}
+	if scopes, ok := TokenScopes(token); ok {
+		for _, scope := range scopes {
+			granted[scope] = true
+		}
+	}
+
+	var missing []string
+	for _, scope := range required {
+		if !granted[scope] {
+			missing = append(missing, scope)
+		}
+	}
+	return missing
+}
@@ -0,0 +1,100 @@
+package oauthtoken
+
+import (
+	"sync"
+	"time"
+
+	lru "github.com/hashicorp/golang-lru"
+	"golang.org/x/oauth2"
+)
+
+type tokenCacheEntry struct {
+	token   *oauth2.Token
+	expires time.Time
+}
+
+// tokenCache is an in-memory LRU cache of the OAuth tokens of the users, keyed
+// by user ID. A nil tokenCache caches nothing.
+type tokenCache struct {
+	mu    sync.Mutex
+	cache *lru.Cache
+	ttl   time.Duration
+	now   func() time.Time
+	// generation is incremented on every invalidation so that the tokens
+	// loaded concurrently with an invalidation are not cached.
+	generation uint64
+}
+
+// newTokenCache returns a cache of the tokens of at most maxEntries users, or
+// nil when ttl is zero.
+func newTokenCache(ttl time.Duration, maxEntries int) (*tokenCache, error) {
+	if ttl <= 0 {
+		return nil, nil
+	}
+	cache, err := lru.New(maxEntries)
+	if err != nil {
+		return nil, err
+	}
+	return &tokenCache{cache: cache, ttl: ttl, now: time.Now}, nil
+}
+
+// get returns the cached token of the user, unless it has expired according
+// to hasExpired, and the generation of the cache to pass to set when there is
+// none.
+func (c *tokenCache) get(userID int64, hasExpired func(*oauth2.Token) bool) (*oauth2.Token, uint64, bool) {
+	if c == nil {
+		return nil, 0, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	v, ok := c.cache.Get(userID)
+	if ok {
+		entry := v.(tokenCacheEntry)
+		if c.now().Before(entry.expires) && !hasExpired(entry.token) {
+			tokenCacheRequests.WithLabelValues("hit").Inc()
+			return entry.token, 0, true
+		}
+		c.cache.Remove(userID)
+	}
+	tokenCacheRequests.WithLabelValues("miss").Inc()
+	return nil, c.generation, false
+}
+
+// set caches the token of the user, unless the cache was invalidated since
+// the generation returned by get.
+func (c *tokenCache) set(userID int64, generation uint64, token *oauth2.Token) {
+	if c == nil || token == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if generation != c.generation {
+		return
+	}
+	c.cache.Add(userID, tokenCacheEntry{token: token, expires: c.now().Add(c.ttl)})
+}
+
+// currentGeneration returns the generation to pass to set for tokens loaded
+// without a lookup.
+func (c *tokenCache) currentGeneration() uint64 {
+	if c == nil {
+		return 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.generation
+}
+
+// invalidate removes the cached token of the user.
+func (c *tokenCache) invalidate(userID int64) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.generation++
+	c.cache.Remove(userID)
+}
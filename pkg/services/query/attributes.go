@@ -0,0 +1,92 @@
+package query
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/grafana/grafana/pkg/expr"
+	"github.com/grafana/grafana/pkg/models"
+)
+
+const (
+	// pluginContextAttrHeaderPrefix prefixes the headers the plugin context
+	// attributes of a request are forwarded in.
+	pluginContextAttrHeaderPrefix = "X-Grafana-Ctx-"
+
+	maxPluginContextAttrs           = 16
+	maxPluginContextAttrNameLength  = 64
+	maxPluginContextAttrValueLength = 256
+)
+
+// pluginContextAttrNamePattern restricts the attribute names to characters
+// valid in header names.
+var pluginContextAttrNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_-]*$`)
+
+// validatePluginContextAttrs checks the number, names, sizes and characters of
+// the plugin context attributes of a request. The values are forwarded in
+// headers, control characters are rejected so that they can't inject other
+// headers.
+func validatePluginContextAttrs(attrs map[string]string) error {
+	if len(attrs) > maxPluginContextAttrs {
+		return NewErrBadQuery(fmt.Sprintf("too many plugin context attributes, at most %d are allowed", maxPluginContextAttrs))
+	}
+	for name, value := range attrs {
+		if len(name) > maxPluginContextAttrNameLength || !pluginContextAttrNamePattern.MatchString(name) {
+			return NewErrBadQuery(fmt.Sprintf("invalid plugin context attribute name %q", name))
+		}
+		if len(value) > maxPluginContextAttrValueLength {
+			return NewErrBadQuery(fmt.Sprintf("plugin context attribute %q is longer than %d bytes", name, maxPluginContextAttrValueLength))
+		}
+		if strings.IndexFunc(value, isHeaderControlCharacter) >= 0 {
+			return NewErrBadQuery(fmt.Sprintf("plugin context attribute %q contains control characters", name))
+		}
+	}
+	return nil
+}
+
+// allowsPluginContextAttr tells whether the data source accepts the plugin
+// context attribute, i.e. whether the attribute is listed in the
+// allowedPluginContextAttrs of its JSON data.
+func allowsPluginContextAttr(ds *models.DataSource, name string) bool {
+	if ds.JsonData == nil {
+		return false
+	}
+	for _, allowed := range ds.JsonData.Get("allowedPluginContextAttrs").MustStringArray() {
+		if allowed == name {
+			return true
+		}
+	}
+	return false
+}
+
+// checkPluginContextAttrs rejects the plugin context attributes that no data
+// source of the request accepts, so that clients can't send arbitrary headers
+// to the plugins.
+func checkPluginContextAttrs(req *parsedRequest) error {
+	for name := range req.pluginContextAttrs {
+		allowed := false
+		for _, pq := range req.parsedQueries {
+			if !expr.IsDataSource(pq.datasource.Uid) && allowsPluginContextAttr(pq.datasource, name) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return NewErrBadQuery(fmt.Sprintf("plugin context attribute %q is not allowed by the data sources of the queries", name))
+		}
+	}
+	return nil
+}
+
+// pluginContextAttrHeaders returns the headers forwarding the plugin context
+// attributes the data source accepts.
+func pluginContextAttrHeaders(ds *models.DataSource, attrs map[string]string) map[string]string {
+	headers := map[string]string{}
+	for name, value := range attrs {
+		if allowsPluginContextAttr(ds, name) {
+			headers[pluginContextAttrHeaderPrefix+name] = value
+		}
+	}
+	return headers
+}
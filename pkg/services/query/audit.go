@@ -0,0 +1,210 @@
+package query
+
+import (
+	"context"
+	"errors"
+	"regexp"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana/pkg/infra/log"
+	"github.com/grafana/grafana/pkg/models"
+	"github.com/grafana/grafana/pkg/setting"
+	"golang.org/x/oauth2"
+)
+
+// Outcomes of audited data source requests.
+const (
+	AuditOutcomeSuccess   = "success"
+	AuditOutcomeError     = "error"
+	AuditOutcomeCancelled = "cancelled"
+)
+
+// AuditRecord describes a request sent to a data source. Queries holds the
+// query models with their secrets masked.
+type AuditRecord struct {
+	RequestID      string
+	UserID         int64
+	UserLogin      string
+	OrgID          int64
+	DatasourceUID  string
+	DatasourceType string
+	RefIDs         []string
+	Queries        []string
+	From           time.Time
+	To             time.Time
+	Duration       time.Duration
+	Outcome        string
+	// FailedRefIDs are the queries answered with an error.
+	FailedRefIDs []string
+	Error        string
+}
+
+// Endpoints of the data sources the OAuth token of the user is forwarded to.
+const (
+	OAuthPassThruEndpointQuery    = "query"
+	OAuthPassThruEndpointResource = "resource"
+)
+
+// OAuthPassThruAuditRecord describes the OAuth token of a user forwarded to a
+// data source. It never holds the token itself.
+type OAuthPassThruAuditRecord struct {
+	RequestID      string
+	UserID         int64
+	UserLogin      string
+	OrgID          int64
+	DatasourceUID  string
+	DatasourceType string
+	Endpoint       string
+	// TokenExpiry is zero for tokens that don't expire.
+	TokenExpiry time.Time
+}
+
+// AuditSink receives the records of the audited data source requests and
+// OAuth token forwards.
+type AuditSink interface {
+	Record(ctx context.Context, record AuditRecord)
+	RecordOAuthPassThru(ctx context.Context, record OAuthPassThruAuditRecord)
+}
+
+// logAuditSink writes the audit records to the log.
+type logAuditSink struct {
+	log log.Logger
+}
+
+func newLogAuditSink() *logAuditSink {
+	return &logAuditSink{log: log.New("query_audit")}
+}
+
+func (s *logAuditSink) Record(_ context.Context, record AuditRecord) {
+	ctx := []interface{}{
+		"requestId", record.RequestID,
+		"userId", record.UserID,
+		"userLogin", record.UserLogin,
+		"orgId", record.OrgID,
+		"datasource", record.DatasourceUID,
+		"datasourceType", record.DatasourceType,
+		"refIds", record.RefIDs,
+		"queries", record.Queries,
+		"from", record.From,
+		"to", record.To,
+		"duration", record.Duration,
+		"outcome", record.Outcome,
+	}
+	if len(record.FailedRefIDs) > 0 {
+		ctx = append(ctx, "failedRefIds", record.FailedRefIDs)
+	}
+	if record.Error != "" {
+		ctx = append(ctx, "error", record.Error)
+	}
+	s.log.Info("Query executed", ctx...)
+}
+
+func (s *logAuditSink) RecordOAuthPassThru(_ context.Context, record OAuthPassThruAuditRecord) {
+	s.log.Info("OAuth token forwarded",
+		"requestId", record.RequestID,
+		"userId", record.UserID,
+		"userLogin", record.UserLogin,
+		"orgId", record.OrgID,
+		"datasource", record.DatasourceUID,
+		"datasourceType", record.DatasourceType,
+		"endpoint", record.Endpoint,
+		"tokenExpiry", record.TokenExpiry,
+	)
+}
+
+// SetAuditSink replaces the sink the audit records are sent to, which is the
+// log by default. Requests are only audited when auditing is enabled.
+func (s *Service) SetAuditSink(sink AuditSink) {
+	s.auditSink = sink
+}
+
+// newAuditRedactor returns the redactor for the audited queries, with the
+// configured patterns in addition to the default ones.
+func newAuditRedactor(cfg *setting.Cfg, logger log.Logger) *redactor {
+	var patterns []*regexp.Regexp
+	for _, p := range cfg.QueryAuditRedactPatterns {
+		pattern, err := regexp.Compile(p)
+		if err != nil {
+			logger.Error("Ignoring invalid query audit redact pattern", "pattern", p, "error", err)
+			continue
+		}
+		patterns = append(patterns, pattern)
+	}
+	return newRedactor(patterns...)
+}
+
+// auditQueryData sends the record of a data source request to the audit sink
+// when auditing is enabled.
+func (s *Service) auditQueryData(ctx context.Context, user *models.SignedInUser, ds *models.DataSource, req *backend.QueryDataRequest, duration time.Duration, resp *backend.QueryDataResponse, err error) {
+	if s.cfg == nil || !s.cfg.QueryAuditEnabled || s.auditSink == nil {
+		return
+	}
+
+	record := AuditRecord{
+		RequestID:      requestIDFromContext(ctx),
+		OrgID:          ds.OrgId,
+		DatasourceUID:  ds.Uid,
+		DatasourceType: ds.Type,
+		Duration:       duration,
+		Outcome:        AuditOutcomeSuccess,
+	}
+	if user != nil {
+		record.UserID = user.UserId
+		record.UserLogin = user.Login
+		record.OrgID = user.OrgId
+	}
+	for i, q := range req.Queries {
+		if i == 0 || q.TimeRange.From.Before(record.From) {
+			record.From = q.TimeRange.From
+		}
+		if q.TimeRange.To.After(record.To) {
+			record.To = q.TimeRange.To
+		}
+		record.RefIDs = append(record.RefIDs, q.RefID)
+		record.Queries = append(record.Queries, s.auditRedactor.redactQuery(q.JSON))
+	}
+
+	switch {
+	case errors.Is(ctx.Err(), context.Canceled):
+		record.Outcome = AuditOutcomeCancelled
+	case err != nil:
+		record.Outcome = AuditOutcomeError
+		record.Error = s.auditRedactor.redact(err.Error())
+	case resp != nil:
+		for _, q := range req.Queries {
+			if dr, ok := resp.Responses[q.RefID]; ok && dr.Error != nil {
+				record.FailedRefIDs = append(record.FailedRefIDs, q.RefID)
+			}
+		}
+		if len(record.FailedRefIDs) > 0 {
+			record.Outcome = AuditOutcomeError
+		}
+	}
+
+	s.auditSink.Record(ctx, record)
+}
+
+// auditOAuthPassThru counts the OAuth token of the user forwarded to the data
+// source, and sends its record to the audit sink when auditing is enabled.
+func (s *Service) auditOAuthPassThru(ctx context.Context, user *models.SignedInUser, ds *models.DataSource, token *oauth2.Token, endpoint string) {
+	queryOAuthPassThru.WithLabelValues(ds.Type).Inc()
+	if s.cfg == nil || !s.cfg.QueryAuditEnabled || s.auditSink == nil {
+		return
+	}
+
+	record := OAuthPassThruAuditRecord{
+		RequestID:      requestIDFromContext(ctx),
+		OrgID:          ds.OrgId,
+		DatasourceUID:  ds.Uid,
+		DatasourceType: ds.Type,
+		Endpoint:       endpoint,
+		TokenExpiry:    token.Expiry,
+	}
+	if user != nil {
+		record.UserID = user.UserId
+		record.UserLogin = user.Login
+		record.OrgID = user.OrgId
+	}
+	s.auditSink.RecordOAuthPassThru(ctx, record)
+}
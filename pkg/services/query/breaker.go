@@ -0,0 +1,238 @@
+package query
+
+import (
+	"context"
+	"errors"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana/pkg/models"
+)
+
+// CircuitState is the state of the circuit breaker of a data source.
+type CircuitState int
+
+const (
+	// CircuitClosed lets all queries through.
+	CircuitClosed CircuitState = iota
+	// CircuitOpen fails all queries fast until the cooldown elapsed.
+	CircuitOpen
+	// CircuitHalfOpen lets a single probe request through, which closes the
+	// circuit when it succeeds and opens it again when it fails.
+	CircuitHalfOpen
+)
+
+func (s CircuitState) String() string {
+	switch s {
+	case CircuitOpen:
+		return "open"
+	case CircuitHalfOpen:
+		return "half-open"
+	default:
+		return "closed"
+	}
+}
+
+func (s CircuitState) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// CircuitBreakerStatus describes the circuit breaker of a data source.
+type CircuitBreakerStatus struct {
+	OrgID               int64        `json:"orgId"`
+	DatasourceUID       string       `json:"datasourceUid"`
+	State               CircuitState `json:"state"`
+	ConsecutiveFailures int          `json:"consecutiveFailures"`
+	// OpenedAt is when the circuit last opened, RetryAfterSeconds how long it
+	// stays open before a probe request is let through.
+	OpenedAt          time.Time `json:"openedAt"`
+	RetryAfterSeconds int64     `json:"retryAfterSeconds"`
+}
+
+// requestOutcome is what a data source request tells about the health of the
+// data source.
+type requestOutcome int
+
+const (
+	requestSucceeded requestOutcome = iota
+	requestFailed
+	// requestCancelled requests were cancelled by the client and tell nothing
+	// about the data source.
+	requestCancelled
+)
+
+type breakerKey struct {
+	orgID         int64
+	datasourceUID string
+}
+
+type breaker struct {
+	state    CircuitState
+	failures int
+	openedAt time.Time
+	probing  bool
+}
+
+// circuitBreakers track the consecutive failures of the requests to every
+// data source, to stop sending requests to data sources that are down.
+type circuitBreakers struct {
+	mu       sync.Mutex
+	breakers map[breakerKey]*breaker
+	// threshold is the number of consecutive failures opening a circuit, zero
+	// disables the circuit breakers.
+	threshold int
+	cooldown  time.Duration
+	now       func() time.Time
+}
+
+func newCircuitBreakers(threshold int, cooldown time.Duration) *circuitBreakers {
+	return &circuitBreakers{
+		breakers:  map[breakerKey]*breaker{},
+		threshold: threshold,
+		cooldown:  cooldown,
+		now:       time.Now,
+	}
+}
+
+// allow reports whether a request may be sent to the data source. When it
+// may, the returned function must be called with the outcome of the request.
+// When it may not, the returned duration is the remaining cooldown.
+func (c *circuitBreakers) allow(orgID int64, datasourceUID string) (func(requestOutcome), time.Duration, bool) {
+	if c.threshold <= 0 {
+		return func(requestOutcome) {}, 0, true
+	}
+
+	key := breakerKey{orgID: orgID, datasourceUID: datasourceUID}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	b, ok := c.breakers[key]
+	if !ok {
+		b = &breaker{}
+		c.breakers[key] = b
+	}
+
+	probe := false
+	switch b.state {
+	case CircuitOpen:
+		if elapsed := c.now().Sub(b.openedAt); elapsed < c.cooldown {
+			return nil, c.cooldown - elapsed, false
+		}
+		c.setState(key, b, CircuitHalfOpen)
+		fallthrough
+	case CircuitHalfOpen:
+		if b.probing {
+			return nil, 0, false
+		}
+		b.probing = true
+		probe = true
+	}
+
+	return func(outcome requestOutcome) {
+		c.record(key, b, probe, outcome)
+	}, 0, true
+}
+
+func (c *circuitBreakers) record(key breakerKey, b *breaker, probe bool, outcome requestOutcome) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if probe {
+		b.probing = false
+	}
+	switch outcome {
+	case requestSucceeded:
+		b.failures = 0
+		if b.state != CircuitClosed {
+			c.setState(key, b, CircuitClosed)
+		}
+	case requestFailed:
+		b.failures++
+		if probe || (b.state == CircuitClosed && b.failures >= c.threshold) {
+			b.openedAt = c.now()
+			c.setState(key, b, CircuitOpen)
+		}
+	}
+}
+
+func (c *circuitBreakers) setState(key breakerKey, b *breaker, state CircuitState) {
+	b.state = state
+	queryCircuitBreakerState.WithLabelValues(key.datasourceUID).Set(float64(state))
+}
+
+// statuses returns the status of the circuit breaker of every data source
+// queried since startup.
+func (c *circuitBreakers) statuses() []CircuitBreakerStatus {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	statuses := make([]CircuitBreakerStatus, 0, len(c.breakers))
+	for key, b := range c.breakers {
+		status := CircuitBreakerStatus{
+			OrgID:               key.orgID,
+			DatasourceUID:       key.datasourceUID,
+			State:               b.state,
+			ConsecutiveFailures: b.failures,
+			OpenedAt:            b.openedAt,
+		}
+		if b.state == CircuitOpen {
+			if remaining := c.cooldown - c.now().Sub(b.openedAt); remaining > 0 {
+				status.RetryAfterSeconds = int64(math.Ceil(remaining.Seconds()))
+			}
+		}
+		statuses = append(statuses, status)
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		if statuses[i].OrgID != statuses[j].OrgID {
+			return statuses[i].OrgID < statuses[j].OrgID
+		}
+		return statuses[i].DatasourceUID < statuses[j].DatasourceUID
+	})
+	return statuses
+}
+
+// CircuitBreakerStatuses returns the status of the circuit breaker of every
+// data source queried since startup.
+func (s *Service) CircuitBreakerStatuses() []CircuitBreakerStatus {
+	return s.breakers.statuses()
+}
+
+// unavailableResponse reports the data source as temporarily unavailable for
+// every query of the request.
+func unavailableResponse(ds *models.DataSource, req *backend.QueryDataRequest, retryAfter time.Duration) *backend.QueryDataResponse {
+	queryCircuitBreakerRejected.WithLabelValues(ds.Uid).Add(float64(len(req.Queries)))
+
+	resp := backend.NewQueryDataResponse()
+	for _, q := range req.Queries {
+		resp.Responses[q.RefID] = backend.DataResponse{
+			Error: &ErrDatasourceUnavailable{RefID: q.RefID, DatasourceUID: ds.Uid, RetryAfter: retryAfter},
+		}
+	}
+	return resp
+}
+
+// outcomeOf tells whether the data source failed to answer a request, as
+// opposed to answering with errors for some queries. Requests where every
+// query timed out count as failed.
+func outcomeOf(ctx context.Context, resp *backend.QueryDataResponse, err error) requestOutcome {
+	if errors.Is(ctx.Err(), context.Canceled) {
+		return requestCancelled
+	}
+	if err != nil {
+		return requestFailed
+	}
+	if resp == nil || len(resp.Responses) == 0 {
+		return requestSucceeded
+	}
+	for _, dr := range resp.Responses {
+		var timeout *ErrQueryTimeout
+		if !errors.As(dr.Error, &timeout) {
+			return requestSucceeded
+		}
+	}
+	return requestFailed
+}
@@ -0,0 +1,184 @@
+package query
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana/pkg/infra/tracing"
+	"github.com/grafana/grafana/pkg/models"
+	"github.com/grafana/grafana/pkg/plugins"
+	"github.com/grafana/grafana/pkg/services/featuremgmt"
+	"github.com/grafana/grafana/pkg/setting"
+	"github.com/stretchr/testify/require"
+)
+
+// scriptedPluginClient answers the requests with the scripted errors in order,
+// a nil error answers with an empty response for every query.
+type scriptedPluginClient struct {
+	plugins.Client
+
+	script []error
+	calls  int
+}
+
+func (c *scriptedPluginClient) QueryData(_ context.Context, req *backend.QueryDataRequest) (*backend.QueryDataResponse, error) {
+	err := c.script[c.calls]
+	c.calls++
+	if err != nil {
+		return nil, err
+	}
+	resp := backend.NewQueryDataResponse()
+	for _, q := range req.Queries {
+		resp.Responses[q.RefID] = backend.DataResponse{}
+	}
+	return resp, nil
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	setupBreaker := func(t *testing.T, script ...error) (*Service, *scriptedPluginClient, *time.Time) {
+		t.Helper()
+		tracer, err := tracing.InitializeTracerForTest()
+		require.NoError(t, err)
+
+		cfg := setting.NewCfg()
+		cfg.QueryMaxRetries = 0
+		cfg.QueryCircuitBreakerFailures = 2
+		cfg.QueryCircuitBreakerCooldown = time.Minute
+
+		client := &scriptedPluginClient{script: script}
+		s := ProvideService(cfg, nil, nil, nil, nil, client, nil, nil, nil, nil, tracer, featuremgmt.WithFeatures())
+
+		now := time.Date(2022, 4, 1, 12, 0, 0, 0, time.UTC)
+		s.breakers.now = func() time.Time { return now }
+		return s, client, &now
+	}
+
+	ds := &models.DataSource{OrgId: 1, Uid: "down"}
+	request := func() *backend.QueryDataRequest {
+		return &backend.QueryDataRequest{
+			Headers: map[string]string{},
+			Queries: []backend.DataQuery{{RefID: "A"}, {RefID: "B"}},
+		}
+	}
+
+	state := func(t *testing.T, s *Service) CircuitState {
+		t.Helper()
+		statuses := s.CircuitBreakerStatuses()
+		require.Len(t, statuses, 1)
+		return statuses[0].State
+	}
+
+	requireUnavailable := func(t *testing.T, resp *backend.QueryDataResponse, err error) {
+		t.Helper()
+		require.NoError(t, err)
+		for _, refID := range []string{"A", "B"} {
+			var unavailable *ErrDatasourceUnavailable
+			require.True(t, errors.As(resp.Responses[refID].Error, &unavailable))
+			require.Equal(t, "down", unavailable.DatasourceUID)
+		}
+	}
+
+	t.Run("it opens after consecutive failures and closes after a successful probe", func(t *testing.T) {
+		down := errors.New("connection refused")
+		s, client, now := setupBreaker(t, down, down, down, nil, nil)
+		ctx := context.Background()
+
+		_, err := s.queryData(ctx, ds, request())
+		require.True(t, errors.Is(err, down))
+		require.Equal(t, CircuitClosed, state(t, s))
+
+		_, err = s.queryData(ctx, ds, request())
+		require.True(t, errors.Is(err, down))
+		require.Equal(t, CircuitOpen, state(t, s))
+
+		// Open: queries fail fast without calling the plugin.
+		resp, err := s.queryData(ctx, ds, request())
+		requireUnavailable(t, resp, err)
+		require.Equal(t, 2, client.calls)
+		require.Equal(t, int64(60), s.CircuitBreakerStatuses()[0].RetryAfterSeconds)
+
+		// Half-open: the failed probe opens the circuit again.
+		*now = now.Add(time.Minute)
+		_, err = s.queryData(ctx, ds, request())
+		require.True(t, errors.Is(err, down))
+		require.Equal(t, 3, client.calls)
+		require.Equal(t, CircuitOpen, state(t, s))
+
+		resp, err = s.queryData(ctx, ds, request())
+		requireUnavailable(t, resp, err)
+		require.Equal(t, 3, client.calls)
+
+		// Half-open: the successful probe closes the circuit.
+		*now = now.Add(time.Minute)
+		resp, err = s.queryData(ctx, ds, request())
+		require.NoError(t, err)
+		require.NoError(t, resp.Responses["A"].Error)
+		require.Equal(t, CircuitClosed, state(t, s))
+		require.Equal(t, 0, s.CircuitBreakerStatuses()[0].ConsecutiveFailures)
+
+		_, err = s.queryData(ctx, ds, request())
+		require.NoError(t, err)
+		require.Equal(t, 5, client.calls)
+	})
+
+	t.Run("it lets a single probe through while half-open", func(t *testing.T) {
+		breakers := newCircuitBreakers(1, time.Minute)
+		now := time.Now()
+		breakers.now = func() time.Time { return now }
+
+		record, _, ok := breakers.allow(1, "down")
+		require.True(t, ok)
+		record(requestFailed)
+
+		now = now.Add(time.Minute)
+		probe, _, ok := breakers.allow(1, "down")
+		require.True(t, ok)
+		_, _, ok = breakers.allow(1, "down")
+		require.False(t, ok)
+
+		// A cancelled probe tells nothing about the data source, the next
+		// request probes again.
+		probe(requestCancelled)
+		probe, _, ok = breakers.allow(1, "down")
+		require.True(t, ok)
+		probe(requestSucceeded)
+		require.Equal(t, CircuitClosed, breakers.statuses()[0].State)
+	})
+
+	t.Run("it does not count failed queries of answered requests", func(t *testing.T) {
+		s, _, _ := setupBreaker(t)
+		s.pluginClient = &failingQueriesClient{}
+
+		for i := 0; i < 3; i++ {
+			resp, err := s.queryData(context.Background(), ds, request())
+			require.NoError(t, err)
+			require.Error(t, resp.Responses["A"].Error)
+		}
+		require.Equal(t, CircuitClosed, state(t, s))
+	})
+
+	t.Run("it is disabled without a failure threshold", func(t *testing.T) {
+		breakers := newCircuitBreakers(0, time.Minute)
+		for i := 0; i < 10; i++ {
+			record, _, ok := breakers.allow(1, "down")
+			require.True(t, ok)
+			record(requestFailed)
+		}
+		require.Empty(t, breakers.statuses())
+	})
+}
+
+type failingQueriesClient struct {
+	plugins.Client
+}
+
+func (c *failingQueriesClient) QueryData(_ context.Context, req *backend.QueryDataRequest) (*backend.QueryDataResponse, error) {
+	resp := backend.NewQueryDataResponse()
+	for _, q := range req.Queries {
+		resp.Responses[q.RefID] = backend.DataResponse{Error: errors.New("syntax error")}
+	}
+	return resp, nil
+}
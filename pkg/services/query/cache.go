@@ -0,0 +1,153 @@
+package query
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/grafana/grafana/pkg/models"
+	lru "github.com/hashicorp/golang-lru"
+)
+
+// QueryCache stores query responses by key. Implementations must be safe
+// for concurrent use.
+type QueryCache interface {
+	Get(key string) (*backend.QueryDataResponse, bool)
+	Set(key string, resp *backend.QueryDataResponse, ttl time.Duration)
+}
+
+type cacheEntry struct {
+	resp    *backend.QueryDataResponse
+	expires time.Time
+}
+
+// memoryQueryCache is an in-memory LRU QueryCache.
+type memoryQueryCache struct {
+	mu    sync.Mutex
+	cache *lru.Cache
+	now   func() time.Time
+}
+
+func newMemoryQueryCache(maxEntries int) (*memoryQueryCache, error) {
+	cache, err := lru.New(maxEntries)
+	if err != nil {
+		return nil, err
+	}
+	return &memoryQueryCache{cache: cache, now: time.Now}, nil
+}
+
+func (c *memoryQueryCache) Get(key string) (*backend.QueryDataResponse, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	v, ok := c.cache.Get(key)
+	if !ok {
+		return nil, false
+	}
+	entry := v.(cacheEntry)
+	if c.now().After(entry.expires) {
+		c.cache.Remove(key)
+		return nil, false
+	}
+	return entry.resp, true
+}
+
+func (c *memoryQueryCache) Set(key string, resp *backend.QueryDataResponse, ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.cache.Add(key, cacheEntry{resp: resp, expires: c.now().Add(ttl)})
+}
+
+var cachedNotice = data.Notice{
+	Severity: data.NoticeSeverityInfo,
+	Text:     "Served from cache",
+}
+
+// queryDataWithCache serves the request from the query cache when possible
+// and stores successful responses otherwise.
+func (s *Service) queryDataWithCache(ctx context.Context, user *models.SignedInUser, ds *models.DataSource, req *backend.QueryDataRequest) (*backend.QueryDataResponse, error) {
+	if s.cache == nil || (ds.JsonData != nil && ds.JsonData.Get("disableQueryCache").MustBool()) {
+		return s.queryData(ctx, ds, req)
+	}
+
+	key, err := s.cacheKey(user, ds, req)
+	if err != nil {
+		s.log.Warn("Failed to compute query cache key", "datasource", ds.Uid, "error", err)
+		return s.queryData(ctx, ds, req)
+	}
+
+	if cached, ok := s.cache.Get(key); ok {
+		queryCacheRequests.WithLabelValues("hit").Inc()
+		queryStatsFromContext(ctx).cached = true
+		resp := backend.NewQueryDataResponse()
+		for refID, dr := range cached.Responses {
+			resp.Responses[refID] = withNotice(dr, refID, cachedNotice)
+		}
+		return resp, nil
+	}
+	queryCacheRequests.WithLabelValues("miss").Inc()
+
+	resp, err := s.queryData(ctx, ds, req)
+	if err != nil || resp == nil {
+		return resp, err
+	}
+	for _, dr := range resp.Responses {
+		if dr.Error != nil {
+			return resp, nil
+		}
+	}
+	s.cache.Set(key, resp, s.cfg.QueryCacheTTL)
+	return resp, nil
+}
+
+// cacheKey identifies a request by data source, normalized query models and
+// time range rounded to the configured resolution. The user is part of the key
+// when the user's OAuth token or identity is forwarded to the data source.
+func (s *Service) cacheKey(user *models.SignedInUser, ds *models.DataSource, req *backend.QueryDataRequest) (string, error) {
+	resolution := s.cfg.QueryCacheTimeResolution
+
+	h := sha256.New()
+	fmt.Fprintf(h, "%d/%s", ds.OrgId, ds.Uid)
+	if user != nil && (s.oAuthTokenService.IsOAuthPassThruEnabled(ds) || s.forwardUserIdentity(ds)) {
+		fmt.Fprintf(h, "/user:%d", user.UserId)
+	}
+
+	// Plugin context attributes may change the responses, e.g. when they set
+	// a sampling level.
+	var attrHeaders []string
+	for k := range req.Headers {
+		if strings.HasPrefix(k, pluginContextAttrHeaderPrefix) {
+			attrHeaders = append(attrHeaders, k)
+		}
+	}
+	sort.Strings(attrHeaders)
+	for _, k := range attrHeaders {
+		fmt.Fprintf(h, "/%s:%s", k, req.Headers[k])
+	}
+
+	for _, q := range req.Queries {
+		var model interface{}
+		if err := json.Unmarshal(q.JSON, &model); err != nil {
+			return "", err
+		}
+		normalized, err := json.Marshal(model)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(h, "/%s/%d/%d/%s", q.RefID,
+			q.TimeRange.From.Truncate(resolution).Unix(),
+			q.TimeRange.To.Truncate(resolution).Unix(),
+			normalized)
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
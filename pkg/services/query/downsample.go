@@ -0,0 +1,264 @@
+package query
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+// DownsampleMethod is the algorithm selecting the points kept when
+// downsampling time series.
+type DownsampleMethod string
+
+const (
+	// DownsampleLTTB keeps the points preserving the visual shape of the
+	// series with the Largest-Triangle-Three-Buckets algorithm.
+	DownsampleLTTB DownsampleMethod = "lttb"
+	// DownsampleMinMax keeps the minimum and maximum points of buckets of
+	// consecutive points.
+	DownsampleMinMax DownsampleMethod = "minmax"
+)
+
+// DownsampleOptions are the options of the downsampling of the time series
+// returned by the data sources.
+type DownsampleOptions struct {
+	// MaxPoints is the maximum number of points per series, zero disables
+	// downsampling.
+	MaxPoints int
+	Method    DownsampleMethod
+}
+
+// NewDownsampleOptions validates the downsampling options of a request. The
+// method defaults to LTTB.
+func NewDownsampleOptions(maxPoints int, method string) (DownsampleOptions, error) {
+	opts := DownsampleOptions{MaxPoints: maxPoints, Method: DownsampleMethod(method)}
+	switch opts.Method {
+	case "":
+		opts.Method = DownsampleLTTB
+	case DownsampleLTTB, DownsampleMinMax:
+	default:
+		return DownsampleOptions{}, NewErrBadQuery(fmt.Sprintf("invalid downsample method %q, must be either lttb or minmax", method))
+	}
+	if maxPoints < 0 || (maxPoints > 0 && maxPoints < 3) {
+		return DownsampleOptions{}, NewErrBadQuery("maxSeriesPoints must be at least 3")
+	}
+	return opts, nil
+}
+
+type downsampleKey struct{}
+
+// WithDownsampling returns a copy of ctx whose time series responses are
+// downsampled with the given options.
+func WithDownsampling(ctx context.Context, opts DownsampleOptions) context.Context {
+	return context.WithValue(ctx, downsampleKey{}, opts)
+}
+
+func downsampleOptionsFromContext(ctx context.Context) DownsampleOptions {
+	opts, _ := ctx.Value(downsampleKey{}).(DownsampleOptions)
+	return opts
+}
+
+// downsampleResponse replaces the time series frames of the responses having
+// more points than requested with downsampled copies. Other frames are left
+// untouched.
+func downsampleResponse(resp *backend.QueryDataResponse, opts DownsampleOptions) {
+	if opts.MaxPoints <= 0 || resp == nil {
+		return
+	}
+
+	for refID, dr := range resp.Responses {
+		if dr.Error != nil {
+			continue
+		}
+		var frames data.Frames
+		for i, f := range dr.Frames {
+			downsampled, ok := downsampleFrame(f, opts)
+			if !ok {
+				continue
+			}
+			if frames == nil {
+				frames = append(data.Frames{}, dr.Frames...)
+			}
+			frames[i] = downsampled
+		}
+		if frames != nil {
+			dr.Frames = frames
+			resp.Responses[refID] = dr
+		}
+	}
+}
+
+// downsampleFrame returns a copy of the frame keeping at most the maximum
+// number of points. Only frames of a single numeric series over a time field
+// sorted in ascending order are downsampled, it returns false for other frames
+// and frames with fewer points.
+func downsampleFrame(f *data.Frame, opts DownsampleOptions) (*data.Frame, bool) {
+	length, err := f.RowLen()
+	if err != nil || length <= opts.MaxPoints {
+		return nil, false
+	}
+
+	schema := f.TimeSeriesSchema()
+	if schema.Type != data.TimeSeriesTypeWide || schema.TimeIsNullable || len(schema.ValueIndices) != 1 || len(schema.FactorIndices) != 0 {
+		return nil, false
+	}
+	timeField := f.Fields[schema.TimeIndex]
+	valueField := f.Fields[schema.ValueIndices[0]]
+	if !valueField.Type().Numeric() {
+		return nil, false
+	}
+
+	xs := make([]float64, length)
+	ys := make([]float64, length)
+	for i := 0; i < length; i++ {
+		xs[i] = float64(timeField.At(i).(time.Time).UnixNano())
+		if i > 0 && xs[i] < xs[i-1] {
+			return nil, false
+		}
+		v, err := valueField.NullableFloatAt(i)
+		if err != nil {
+			return nil, false
+		}
+		ys[i] = math.NaN()
+		if v != nil {
+			ys[i] = *v
+		}
+	}
+
+	var indices []int
+	if opts.Method == DownsampleMinMax {
+		indices = minMaxIndices(ys, opts.MaxPoints)
+	} else {
+		indices = lttbIndices(xs, ys, opts.MaxPoints)
+	}
+
+	downsampled := data.NewFrame(f.Name)
+	downsampled.RefID = f.RefID
+	for _, field := range f.Fields {
+		df := data.NewFieldFromFieldType(field.Type(), len(indices))
+		df.Name = field.Name
+		df.Labels = field.Labels
+		df.Config = field.Config
+		for i, idx := range indices {
+			df.Set(i, field.CopyAt(idx))
+		}
+		downsampled.Fields = append(downsampled.Fields, df)
+	}
+
+	meta := data.FrameMeta{}
+	if f.Meta != nil {
+		meta = *f.Meta
+	}
+	meta.Notices = append(append([]data.Notice{}, meta.Notices...), data.Notice{
+		Severity: data.NoticeSeverityInfo,
+		Text:     fmt.Sprintf("Series downsampled from %d to %d points with %s", length, len(indices), opts.Method),
+	})
+	downsampled.Meta = &meta
+
+	return downsampled, true
+}
+
+// lttbIndices returns the indices of the points kept by the
+// Largest-Triangle-Three-Buckets algorithm: the first and last points, and in
+// each bucket of the points in between the point forming the largest triangle
+// with the point kept in the previous bucket and the average of the next one.
+func lttbIndices(xs, ys []float64, threshold int) []int {
+	n := len(xs)
+	indices := make([]int, 0, threshold)
+	indices = append(indices, 0)
+
+	bucketSize := float64(n-2) / float64(threshold-2)
+	a := 0
+	for i := 0; i < threshold-2; i++ {
+		start := int(float64(i)*bucketSize) + 1
+		end := int(float64(i+1)*bucketSize) + 1
+
+		// The average point of the next bucket, the last point for the
+		// last bucket.
+		nextStart, nextEnd := end, int(float64(i+2)*bucketSize)+1
+		if nextEnd > n-1 {
+			nextEnd = n - 1
+		}
+		if nextStart >= nextEnd {
+			nextStart, nextEnd = n-1, n
+		}
+		var avgX, avgY float64
+		count := 0
+		for j := nextStart; j < nextEnd; j++ {
+			if math.IsNaN(ys[j]) {
+				continue
+			}
+			avgX += xs[j]
+			avgY += ys[j]
+			count++
+		}
+		if count > 0 {
+			avgX /= float64(count)
+			avgY /= float64(count)
+		} else {
+			avgX, avgY = xs[nextEnd-1], ys[nextEnd-1]
+		}
+
+		maxArea := -1.0
+		selected := start
+		for j := start; j < end; j++ {
+			area := math.Abs((xs[a]-avgX)*(ys[j]-ys[a])-(xs[a]-xs[j])*(avgY-ys[a])) / 2
+			if area > maxArea {
+				maxArea = area
+				selected = j
+			}
+		}
+		indices = append(indices, selected)
+		a = selected
+	}
+
+	return append(indices, n-1)
+}
+
+// minMaxIndices returns the indices of the minimum and maximum points of
+// buckets of consecutive points, in the order of the points. Null points are
+// only kept for buckets without other points.
+func minMaxIndices(ys []float64, maxPoints int) []int {
+	n := len(ys)
+	buckets := maxPoints / 2
+	indices := make([]int, 0, buckets*2)
+
+	bucketSize := float64(n) / float64(buckets)
+	for i := 0; i < buckets; i++ {
+		start := int(float64(i) * bucketSize)
+		end := int(float64(i+1) * bucketSize)
+		if i == buckets-1 {
+			end = n
+		}
+
+		minIdx, maxIdx := -1, -1
+		for j := start; j < end; j++ {
+			if math.IsNaN(ys[j]) {
+				continue
+			}
+			if minIdx < 0 || ys[j] < ys[minIdx] {
+				minIdx = j
+			}
+			if maxIdx < 0 || ys[j] > ys[maxIdx] {
+				maxIdx = j
+			}
+		}
+
+		switch {
+		case minIdx < 0:
+			indices = append(indices, start)
+		case minIdx == maxIdx:
+			indices = append(indices, minIdx)
+		case minIdx < maxIdx:
+			indices = append(indices, minIdx, maxIdx)
+		default:
+			indices = append(indices, maxIdx, minIdx)
+		}
+	}
+
+	return indices
+}
@@ -0,0 +1,167 @@
+package query
+
+import (
+	"errors"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/stretchr/testify/require"
+)
+
+// syntheticSeries returns a frame of a sine wave of n points at one second
+// steps, with a spike of 1000 at spikeAt and a dip of -1000 at dipAt.
+func syntheticSeries(n, spikeAt, dipAt int) *data.Frame {
+	start := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	times := make([]time.Time, n)
+	values := make([]float64, n)
+	for i := 0; i < n; i++ {
+		times[i] = start.Add(time.Duration(i) * time.Second)
+		values[i] = math.Sin(float64(i) / 50)
+	}
+	values[spikeAt] = 1000
+	values[dipAt] = -1000
+	return data.NewFrame("series",
+		data.NewField("time", nil, times),
+		data.NewField("value", data.Labels{"job": "test"}, values),
+	)
+}
+
+func frameValues(t *testing.T, f *data.Frame) []float64 {
+	t.Helper()
+	values := make([]float64, f.Fields[1].Len())
+	for i := range values {
+		v, err := f.Fields[1].FloatAt(i)
+		require.NoError(t, err)
+		values[i] = v
+	}
+	return values
+}
+
+func TestDownsampleResponse(t *testing.T) {
+	for _, method := range []DownsampleMethod{DownsampleLTTB, DownsampleMinMax} {
+		t.Run(string(method), func(t *testing.T) {
+			for _, tc := range []struct {
+				points, maxPoints int
+			}{
+				{points: 10000, maxPoints: 100},
+				{points: 1001, maxPoints: 500},
+				{points: 50, maxPoints: 49},
+			} {
+				original := syntheticSeries(tc.points, tc.points/3, tc.points*2/3)
+				resp := &backend.QueryDataResponse{Responses: backend.Responses{
+					"A": {Frames: data.Frames{original}},
+				}}
+
+				downsampleResponse(resp, DownsampleOptions{MaxPoints: tc.maxPoints, Method: method})
+
+				f := resp.Responses["A"].Frames[0]
+				require.NotSame(t, original, f)
+				require.LessOrEqual(t, f.Fields[0].Len(), tc.maxPoints)
+				require.Greater(t, f.Fields[0].Len(), tc.maxPoints/2)
+				require.Equal(t, "value", f.Fields[1].Name)
+				require.Equal(t, data.Labels{"job": "test"}, f.Fields[1].Labels)
+
+				// The extremes are kept.
+				values := frameValues(t, f)
+				require.Contains(t, values, 1000.0)
+				require.Contains(t, values, -1000.0)
+
+				// The time is still sorted.
+				for i := 1; i < f.Fields[0].Len(); i++ {
+					require.True(t, f.Fields[0].At(i).(time.Time).After(f.Fields[0].At(i-1).(time.Time)))
+				}
+
+				require.NotNil(t, f.Meta)
+				require.Len(t, f.Meta.Notices, 1)
+				require.Equal(t, data.NoticeSeverityInfo, f.Meta.Notices[0].Severity)
+
+				// The original frame is left untouched.
+				require.Equal(t, tc.points, original.Fields[0].Len())
+				require.Nil(t, original.Meta)
+			}
+		})
+	}
+
+	t.Run("LTTB keeps the first and last points", func(t *testing.T) {
+		original := syntheticSeries(1000, 10, 20)
+		xs := make([]float64, 1000)
+		for i := range xs {
+			xs[i] = float64(i)
+		}
+		indices := lttbIndices(xs, frameValues(t, original), 10)
+		require.Len(t, indices, 10)
+		require.Equal(t, 0, indices[0])
+		require.Equal(t, 999, indices[9])
+	})
+
+	t.Run("null values are ignored when selecting points", func(t *testing.T) {
+		n := 1000
+		times := make([]time.Time, n)
+		values := make([]*float64, n)
+		for i := 0; i < n; i++ {
+			times[i] = time.Unix(int64(i), 0)
+			if i%2 == 0 {
+				v := float64(i % 7)
+				values[i] = &v
+			}
+		}
+		peak := 500.0
+		values[501] = &peak
+		resp := &backend.QueryDataResponse{Responses: backend.Responses{
+			"A": {Frames: data.Frames{data.NewFrame("", data.NewField("time", nil, times), data.NewField("value", nil, values))}},
+		}}
+
+		downsampleResponse(resp, DownsampleOptions{MaxPoints: 20, Method: DownsampleMinMax})
+
+		f := resp.Responses["A"].Frames[0]
+		require.LessOrEqual(t, f.Fields[1].Len(), 20)
+		found := false
+		for i := 0; i < f.Fields[1].Len(); i++ {
+			v := f.Fields[1].At(i).(*float64)
+			require.NotNil(t, v)
+			found = found || *v == peak
+		}
+		require.True(t, found)
+	})
+
+	t.Run("frames that aren't a time series pass through", func(t *testing.T) {
+		table := data.NewFrame("table",
+			data.NewField("name", nil, make([]string, 100)),
+			data.NewField("value", nil, make([]float64, 100)),
+		)
+		multi := data.NewFrame("multi",
+			data.NewField("time", nil, make([]time.Time, 100)),
+			data.NewField("a", nil, make([]float64, 100)),
+			data.NewField("b", nil, make([]float64, 100)),
+		)
+		unsorted := syntheticSeries(100, 1, 2)
+		unsorted.Fields[0].Set(50, time.Time{})
+		small := syntheticSeries(10, 1, 2)
+		resp := &backend.QueryDataResponse{Responses: backend.Responses{
+			"A": {Frames: data.Frames{table, multi, unsorted, small}},
+		}}
+
+		downsampleResponse(resp, DownsampleOptions{MaxPoints: 10, Method: DownsampleLTTB})
+
+		require.Equal(t, data.Frames{table, multi, unsorted, small}, resp.Responses["A"].Frames)
+	})
+}
+
+func TestNewDownsampleOptions(t *testing.T) {
+	opts, err := NewDownsampleOptions(100, "")
+	require.NoError(t, err)
+	require.Equal(t, DownsampleOptions{MaxPoints: 100, Method: DownsampleLTTB}, opts)
+
+	opts, err = NewDownsampleOptions(100, "minmax")
+	require.NoError(t, err)
+	require.Equal(t, DownsampleMinMax, opts.Method)
+
+	var badQuery *ErrBadQuery
+	_, err = NewDownsampleOptions(100, "average")
+	require.True(t, errors.As(err, &badQuery))
+	_, err = NewDownsampleOptions(2, "lttb")
+	require.True(t, errors.As(err, &badQuery))
+}
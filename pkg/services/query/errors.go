@@ -1,6 +1,10 @@
 package query
 
-import "fmt"
+import (
+	"fmt"
+	"strings"
+	"time"
+)
 
 // ErrBadQuery returned whenever request is malformed and must contain a message
 // suitable to return in API response.
@@ -15,3 +19,154 @@ func NewErrBadQuery(msg string) *ErrBadQuery {
 func (e ErrBadQuery) Error() string {
 	return fmt.Sprintf("bad query: %s", e.Message)
 }
+
+// ErrQuotaExceeded is returned when a data source has reached its configured
+// query quota. RetryAfter is a hint of when a new query may be accepted.
+type ErrQuotaExceeded struct {
+	DatasourceUID string
+	RetryAfter    time.Duration
+}
+
+func (e ErrQuotaExceeded) Error() string {
+	return fmt.Sprintf("query quota exceeded for data source %s", e.DatasourceUID)
+}
+
+// ErrQueryQueueFull is returned when the maximum number of data source
+// requests are in flight and the request could not be queued, or waited in the
+// queue for longer than the maximum queue time.
+type ErrQueryQueueFull struct {
+	// Waited is how long the request waited in the queue, zero when the queue
+	// was full.
+	Waited     time.Duration
+	RetryAfter time.Duration
+}
+
+func (e ErrQueryQueueFull) Error() string {
+	if e.Waited <= 0 {
+		return "too many queries in flight and the query queue is full"
+	}
+	return fmt.Sprintf("too many queries in flight, the query was not sent after waiting %s", e.Waited)
+}
+
+// ErrQueryTimeout is set as the error of a query that did not complete within
+// the data source query timeout.
+type ErrQueryTimeout struct {
+	RefID   string
+	Timeout time.Duration
+}
+
+func (e ErrQueryTimeout) Error() string {
+	return fmt.Sprintf("query %s timed out after %s", e.RefID, e.Timeout)
+}
+
+// ErrOAuthTokenRefresh is reported for every query of a data source with OAuth
+// pass-thru enabled when the token of the user has expired and could not be
+// refreshed.
+type ErrOAuthTokenRefresh struct {
+	Err error
+}
+
+func (e ErrOAuthTokenRefresh) Error() string {
+	return "OAuth token could not be refreshed, please sign out and sign in again"
+}
+
+func (e ErrOAuthTokenRefresh) Unwrap() error {
+	return e.Err
+}
+
+// ErrOAuthScopesMissing is reported for every query of a data source with
+// OAuth pass-thru enabled when the token of the user lacks some of the scopes
+// required by the data source.
+type ErrOAuthScopesMissing struct {
+	DatasourceName string
+	MissingScopes  []string
+}
+
+func (e ErrOAuthScopesMissing) Error() string {
+	return fmt.Sprintf("data source %s requires the OAuth scopes %s which were not granted, please sign out and sign in again to grant them", e.DatasourceName, strings.Join(e.MissingScopes, " "))
+}
+
+// ErrOAuthIdentityRequired is reported for every query of a data source with
+// OAuth pass-thru enabled when the request is authenticated with an API key,
+// a service account or anonymously, which have no OAuth identity to forward.
+type ErrOAuthIdentityRequired struct {
+	DatasourceName string
+	// Principal describes how the request is authenticated, e.g. "an API key".
+	Principal string
+}
+
+func (e ErrOAuthIdentityRequired) Error() string {
+	return fmt.Sprintf("data source %s forwards the OAuth identity of the user and requires a user session, it can't be queried with %s", e.DatasourceName, e.Principal)
+}
+
+// ErrRateLimited is reported for a query that was not sent because its data
+// source reached the rate limits configured in its json data.
+type ErrRateLimited struct {
+	RefID         string
+	DatasourceUID string
+	RetryAfter    time.Duration
+}
+
+func (e ErrRateLimited) Error() string {
+	return fmt.Sprintf("query %s was rate limited by data source %s, retry after %s", e.RefID, e.DatasourceUID, e.RetryAfter)
+}
+
+// ErrDatasourceUnavailable is reported for a query that was not sent because
+// the circuit breaker of its data source is open after consecutive failures.
+type ErrDatasourceUnavailable struct {
+	RefID         string
+	DatasourceUID string
+	RetryAfter    time.Duration
+}
+
+func (e ErrDatasourceUnavailable) Error() string {
+	if e.RetryAfter <= 0 {
+		return fmt.Sprintf("query %s was not sent, data source %s is temporarily unavailable", e.RefID, e.DatasourceUID)
+	}
+	return fmt.Sprintf("query %s was not sent, data source %s is temporarily unavailable, retry after %s", e.RefID, e.DatasourceUID, e.RetryAfter.Round(time.Second))
+}
+
+// ErrDatasourceUnhealthy is reported for a query that was not sent because the
+// last health check of its data source failed.
+type ErrDatasourceUnhealthy struct {
+	RefID         string
+	DatasourceUID string
+	// Message is the message of the failed health check.
+	Message string
+}
+
+func (e ErrDatasourceUnhealthy) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("query %s was not sent, the health check of data source %s failed", e.RefID, e.DatasourceUID)
+	}
+	return fmt.Sprintf("query %s was not sent, the health check of data source %s failed: %s", e.RefID, e.DatasourceUID, e.Message)
+}
+
+// ErrResponseTooLarge replaces the data of a query whose response exceeded the
+// data source response size limit.
+type ErrResponseTooLarge struct {
+	RefID string
+	Size  int64
+	Limit int64
+}
+
+func (e ErrResponseTooLarge) Error() string {
+	return fmt.Sprintf("response of query %s is too large (%d bytes, limit is %d bytes), narrow the query by reducing the time range or adding filters", e.RefID, e.Size, e.Limit)
+}
+
+// ErrDatasourceSecretsDecryption is returned when the secure json data of a
+// data source cannot be decrypted, typically because the secret key changed
+// since the secrets were encrypted.
+type ErrDatasourceSecretsDecryption struct {
+	DatasourceUID  string
+	DatasourceName string
+	Err            error
+}
+
+func (e ErrDatasourceSecretsDecryption) Error() string {
+	return fmt.Sprintf("failed to decrypt the secrets of data source %s (%s): %s", e.DatasourceName, e.DatasourceUID, e.Err)
+}
+
+func (e ErrDatasourceSecretsDecryption) Unwrap() error {
+	return e.Err
+}
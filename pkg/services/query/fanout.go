@@ -0,0 +1,129 @@
+package query
+
+import (
+	"context"
+	"sync"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana/pkg/expr"
+	"github.com/grafana/grafana/pkg/models"
+)
+
+// groupByDataSource splits the data source queries of the request per data
+// source, in order of first appearance. Expression queries are left out.
+func groupByDataSource(parsedReq *parsedRequest) []*parsedRequest {
+	var groups []*parsedRequest
+	byUID := map[string]*parsedRequest{}
+	for _, pq := range parsedReq.parsedQueries {
+		if expr.IsDataSource(pq.datasource.Uid) {
+			continue
+		}
+		group, ok := byUID[pq.datasource.Uid]
+		if !ok {
+			group = &parsedRequest{pluginContextAttrs: parsedReq.pluginContextAttrs}
+			byUID[pq.datasource.Uid] = group
+			groups = append(groups, group)
+		}
+		group.parsedQueries = append(group.parsedQueries, pq)
+	}
+	return groups
+}
+
+// queryDataSources queries every data source of the request and merges the
+// responses by refId. Requests for several data sources are sent concurrently;
+// a failing data source does not cancel the others, its error is reported for
+// each of its queries instead.
+func (s *Service) queryDataSources(ctx context.Context, user *models.SignedInUser, parsedReq *parsedRequest) (*backend.QueryDataResponse, error) {
+	groups := groupByDataSource(parsedReq)
+	if len(groups) == 0 {
+		return backend.NewQueryDataResponse(), nil
+	}
+	if len(groups) == 1 {
+		return s.handleQueryData(ctx, user, groups[0])
+	}
+
+	resp := backend.NewQueryDataResponse()
+	err := s.fanOut(ctx, user, groups, func(responses backend.Responses) error {
+		for refID, res := range responses {
+			resp.Responses[refID] = res
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// fanOut queries the data source groups concurrently and passes the responses
+// of each group to send as soon as the group finished. send is never called
+// concurrently. When send fails the remaining queries are cancelled and its
+// error is returned.
+func (s *Service) fanOut(ctx context.Context, user *models.SignedInUser, groups []*parsedRequest, send func(backend.Responses) error) error {
+	groupCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var sem chan struct{}
+	if s.cfg != nil && s.cfg.QueryMaxConcurrentDataSources > 0 {
+		sem = make(chan struct{}, s.cfg.QueryMaxConcurrentDataSources)
+	}
+
+	var (
+		wg      sync.WaitGroup
+		mu      sync.Mutex
+		sendErr error
+	)
+
+	sendLocked := func(responses backend.Responses) {
+		mu.Lock()
+		defer mu.Unlock()
+		if sendErr != nil {
+			return
+		}
+		if err := send(responses); err != nil {
+			sendErr = err
+			cancel()
+		}
+	}
+
+	errorResponses := func(group *parsedRequest, err error) backend.Responses {
+		responses := backend.Responses{}
+		for _, pq := range group.parsedQueries {
+			responses[pq.query.RefID] = backend.DataResponse{Error: err}
+		}
+		return responses
+	}
+
+	for _, group := range groups {
+		wg.Add(1)
+		go func(group *parsedRequest) {
+			defer wg.Done()
+
+			if sem != nil {
+				select {
+				case sem <- struct{}{}:
+					defer func() { <-sem }()
+				case <-groupCtx.Done():
+					sendLocked(errorResponses(group, groupCtx.Err()))
+					return
+				}
+			}
+
+			groupResp, err := s.handleQueryData(groupCtx, user, group)
+			if err != nil {
+				s.log.Warn("Data source query failed", "datasource", group.parsedQueries[0].datasource.Uid, "error", err)
+				sendLocked(errorResponses(group, err))
+				return
+			}
+			if groupResp != nil {
+				sendLocked(groupResp.Responses)
+			}
+		}(group)
+	}
+	wg.Wait()
+
+	if sendErr != nil {
+		return sendErr
+	}
+	return ctx.Err()
+}
@@ -0,0 +1,74 @@
+package query
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/grafana/grafana/pkg/components/simplejson"
+	"github.com/grafana/grafana/pkg/infra/log"
+	"github.com/grafana/grafana/pkg/models"
+	"github.com/stretchr/testify/require"
+)
+
+// recordingLogger records the messages and context of every log line.
+type recordingLogger struct {
+	log.Logger
+
+	mu    sync.Mutex
+	lines []string
+}
+
+func (l *recordingLogger) record(msg string, ctx ...interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.lines = append(l.lines, fmt.Sprint(append([]interface{}{msg}, ctx...)...))
+}
+
+func (l *recordingLogger) Debug(msg string, ctx ...interface{}) { l.record(msg, ctx...) }
+func (l *recordingLogger) Info(msg string, ctx ...interface{})  { l.record(msg, ctx...) }
+func (l *recordingLogger) Warn(msg string, ctx ...interface{})  { l.record(msg, ctx...) }
+func (l *recordingLogger) Error(msg string, ctx ...interface{}) { l.record(msg, ctx...) }
+
+func (l *recordingLogger) output() string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return strings.Join(l.lines, "\n")
+}
+
+func TestCustomHeaders(t *testing.T) {
+	logger := &recordingLogger{}
+	s := &Service{log: logger}
+	ds := &models.DataSource{
+		Uid: "loki",
+		JsonData: simplejson.NewFromAny(map[string]interface{}{
+			"httpHeaderName1": "X-Scope-OrgID",
+			"httpHeaderName2": " Authorization ",
+			"httpHeaderName3": "X-Missing",
+			"httpHeaderName4": "",
+			"httpHeaderName6": "X-After-Gap",
+		}),
+	}
+	decrypted := map[string]string{
+		"httpHeaderValue1": "tenant-secret",
+		"httpHeaderValue2": "Bearer token-secret",
+		"httpHeaderValue4": "nameless-secret",
+		"httpHeaderValue6": "gap-secret",
+	}
+
+	headers := s.customHeaders(ds, decrypted)
+
+	require.Equal(t, map[string]string{
+		"X-Scope-OrgID": "tenant-secret",
+		"Authorization": "Bearer token-secret",
+		"X-After-Gap":   "gap-secret",
+	}, headers)
+
+	output := logger.output()
+	require.Contains(t, output, "X-Scope-OrgID")
+	require.Contains(t, output, "X-Missing")
+	for _, value := range decrypted {
+		require.NotContains(t, output, value)
+	}
+}
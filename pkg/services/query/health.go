@@ -0,0 +1,201 @@
+package query
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana/pkg/models"
+	"github.com/grafana/grafana/pkg/plugins/backendplugin"
+)
+
+// HealthState is the last known health of a data source.
+type HealthState int
+
+const (
+	// HealthUnknown data sources are queried, either because they were not
+	// checked yet or because their plugin does not implement health checks.
+	HealthUnknown HealthState = iota
+	HealthOK
+	// HealthError data sources fail queries fast until a following health
+	// check succeeds.
+	HealthError
+)
+
+func (s HealthState) String() string {
+	switch s {
+	case HealthOK:
+		return "ok"
+	case HealthError:
+		return "error"
+	default:
+		return "unknown"
+	}
+}
+
+func (s HealthState) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// DatasourceHealthStatus describes the result of the last health check of a
+// data source.
+type DatasourceHealthStatus struct {
+	OrgID         int64       `json:"orgId"`
+	DatasourceUID string      `json:"datasourceUid"`
+	State         HealthState `json:"state"`
+	Message       string      `json:"message,omitempty"`
+	CheckedAt     time.Time   `json:"checkedAt"`
+}
+
+type ignoreHealthKey struct{}
+
+// WithIgnoreHealth returns a copy of ctx whose queries are sent to the data
+// sources even when their last health check failed.
+func WithIgnoreHealth(ctx context.Context) context.Context {
+	return context.WithValue(ctx, ignoreHealthKey{}, true)
+}
+
+func ignoreHealthFromContext(ctx context.Context) bool {
+	ignore, _ := ctx.Value(ignoreHealthKey{}).(bool)
+	return ignore
+}
+
+type healthEntry struct {
+	state     HealthState
+	message   string
+	checkedAt time.Time
+	checking  bool
+}
+
+// healthCheckers cache the result of the plugin health checks of every data
+// source, to fail the queries of data sources known to be unhealthy fast.
+type healthCheckers struct {
+	mu      sync.Mutex
+	entries map[breakerKey]*healthEntry
+	// ttl is how long the result of a health check is used, zero disables the
+	// health checks.
+	ttl time.Duration
+	now func() time.Time
+}
+
+func newHealthCheckers(ttl time.Duration) *healthCheckers {
+	return &healthCheckers{
+		entries: map[breakerKey]*healthEntry{},
+		ttl:     ttl,
+		now:     time.Now,
+	}
+}
+
+// state returns the health of the data source of the request, checking it
+// with the plugin when it was never checked or the last result expired.
+// Concurrent requests use the last known result while a check is running.
+func (h *healthCheckers) state(ctx context.Context, client backend.CheckHealthHandler, ds *models.DataSource, req *backend.QueryDataRequest) (HealthState, string) {
+	key := breakerKey{orgID: ds.OrgId, datasourceUID: ds.Uid}
+
+	h.mu.Lock()
+	e, ok := h.entries[key]
+	if !ok {
+		e = &healthEntry{}
+		h.entries[key] = e
+	}
+	if e.checking || (!e.checkedAt.IsZero() && h.now().Sub(e.checkedAt) < h.ttl) {
+		state, message := e.state, e.message
+		h.mu.Unlock()
+		return state, message
+	}
+	e.checking = true
+	h.mu.Unlock()
+
+	state, message := checkHealth(ctx, client, req.PluginContext)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	e.checking = false
+	// A cancelled check tells nothing about the data source, the next request
+	// checks again.
+	if ctx.Err() == nil {
+		e.state, e.message, e.checkedAt = state, message, h.now()
+	}
+	return e.state, e.message
+}
+
+func checkHealth(ctx context.Context, client backend.CheckHealthHandler, pluginCtx backend.PluginContext) (HealthState, string) {
+	res, err := client.CheckHealth(ctx, &backend.CheckHealthRequest{PluginContext: pluginCtx})
+	if errors.Is(err, backendplugin.ErrMethodNotImplemented) {
+		return HealthUnknown, ""
+	}
+	if err != nil {
+		// The plugin itself could not be reached, the circuit breaker and
+		// retries handle unavailable plugins.
+		return HealthUnknown, err.Error()
+	}
+	switch res.Status {
+	case backend.HealthStatusOk:
+		return HealthOK, res.Message
+	case backend.HealthStatusError:
+		return HealthError, res.Message
+	default:
+		return HealthUnknown, res.Message
+	}
+}
+
+// statuses returns the result of the last health check of every data source
+// queried since startup.
+func (h *healthCheckers) statuses() []DatasourceHealthStatus {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	statuses := make([]DatasourceHealthStatus, 0, len(h.entries))
+	for key, e := range h.entries {
+		if e.checkedAt.IsZero() {
+			continue
+		}
+		statuses = append(statuses, DatasourceHealthStatus{
+			OrgID:         key.orgID,
+			DatasourceUID: key.datasourceUID,
+			State:         e.state,
+			Message:       e.message,
+			CheckedAt:     e.checkedAt,
+		})
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		if statuses[i].OrgID != statuses[j].OrgID {
+			return statuses[i].OrgID < statuses[j].OrgID
+		}
+		return statuses[i].DatasourceUID < statuses[j].DatasourceUID
+	})
+	return statuses
+}
+
+// HealthStatuses returns the result of the last health check of every data
+// source queried since startup.
+func (s *Service) HealthStatuses() []DatasourceHealthStatus {
+	return s.health.statuses()
+}
+
+// checkDatasourceHealth returns the response failing every query of the
+// request when the data source is known to be unhealthy, or nil when the
+// request may be sent.
+func (s *Service) checkDatasourceHealth(ctx context.Context, ds *models.DataSource, req *backend.QueryDataRequest) *backend.QueryDataResponse {
+	if s.health.ttl <= 0 || ignoreHealthFromContext(ctx) {
+		return nil
+	}
+
+	state, message := s.health.state(ctx, s.pluginClient, ds, req)
+	if state != HealthError {
+		return nil
+	}
+
+	queryUnhealthyRejected.WithLabelValues(ds.Uid).Add(float64(len(req.Queries)))
+
+	resp := backend.NewQueryDataResponse()
+	for _, q := range req.Queries {
+		resp.Responses[q.RefID] = backend.DataResponse{
+			Error: &ErrDatasourceUnhealthy{RefID: q.RefID, DatasourceUID: ds.Uid, Message: message},
+		}
+	}
+	return resp
+}
@@ -0,0 +1,156 @@
+package query
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana/pkg/infra/tracing"
+	"github.com/grafana/grafana/pkg/models"
+	"github.com/grafana/grafana/pkg/plugins"
+	"github.com/grafana/grafana/pkg/plugins/backendplugin"
+	"github.com/grafana/grafana/pkg/services/featuremgmt"
+	"github.com/grafana/grafana/pkg/setting"
+	"github.com/stretchr/testify/require"
+)
+
+// flippingHealthClient answers the health checks with the scripted statuses
+// in order, and every query with an empty response.
+type flippingHealthClient struct {
+	plugins.Client
+
+	health       []backend.HealthStatus
+	healthChecks int
+	queries      int
+}
+
+func (c *flippingHealthClient) CheckHealth(_ context.Context, _ *backend.CheckHealthRequest) (*backend.CheckHealthResult, error) {
+	status := c.health[c.healthChecks]
+	c.healthChecks++
+	return &backend.CheckHealthResult{Status: status, Message: "health " + status.String()}, nil
+}
+
+func (c *flippingHealthClient) QueryData(_ context.Context, req *backend.QueryDataRequest) (*backend.QueryDataResponse, error) {
+	c.queries++
+	resp := backend.NewQueryDataResponse()
+	for _, q := range req.Queries {
+		resp.Responses[q.RefID] = backend.DataResponse{}
+	}
+	return resp, nil
+}
+
+type unimplementedHealthClient struct {
+	flippingHealthClient
+}
+
+func (c *unimplementedHealthClient) CheckHealth(_ context.Context, _ *backend.CheckHealthRequest) (*backend.CheckHealthResult, error) {
+	c.healthChecks++
+	return nil, backendplugin.ErrMethodNotImplemented
+}
+
+func TestHealthCheck(t *testing.T) {
+	setupHealth := func(t *testing.T, client plugins.Client) (*Service, *time.Time) {
+		t.Helper()
+		tracer, err := tracing.InitializeTracerForTest()
+		require.NoError(t, err)
+
+		cfg := setting.NewCfg()
+		cfg.QueryMaxRetries = 0
+		cfg.QueryHealthCheckTTL = time.Minute
+
+		s := ProvideService(cfg, nil, nil, nil, nil, client, nil, nil, nil, nil, tracer, featuremgmt.WithFeatures())
+
+		now := time.Date(2022, 4, 1, 12, 0, 0, 0, time.UTC)
+		s.health.now = func() time.Time { return now }
+		return s, &now
+	}
+
+	ds := &models.DataSource{OrgId: 1, Uid: "flaky"}
+	request := func() *backend.QueryDataRequest {
+		return &backend.QueryDataRequest{
+			Headers: map[string]string{},
+			Queries: []backend.DataQuery{{RefID: "A"}, {RefID: "B"}},
+		}
+	}
+
+	requireUnhealthy := func(t *testing.T, resp *backend.QueryDataResponse, err error) {
+		t.Helper()
+		require.NoError(t, err)
+		for _, refID := range []string{"A", "B"} {
+			var unhealthy *ErrDatasourceUnhealthy
+			require.True(t, errors.As(resp.Responses[refID].Error, &unhealthy))
+			require.Equal(t, "flaky", unhealthy.DatasourceUID)
+			require.Equal(t, "health ERROR", unhealthy.Message)
+		}
+	}
+
+	t.Run("it fails queries fast while the cached health is error", func(t *testing.T) {
+		client := &flippingHealthClient{health: []backend.HealthStatus{backend.HealthStatusOk, backend.HealthStatusError, backend.HealthStatusOk}}
+		s, now := setupHealth(t, client)
+		ctx := context.Background()
+
+		// The health is checked on first use and cached for the TTL.
+		resp, err := s.queryData(ctx, ds, request())
+		require.NoError(t, err)
+		require.NoError(t, resp.Responses["A"].Error)
+		_, err = s.queryData(ctx, ds, request())
+		require.NoError(t, err)
+		require.Equal(t, 1, client.healthChecks)
+		require.Equal(t, 2, client.queries)
+
+		// The health flips to error once the TTL expired.
+		*now = now.Add(time.Minute)
+		resp, err = s.queryData(ctx, ds, request())
+		requireUnhealthy(t, resp, err)
+		resp, err = s.queryData(ctx, ds, request())
+		requireUnhealthy(t, resp, err)
+		require.Equal(t, 2, client.healthChecks)
+		require.Equal(t, 2, client.queries)
+
+		statuses := s.HealthStatuses()
+		require.Len(t, statuses, 1)
+		require.Equal(t, HealthError, statuses[0].State)
+		require.Equal(t, "health ERROR", statuses[0].Message)
+		require.Equal(t, *now, statuses[0].CheckedAt)
+
+		// Requests ignoring the health are sent anyway.
+		resp, err = s.queryData(WithIgnoreHealth(ctx), ds, request())
+		require.NoError(t, err)
+		require.NoError(t, resp.Responses["A"].Error)
+		require.Equal(t, 3, client.queries)
+
+		// The health flips back to ok once the TTL expired again.
+		*now = now.Add(time.Minute)
+		resp, err = s.queryData(ctx, ds, request())
+		require.NoError(t, err)
+		require.NoError(t, resp.Responses["A"].Error)
+		require.Equal(t, 3, client.healthChecks)
+		require.Equal(t, HealthOK, s.HealthStatuses()[0].State)
+	})
+
+	t.Run("it queries data sources without health checks", func(t *testing.T) {
+		client := &unimplementedHealthClient{}
+		s, _ := setupHealth(t, client)
+
+		for i := 0; i < 2; i++ {
+			resp, err := s.queryData(context.Background(), ds, request())
+			require.NoError(t, err)
+			require.NoError(t, resp.Responses["A"].Error)
+		}
+		require.Equal(t, 1, client.healthChecks)
+		require.Equal(t, HealthUnknown, s.HealthStatuses()[0].State)
+	})
+
+	t.Run("it is disabled without a TTL", func(t *testing.T) {
+		client := &flippingHealthClient{}
+		s, _ := setupHealth(t, client)
+		s.health = newHealthCheckers(0)
+
+		_, err := s.queryData(context.Background(), ds, request())
+		require.NoError(t, err)
+		require.Equal(t, 0, client.healthChecks)
+		require.Empty(t, s.HealthStatuses())
+	})
+}
@@ -0,0 +1,72 @@
+package query
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+type includeHiddenKey struct{}
+
+// WithIncludeHidden returns a copy of ctx whose queries are executed even when
+// hidden with "hide": true.
+func WithIncludeHidden(ctx context.Context) context.Context {
+	return context.WithValue(ctx, includeHiddenKey{}, true)
+}
+
+func includeHiddenFromContext(ctx context.Context) bool {
+	include, _ := ctx.Value(includeHiddenKey{}).(bool)
+	return include
+}
+
+// isHidden tells whether the query was hidden with "hide": true.
+func isHidden(q backend.DataQuery) bool {
+	model := struct {
+		Hide bool `json:"hide"`
+	}{}
+	if err := json.Unmarshal(q.JSON, &model); err != nil {
+		return false
+	}
+	return model.Hide
+}
+
+// skipHiddenQueries removes the hidden queries from the request, recording
+// their refIds. Requests with expressions are left untouched, as expressions
+// may use hidden queries and drop their results themselves.
+func skipHiddenQueries(req *parsedRequest) {
+	if req.hasExpression {
+		return
+	}
+
+	queries := req.parsedQueries[:0]
+	for _, pq := range req.parsedQueries {
+		if isHidden(pq.query) {
+			req.skippedRefIDs = append(req.skippedRefIDs, pq.query.RefID)
+			continue
+		}
+		queries = append(queries, pq)
+	}
+	req.parsedQueries = queries
+}
+
+// skippedResponses returns the responses of the skipped queries: an empty
+// frame whose metadata tells that the query was skipped, so that clients
+// can tell skipped queries apart from queries without data.
+func skippedResponses(req *parsedRequest) backend.Responses {
+	responses := backend.Responses{}
+	for _, refID := range req.skippedRefIDs {
+		frame := data.NewFrame("")
+		frame.RefID = refID
+		frame.Meta = &data.FrameMeta{
+			Custom: map[string]interface{}{"skipped": true},
+			Notices: []data.Notice{{
+				Severity: data.NoticeSeverityInfo,
+				Text:     "Query skipped because it is hidden",
+			}},
+		}
+		responses[refID] = backend.DataResponse{Frames: data.Frames{frame}}
+	}
+	return responses
+}
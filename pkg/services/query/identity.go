@@ -0,0 +1,75 @@
+package query
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/grafana/grafana/pkg/models"
+)
+
+const (
+	userLoginHeader     = "X-Grafana-User-Login"
+	userEmailHeader     = "X-Grafana-User-Email"
+	userAnonymousHeader = "X-Grafana-User-Anonymous"
+	orgRoleHeader       = "X-Grafana-Org-Role"
+	teamsHeader         = "X-Grafana-Teams"
+)
+
+// forwardUserIdentity reports whether the identity of the signed in user is
+// sent to the data source. The forwardUserIdentity json data option takes
+// precedence over the configured default.
+func (s *Service) forwardUserIdentity(ds *models.DataSource) bool {
+	if ds.JsonData != nil {
+		if forward, err := ds.JsonData.Get("forwardUserIdentity").Bool(); err == nil {
+			return forward
+		}
+	}
+	return s.cfg != nil && s.cfg.QueryForwardUserIdentity
+}
+
+// userIdentityHeaders returns the headers describing the user to data source
+// plugins that implement their own access control. Anonymous users are
+// reported as such instead of with an empty login.
+func userIdentityHeaders(user *models.SignedInUser) map[string]string {
+	if user == nil || user.IsAnonymous {
+		headers := map[string]string{userAnonymousHeader: "true"}
+		if user != nil && user.OrgRole != "" {
+			headers[orgRoleHeader] = sanitizeHeaderValue(string(user.OrgRole))
+		}
+		return headers
+	}
+
+	headers := map[string]string{
+		userLoginHeader: sanitizeHeaderValue(user.Login),
+		orgRoleHeader:   sanitizeHeaderValue(string(user.OrgRole)),
+	}
+	if user.Email != "" {
+		headers[userEmailHeader] = sanitizeHeaderValue(user.Email)
+	}
+	if len(user.Teams) > 0 {
+		teams := make([]string, 0, len(user.Teams))
+		for _, id := range user.Teams {
+			teams = append(teams, strconv.FormatInt(id, 10))
+		}
+		headers[teamsHeader] = strings.Join(teams, ",")
+	}
+	return headers
+}
+
+// sanitizeHeaderValue removes the control characters that are not allowed in
+// header values, so that user controlled values like the login can't inject
+// other headers.
+func sanitizeHeaderValue(value string) string {
+	return strings.TrimSpace(strings.Map(func(r rune) rune {
+		if isHeaderControlCharacter(r) {
+			return -1
+		}
+		return r
+	}, value))
+}
+
+// isHeaderControlCharacter reports whether r is a control character that is
+// not allowed in header values.
+func isHeaderControlCharacter(r rune) bool {
+	return (r < 0x20 && r != '\t') || r == 0x7f
+}
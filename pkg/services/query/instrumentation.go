@@ -0,0 +1,76 @@
+package query
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana/pkg/models"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+type queryStatsKey struct{}
+
+// queryStats records how a data source request was served, so that it can be
+// reported by the metrics of the request.
+type queryStats struct {
+	cached  bool
+	retried bool
+}
+
+func withQueryStats(ctx context.Context) (context.Context, *queryStats) {
+	stats := &queryStats{}
+	return context.WithValue(ctx, queryStatsKey{}, stats), stats
+}
+
+// queryStatsFromContext returns the stats of the request, or stats that are
+// not reported when the request is not instrumented.
+func queryStatsFromContext(ctx context.Context) *queryStats {
+	if stats, ok := ctx.Value(queryStatsKey{}).(*queryStats); ok {
+		return stats
+	}
+	return &queryStats{}
+}
+
+// queryDataWithMetrics reports the duration and the failed queries of a data
+// source request, whether it was served from the cache or by the plugin, and
+// audits it. Queries cancelled by the client are not counted as failures.
+func (s *Service) queryDataWithMetrics(ctx context.Context, user *models.SignedInUser, ds *models.DataSource, req *backend.QueryDataRequest) (*backend.QueryDataResponse, error) {
+	ctx, stats := withQueryStats(ctx)
+	start := time.Now()
+
+	resp, err := s.queryDataWithCache(ctx, user, ds, req)
+	duration := time.Since(start)
+	s.auditQueryData(ctx, user, ds, req, duration, resp, err)
+
+	labels := prometheus.Labels{
+		"datasource_type": ds.Type,
+		"cached":          strconv.FormatBool(stats.cached),
+		"retried":         strconv.FormatBool(stats.retried),
+	}
+	queryDuration.With(labels).Observe(duration.Seconds())
+
+	if errors.Is(ctx.Err(), context.Canceled) {
+		queryCancelled.WithLabelValues(ds.Type).Add(float64(len(req.Queries)))
+		return resp, err
+	}
+
+	failed := 0
+	switch {
+	case err != nil:
+		failed = len(req.Queries)
+	case resp != nil:
+		for _, dr := range resp.Responses {
+			if dr.Error != nil {
+				failed++
+			}
+		}
+	}
+	if failed > 0 {
+		queryErrors.With(labels).Add(float64(failed))
+	}
+
+	return resp, err
+}
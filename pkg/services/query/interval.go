@@ -0,0 +1,39 @@
+package query
+
+import (
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana/pkg/models"
+	"github.com/grafana/grafana/pkg/tsdb/intervalv2"
+)
+
+// defaultInterval computes the interval of a query sent without intervalMs
+// from its time range and max data points, so that data sources don't pick
+// steps of their own for long time ranges. The interval is at least the
+// configured minimum interval and the minimum interval of the data source.
+// It returns false when the time range is empty.
+func (s *Service) defaultInterval(ds *models.DataSource, timeRange backend.TimeRange, maxDataPoints int64) (time.Duration, bool) {
+	if !timeRange.To.After(timeRange.From) {
+		return 0, false
+	}
+
+	var minInterval time.Duration
+	if s.cfg != nil {
+		minInterval = s.cfg.QueryMinInterval
+	}
+	if ds.JsonData != nil {
+		if timeInterval := ds.JsonData.Get("timeInterval").MustString(); timeInterval != "" {
+			dsInterval, err := intervalv2.ParseIntervalStringToTimeDuration(timeInterval)
+			if err != nil {
+				s.log.Warn("Ignoring invalid minimum interval of data source", "datasource", ds.Uid, "timeInterval", timeInterval, "error", err)
+			} else if dsInterval > minInterval {
+				minInterval = dsInterval
+			}
+		}
+	}
+
+	// The calculator uses its default resolution when maxDataPoints is zero.
+	interval := intervalv2.NewCalculator().Calculate(timeRange, minInterval, maxDataPoints)
+	return interval.Value, true
+}
@@ -0,0 +1,94 @@
+package query
+
+import (
+	"context"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/grafana/grafana/pkg/setting"
+)
+
+// defaultMaxConcurrentPerCPU is the number of data source requests allowed in
+// flight per CPU usable by the process, when not configured.
+const defaultMaxConcurrentPerCPU = 16
+
+// concurrencyLimiter limits the number of data source requests in flight in
+// the whole instance, so that load spikes don't spawn unbounded numbers of
+// plugin calls. Requests over the limit wait for a slot in a bounded queue.
+type concurrencyLimiter struct {
+	// slots is nil when the number of requests is unlimited.
+	slots    chan struct{}
+	maxQueue int
+	maxWait  time.Duration
+
+	mu     sync.Mutex
+	queued int
+}
+
+func newConcurrencyLimiter(maxConcurrent, maxQueue int, maxWait time.Duration) *concurrencyLimiter {
+	l := &concurrencyLimiter{maxQueue: maxQueue, maxWait: maxWait}
+	if maxConcurrent > 0 {
+		l.slots = make(chan struct{}, maxConcurrent)
+	}
+	return l
+}
+
+// configConcurrencyLimiter returns the limiter configured with the
+// max_concurrent_requests, max_queued_requests and max_queue_time settings.
+// Zero concurrent requests defaults to a number proportional to GOMAXPROCS,
+// a negative number disables the limit.
+func configConcurrencyLimiter(cfg *setting.Cfg) *concurrencyLimiter {
+	maxConcurrent := cfg.QueryMaxConcurrentRequests
+	if maxConcurrent == 0 {
+		maxConcurrent = defaultMaxConcurrentPerCPU * runtime.GOMAXPROCS(0)
+	}
+	return newConcurrencyLimiter(maxConcurrent, cfg.QueryMaxQueuedRequests, cfg.QueryMaxQueueTime)
+}
+
+// acquire reserves a slot for a data source request, waiting in the queue when
+// all slots are taken. The returned release function must be called once the
+// request finished.
+func (l *concurrencyLimiter) acquire(ctx context.Context) (func(), error) {
+	if l.slots == nil {
+		return func() {}, nil
+	}
+	release := func() { <-l.slots }
+
+	select {
+	case l.slots <- struct{}{}:
+		return release, nil
+	default:
+	}
+
+	l.mu.Lock()
+	if l.queued >= l.maxQueue {
+		l.mu.Unlock()
+		return nil, &ErrQueryQueueFull{RetryAfter: time.Second}
+	}
+	l.queued++
+	queryQueueDepth.Set(float64(l.queued))
+	l.mu.Unlock()
+
+	start := time.Now()
+	defer func() {
+		queryQueueWait.Observe(time.Since(start).Seconds())
+
+		l.mu.Lock()
+		l.queued--
+		queryQueueDepth.Set(float64(l.queued))
+		l.mu.Unlock()
+	}()
+
+	timer := time.NewTimer(l.maxWait)
+	defer timer.Stop()
+
+	select {
+	case l.slots <- struct{}{}:
+		return release, nil
+	case <-timer.C:
+		return nil, &ErrQueryQueueFull{Waited: l.maxWait, RetryAfter: time.Second}
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
@@ -0,0 +1,183 @@
+package query
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana/pkg/infra/tracing"
+	"github.com/grafana/grafana/pkg/models"
+	"github.com/grafana/grafana/pkg/plugins"
+	"github.com/grafana/grafana/pkg/services/featuremgmt"
+	"github.com/grafana/grafana/pkg/setting"
+	"github.com/stretchr/testify/require"
+)
+
+// slowPluginClient answers every request after a delay, or once unblocked
+// when a block channel is set, and tracks the requests in flight.
+type slowPluginClient struct {
+	plugins.Client
+
+	delay       time.Duration
+	block       chan struct{}
+	inFlight    int64
+	maxInFlight int64
+}
+
+func (c *slowPluginClient) QueryData(ctx context.Context, req *backend.QueryDataRequest) (*backend.QueryDataResponse, error) {
+	inFlight := atomic.AddInt64(&c.inFlight, 1)
+	defer atomic.AddInt64(&c.inFlight, -1)
+	for {
+		max := atomic.LoadInt64(&c.maxInFlight)
+		if inFlight <= max || atomic.CompareAndSwapInt64(&c.maxInFlight, max, inFlight) {
+			break
+		}
+	}
+
+	if c.block != nil {
+		<-c.block
+	} else {
+		time.Sleep(c.delay)
+	}
+
+	resp := backend.NewQueryDataResponse()
+	for _, q := range req.Queries {
+		resp.Responses[q.RefID] = backend.DataResponse{}
+	}
+	return resp, nil
+}
+
+func TestConcurrencyLimiter(t *testing.T) {
+	setupLimiter := func(t *testing.T, client *slowPluginClient, maxConcurrent, maxQueued int, maxQueueTime time.Duration) *Service {
+		t.Helper()
+		tracer, err := tracing.InitializeTracerForTest()
+		require.NoError(t, err)
+
+		cfg := setting.NewCfg()
+		cfg.QueryMaxRetries = 0
+		cfg.QueryMaxConcurrentRequests = maxConcurrent
+		cfg.QueryMaxQueuedRequests = maxQueued
+		cfg.QueryMaxQueueTime = maxQueueTime
+
+		return ProvideService(cfg, nil, nil, nil, nil, client, nil, nil, nil, nil, tracer, featuremgmt.WithFeatures())
+	}
+
+	request := func() *backend.QueryDataRequest {
+		return &backend.QueryDataRequest{
+			Headers: map[string]string{},
+			Queries: []backend.DataQuery{{RefID: "A"}},
+		}
+	}
+
+	queued := func(s *Service) int {
+		s.limiter.mu.Lock()
+		defer s.limiter.mu.Unlock()
+		return s.limiter.queued
+	}
+
+	t.Run("it caps the requests in flight under load", func(t *testing.T) {
+		client := &slowPluginClient{delay: 10 * time.Millisecond}
+		s := setupLimiter(t, client, 4, 100, 10*time.Second)
+
+		var wg sync.WaitGroup
+		errs := make(chan error, 50)
+		for i := 0; i < 50; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				ds := &models.DataSource{OrgId: 1, Uid: fmt.Sprintf("ds%d", i%10)}
+				_, err := s.queryData(context.Background(), ds, request())
+				errs <- err
+			}(i)
+		}
+		wg.Wait()
+		close(errs)
+
+		for err := range errs {
+			require.NoError(t, err)
+		}
+		require.Equal(t, int64(4), atomic.LoadInt64(&client.maxInFlight))
+		require.Equal(t, 0, queued(s))
+	})
+
+	t.Run("it rejects requests that can't be queued or waited too long", func(t *testing.T) {
+		client := &slowPluginClient{block: make(chan struct{})}
+		s := setupLimiter(t, client, 2, 2, 100*time.Millisecond)
+		ds := &models.DataSource{OrgId: 1, Uid: "slow"}
+
+		results := make(chan error, 4)
+		for i := 0; i < 4; i++ {
+			go func() {
+				_, err := s.queryData(context.Background(), ds, request())
+				results <- err
+			}()
+		}
+		require.Eventually(t, func() bool {
+			return atomic.LoadInt64(&client.inFlight) == 2 && queued(s) == 2
+		}, time.Second, time.Millisecond)
+
+		// The queue is full, the request is rejected right away.
+		_, err := s.queryData(context.Background(), ds, request())
+		var queueFull *ErrQueryQueueFull
+		require.True(t, errors.As(err, &queueFull))
+		require.Zero(t, queueFull.Waited)
+		require.Equal(t, time.Second, queueFull.RetryAfter)
+
+		// The queued requests time out while the first ones are still running.
+		for i := 0; i < 2; i++ {
+			err := <-results
+			require.True(t, errors.As(err, &queueFull))
+			require.Equal(t, 100*time.Millisecond, queueFull.Waited)
+		}
+		require.Equal(t, 0, queued(s))
+
+		close(client.block)
+		for i := 0; i < 2; i++ {
+			require.NoError(t, <-results)
+		}
+
+		// Slots are released once the requests finished.
+		_, err = s.queryData(context.Background(), ds, request())
+		require.NoError(t, err)
+	})
+
+	t.Run("it stops waiting when the request is cancelled", func(t *testing.T) {
+		client := &slowPluginClient{block: make(chan struct{})}
+		defer close(client.block)
+		s := setupLimiter(t, client, 1, 1, time.Minute)
+		ds := &models.DataSource{OrgId: 1, Uid: "slow"}
+
+		go func() {
+			_, _ = s.queryData(context.Background(), ds, request())
+		}()
+		require.Eventually(t, func() bool {
+			return atomic.LoadInt64(&client.inFlight) == 1
+		}, time.Second, time.Millisecond)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		result := make(chan error, 1)
+		go func() {
+			_, err := s.queryData(ctx, ds, request())
+			result <- err
+		}()
+		require.Eventually(t, func() bool { return queued(s) == 1 }, time.Second, time.Millisecond)
+
+		cancel()
+		require.True(t, errors.Is(<-result, context.Canceled))
+		require.Equal(t, 0, queued(s))
+	})
+
+	t.Run("it is disabled with a negative limit", func(t *testing.T) {
+		client := &slowPluginClient{}
+		s := setupLimiter(t, client, -1, 0, 0)
+		require.Nil(t, s.limiter.slots)
+
+		_, err := s.queryData(context.Background(), &models.DataSource{OrgId: 1, Uid: "ds"}, request())
+		require.NoError(t, err)
+	})
+}
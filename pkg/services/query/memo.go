@@ -0,0 +1,79 @@
+package query
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/grafana/grafana/pkg/components/simplejson"
+	"github.com/grafana/grafana/pkg/models"
+)
+
+// requestMemo memoizes the data source lookups and secret decryptions of a
+// single query request, whose queries often reference the same data sources.
+// It is shared by the query groups of the request, which may run concurrently.
+type requestMemo struct {
+	mu          sync.Mutex
+	dataSources map[string]dataSourceLookup
+	secrets     map[string]map[string]string
+}
+
+// dataSourceLookup is the data source a query references.
+type dataSourceLookup struct {
+	ds     *models.DataSource
+	byName bool
+}
+
+type requestMemoKey struct{}
+
+// withRequestMemo returns a copy of ctx carrying a memo for the request, or
+// ctx itself when it already carries one.
+func withRequestMemo(ctx context.Context) context.Context {
+	if requestMemoFromContext(ctx) != nil {
+		return ctx
+	}
+	return context.WithValue(ctx, requestMemoKey{}, &requestMemo{
+		dataSources: map[string]dataSourceLookup{},
+		secrets:     map[string]map[string]string{},
+	})
+}
+
+func requestMemoFromContext(ctx context.Context) *requestMemo {
+	memo, _ := ctx.Value(requestMemoKey{}).(*requestMemo)
+	return memo
+}
+
+// dataSourceRefKey identifies the data source reference of a query, so that
+// queries referencing a data source the same way share the lookup.
+func dataSourceRefKey(query *simplejson.Json) string {
+	return fmt.Sprintf("%d/%q/%q",
+		query.Get("datasourceId").MustInt64(0),
+		query.Get("datasource").Get("uid").MustString(),
+		query.Get("datasource").MustString())
+}
+
+func (m *requestMemo) dataSource(key string) (dataSourceLookup, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	lookup, ok := m.dataSources[key]
+	return lookup, ok
+}
+
+func (m *requestMemo) setDataSource(key string, lookup dataSourceLookup) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.dataSources[key] = lookup
+}
+
+func (m *requestMemo) decryptedSecrets(uid string) (map[string]string, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	decrypted, ok := m.secrets[uid]
+	return decrypted, ok
+}
+
+func (m *requestMemo) setDecryptedSecrets(uid string, decrypted map[string]string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.secrets[uid] = decrypted
+}
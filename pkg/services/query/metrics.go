@@ -0,0 +1,101 @@
+package query
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	queryCacheRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "grafana",
+		Subsystem: "query",
+		Name:      "cache_requests_total",
+		Help:      "Number of query cache lookups by result (hit or miss).",
+	}, []string{"result"})
+
+	queryRetries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "grafana",
+		Subsystem: "query",
+		Name:      "plugin_retries_total",
+		Help:      "Number of data source queries retried after a transient plugin error.",
+	}, []string{"plugin_id"})
+
+	queryThrottled = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "grafana",
+		Subsystem: "query",
+		Name:      "throttled_total",
+		Help:      "Number of queries rejected by the rate limits of their data source.",
+	}, []string{"datasource_uid"})
+
+	queryDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "grafana",
+		Subsystem: "query",
+		Name:      "duration_seconds",
+		Help:      "Duration of data source query requests by data source type.",
+		Buckets:   []float64{.05, .1, .25, .5, 1, 2.5, 5, 10, 30},
+	}, []string{"datasource_type", "cached", "retried"})
+
+	queryErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "grafana",
+		Subsystem: "query",
+		Name:      "errors_total",
+		Help:      "Number of data source queries that returned an error by data source type.",
+	}, []string{"datasource_type", "cached", "retried"})
+
+	queryCancelled = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "grafana",
+		Subsystem: "query",
+		Name:      "cancelled_total",
+		Help:      "Number of data source queries cancelled because the client closed the request.",
+	}, []string{"datasource_type"})
+
+	queryCircuitBreakerState = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "grafana",
+		Subsystem: "query",
+		Name:      "circuit_breaker_state",
+		Help:      "State of the circuit breaker of the data source: 0 closed, 1 open, 2 half-open.",
+	}, []string{"datasource_uid"})
+
+	queryCircuitBreakerRejected = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "grafana",
+		Subsystem: "query",
+		Name:      "circuit_breaker_rejected_total",
+		Help:      "Number of queries failed fast because the circuit breaker of their data source was open.",
+	}, []string{"datasource_uid"})
+
+	queryUnhealthyRejected = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "grafana",
+		Subsystem: "query",
+		Name:      "unhealthy_rejected_total",
+		Help:      "Number of queries failed fast because the last health check of their data source failed.",
+	}, []string{"datasource_uid"})
+
+	queryQueueDepth = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: "grafana",
+		Subsystem: "query",
+		Name:      "queue_depth",
+		Help:      "Number of data source requests waiting for the number of requests in flight to go below the limit.",
+	})
+
+	queryQueueWait = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: "grafana",
+		Subsystem: "query",
+		Name:      "queue_wait_seconds",
+		Help:      "Time data source requests waited in the queue before being sent or rejected.",
+		Buckets:   []float64{.005, .01, .05, .1, .25, .5, 1, 2.5, 5, 10},
+	})
+
+	querySecretsDecryptionFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "grafana",
+		Subsystem: "query",
+		Name:      "secrets_decryption_failures_total",
+		Help:      "Number of data source requests that failed because the data source secrets could not be decrypted.",
+	}, []string{"datasource_uid"})
+
+	queryOAuthPassThru = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "grafana",
+		Subsystem: "query",
+		Name:      "oauth_pass_thru_total",
+		Help:      "Number of requests the OAuth token of the user was forwarded with by data source type.",
+	}, []string{"datasource_type"})
+)
@@ -0,0 +1,172 @@
+package query
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/grafana/grafana/pkg/models"
+	"github.com/grafana/grafana/pkg/services/oauthtoken"
+	"golang.org/x/oauth2"
+)
+
+const (
+	defaultOAuthPassThruHeader = "Authorization"
+
+	// oauthPassThruTokenTypeNone forwards the bare access token, without the
+	// token type in front of it.
+	oauthPassThruTokenTypeNone = "none"
+)
+
+// reservedHeaders are the headers Grafana or the HTTP transport set on the
+// requests to the data sources, which can't carry the OAuth access token.
+var reservedHeaders = map[string]bool{
+	"Accept-Encoding":   true,
+	"Connection":        true,
+	"Content-Encoding":  true,
+	"Content-Length":    true,
+	"Content-Type":      true,
+	"Cookie":            true,
+	"Host":              true,
+	"Traceparent":       true,
+	"Tracestate":        true,
+	"Transfer-Encoding": true,
+	"Uber-Trace-Id":     true,
+	"User-Agent":        true,
+	requestIDHeader:     true,
+}
+
+// reservedHeaderPrefix prefixes the headers Grafana forwards the identity of
+// the user and the plugin context attributes in.
+const reservedHeaderPrefix = "X-Grafana-"
+
+var headerNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_-]*$`)
+
+// oauthPassThruHeaderName returns the header the OAuth access token is
+// forwarded in, configured with the oauthPassThruHeaderName json data option.
+func oauthPassThruHeaderName(ds *models.DataSource) string {
+	if ds.JsonData != nil {
+		if name := strings.TrimSpace(ds.JsonData.Get("oauthPassThruHeaderName").MustString()); name != "" {
+			return http.CanonicalHeaderKey(name)
+		}
+	}
+	return defaultOAuthPassThruHeader
+}
+
+// ValidateOAuthPassThruHeader checks that the header the data source forwards
+// the OAuth access token in is a valid header name that Grafana doesn't use
+// for something else.
+func ValidateOAuthPassThruHeader(ds *models.DataSource) error {
+	name := oauthPassThruHeaderName(ds)
+	if name == defaultOAuthPassThruHeader {
+		return nil
+	}
+	if !headerNamePattern.MatchString(name) {
+		return fmt.Errorf("invalid OAuth pass-thru header name %q", name)
+	}
+	if reservedHeaders[name] || strings.HasPrefix(name, reservedHeaderPrefix) || name == http.CanonicalHeaderKey(idTokenHeader(ds)) {
+		return fmt.Errorf("OAuth pass-thru header name %q is reserved", name)
+	}
+	return nil
+}
+
+// oauthPassThruHeader returns the header forwarding the OAuth access token to
+// the data source. The token is prefixed with its type unless the data source
+// overrides the type with the oauthPassThruTokenType json data option, which
+// can be "none" to forward the bare token.
+func oauthPassThruHeader(ds *models.DataSource, token *oauth2.Token) (string, string) {
+	tokenType := token.Type()
+	if ds.JsonData != nil {
+		if override := strings.TrimSpace(ds.JsonData.Get("oauthPassThruTokenType").MustString()); override != "" {
+			tokenType = override
+		}
+	}
+	if strings.EqualFold(tokenType, oauthPassThruTokenTypeNone) {
+		return oauthPassThruHeaderName(ds), token.AccessToken
+	}
+	return oauthPassThruHeaderName(ds), fmt.Sprintf("%s %s", tokenType, token.AccessToken)
+}
+
+// requiredScopes returns the OAuth scopes the data source requires the
+// forwarded token to be granted, configured with the requiredScopes json data
+// option as a list or a space-delimited string.
+func requiredScopes(ds *models.DataSource) []string {
+	if ds.JsonData == nil {
+		return nil
+	}
+	value := ds.JsonData.Get("requiredScopes")
+	if scopes, err := value.StringArray(); err == nil {
+		var required []string
+		for _, scope := range scopes {
+			required = append(required, strings.Fields(scope)...)
+		}
+		return required
+	}
+	return strings.Fields(value.MustString())
+}
+
+// oauthIdentityRequired returns ErrOAuthIdentityRequired when the user is a
+// principal without OAuth identity. Requests without user, made by Grafana
+// itself, are not rejected.
+func oauthIdentityRequired(ds *models.DataSource, user *models.SignedInUser) error {
+	if user == nil {
+		return nil
+	}
+	var principal string
+	switch {
+	case user.ApiKeyId != 0:
+		principal = "an API key"
+	case user.IsServiceAccount:
+		principal = "a service account"
+	case user.IsAnonymous:
+		principal = "anonymous access"
+	default:
+		return nil
+	}
+	return &ErrOAuthIdentityRequired{DatasourceName: ds.Name, Principal: principal}
+}
+
+// OAuthPassThruHeaders returns the headers forwarding the OAuth access token
+// of the user, and its ID token, to the data source when it has OAuth
+// pass-thru enabled. The token is refreshed when needed, an error wrapping
+// oauthtoken.ErrTokenRefreshFailed is returned when that fails,
+// ErrOAuthIdentityRequired for principals without OAuth identity and
+// ErrOAuthScopesMissing when the token lacks required scopes. It's used by
+// both the queries and the resource calls of the data source, the endpoint
+// the token is forwarded to is audited.
+func (s *Service) OAuthPassThruHeaders(ctx context.Context, user *models.SignedInUser, ds *models.DataSource, endpoint string) (map[string]string, error) {
+	if !s.oAuthTokenService.IsOAuthPassThruEnabled(ds) {
+		return nil, nil
+	}
+	if err := ValidateOAuthPassThruHeader(ds); err != nil {
+		return nil, fmt.Errorf("data source %s: %w", ds.Name, err)
+	}
+	if err := oauthIdentityRequired(ds, user); err != nil {
+		return nil, err
+	}
+	token, err := s.oAuthTokenService.GetValidOAuthToken(ctx, user)
+	if errors.Is(err, oauthtoken.ErrTokenRefreshFailed) {
+		return nil, err
+	}
+	if token == nil {
+		return nil, nil
+	}
+	if missing := oauthtoken.MissingScopes(token, requiredScopes(ds)); len(missing) > 0 {
+		return nil, &ErrOAuthScopesMissing{DatasourceName: ds.Name, MissingScopes: missing}
+	}
+
+	header, value := oauthPassThruHeader(ds, token)
+	headers := map[string]string{header: value}
+	if header := idTokenHeader(ds); header != "" {
+		if idToken, ok := oauthtoken.IDToken(token); ok {
+			headers[header] = idToken
+		} else {
+			s.log.Warn("No ID token to forward to data source", "datasource", ds.Uid)
+		}
+	}
+	s.auditOAuthPassThru(ctx, user, ds, token, endpoint)
+	return headers, nil
+}
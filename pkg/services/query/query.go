@@ -2,7 +2,9 @@ package query
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"sort"
 	"strings"
 	"time"
 
@@ -10,22 +12,33 @@ import (
 	"github.com/grafana/grafana/pkg/components/simplejson"
 	"github.com/grafana/grafana/pkg/expr"
 	"github.com/grafana/grafana/pkg/infra/log"
+	"github.com/grafana/grafana/pkg/infra/tracing"
 	"github.com/grafana/grafana/pkg/models"
 	"github.com/grafana/grafana/pkg/plugins"
 	"github.com/grafana/grafana/pkg/plugins/adapters"
 	"github.com/grafana/grafana/pkg/services/datasources"
+	"github.com/grafana/grafana/pkg/services/datasources/permissions"
+	"github.com/grafana/grafana/pkg/services/featuremgmt"
 	"github.com/grafana/grafana/pkg/services/oauthtoken"
+	"github.com/grafana/grafana/pkg/services/pluginsettings"
 	"github.com/grafana/grafana/pkg/services/secrets"
 	"github.com/grafana/grafana/pkg/setting"
 	"github.com/grafana/grafana/pkg/tsdb/grafanads"
 	"github.com/grafana/grafana/pkg/tsdb/legacydata"
 
 	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
 )
 
 const (
 	headerName  = "httpHeaderName"
 	headerValue = "httpHeaderValue"
+
+	defaultIDTokenHeader = "X-ID-Token"
+
+	// defaultDataSourceRef references the default data source of the
+	// organization in queries using the deprecated string form.
+	defaultDataSourceRef = "default"
 )
 
 func ProvideService(
@@ -35,19 +48,52 @@ func ProvideService(
 	pluginRequestValidator models.PluginRequestValidator,
 	SecretsService secrets.Service,
 	pluginClient plugins.Client,
+	pluginStore plugins.Store,
+	pluginSettings pluginsettings.Service,
+	dataSourcePermissions permissions.DatasourcePermissionsService,
 	oAuthTokenService oauthtoken.OAuthTokenService,
+	tracer tracing.Tracer,
+	features featuremgmt.FeatureToggles,
 ) *Service {
 	g := &Service{
 		cfg:                    cfg,
 		dataSourceCache:        dataSourceCache,
 		expressionService:      expressionService,
-		pluginRequestValidator: pluginRequestValidator,
+		pluginRequestValidator: models.AsQueryRequestValidator(pluginRequestValidator),
 		secretsService:         SecretsService,
 		pluginClient:           pluginClient,
+		pluginStore:            pluginStore,
+		pluginSettings:         pluginSettings,
+		dataSourcePermissions:  dataSourcePermissions,
 		oAuthTokenService:      oAuthTokenService,
+		tracer:                 tracer,
+		features:               features,
+		quota:                  newQuotaTracker(),
+		rateLimiter:            newQuotaTracker(),
+		breakers:               newCircuitBreakers(0, 0),
+		health:                 newHealthCheckers(0),
+		limiter:                newConcurrencyLimiter(0, 0, 0),
 		log:                    log.New("query_data"),
 	}
 	g.log.Info("Query Service initialization")
+
+	if cfg != nil && cfg.QueryCacheEnabled {
+		cache, err := newMemoryQueryCache(cfg.QueryCacheMaxEntries)
+		if err != nil {
+			g.log.Error("Failed to initialize query cache, query caching is disabled", "error", err)
+		} else {
+			g.cache = cache
+		}
+	}
+	if cfg != nil {
+		g.breakers = newCircuitBreakers(cfg.QueryCircuitBreakerFailures, cfg.QueryCircuitBreakerCooldown)
+		g.health = newHealthCheckers(cfg.QueryHealthCheckTTL)
+		g.limiter = configConcurrencyLimiter(cfg)
+	}
+	if cfg != nil && cfg.QueryAuditEnabled {
+		g.auditSink = newLogAuditSink()
+		g.auditRedactor = newAuditRedactor(cfg, g.log)
+	}
 	return g
 }
 
@@ -55,10 +101,23 @@ type Service struct {
 	cfg                    *setting.Cfg
 	dataSourceCache        datasources.CacheService
 	expressionService      *expr.Service
-	pluginRequestValidator models.PluginRequestValidator
+	pluginRequestValidator models.QueryRequestValidator
 	secretsService         secrets.Service
 	pluginClient           plugins.Client
+	pluginStore            plugins.Store
+	pluginSettings         pluginsettings.Service
+	dataSourcePermissions  permissions.DatasourcePermissionsService
 	oAuthTokenService      oauthtoken.OAuthTokenService
+	tracer                 tracing.Tracer
+	features               featuremgmt.FeatureToggles
+	quota                  *quotaTracker
+	rateLimiter            *quotaTracker
+	breakers               *circuitBreakers
+	health                 *healthCheckers
+	limiter                *concurrencyLimiter
+	cache                  QueryCache
+	auditSink              AuditSink
+	auditRedactor          *redactor
 	log                    log.Logger
 }
 
@@ -70,14 +129,77 @@ func (s *Service) Run(ctx context.Context) error {
 
 // QueryData can process queries and return query responses.
 func (s *Service) QueryData(ctx context.Context, user *models.SignedInUser, skipCache bool, reqDTO dtos.MetricRequest, handleExpressions bool) (*backend.QueryDataResponse, error) {
+	ctx = withRequestMemo(ensureRequestID(ctx))
 	parsedReq, err := s.parseMetricRequest(ctx, user, skipCache, reqDTO)
 	if err != nil {
 		return nil, err
 	}
+
+	var resp *backend.QueryDataResponse
+	if handleExpressions && parsedReq.hasExpression {
+		resp, err = s.handleExpressions(ctx, user, parsedReq)
+	} else {
+		resp, err = s.queryDataSources(ctx, user, parsedReq)
+	}
+
+	// Plugins report interrupted queries with errors of their own, report
+	// them as cancelled when the client went away instead of as failures.
+	if errors.Is(ctx.Err(), context.Canceled) {
+		s.log.Debug("Query request cancelled by the client", "requestId", requestIDFromContext(ctx))
+		return nil, ctx.Err()
+	}
+	if err == nil && resp != nil {
+		addQueryNotices(resp, parsedReq)
+		downsampleResponse(resp, downsampleOptionsFromContext(ctx))
+		for refID, res := range skippedResponses(parsedReq) {
+			resp.Responses[refID] = res
+		}
+	}
+	return resp, err
+}
+
+// QueryDataStream processes queries like QueryData, but passes the responses
+// of each data source to send as soon as the data source answered instead of
+// waiting for all of them. send is never called concurrently. Errors returned
+// before send was called are the errors QueryData would have returned.
+func (s *Service) QueryDataStream(ctx context.Context, user *models.SignedInUser, skipCache bool, reqDTO dtos.MetricRequest, handleExpressions bool, send func(backend.Responses) error) error {
+	ctx = withRequestMemo(ensureRequestID(ctx))
+	parsedReq, err := s.parseMetricRequest(ctx, user, skipCache, reqDTO)
+	if err != nil {
+		return err
+	}
+
+	sendMarked := func(responses backend.Responses) error {
+		resp := &backend.QueryDataResponse{Responses: responses}
+		addQueryNotices(resp, parsedReq)
+		downsampleResponse(resp, downsampleOptionsFromContext(ctx))
+		return send(resp.Responses)
+	}
+
 	if handleExpressions && parsedReq.hasExpression {
-		return s.handleExpressions(ctx, user, parsedReq)
+		var resp *backend.QueryDataResponse
+		resp, err = s.handleExpressions(ctx, user, parsedReq)
+		if err == nil && resp != nil {
+			err = sendMarked(resp.Responses)
+		}
+	} else if groups := groupByDataSource(parsedReq); len(groups) == 1 {
+		var resp *backend.QueryDataResponse
+		resp, err = s.handleQueryData(ctx, user, groups[0])
+		if err == nil && resp != nil {
+			err = sendMarked(resp.Responses)
+		}
+	} else if len(groups) > 1 {
+		err = s.fanOut(ctx, user, groups, sendMarked)
+	}
+	if err == nil && len(parsedReq.skippedRefIDs) > 0 {
+		err = send(skippedResponses(parsedReq))
 	}
-	return s.handleQueryData(ctx, user, parsedReq)
+
+	if errors.Is(ctx.Err(), context.Canceled) {
+		s.log.Debug("Query request cancelled by the client", "requestId", requestIDFromContext(ctx))
+		return ctx.Err()
+	}
+	return err
 }
 
 // handleExpressions handles POST /api/ds/query when there is an expression.
@@ -106,6 +228,20 @@ func (s *Service) handleExpressions(ctx context.Context, user *models.SignedInUs
 		})
 	}
 
+	if s.features.IsEnabled(featuremgmt.FlagQueryServiceExpressions) {
+		// Reject invalid pipelines, e.g. with cyclic dependencies, before
+		// sending any query to the data sources.
+		if _, err := s.expressionService.BuildPipeline(&exprReq); err != nil {
+			return nil, NewErrBadQuery(fmt.Sprintf("invalid expression: %s", err))
+		}
+
+		resp, err := s.queryDataSources(ctx, user, parsedReq)
+		if err != nil {
+			return nil, err
+		}
+		exprReq.Responses = resp.Responses
+	}
+
 	qdr, err := s.expressionService.TransformData(ctx, &exprReq)
 	if err != nil {
 		return nil, fmt.Errorf("expression request error: %w", err)
@@ -113,13 +249,34 @@ func (s *Service) handleExpressions(ctx context.Context, user *models.SignedInUs
 	return qdr, nil
 }
 
+// validateRequest runs the plugin request validator on the queries sent to
+// the data source, denying the access to the data source when it fails.
+func (s *Service) validateRequest(ctx context.Context, ds *models.DataSource, parsedReq *parsedRequest) error {
+	queries := make([]backend.DataQuery, 0, len(parsedReq.parsedQueries))
+	for _, pq := range parsedReq.parsedQueries {
+		queries = append(queries, pq.query)
+	}
+	if err := s.pluginRequestValidator.ValidateQueries(ctx, ds, queries); err != nil {
+		s.log.Warn("Request to data source denied", "datasource", ds.Uid, "reason", err)
+		return models.ErrDataSourceAccessDenied
+	}
+	return nil
+}
+
 func (s *Service) handleQueryData(ctx context.Context, user *models.SignedInUser, parsedReq *parsedRequest) (*backend.QueryDataResponse, error) {
 	ds := parsedReq.parsedQueries[0].datasource
-	if err := s.pluginRequestValidator.Validate(ds.Url, nil); err != nil {
-		return nil, models.ErrDataSourceAccessDenied
+	if err := s.validateRequest(ctx, ds, parsedReq); err != nil {
+		return nil, err
 	}
 
-	instanceSettings, err := adapters.ModelToInstanceSettings(ds, s.decryptSecureJsonDataFn(ctx))
+	decryptedJsonData, err := s.decryptSecureJsonData(ctx, ds)
+	if err != nil {
+		return nil, err
+	}
+
+	instanceSettings, err := adapters.ModelToInstanceSettings(ds, func(map[string][]byte) map[string]string {
+		return decryptedJsonData
+	})
 	if err != nil {
 		return nil, fmt.Errorf("failed to convert data source to instance settings: %w", err)
 	}
@@ -135,18 +292,36 @@ func (s *Service) handleQueryData(ctx context.Context, user *models.SignedInUser
 		Queries: []backend.DataQuery{},
 	}
 
-	if s.oAuthTokenService.IsOAuthPassThruEnabled(ds) {
-		if token := s.oAuthTokenService.GetCurrentOAuthToken(ctx, user); token != nil {
-			req.Headers["Authorization"] = fmt.Sprintf("%s %s", token.Type(), token.AccessToken)
+	oauthHeaders, err := s.OAuthPassThruHeaders(ctx, user, ds, OAuthPassThruEndpointQuery)
+	var identityErr *ErrOAuthIdentityRequired
+	var scopesErr *ErrOAuthScopesMissing
+	if errors.Is(err, oauthtoken.ErrTokenRefreshFailed) {
+		return oauthErrorResponse(parsedReq, &ErrOAuthTokenRefresh{Err: err}), nil
+	}
+	if errors.As(err, &identityErr) {
+		return oauthErrorResponse(parsedReq, identityErr), nil
+	}
+	if errors.As(err, &scopesErr) {
+		return oauthErrorResponse(parsedReq, scopesErr), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range oauthHeaders {
+		req.Headers[k] = v
+	}
 
-			idToken, ok := token.Extra("id_token").(string)
-			if ok && idToken != "" {
-				req.Headers["X-ID-Token"] = idToken
-			}
+	for k, v := range s.customHeaders(ds, instanceSettings.DecryptedSecureJSONData) {
+		req.Headers[k] = v
+	}
+
+	if s.forwardUserIdentity(ds) {
+		for k, v := range userIdentityHeaders(user) {
+			req.Headers[k] = v
 		}
 	}
 
-	for k, v := range customHeaders(ds.JsonData, instanceSettings.DecryptedSecureJSONData) {
+	for k, v := range pluginContextAttrHeaders(ds, parsedReq.pluginContextAttrs) {
 		req.Headers[k] = v
 	}
 
@@ -154,36 +329,155 @@ func (s *Service) handleQueryData(ctx context.Context, user *models.SignedInUser
 		req.Queries = append(req.Queries, q.query)
 	}
 
-	return s.pluginClient.QueryData(ctx, req)
+	return s.queryDataWithMetrics(ctx, user, ds, req)
+}
+
+// oauthErrorResponse reports the error preventing the OAuth identity of the
+// user from being forwarded for every query of the request, so that users are
+// told to authenticate again and the queries of other data sources still run.
+func oauthErrorResponse(parsedReq *parsedRequest, err error) *backend.QueryDataResponse {
+	resp := backend.NewQueryDataResponse()
+	for _, pq := range parsedReq.parsedQueries {
+		resp.Responses[pq.query.RefID] = backend.DataResponse{
+			Error: err,
+		}
+	}
+	return resp
+}
+
+// rateLimitedResponse reports the rate limit error for every query of the request.
+func rateLimitedResponse(ds *models.DataSource, req *backend.QueryDataRequest, err error) *backend.QueryDataResponse {
+	var retryAfter time.Duration
+	var quotaErr *ErrQuotaExceeded
+	if errors.As(err, &quotaErr) {
+		retryAfter = quotaErr.RetryAfter
+	}
+
+	queryThrottled.WithLabelValues(ds.Uid).Add(float64(len(req.Queries)))
+
+	resp := backend.NewQueryDataResponse()
+	for _, q := range req.Queries {
+		resp.Responses[q.RefID] = backend.DataResponse{
+			Error: &ErrRateLimited{RefID: q.RefID, DatasourceUID: ds.Uid, RetryAfter: retryAfter},
+		}
+	}
+	return resp
+}
+
+// queryData sends the request to the data source plugin, subject to the data
+// source health, quota, rate limits, circuit breaker, the limit of requests in
+// flight, query timeout and response size limit.
+func (s *Service) queryData(ctx context.Context, ds *models.DataSource, req *backend.QueryDataRequest) (*backend.QueryDataResponse, error) {
+	ctx, endSpan := s.startQuerySpan(ctx, ds, req)
+	defer endSpan()
+
+	if resp := s.checkDatasourceHealth(ctx, ds, req); resp != nil {
+		return resp, nil
+	}
+
+	release, err := s.quota.acquire(ds.OrgId, ds.Uid, configQuotaLimits(s.cfg))
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	releaseRateLimit, err := s.rateLimiter.acquire(ds.OrgId, ds.Uid, dataSourceQuotaLimits(ds))
+	if err != nil {
+		return rateLimitedResponse(ds, req, err), nil
+	}
+	defer releaseRateLimit()
+
+	record, retryAfter, ok := s.breakers.allow(ds.OrgId, ds.Uid)
+	if !ok {
+		return unavailableResponse(ds, req, retryAfter), nil
+	}
+
+	releaseSlot, err := s.limiter.acquire(ctx)
+	if err != nil {
+		record(requestCancelled)
+		return nil, err
+	}
+	resp, err := s.queryDataWithTimeout(ctx, ds, req)
+	releaseSlot()
+	record(outcomeOf(ctx, resp, err))
+	if err != nil {
+		return nil, err
+	}
+	return s.limitResponseSize(ds, resp), nil
 }
 
 type parsedQuery struct {
 	datasource *models.DataSource
 	query      backend.DataQuery
+
+	// notices are added to the response of the query, e.g. to tell that the
+	// data source was referenced in a deprecated way.
+	notices []data.Notice
 }
 
 type parsedRequest struct {
 	hasExpression bool
 	parsedQueries []parsedQuery
+
+	// skippedRefIDs are the refIds of the hidden queries that are not
+	// executed.
+	skippedRefIDs []string
+
+	// pluginContextAttrs are forwarded to the data sources accepting them.
+	pluginContextAttrs map[string]string
+}
+
+// idTokenHeader returns the header the OAuth ID token is forwarded in, or an
+// empty string when the data source disabled forwarding of the ID token.
+func idTokenHeader(ds *models.DataSource) string {
+	if ds.JsonData == nil {
+		return defaultIDTokenHeader
+	}
+	if !ds.JsonData.Get("oauthPassThruIdToken").MustBool(true) {
+		return ""
+	}
+	if header := ds.JsonData.Get("oauthIdTokenHeaderName").MustString(); header != "" {
+		return header
+	}
+	return defaultIDTokenHeader
 }
 
-func customHeaders(jsonData *simplejson.Json, decryptedJsonData map[string]string) map[string]string {
-	if jsonData == nil {
+// customHeaders returns the custom HTTP headers configured on the data source
+// with the httpHeaderNameN and httpHeaderValueN keys of its JSON data and
+// secure JSON data. Headers without name or value are skipped. Only the names
+// of the headers are logged, as their values are secrets like tenant IDs or
+// API keys.
+func (s *Service) customHeaders(ds *models.DataSource, decryptedJsonData map[string]string) map[string]string {
+	if ds.JsonData == nil {
 		return nil
 	}
 
-	data := jsonData.MustMap()
+	data := ds.JsonData.MustMap()
 
 	headers := map[string]string{}
+	var names []string
 	for k := range data {
-		if strings.HasPrefix(k, headerName) {
-			if header, ok := data[k].(string); ok {
-				valueKey := strings.ReplaceAll(k, headerName, headerValue)
-				headers[header] = decryptedJsonData[valueKey]
-			}
+		if !strings.HasPrefix(k, headerName) {
+			continue
+		}
+		header, ok := data[k].(string)
+		header = strings.TrimSpace(header)
+		if !ok || header == "" {
+			continue
+		}
+		value, ok := decryptedJsonData[headerValue+strings.TrimPrefix(k, headerName)]
+		if !ok {
+			s.log.Warn("Ignoring custom header of data source without value", "datasource", ds.Uid, "header", header)
+			continue
 		}
+		headers[header] = value
+		names = append(names, header)
 	}
 
+	if len(names) > 0 {
+		sort.Strings(names)
+		s.log.Debug("Forwarding custom headers of data source", "datasource", ds.Uid, "headers", names)
+	}
 	return headers
 }
 
@@ -193,15 +487,48 @@ func (s *Service) parseMetricRequest(ctx context.Context, user *models.SignedInU
 	}
 
 	timeRange := legacydata.NewDataTimeRange(reqDTO.From, reqDTO.To)
+	var timeRangeOptions []legacydata.TimeRangeOption
+	if reqDTO.Timezone != "" {
+		location, err := time.LoadLocation(reqDTO.Timezone)
+		if err != nil {
+			return nil, NewErrBadQuery(fmt.Sprintf("invalid timezone %q", reqDTO.Timezone))
+		}
+		timeRangeOptions = append(timeRangeOptions, legacydata.WithLocation(location))
+	}
+	if err := validatePluginContextAttrs(reqDTO.PluginContextAttrs); err != nil {
+		return nil, err
+	}
 	req := &parsedRequest{
-		hasExpression: false,
-		parsedQueries: []parsedQuery{},
+		hasExpression:      false,
+		parsedQueries:      []parsedQuery{},
+		pluginContextAttrs: reqDTO.PluginContextAttrs,
+	}
+
+	refIDs, err := assignRefIDs(reqDTO.Queries)
+	if err != nil {
+		return nil, err
+	}
+
+	var override *models.DataSource
+	if reqDTO.DatasourceUID != "" {
+		override, err = s.getOverrideDataSource(ctx, user, skipCache, reqDTO.DatasourceUID)
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	// Parse the queries
-	datasourcesByUid := map[string]*models.DataSource{}
-	for _, query := range reqDTO.Queries {
-		ds, err := s.getDataSourceFromQuery(ctx, user, skipCache, query, datasourcesByUid)
+	for i, query := range reqDTO.Queries {
+		var notices []data.Notice
+		if refIDs[i] != query.Get("refId").MustString() {
+			query.Set("refId", refIDs[i])
+			notices = append(notices, data.Notice{
+				Severity: data.NoticeSeverityInfo,
+				Text:     fmt.Sprintf("Query had no refId and was assigned refId %s", refIDs[i]),
+			})
+		}
+
+		ds, byName, err := s.getDataSourceFromQuery(ctx, user, skipCache, query)
 		if err != nil {
 			return nil, err
 		}
@@ -209,11 +536,40 @@ func (s *Service) parseMetricRequest(ctx context.Context, user *models.SignedInU
 			return nil, NewErrBadQuery("invalid data source ID")
 		}
 
-		datasourcesByUid[ds.Uid] = ds
+		if byName {
+			notices = append(notices, data.Notice{
+				Severity: data.NoticeSeverityWarning,
+				Text:     fmt.Sprintf("Referencing data sources by name is deprecated, use the uid %q of data source %s instead", ds.Uid, ds.Name),
+			})
+		}
+
+		if override != nil && !expr.IsDataSource(ds.Uid) {
+			if ds.Type != override.Type {
+				return nil, NewErrBadQuery(fmt.Sprintf("data source %s of type %s can't replace data source %s of type %s in query %s", override.Uid, override.Type, ds.Uid, ds.Type, refIDs[i]))
+			}
+			ds = override
+			query.Del("datasourceId")
+			query.Set("datasource", map[string]interface{}{"uid": ds.Uid, "type": ds.Type})
+		}
+
 		if expr.IsDataSource(ds.Uid) {
 			req.hasExpression = true
 		}
 
+		queryTimeRange := backend.TimeRange{
+			From: timeRange.GetFromAsTimeUTC(timeRangeOptions...),
+			To:   timeRange.GetToAsTimeUTC(timeRangeOptions...),
+		}
+		interval := time.Duration(query.Get("intervalMs").MustInt64(1000)) * time.Millisecond
+		if _, ok := query.CheckGet("intervalMs"); !ok && !expr.IsDataSource(ds.Uid) {
+			// The computed interval is recorded in the query model too, which
+			// is what most data sources read it from.
+			if computed, ok := s.defaultInterval(ds, queryTimeRange, query.Get("maxDataPoints").MustInt64(0)); ok {
+				interval = computed
+				query.Set("intervalMs", computed.Milliseconds())
+			}
+		}
+
 		s.log.Debug("Processing metrics query", "query", query)
 
 		modelJSON, err := query.MarshalJSON()
@@ -223,51 +579,69 @@ func (s *Service) parseMetricRequest(ctx context.Context, user *models.SignedInU
 
 		req.parsedQueries = append(req.parsedQueries, parsedQuery{
 			datasource: ds,
+			notices:    notices,
 			query: backend.DataQuery{
-				TimeRange: backend.TimeRange{
-					From: timeRange.GetFromAsTimeUTC(),
-					To:   timeRange.GetToAsTimeUTC(),
-				},
-				RefID:         query.Get("refId").MustString("A"),
+				TimeRange:     queryTimeRange,
+				RefID:         refIDs[i],
 				MaxDataPoints: query.Get("maxDataPoints").MustInt64(100),
-				Interval:      time.Duration(query.Get("intervalMs").MustInt64(1000)) * time.Millisecond,
+				Interval:      interval,
 				QueryType:     query.Get("queryType").MustString(""),
 				JSON:          modelJSON,
 			},
 		})
 	}
 
-	if !req.hasExpression {
-		if len(datasourcesByUid) > 1 {
-			// We do not (yet) support mixed query type
-			return nil, NewErrBadQuery("all queries must use the same datasource")
-		}
+	if err := checkPluginContextAttrs(req); err != nil {
+		return nil, err
+	}
+	if !includeHiddenFromContext(ctx) {
+		skipHiddenQueries(req)
 	}
 
 	return req, nil
 }
 
-func (s *Service) getDataSourceFromQuery(ctx context.Context, user *models.SignedInUser, skipCache bool, query *simplejson.Json, history map[string]*models.DataSource) (*models.DataSource, error) {
+// getDataSourceFromQuery returns the data source referenced by the query, and
+// whether it was referenced by name. The data sources are looked up once per
+// request, later queries referencing them the same way share the lookup.
+func (s *Service) getDataSourceFromQuery(ctx context.Context, user *models.SignedInUser, skipCache bool, query *simplejson.Json) (*models.DataSource, bool, error) {
+	memo := requestMemoFromContext(ctx)
+	key := dataSourceRefKey(query)
+	if memo != nil {
+		if lookup, ok := memo.dataSource(key); ok {
+			return lookup.ds, lookup.byName, nil
+		}
+	}
+
+	ds, byName, err := s.lookupDataSourceFromQuery(ctx, user, skipCache, query)
+	if err != nil {
+		return nil, false, err
+	}
+	if memo != nil && ds != nil {
+		memo.setDataSource(key, dataSourceLookup{ds: ds, byName: byName})
+	}
+	return ds, byName, nil
+}
+
+func (s *Service) lookupDataSourceFromQuery(ctx context.Context, user *models.SignedInUser, skipCache bool, query *simplejson.Json) (*models.DataSource, bool, error) {
+	var ds *models.DataSource
 	var err error
 	uid := query.Get("datasource").Get("uid").MustString()
 
-	// before 8.3 special types could be sent as datasource (expr)
+	// before 8.3 special types could be sent as datasource (expr), and
+	// older dashboards reference data sources by name
+	ref := ""
 	if uid == "" {
-		uid = query.Get("datasource").MustString()
-	}
-
-	// check cache value
-	ds, ok := history[uid]
-	if ok {
-		return ds, nil
+		ref = query.Get("datasource").MustString()
+		uid = ref
 	}
 
 	if expr.IsDataSource(uid) {
-		return expr.DataSourceModel(), nil
+		return expr.DataSourceModel(), false, nil
 	}
 
 	if uid == grafanads.DatasourceUID {
-		return grafanads.DataSourceModel(user.OrgId), nil
+		return grafanads.DataSourceModel(user.OrgId), false, nil
 	}
 
 	// use datasourceId if it exists
@@ -275,28 +649,154 @@ func (s *Service) getDataSourceFromQuery(ctx context.Context, user *models.Signe
 	if id > 0 {
 		ds, err = s.dataSourceCache.GetDatasource(ctx, id, user, skipCache)
 		if err != nil {
-			return nil, err
+			return nil, false, err
 		}
-		return ds, nil
+		return ds, false, nil
+	}
+
+	if ref != "" {
+		return s.getDataSourceByRef(ctx, user, skipCache, ref)
 	}
 
 	if uid != "" {
 		ds, err = s.dataSourceCache.GetDatasourceByUID(ctx, uid, user, skipCache)
 		if err != nil {
-			return nil, err
+			return nil, false, err
 		}
-		return ds, nil
+		return ds, false, nil
 	}
 
-	return nil, NewErrBadQuery("missing data source ID/UID")
+	return nil, false, NewErrBadQuery("missing data source ID/UID")
 }
 
-func (s *Service) decryptSecureJsonDataFn(ctx context.Context) func(map[string][]byte) map[string]string {
-	return func(m map[string][]byte) map[string]string {
-		decryptedJsonData, err := s.secretsService.DecryptJsonData(ctx, m)
+// getDataSourceByRef resolves a data source referenced with a plain string,
+// which is either its uid or, in the deprecated form, its name or the
+// default keyword. The returned bool reports whether the name was used.
+func (s *Service) getDataSourceByRef(ctx context.Context, user *models.SignedInUser, skipCache bool, ref string) (*models.DataSource, bool, error) {
+	if ref == defaultDataSourceRef {
+		ds, err := s.dataSourceCache.GetDefaultDatasource(ctx, user, skipCache)
+		if errors.Is(err, models.ErrDataSourceNotFound) {
+			return nil, false, NewErrBadQuery("no default data source is configured")
+		}
 		if err != nil {
-			s.log.Error("Failed to decrypt secure json data", "error", err)
+			return nil, false, err
 		}
-		return decryptedJsonData
+		return ds, true, nil
+	}
+
+	ds, err := s.dataSourceCache.GetDatasourceByUID(ctx, ref, user, skipCache)
+	if err == nil {
+		return ds, false, nil
+	}
+	if !errors.Is(err, models.ErrDataSourceNotFound) {
+		return nil, false, err
+	}
+
+	ds, err = s.dataSourceCache.GetDatasourceByName(ctx, ref, user, skipCache)
+	switch {
+	case errors.Is(err, models.ErrDataSourceNotFound):
+		return nil, false, NewErrBadQuery(fmt.Sprintf("data source %q not found", ref))
+	case errors.Is(err, models.ErrDataSourceNameAmbiguous):
+		return nil, false, NewErrBadQuery(fmt.Sprintf("data source name %q matches more than one data source, reference the data source by uid", ref))
+	case err != nil:
+		return nil, false, err
+	}
+	return ds, true, nil
+}
+
+// getOverrideDataSource returns the data source replacing the data sources of
+// the queries of a request.
+func (s *Service) getOverrideDataSource(ctx context.Context, user *models.SignedInUser, skipCache bool, uid string) (*models.DataSource, error) {
+	if expr.IsDataSource(uid) {
+		return nil, NewErrBadQuery("the data source of the queries can't be replaced with expressions")
+	}
+	ds, err := s.dataSourceCache.GetDatasourceByUID(ctx, uid, user, skipCache)
+	if errors.Is(err, models.ErrDataSourceNotFound) {
+		return nil, NewErrBadQuery(fmt.Sprintf("data source %q not found", uid))
+	}
+	return ds, err
+}
+
+// addQueryNotices adds the notices recorded while parsing the request to the
+// responses of the queries.
+func addQueryNotices(resp *backend.QueryDataResponse, parsedReq *parsedRequest) {
+	for _, pq := range parsedReq.parsedQueries {
+		res, ok := resp.Responses[pq.query.RefID]
+		if !ok {
+			continue
+		}
+		for _, notice := range pq.notices {
+			res = withNotice(res, pq.query.RefID, notice)
+		}
+		resp.Responses[pq.query.RefID] = res
+	}
+}
+
+// assignRefIDs returns the refId of every query, assigning the first unused
+// refIds in the A, B, ... Z, AA, AB sequence to the queries without one. Duplicate
+// refIds are rejected as the responses are keyed by refId.
+func assignRefIDs(queries []*simplejson.Json) ([]string, error) {
+	refIDs := make([]string, len(queries))
+	used := map[string]int{}
+	var duplicates []string
+	for i, query := range queries {
+		refID := query.Get("refId").MustString()
+		if refID == "" {
+			continue
+		}
+		used[refID]++
+		if used[refID] == 2 {
+			duplicates = append(duplicates, refID)
+		}
+		refIDs[i] = refID
+	}
+	if len(duplicates) > 0 {
+		return nil, NewErrBadQuery(fmt.Sprintf("duplicate refIds in queries: %s", strings.Join(duplicates, ", ")))
+	}
+
+	next := 0
+	for i := range refIDs {
+		if refIDs[i] != "" {
+			continue
+		}
+		for used[refIDForIndex(next)] > 0 {
+			next++
+		}
+		refIDs[i] = refIDForIndex(next)
+		used[refIDs[i]]++
+	}
+	return refIDs, nil
+}
+
+// refIDForIndex returns the refId at the given position of the A, B, ... Z,
+// AA, AB sequence the frontend uses.
+func refIDForIndex(i int) string {
+	refID := ""
+	for ; i >= 0; i = i/26 - 1 {
+		refID = string(rune('A'+i%26)) + refID
+	}
+	return refID
+}
+
+// decryptSecureJsonData decrypts the secrets of the data source. Failures are
+// reported as an ErrDatasourceSecretsDecryption so that the data source is
+// never queried with partially decrypted secrets.
+func (s *Service) decryptSecureJsonData(ctx context.Context, ds *models.DataSource) (map[string]string, error) {
+	memo := requestMemoFromContext(ctx)
+	if memo != nil {
+		if decryptedJsonData, ok := memo.decryptedSecrets(ds.Uid); ok {
+			return decryptedJsonData, nil
+		}
+	}
+
+	decryptedJsonData, err := s.secretsService.DecryptJsonData(ctx, ds.SecureJsonData)
+	if err != nil {
+		s.log.Error("Failed to decrypt secure json data", "datasource", ds.Uid, "name", ds.Name, "error", err)
+		querySecretsDecryptionFailures.WithLabelValues(ds.Uid).Inc()
+		return nil, &ErrDatasourceSecretsDecryption{DatasourceUID: ds.Uid, DatasourceName: ds.Name, Err: err}
+	}
+	if memo != nil {
+		memo.setDecryptedSecrets(ds.Uid, decryptedJsonData)
 	}
+	return decryptedJsonData, nil
 }
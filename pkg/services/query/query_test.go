@@ -2,19 +2,40 @@ package query_test
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"golang.org/x/oauth2"
 
 	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
 	"github.com/grafana/grafana/pkg/api/dtos"
 	"github.com/grafana/grafana/pkg/components/simplejson"
+	"github.com/grafana/grafana/pkg/expr"
+	"github.com/grafana/grafana/pkg/infra/tracing"
 	"github.com/grafana/grafana/pkg/models"
 	"github.com/grafana/grafana/pkg/plugins"
+	"github.com/grafana/grafana/pkg/plugins/backendplugin"
+	"github.com/grafana/grafana/pkg/services/datasources/permissions"
+	"github.com/grafana/grafana/pkg/services/featuremgmt"
+	"github.com/grafana/grafana/pkg/services/oauthtoken"
+	"github.com/grafana/grafana/pkg/services/pluginsettings"
 	"github.com/grafana/grafana/pkg/services/query"
 	"github.com/grafana/grafana/pkg/services/secrets"
+	"github.com/grafana/grafana/pkg/services/secrets/fakes"
+	"github.com/grafana/grafana/pkg/setting"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
 	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 func TestQueryData(t *testing.T) {
@@ -23,62 +44,2330 @@ func TestQueryData(t *testing.T) {
 		tc.dataSourceCache.ds.JsonData = simplejson.NewFromAny(map[string]interface{}{"httpHeaderName1": "foo", "httpHeaderName2": "bar"})
 		tc.secretService.decryptedJson = map[string]string{"httpHeaderValue1": "test-header", "httpHeaderValue2": "test-header2"}
 
+		ctx := query.WithRequestID(context.Background(), "request-id")
+		_, err := tc.queryService.QueryData(ctx, nil, true, metricRequest(), false)
+		require.Nil(t, err)
+
+		expected := map[string]string{
+			"foo":          "test-header",
+			"bar":          "test-header2",
+			"Traceparent":  "fake-trace",
+			"X-Request-Id": "request-id",
+		}
+		require.Equal(t, expected, tc.pluginContext.req.Headers)
+	})
+
+	t.Run("it auth custom headers to the request", func(t *testing.T) {
+		token := &oauth2.Token{
+			TokenType:   "bearer",
+			AccessToken: "access-token",
+		}
+		token = token.WithExtra(map[string]interface{}{"id_token": "id-token"})
+
+		tc := setup()
+		tc.oauthTokenService.passThruEnabled = true
+		tc.oauthTokenService.token = token
+
+		ctx := query.WithRequestID(context.Background(), "request-id")
+		_, err := tc.queryService.QueryData(ctx, nil, true, metricRequest(), false)
+		require.Nil(t, err)
+
+		expected := map[string]string{
+			"Authorization": "Bearer access-token",
+			"X-ID-Token":    "id-token",
+			"Traceparent":   "fake-trace",
+			"X-Request-Id":  "request-id",
+		}
+		require.Equal(t, expected, tc.pluginContext.req.Headers)
+	})
+}
+
+func TestQueryDataIDToken(t *testing.T) {
+	setupIDToken := func(jsonData map[string]interface{}, idToken string) *testContext {
+		token := &oauth2.Token{
+			TokenType:   "bearer",
+			AccessToken: "access-token",
+		}
+		if idToken != "" {
+			token = token.WithExtra(map[string]interface{}{"id_token": idToken})
+		}
+
+		tc := setup()
+		tc.dataSourceCache.ds.JsonData = simplejson.NewFromAny(jsonData)
+		tc.oauthTokenService.passThruEnabled = true
+		tc.oauthTokenService.token = token
+		return tc
+	}
+
+	t.Run("it forwards the ID token in a custom header", func(t *testing.T) {
+		tc := setupIDToken(map[string]interface{}{"oauthIdTokenHeaderName": "X-Upstream-Identity"}, "id-token")
+
+		_, err := tc.queryService.QueryData(context.Background(), nil, true, metricRequest(), false)
+		require.NoError(t, err)
+
+		require.Equal(t, "Bearer access-token", tc.pluginContext.req.Headers["Authorization"])
+		require.Equal(t, "id-token", tc.pluginContext.req.Headers["X-Upstream-Identity"])
+		require.NotContains(t, tc.pluginContext.req.Headers, "X-ID-Token")
+	})
+
+	t.Run("it does not forward the ID token when disabled", func(t *testing.T) {
+		tc := setupIDToken(map[string]interface{}{"oauthPassThruIdToken": false}, "id-token")
+
+		_, err := tc.queryService.QueryData(context.Background(), nil, true, metricRequest(), false)
+		require.NoError(t, err)
+
+		require.Equal(t, "Bearer access-token", tc.pluginContext.req.Headers["Authorization"])
+		require.NotContains(t, tc.pluginContext.req.Headers, "X-ID-Token")
+	})
+
+	t.Run("it forwards only the access token when there is no ID token", func(t *testing.T) {
+		tc := setupIDToken(map[string]interface{}{}, "")
+
+		_, err := tc.queryService.QueryData(context.Background(), nil, true, metricRequest(), false)
+		require.NoError(t, err)
+
+		require.Equal(t, "Bearer access-token", tc.pluginContext.req.Headers["Authorization"])
+		require.NotContains(t, tc.pluginContext.req.Headers, "X-ID-Token")
+	})
+}
+
+func TestQueryDataOAuthPassThruHeader(t *testing.T) {
+	setupPassThru := func(jsonData map[string]interface{}) *testContext {
+		tc := setup()
+		tc.dataSourceCache.ds.JsonData = simplejson.NewFromAny(jsonData)
+		tc.oauthTokenService.passThruEnabled = true
+		tc.oauthTokenService.token = &oauth2.Token{TokenType: "bearer", AccessToken: "access-token"}
+		return tc
+	}
+
+	t.Run("it forwards the bare access token in a custom header", func(t *testing.T) {
+		tc := setupPassThru(map[string]interface{}{
+			"oauthPassThruHeaderName": "x-forwarded-access-token",
+			"oauthPassThruTokenType":  "none",
+		})
+
+		_, err := tc.queryService.QueryData(context.Background(), nil, true, metricRequest(), false)
+		require.NoError(t, err)
+
+		require.Equal(t, "access-token", tc.pluginContext.req.Headers["X-Forwarded-Access-Token"])
+		require.NotContains(t, tc.pluginContext.req.Headers, "Authorization")
+	})
+
+	t.Run("it forwards the access token with a custom token type", func(t *testing.T) {
+		tc := setupPassThru(map[string]interface{}{"oauthPassThruTokenType": "Token"})
+
+		_, err := tc.queryService.QueryData(context.Background(), nil, true, metricRequest(), false)
+		require.NoError(t, err)
+
+		require.Equal(t, "Token access-token", tc.pluginContext.req.Headers["Authorization"])
+	})
+
+	t.Run("it rejects reserved header names", func(t *testing.T) {
+		for _, name := range []string{"Content-Type", "x-grafana-user-login", "X-Request-Id", "X-ID-Token", "Bad Header"} {
+			tc := setupPassThru(map[string]interface{}{"oauthPassThruHeaderName": name})
+
+			_, err := tc.queryService.QueryData(context.Background(), nil, true, metricRequest(), false)
+			require.Error(t, err, name)
+			require.Nil(t, tc.pluginContext.req, name)
+		}
+	})
+}
+
+func TestOAuthPassThruHeaders(t *testing.T) {
+	t.Run("it returns the headers forwarding the tokens when pass-thru is enabled", func(t *testing.T) {
+		tc := setup()
+		tc.oauthTokenService.passThruEnabled = true
+		tc.oauthTokenService.token = (&oauth2.Token{TokenType: "Bearer", AccessToken: "access-token"}).WithExtra(map[string]interface{}{"id_token": "id-token"})
+
+		headers, err := tc.queryService.OAuthPassThruHeaders(context.Background(), nil, tc.dataSourceCache.ds, query.OAuthPassThruEndpointResource)
+		require.NoError(t, err)
+		require.Equal(t, map[string]string{"Authorization": "Bearer access-token", "X-ID-Token": "id-token"}, headers)
+	})
+
+	t.Run("it returns no headers when pass-thru is disabled", func(t *testing.T) {
+		tc := setup()
+		tc.oauthTokenService.token = &oauth2.Token{TokenType: "Bearer", AccessToken: "access-token"}
+
+		headers, err := tc.queryService.OAuthPassThruHeaders(context.Background(), nil, tc.dataSourceCache.ds, query.OAuthPassThruEndpointResource)
+		require.NoError(t, err)
+		require.Empty(t, headers)
+	})
+
+	t.Run("it returns the token refresh errors", func(t *testing.T) {
+		tc := setup()
+		tc.oauthTokenService.passThruEnabled = true
+		tc.oauthTokenService.err = oauthtoken.ErrTokenRefreshFailed
+
+		_, err := tc.queryService.OAuthPassThruHeaders(context.Background(), nil, tc.dataSourceCache.ds, query.OAuthPassThruEndpointResource)
+		require.True(t, errors.Is(err, oauthtoken.ErrTokenRefreshFailed))
+	})
+}
+
+func TestQueryDataUserIdentity(t *testing.T) {
+	user := &models.SignedInUser{
+		UserId:  1,
+		Login:   "alice\r\nX-Injected: true",
+		Email:   "alice@example.com",
+		OrgRole: models.ROLE_EDITOR,
+		Teams:   []int64{3, 7},
+	}
+
+	identityConfig := func() *setting.Cfg {
+		cfg := setting.NewCfg()
+		cfg.QueryForwardUserIdentity = true
+		return cfg
+	}
+
+	t.Run("it does not forward the user identity by default", func(t *testing.T) {
+		tc := setup()
+
+		_, err := tc.queryService.QueryData(context.Background(), user, true, metricRequest(), false)
+		require.NoError(t, err)
+
+		require.NotContains(t, tc.pluginContext.req.Headers, "X-Grafana-User-Login")
+		require.NotContains(t, tc.pluginContext.req.Headers, "X-Grafana-Org-Role")
+		require.NotContains(t, tc.pluginContext.req.Headers, "X-Grafana-User-Anonymous")
+	})
+
+	t.Run("it forwards the sanitized user identity when enabled", func(t *testing.T) {
+		tc := setupWithConfig(identityConfig())
+
+		_, err := tc.queryService.QueryData(context.Background(), user, true, metricRequest(), false)
+		require.NoError(t, err)
+
+		headers := tc.pluginContext.req.Headers
+		require.Equal(t, "aliceX-Injected: true", headers["X-Grafana-User-Login"])
+		require.Equal(t, "alice@example.com", headers["X-Grafana-User-Email"])
+		require.Equal(t, "Editor", headers["X-Grafana-Org-Role"])
+		require.Equal(t, "3,7", headers["X-Grafana-Teams"])
+		require.NotContains(t, headers, "X-Grafana-User-Anonymous")
+	})
+
+	t.Run("it forwards the user identity when enabled for the data source", func(t *testing.T) {
+		tc := setup()
+		tc.dataSourceCache.ds.JsonData = simplejson.NewFromAny(map[string]interface{}{"forwardUserIdentity": true})
+
+		_, err := tc.queryService.QueryData(context.Background(), user, true, metricRequest(), false)
+		require.NoError(t, err)
+
+		require.Equal(t, "Editor", tc.pluginContext.req.Headers["X-Grafana-Org-Role"])
+	})
+
+	t.Run("it does not forward the user identity when disabled for the data source", func(t *testing.T) {
+		tc := setupWithConfig(identityConfig())
+		tc.dataSourceCache.ds.JsonData = simplejson.NewFromAny(map[string]interface{}{"forwardUserIdentity": false})
+
+		_, err := tc.queryService.QueryData(context.Background(), user, true, metricRequest(), false)
+		require.NoError(t, err)
+
+		require.NotContains(t, tc.pluginContext.req.Headers, "X-Grafana-User-Login")
+	})
+
+	t.Run("it marks anonymous users", func(t *testing.T) {
+		tc := setupWithConfig(identityConfig())
+		anonymous := &models.SignedInUser{OrgId: 1, OrgRole: models.ROLE_VIEWER, IsAnonymous: true}
+
+		_, err := tc.queryService.QueryData(context.Background(), anonymous, true, metricRequest(), false)
+		require.NoError(t, err)
+
+		headers := tc.pluginContext.req.Headers
+		require.Equal(t, "true", headers["X-Grafana-User-Anonymous"])
+		require.Equal(t, "Viewer", headers["X-Grafana-Org-Role"])
+		require.NotContains(t, headers, "X-Grafana-User-Login")
+		require.NotContains(t, headers, "X-Grafana-User-Email")
+	})
+}
+
+func TestQueryDataOAuthTokenRefresh(t *testing.T) {
+	t.Run("it reports a failed token refresh for every query", func(t *testing.T) {
+		tc := setup()
+		tc.oauthTokenService.passThruEnabled = true
+		tc.oauthTokenService.err = fmt.Errorf("%w: invalid_grant", oauthtoken.ErrTokenRefreshFailed)
+
+		resp, err := tc.queryService.QueryData(context.Background(), nil, true, metricRequest(), false)
+		require.NoError(t, err)
+
+		var refreshErr *query.ErrOAuthTokenRefresh
+		require.True(t, errors.As(resp.Responses["A"].Error, &refreshErr))
+		require.True(t, errors.Is(resp.Responses["A"].Error, oauthtoken.ErrTokenRefreshFailed))
+		require.Nil(t, tc.pluginContext.req)
+	})
+
+	t.Run("it queries without a token when the user has none", func(t *testing.T) {
+		tc := setup()
+		tc.oauthTokenService.passThruEnabled = true
+
+		_, err := tc.queryService.QueryData(context.Background(), nil, true, metricRequest(), false)
+		require.NoError(t, err)
+		require.NotContains(t, tc.pluginContext.req.Headers, "Authorization")
+	})
+}
+
+func TestQueryDataOAuthIdentityRequired(t *testing.T) {
+	principals := map[string]*models.SignedInUser{
+		"an API key":        {OrgId: 1, ApiKeyId: 1, OrgRole: models.ROLE_VIEWER},
+		"a service account": {OrgId: 1, UserId: 2, Login: "sa-1", IsServiceAccount: true, OrgRole: models.ROLE_VIEWER},
+		"anonymous access":  {OrgId: 1, IsAnonymous: true, OrgRole: models.ROLE_VIEWER},
+	}
+
+	for principal, user := range principals {
+		t.Run(fmt.Sprintf("it rejects the queries made with %s", principal), func(t *testing.T) {
+			tc := setup()
+			tc.dataSourceCache.ds.Name = "Loki"
+			tc.oauthTokenService.passThruEnabled = true
+			tc.oauthTokenService.token = &oauth2.Token{TokenType: "Bearer", AccessToken: "access-token"}
+
+			resp, err := tc.queryService.QueryData(context.Background(), user, true, metricRequest(), false)
+			require.NoError(t, err)
+
+			var identityErr *query.ErrOAuthIdentityRequired
+			require.True(t, errors.As(resp.Responses["A"].Error, &identityErr))
+			require.Equal(t, principal, identityErr.Principal)
+			require.Equal(t, "Loki", identityErr.DatasourceName)
+			require.Nil(t, tc.pluginContext.req)
+		})
+	}
+
+	t.Run("it queries the other data sources", func(t *testing.T) {
+		tc := setupWithDataSources(
+			&models.DataSource{Uid: "ds-a", Type: "test", JsonData: simplejson.NewFromAny(map[string]interface{}{"oauthPassThru": true})},
+			&models.DataSource{Uid: "ds-b", Type: "test", JsonData: simplejson.New()},
+		)
+		req := expressionRequest(
+			`{"refId": "A", "datasource": {"uid": "ds-a"}}`,
+			`{"refId": "B", "datasource": {"uid": "ds-b"}}`,
+		)
+
+		resp, err := tc.queryService.QueryData(context.Background(), principals["an API key"], true, req, false)
+		require.NoError(t, err)
+
+		var identityErr *query.ErrOAuthIdentityRequired
+		require.True(t, errors.As(resp.Responses["A"].Error, &identityErr))
+		require.NoError(t, resp.Responses["B"].Error)
+		require.Equal(t, "ds-b", tc.pluginContext.req.PluginContext.DataSourceInstanceSettings.UID)
+	})
+
+	t.Run("it queries with signed in users", func(t *testing.T) {
+		tc := setup()
+		tc.oauthTokenService.passThruEnabled = true
+		tc.oauthTokenService.token = &oauth2.Token{TokenType: "Bearer", AccessToken: "access-token"}
+
+		_, err := tc.queryService.QueryData(context.Background(), &models.SignedInUser{OrgId: 1, UserId: 1, Login: "alice"}, true, metricRequest(), false)
+		require.NoError(t, err)
+		require.Equal(t, "Bearer access-token", tc.pluginContext.req.Headers["Authorization"])
+	})
+}
+
+func TestQueryDataOAuthRequiredScopes(t *testing.T) {
+	setupScopes := func(requiredScopes interface{}, grantedScope string) *testContext {
+		tc := setup()
+		tc.dataSourceCache.ds.Name = "Loki"
+		jsonData := map[string]interface{}{}
+		if requiredScopes != nil {
+			jsonData["requiredScopes"] = requiredScopes
+		}
+		tc.dataSourceCache.ds.JsonData = simplejson.NewFromAny(jsonData)
+		tc.oauthTokenService.passThruEnabled = true
+		tc.oauthTokenService.token = (&oauth2.Token{TokenType: "Bearer", AccessToken: "access-token"}).
+			WithExtra(map[string]interface{}{"scope": grantedScope})
+		return tc
+	}
+
+	t.Run("it forwards the token when it's granted the required scopes", func(t *testing.T) {
+		for _, required := range []interface{}{[]interface{}{"logs:read", "openid"}, "openid logs:read"} {
+			tc := setupScopes(required, "openid profile logs:read")
+
+			_, err := tc.queryService.QueryData(context.Background(), nil, true, metricRequest(), false)
+			require.NoError(t, err)
+			require.Equal(t, "Bearer access-token", tc.pluginContext.req.Headers["Authorization"])
+		}
+	})
+
+	t.Run("it reports the missing scopes for every query", func(t *testing.T) {
+		tc := setupScopes([]interface{}{"openid", "logs:read", "Logs:Write"}, "openid logs:write")
+
+		resp, err := tc.queryService.QueryData(context.Background(), nil, true, metricRequest(), false)
+		require.NoError(t, err)
+
+		var scopesErr *query.ErrOAuthScopesMissing
+		require.True(t, errors.As(resp.Responses["A"].Error, &scopesErr))
+		require.Equal(t, []string{"logs:read", "Logs:Write"}, scopesErr.MissingScopes)
+		require.Contains(t, scopesErr.Error(), "sign in again")
+		require.Nil(t, tc.pluginContext.req)
+	})
+
+	t.Run("it forwards the token when no scopes are required", func(t *testing.T) {
+		tc := setupScopes(nil, "")
+
+		_, err := tc.queryService.QueryData(context.Background(), nil, true, metricRequest(), false)
+		require.NoError(t, err)
+		require.Equal(t, "Bearer access-token", tc.pluginContext.req.Headers["Authorization"])
+	})
+}
+
+func TestQueryDataTracing(t *testing.T) {
+	t.Run("it records a span for the data source call", func(t *testing.T) {
+		tc := setup()
+		tc.dataSourceCache.ds.Uid = "ds-uid"
+		tc.dataSourceCache.ds.Type = "prometheus"
+
+		_, err := tc.queryService.QueryData(context.Background(), nil, true, metricRequest(), false)
+		require.NoError(t, err)
+
+		require.Len(t, tc.tracer.spans, 1)
+		span := tc.tracer.spans[0]
+		require.Equal(t, "query.QueryData", span.name)
+		require.True(t, span.ended)
+		require.Equal(t, "ds-uid", span.attributes["datasource.uid"])
+		require.Equal(t, "prometheus", span.attributes["datasource.type"])
+	})
+
+	t.Run("it propagates the incoming request ID", func(t *testing.T) {
+		tc := setup()
+
+		ctx := query.WithRequestID(context.Background(), "request-id")
+		_, err := tc.queryService.QueryData(ctx, nil, true, metricRequest(), false)
+		require.NoError(t, err)
+
+		require.Equal(t, "request-id", tc.pluginContext.req.Headers["X-Request-Id"])
+		require.Equal(t, "fake-trace", tc.pluginContext.req.Headers["Traceparent"])
+	})
+
+	t.Run("it generates a request ID when none is provided", func(t *testing.T) {
+		tc := setup()
+
+		_, err := tc.queryService.QueryData(context.Background(), nil, true, metricRequest(), false)
+		require.NoError(t, err)
+		first := tc.pluginContext.req.Headers["X-Request-Id"]
+		require.NotEmpty(t, first)
+
+		_, err = tc.queryService.QueryData(context.Background(), nil, true, metricRequest(), false)
+		require.NoError(t, err)
+		require.NotEqual(t, first, tc.pluginContext.req.Headers["X-Request-Id"])
+	})
+}
+
+func TestQueryDataExpressions(t *testing.T) {
+	user := &models.SignedInUser{OrgId: 1}
+
+	setupExpressions := func(enabled bool, frames map[string]*data.Frame) *testContext {
+		tc := setupWithFeatures(nil, featuremgmt.WithFeatures(featuremgmt.FlagQueryServiceExpressions, enabled))
+		tc.dataSourceCache.ds.Uid = "ds-uid"
+		tc.dataSourceCache.ds.Type = "test"
+		tc.pluginContext.queryDataFn = func(ctx context.Context, req *backend.QueryDataRequest) (*backend.QueryDataResponse, error) {
+			resp := backend.NewQueryDataResponse()
+			for _, q := range req.Queries {
+				resp.Responses[q.RefID] = backend.DataResponse{Frames: data.Frames{frames[q.RefID]}}
+			}
+			return resp, nil
+		}
+		return tc
+	}
+
+	t.Run("it reduces a data source query", func(t *testing.T) {
+		tc := setupExpressions(true, map[string]*data.Frame{
+			"A": data.NewFrame("",
+				data.NewField("time", nil, []time.Time{time.Unix(1, 0), time.Unix(2, 0), time.Unix(3, 0)}),
+				data.NewField("value", nil, []float64{1, 2, 3})),
+		})
+
+		req := expressionRequest(
+			`{"refId": "A", "datasource": {"uid": "ds-uid"}}`,
+			`{"refId": "B", "datasource": {"uid": "__expr__", "type": "__expr__"}, "type": "reduce", "expression": "A", "reducer": "sum"}`,
+		)
+		resp, err := tc.queryService.QueryData(context.Background(), user, true, req, true)
+		require.NoError(t, err)
+
+		require.Contains(t, resp.Responses, "A")
+		require.Equal(t, 6.0, numberValue(t, resp.Responses["B"]))
+		require.NotEmpty(t, tc.pluginContext.req.Headers["X-Request-Id"])
+	})
+
+	t.Run("it combines two data source queries with math", func(t *testing.T) {
+		tc := setupExpressions(true, map[string]*data.Frame{
+			"A": data.NewFrame("", data.NewField("value", nil, []float64{2})),
+			"B": data.NewFrame("", data.NewField("value", nil, []float64{3})),
+		})
+
+		req := expressionRequest(
+			`{"refId": "A", "datasource": {"uid": "ds-uid"}}`,
+			`{"refId": "B", "datasource": {"uid": "ds-uid"}}`,
+			`{"refId": "C", "datasource": {"uid": "__expr__", "type": "__expr__"}, "type": "math", "expression": "$A + $B"}`,
+		)
+		resp, err := tc.queryService.QueryData(context.Background(), user, true, req, true)
+		require.NoError(t, err)
+
+		require.Equal(t, 5.0, numberValue(t, resp.Responses["C"]))
+		require.Len(t, tc.pluginContext.req.Queries, 2)
+	})
+
+	t.Run("it rejects expressions with cyclic dependencies", func(t *testing.T) {
+		tc := setupExpressions(true, map[string]*data.Frame{})
+
+		req := expressionRequest(
+			`{"refId": "A", "datasource": {"uid": "ds-uid"}}`,
+			`{"refId": "B", "datasource": {"uid": "__expr__", "type": "__expr__"}, "type": "math", "expression": "$A + $C"}`,
+			`{"refId": "C", "datasource": {"uid": "__expr__", "type": "__expr__"}, "type": "math", "expression": "$B * 2"}`,
+		)
+		_, err := tc.queryService.QueryData(context.Background(), user, true, req, true)
+
+		var badQuery *query.ErrBadQuery
+		require.True(t, errors.As(err, &badQuery))
+		require.Nil(t, tc.pluginContext.req)
+	})
+
+	t.Run("it lets the expression engine query data sources when disabled", func(t *testing.T) {
+		tc := setupExpressions(false, map[string]*data.Frame{
+			"A": data.NewFrame("", data.NewField("value", nil, []float64{2})),
+		})
+
+		req := expressionRequest(
+			`{"refId": "A", "datasource": {"uid": "ds-uid"}}`,
+			`{"refId": "B", "datasource": {"uid": "__expr__", "type": "__expr__"}, "type": "math", "expression": "$A * 2"}`,
+		)
+		resp, err := tc.queryService.QueryData(context.Background(), user, true, req, true)
+		require.NoError(t, err)
+
+		require.Equal(t, 4.0, numberValue(t, resp.Responses["B"]))
+		require.NotContains(t, tc.pluginContext.req.Headers, "X-Request-Id")
+	})
+}
+
+func TestQueryDataMixedDataSources(t *testing.T) {
+	mixedRequest := func() dtos.MetricRequest {
+		return expressionRequest(
+			`{"refId": "A", "datasource": {"uid": "ds-a"}}`,
+			`{"refId": "B", "datasource": {"uid": "ds-b"}}`,
+			`{"refId": "C", "datasource": {"uid": "ds-a"}}`,
+		)
+	}
+
+	setupMixed := func(cfg *setting.Cfg, queryDataFn func(ctx context.Context, req *backend.QueryDataRequest) (*backend.QueryDataResponse, error)) *testContext {
+		tc := setupWithConfig(cfg)
+		tc.dataSourceCache.byUID = map[string]*models.DataSource{
+			"ds-a": {Uid: "ds-a", Type: "test"},
+			"ds-b": {Uid: "ds-b", Type: "test"},
+		}
+		tc.pluginContext.queryDataFn = queryDataFn
+		return tc
+	}
+
+	t.Run("it looks up and decrypts each data source once per request", func(t *testing.T) {
+		tc := setupMixed(nil, echoDataSourceUIDs)
+		tc.dataSourceCache.ds = tc.dataSourceCache.byUID["ds-a"]
+		var queries []string
+		for i := 0; i < 10; i++ {
+			switch i % 3 {
+			case 0:
+				queries = append(queries, fmt.Sprintf(`{"refId": "A%d", "datasource": {"uid": "ds-a"}}`, i))
+			case 1:
+				queries = append(queries, fmt.Sprintf(`{"refId": "B%d", "datasource": {"uid": "ds-b"}}`, i))
+			default:
+				queries = append(queries, fmt.Sprintf(`{"refId": "C%d", "datasourceId": 1}`, i))
+			}
+		}
+
+		resp, err := tc.queryService.QueryData(context.Background(), nil, true, expressionRequest(queries...), false)
+		require.NoError(t, err)
+		require.Len(t, resp.Responses, 10)
+
+		require.Equal(t, map[string]int{"uid:ds-a": 1, "uid:ds-b": 1, "id:1": 1}, tc.dataSourceCache.lookups)
+		require.Equal(t, 2, tc.secretService.decryptions)
+
+		// Every request resolves the data sources again.
+		_, err = tc.queryService.QueryData(context.Background(), nil, true, expressionRequest(queries...), false)
+		require.NoError(t, err)
+		require.Equal(t, map[string]int{"uid:ds-a": 2, "uid:ds-b": 2, "id:1": 2}, tc.dataSourceCache.lookups)
+		require.Equal(t, 4, tc.secretService.decryptions)
+	})
+
+	t.Run("it queries the data sources concurrently", func(t *testing.T) {
+		tc := setupMixed(nil, func(ctx context.Context, req *backend.QueryDataRequest) (*backend.QueryDataResponse, error) {
+			time.Sleep(200 * time.Millisecond)
+			return echoDataSourceUIDs(ctx, req)
+		})
+
+		start := time.Now()
+		resp, err := tc.queryService.QueryData(context.Background(), nil, true, mixedRequest(), false)
+		elapsed := time.Since(start)
+		require.NoError(t, err)
+
+		require.True(t, elapsed < 390*time.Millisecond, "expected concurrent queries, took %s", elapsed)
+		require.Len(t, resp.Responses, 3)
+		require.Equal(t, "ds-a", resp.Responses["A"].Frames[0].Name)
+		require.Equal(t, "ds-b", resp.Responses["B"].Frames[0].Name)
+		require.Equal(t, "ds-a", resp.Responses["C"].Frames[0].Name)
+	})
+
+	t.Run("it limits the number of data sources queried concurrently", func(t *testing.T) {
+		cfg := setting.NewCfg()
+		cfg.QueryMaxConcurrentDataSources = 1
+
+		var mu sync.Mutex
+		inFlight, maxInFlight := 0, 0
+		tc := setupMixed(cfg, func(ctx context.Context, req *backend.QueryDataRequest) (*backend.QueryDataResponse, error) {
+			mu.Lock()
+			inFlight++
+			if inFlight > maxInFlight {
+				maxInFlight = inFlight
+			}
+			mu.Unlock()
+
+			time.Sleep(50 * time.Millisecond)
+
+			mu.Lock()
+			inFlight--
+			mu.Unlock()
+			return echoDataSourceUIDs(ctx, req)
+		})
+
+		resp, err := tc.queryService.QueryData(context.Background(), nil, true, mixedRequest(), false)
+		require.NoError(t, err)
+		require.Len(t, resp.Responses, 3)
+		require.Equal(t, 1, maxInFlight)
+	})
+
+	t.Run("it reports the quota of a data source for each of its queries", func(t *testing.T) {
+		cfg := setting.NewCfg()
+		cfg.QueryDataSourceMaxPerMinute = 1
+		tc := setupMixed(cfg, func(ctx context.Context, req *backend.QueryDataRequest) (*backend.QueryDataResponse, error) {
+			return echoDataSourceUIDs(ctx, req)
+		})
+		_, err := tc.queryService.QueryData(context.Background(), nil, true, expressionRequest(`{"refId": "B", "datasource": {"uid": "ds-b"}}`), false)
+		require.NoError(t, err)
+
+		resp, err := tc.queryService.QueryData(context.Background(), nil, true, mixedRequest(), false)
+		require.NoError(t, err)
+
+		var quotaErr *query.ErrQuotaExceeded
+		require.True(t, errors.As(resp.Responses["B"].Error, &quotaErr))
+		require.Equal(t, "ds-b", quotaErr.DatasourceUID)
+		require.True(t, quotaErr.RetryAfter > 0)
+		require.Equal(t, "ds-a", resp.Responses["A"].Frames[0].Name)
+		require.Equal(t, "ds-a", resp.Responses["C"].Frames[0].Name)
+	})
+
+	t.Run("it reports the full query queue for each query of the data source left out", func(t *testing.T) {
+		cfg := setting.NewCfg()
+		cfg.QueryMaxConcurrentRequests = 1
+		cfg.QueryMaxQueueTime = 10 * time.Millisecond
+		cfg.QueryMaxQueuedRequests = 1
+		tc := setupMixed(cfg, func(ctx context.Context, req *backend.QueryDataRequest) (*backend.QueryDataResponse, error) {
+			time.Sleep(100 * time.Millisecond)
+			return echoDataSourceUIDs(ctx, req)
+		})
+
+		resp, err := tc.queryService.QueryData(context.Background(), nil, true, mixedRequest(), false)
+		require.NoError(t, err)
+
+		// Whichever data source is queried first, the other one times out in the queue.
+		queued := "B"
+		if resp.Responses["B"].Error == nil {
+			queued = "A"
+			require.Equal(t, resp.Responses["A"].Error, resp.Responses["C"].Error)
+		}
+		var queueFull *query.ErrQueryQueueFull
+		require.True(t, errors.As(resp.Responses[queued].Error, &queueFull))
+		require.Equal(t, 10*time.Millisecond, queueFull.Waited)
+		require.Equal(t, time.Second, queueFull.RetryAfter)
+	})
+
+	t.Run("it returns the other responses when a data source fails", func(t *testing.T) {
+		tc := setupMixed(nil, func(ctx context.Context, req *backend.QueryDataRequest) (*backend.QueryDataResponse, error) {
+			if req.PluginContext.DataSourceInstanceSettings.UID == "ds-b" {
+				return nil, errors.New("plugin unavailable")
+			}
+			time.Sleep(50 * time.Millisecond)
+			return echoDataSourceUIDs(ctx, req)
+		})
+
+		resp, err := tc.queryService.QueryData(context.Background(), nil, true, mixedRequest(), false)
+		require.NoError(t, err)
+
+		require.EqualError(t, resp.Responses["B"].Error, "plugin unavailable")
+		require.NoError(t, resp.Responses["A"].Error)
+		require.Equal(t, "ds-a", resp.Responses["A"].Frames[0].Name)
+		require.Equal(t, "ds-a", resp.Responses["C"].Frames[0].Name)
+	})
+}
+
+func TestQueryDataStream(t *testing.T) {
+	setupStream := func(queryDataFn func(ctx context.Context, req *backend.QueryDataRequest) (*backend.QueryDataResponse, error)) *testContext {
+		tc := setupWithDataSources(
+			&models.DataSource{Uid: "ds-slow", Type: "test"},
+			&models.DataSource{Uid: "ds-fast", Type: "test"},
+		)
+		tc.pluginContext.queryDataFn = queryDataFn
+		return tc
+	}
+
+	respond := func(ctx context.Context, req *backend.QueryDataRequest) (*backend.QueryDataResponse, error) {
+		uid := req.PluginContext.DataSourceInstanceSettings.UID
+		if uid == "ds-slow" {
+			time.Sleep(100 * time.Millisecond)
+		}
+		resp := backend.NewQueryDataResponse()
+		for _, q := range req.Queries {
+			resp.Responses[q.RefID] = backend.DataResponse{Frames: data.Frames{data.NewFrame(uid)}}
+		}
+		return resp, nil
+	}
+
+	t.Run("it sends the responses of each data source as soon as it answered", func(t *testing.T) {
+		tc := setupStream(respond)
+		req := expressionRequest(
+			`{"refId": "A", "datasource": {"uid": "ds-slow"}}`,
+			`{"refId": "B", "datasource": {"uid": "ds-fast"}}`,
+			`{"refId": "C", "datasource": {"uid": "ds-slow"}}`,
+		)
+
+		var sent []backend.Responses
+		err := tc.queryService.QueryDataStream(context.Background(), nil, true, req, true, func(responses backend.Responses) error {
+			sent = append(sent, responses)
+			return nil
+		})
+		require.NoError(t, err)
+
+		require.Len(t, sent, 2)
+		require.Len(t, sent[0], 1)
+		require.Equal(t, "ds-fast", sent[0]["B"].Frames[0].Name)
+		require.Len(t, sent[1], 2)
+		require.Equal(t, "ds-slow", sent[1]["A"].Frames[0].Name)
+		require.Equal(t, "ds-slow", sent[1]["C"].Frames[0].Name)
+	})
+
+	t.Run("it returns the error of a single data source without sending anything", func(t *testing.T) {
+		tc := setupStream(respond)
+		tc.pluginRequestValidator.err = errors.New("not allowed")
+
+		called := false
+		err := tc.queryService.QueryDataStream(context.Background(), nil, true, expressionRequest(`{"refId": "A", "datasource": {"uid": "ds-fast"}}`), true, func(responses backend.Responses) error {
+			called = true
+			return nil
+		})
+		require.True(t, errors.Is(err, models.ErrDataSourceAccessDenied))
+		require.False(t, called)
+	})
+
+	t.Run("it stops querying when sending fails", func(t *testing.T) {
+		tc := setupStream(respond)
+		req := expressionRequest(
+			`{"refId": "A", "datasource": {"uid": "ds-slow"}}`,
+			`{"refId": "B", "datasource": {"uid": "ds-fast"}}`,
+		)
+
+		sendErr := errors.New("connection reset")
+		calls := 0
+		err := tc.queryService.QueryDataStream(context.Background(), nil, true, req, true, func(responses backend.Responses) error {
+			calls++
+			return sendErr
+		})
+		require.True(t, errors.Is(err, sendErr))
+		require.Equal(t, 1, calls)
+	})
+}
+
+func TestQueryDataDataSourceByName(t *testing.T) {
+	setupNamed := func() *testContext {
+		tc := setup()
+		tc.dataSourceCache.byUID = map[string]*models.DataSource{
+			"ds-a": {Uid: "ds-a", Name: "Loki", Type: "test"},
+		}
+		tc.dataSourceCache.byName = map[string]*models.DataSource{
+			"Prometheus": {Uid: "ds-b", Name: "Prometheus", Type: "test"},
+		}
+		tc.dataSourceCache.defaultDS = &models.DataSource{Uid: "ds-c", Name: "Graphite", Type: "test"}
+		tc.dataSourceCache.ambiguous = map[string]bool{"loki": true}
+		tc.dataSourceCache.missing = map[string]bool{"Graphite": true}
+		tc.pluginContext.queryDataFn = echoDataSourceUIDs
+		return tc
+	}
+
+	t.Run("it resolves a data source referenced by name", func(t *testing.T) {
+		tc := setupNamed()
+
+		resp, err := tc.queryService.QueryData(context.Background(), nil, true, expressionRequest(`{"refId": "A", "datasource": "Prometheus"}`), false)
+		require.NoError(t, err)
+
+		frame := resp.Responses["A"].Frames[0]
+		require.Equal(t, "ds-b", frame.Name)
+		require.Len(t, frame.Meta.Notices, 1)
+		require.Equal(t, data.NoticeSeverityWarning, frame.Meta.Notices[0].Severity)
+		require.Contains(t, frame.Meta.Notices[0].Text, "deprecated")
+	})
+
+	t.Run("it resolves the default keyword to the default data source", func(t *testing.T) {
+		tc := setupNamed()
+
+		resp, err := tc.queryService.QueryData(context.Background(), nil, true, expressionRequest(`{"refId": "A", "datasource": "default"}`), false)
+		require.NoError(t, err)
+
+		frame := resp.Responses["A"].Frames[0]
+		require.Equal(t, "ds-c", frame.Name)
+		require.Len(t, frame.Meta.Notices, 1)
+	})
+
+	t.Run("it does not add a notice when the string is a uid", func(t *testing.T) {
+		tc := setupNamed()
+
+		resp, err := tc.queryService.QueryData(context.Background(), nil, true, expressionRequest(`{"refId": "A", "datasource": "ds-a"}`), false)
+		require.NoError(t, err)
+
+		frame := resp.Responses["A"].Frames[0]
+		require.Equal(t, "ds-a", frame.Name)
+		require.Nil(t, frame.Meta)
+	})
+
+	t.Run("it keeps resolving data sources referenced with an object", func(t *testing.T) {
+		tc := setupNamed()
+
+		resp, err := tc.queryService.QueryData(context.Background(), nil, true, expressionRequest(`{"refId": "A", "datasource": {"uid": "ds-a"}}`), false)
+		require.NoError(t, err)
+
+		frame := resp.Responses["A"].Frames[0]
+		require.Equal(t, "ds-a", frame.Name)
+		require.Nil(t, frame.Meta)
+	})
+
+	t.Run("it returns a bad query error for an unknown name", func(t *testing.T) {
+		tc := setupNamed()
+
+		_, err := tc.queryService.QueryData(context.Background(), nil, true, expressionRequest(`{"refId": "A", "datasource": "Graphite"}`), false)
+		var badQuery *query.ErrBadQuery
+		require.True(t, errors.As(err, &badQuery))
+		require.Equal(t, `data source "Graphite" not found`, badQuery.Message)
+	})
+
+	t.Run("it returns a bad query error for an ambiguous name", func(t *testing.T) {
+		tc := setupNamed()
+
+		_, err := tc.queryService.QueryData(context.Background(), nil, true, expressionRequest(`{"refId": "A", "datasource": "loki"}`), false)
+		var badQuery *query.ErrBadQuery
+		require.True(t, errors.As(err, &badQuery))
+		require.Contains(t, badQuery.Message, "matches more than one data source")
+	})
+
+	t.Run("it returns a bad query error when there is no default data source", func(t *testing.T) {
+		tc := setupNamed()
+		tc.dataSourceCache.defaultDS = nil
+
+		_, err := tc.queryService.QueryData(context.Background(), nil, true, expressionRequest(`{"refId": "A", "datasource": "default"}`), false)
+		var badQuery *query.ErrBadQuery
+		require.True(t, errors.As(err, &badQuery))
+	})
+}
+
+func TestQueryDataRefIDs(t *testing.T) {
+	noticeTexts := func(res backend.DataResponse) []string {
+		var texts []string
+		if res.Frames[0].Meta != nil {
+			for _, n := range res.Frames[0].Meta.Notices {
+				texts = append(texts, n.Text)
+			}
+		}
+		return texts
+	}
+
+	t.Run("it rejects duplicate refIds before querying", func(t *testing.T) {
+		tc := setupEcho()
+
+		_, err := tc.queryService.QueryData(context.Background(), nil, true, expressionRequest(
+			`{"refId": "A", "datasourceId": 1}`,
+			`{"refId": "B", "datasourceId": 1}`,
+			`{"refId": "A", "datasourceId": 1}`,
+			`{"refId": "B", "datasourceId": 1}`,
+			`{"refId": "A", "datasourceId": 1}`,
+		), false)
+
+		var badQuery *query.ErrBadQuery
+		require.True(t, errors.As(err, &badQuery))
+		require.Equal(t, "duplicate refIds in queries: A, B", badQuery.Message)
+		require.Nil(t, tc.pluginContext.req)
+	})
+
+	t.Run("it assigns refIds to queries without one", func(t *testing.T) {
+		tc := setupEcho()
+
+		resp, err := tc.queryService.QueryData(context.Background(), nil, true, expressionRequest(
+			`{"datasourceId": 1}`,
+			`{"refId": "", "datasourceId": 1}`,
+		), false)
+		require.NoError(t, err)
+
+		require.Len(t, resp.Responses, 2)
+		require.Equal(t, []string{"Query had no refId and was assigned refId A"}, noticeTexts(resp.Responses["A"]))
+		require.Equal(t, []string{"Query had no refId and was assigned refId B"}, noticeTexts(resp.Responses["B"]))
+		require.JSONEq(t, `{"refId": "A", "datasourceId": 1}`, string(tc.pluginContext.req.Queries[0].JSON))
+	})
+
+	t.Run("it assigns unused refIds when some queries have one", func(t *testing.T) {
+		tc := setupEcho()
+
+		resp, err := tc.queryService.QueryData(context.Background(), nil, true, expressionRequest(
+			`{"datasourceId": 1}`,
+			`{"refId": "A", "datasourceId": 1}`,
+			`{"datasourceId": 1}`,
+			`{"refId": "C", "datasourceId": 1}`,
+		), false)
+		require.NoError(t, err)
+
+		require.Len(t, resp.Responses, 4)
+		require.Empty(t, noticeTexts(resp.Responses["A"]))
+		require.Equal(t, []string{"Query had no refId and was assigned refId B"}, noticeTexts(resp.Responses["B"]))
+		require.Empty(t, noticeTexts(resp.Responses["C"]))
+		require.Equal(t, []string{"Query had no refId and was assigned refId D"}, noticeTexts(resp.Responses["D"]))
+	})
+}
+
+func TestQueryDataTimezone(t *testing.T) {
+	todayRequest := func(timezone string) dtos.MetricRequest {
+		req := metricRequest()
+		req.From = "now/d"
+		req.To = "now/d"
+		req.Timezone = timezone
+		return req
+	}
+
+	t.Run("it resolves relative ranges in UTC by default", func(t *testing.T) {
+		tc := setup()
+
+		_, err := tc.queryService.QueryData(context.Background(), nil, true, todayRequest(""), false)
+		require.NoError(t, err)
+
+		tr := tc.pluginContext.req.Queries[0].TimeRange
+		require.Equal(t, 0, tr.From.Hour())
+		require.Equal(t, 24*time.Hour-time.Millisecond, tr.To.Sub(tr.From))
+	})
+
+	t.Run("it resolves relative ranges in the time zone of the request", func(t *testing.T) {
+		tc := setup()
+
+		_, err := tc.queryService.QueryData(context.Background(), nil, true, todayRequest("Asia/Tokyo"), false)
+		require.NoError(t, err)
+
+		// Asia/Tokyo is UTC+9 all year, its days start at 15:00 UTC.
+		tr := tc.pluginContext.req.Queries[0].TimeRange
+		require.Equal(t, time.UTC, tr.From.Location())
+		require.Equal(t, 15, tr.From.Hour())
+		require.Equal(t, 24*time.Hour-time.Millisecond, tr.To.Sub(tr.From))
+	})
+
+	t.Run("it returns a bad query error for an invalid time zone", func(t *testing.T) {
+		tc := setup()
+
+		_, err := tc.queryService.QueryData(context.Background(), nil, true, todayRequest("Mars/Olympus_Mons"), false)
+		var badQuery *query.ErrBadQuery
+		require.True(t, errors.As(err, &badQuery))
+		require.Equal(t, `invalid timezone "Mars/Olympus_Mons"`, badQuery.Message)
+	})
+}
+
+func TestQueryDataDefaultInterval(t *testing.T) {
+	rangeRequest := func(length time.Duration, query string) dtos.MetricRequest {
+		q, _ := simplejson.NewJson([]byte(query))
+		from := int64(1600000000000)
+		return dtos.MetricRequest{
+			From:    strconv.FormatInt(from, 10),
+			To:      strconv.FormatInt(from+length.Milliseconds(), 10),
+			Queries: []*simplejson.Json{q},
+		}
+	}
+
+	day := 24 * time.Hour
+	tests := []struct {
+		desc        string
+		length      time.Duration
+		query       string
+		minInterval time.Duration
+		dsInterval  string
+		expected    time.Duration
+	}{
+		{desc: "5 minutes", length: 5 * time.Minute, expected: 200 * time.Millisecond},
+		{desc: "1 hour", length: time.Hour, expected: 2 * time.Second},
+		{desc: "6 hours", length: 6 * time.Hour, expected: 15 * time.Second},
+		{desc: "1 day", length: day, expected: time.Minute},
+		{desc: "7 days", length: 7 * day, expected: 5 * time.Minute},
+		{desc: "30 days", length: 30 * day, expected: 30 * time.Minute},
+		{desc: "90 days", length: 90 * day, expected: time.Hour},
+		{desc: "1 day with max data points", length: day, query: `{"refId":"A","datasourceId":1,"maxDataPoints":100}`, expected: 15 * time.Minute},
+		{desc: "1 hour with a global minimum interval", length: time.Hour, minInterval: time.Minute, expected: time.Minute},
+		{desc: "1 hour with a data source minimum interval", length: time.Hour, dsInterval: "30s", expected: 30 * time.Second},
+		{desc: "90 days with a data source minimum interval", length: 90 * day, dsInterval: ">30s", expected: time.Hour},
+		{desc: "5 minutes with an interval", length: 5 * time.Minute, query: `{"refId":"A","datasourceId":1,"intervalMs":5000}`, expected: 5 * time.Second},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			cfg := setting.NewCfg()
+			cfg.QueryMinInterval = tt.minInterval
+			tc := setupWithConfig(cfg)
+			if tt.dsInterval != "" {
+				tc.dataSourceCache.ds = &models.DataSource{JsonData: simplejson.NewFromAny(map[string]interface{}{"timeInterval": tt.dsInterval})}
+			}
+			query := tt.query
+			if query == "" {
+				query = `{"refId":"A","datasourceId":1}`
+			}
+
+			_, err := tc.queryService.QueryData(context.Background(), nil, true, rangeRequest(tt.length, query), false)
+			require.NoError(t, err)
+
+			q := tc.pluginContext.req.Queries[0]
+			require.Equal(t, tt.expected, q.Interval)
+			model, err := simplejson.NewJson(q.JSON)
+			require.NoError(t, err)
+			require.Equal(t, tt.expected.Milliseconds(), model.Get("intervalMs").MustInt64())
+		})
+	}
+
+	t.Run("it does not compute an interval without time range", func(t *testing.T) {
+		tc := setup()
+
 		_, err := tc.queryService.QueryData(context.Background(), nil, true, metricRequest(), false)
-		require.Nil(t, err)
+		require.NoError(t, err)
+
+		q := tc.pluginContext.req.Queries[0]
+		require.Equal(t, time.Second, q.Interval)
+		require.JSONEq(t, `{"refId":"A","datasourceId":1}`, string(q.JSON))
+	})
+}
+
+func TestQueryDataHiddenQueries(t *testing.T) {
+	sentRefIDs := func(tc *testContext) []string {
+		var refIDs []string
+		for _, q := range tc.pluginContext.req.Queries {
+			refIDs = append(refIDs, q.RefID)
+		}
+		return refIDs
+	}
+
+	isSkipped := func(res backend.DataResponse) bool {
+		return len(res.Frames) == 1 && res.Frames[0].Meta != nil && res.Frames[0].Meta.Custom.(map[string]interface{})["skipped"] == true
+	}
+
+	t.Run("it does not execute hidden queries", func(t *testing.T) {
+		tc := setupEcho()
+
+		resp, err := tc.queryService.QueryData(context.Background(), nil, true, expressionRequest(
+			`{"refId": "A", "datasourceId": 1}`,
+			`{"refId": "B", "datasourceId": 1, "hide": true}`,
+			`{"refId": "C", "datasourceId": 1, "hide": false}`,
+		), false)
+		require.NoError(t, err)
+
+		require.Equal(t, []string{"A", "C"}, sentRefIDs(tc))
+		require.Len(t, resp.Responses, 3)
+		require.False(t, isSkipped(resp.Responses["A"]))
+		require.True(t, isSkipped(resp.Responses["B"]))
+		require.False(t, isSkipped(resp.Responses["C"]))
+	})
+
+	t.Run("it does not query the data source when all queries are hidden", func(t *testing.T) {
+		tc := setupEcho()
+
+		resp, err := tc.queryService.QueryData(context.Background(), nil, true, expressionRequest(
+			`{"refId": "A", "datasourceId": 1, "hide": true}`,
+		), false)
+		require.NoError(t, err)
+
+		require.Nil(t, tc.pluginContext.req)
+		require.True(t, isSkipped(resp.Responses["A"]))
+	})
+
+	t.Run("it executes hidden queries when requested", func(t *testing.T) {
+		tc := setupEcho()
+
+		resp, err := tc.queryService.QueryData(query.WithIncludeHidden(context.Background()), nil, true, expressionRequest(
+			`{"refId": "A", "datasourceId": 1}`,
+			`{"refId": "B", "datasourceId": 1, "hide": true}`,
+		), false)
+		require.NoError(t, err)
+
+		require.Equal(t, []string{"A", "B"}, sentRefIDs(tc))
+		require.False(t, isSkipped(resp.Responses["B"]))
+	})
+
+	t.Run("it sends the skipped queries last when streaming", func(t *testing.T) {
+		tc := setupEcho()
+
+		var sent []backend.Responses
+		err := tc.queryService.QueryDataStream(context.Background(), nil, true, expressionRequest(
+			`{"refId": "A", "datasourceId": 1}`,
+			`{"refId": "B", "datasourceId": 1, "hide": true}`,
+		), true, func(responses backend.Responses) error {
+			sent = append(sent, responses)
+			return nil
+		})
+		require.NoError(t, err)
+
+		require.Equal(t, []string{"A"}, sentRefIDs(tc))
+		require.Len(t, sent, 2)
+		require.Contains(t, sent[0], "A")
+		require.True(t, isSkipped(sent[1]["B"]))
+	})
+}
+
+func TestQueryDataDataSourceOverride(t *testing.T) {
+	setupOverride := func() *testContext {
+		tc := setupWithDataSources(
+			&models.DataSource{Uid: "prom-dev", Type: "prometheus"},
+			&models.DataSource{Uid: "prom-prod", Type: "prometheus"},
+			&models.DataSource{Uid: "loki", Type: "loki"},
+		)
+		tc.dataSourceCache.missing = map[string]bool{"missing": true}
+		return tc
+	}
+
+	overrideRequest := func(uid string, queries ...string) dtos.MetricRequest {
+		req := expressionRequest(queries...)
+		req.DatasourceUID = uid
+		return req
+	}
+
+	t.Run("it queries the data source of the same type instead", func(t *testing.T) {
+		tc := setupOverride()
+
+		_, err := tc.queryService.QueryData(context.Background(), nil, true, overrideRequest("prom-prod",
+			`{"refId": "A", "datasource": {"uid": "prom-dev", "type": "prometheus"}, "expr": "up"}`,
+			`{"refId": "B", "datasource": {"uid": "prom-dev", "type": "prometheus"}, "expr": "rate(x[5m])"}`,
+		), false)
+		require.NoError(t, err)
+
+		require.Equal(t, "prom-prod", tc.pluginContext.req.PluginContext.DataSourceInstanceSettings.UID)
+		require.Len(t, tc.pluginContext.req.Queries, 2)
+		require.JSONEq(t, `{"refId": "A", "datasource": {"uid": "prom-prod", "type": "prometheus"}, "expr": "up"}`, string(tc.pluginContext.req.Queries[0].JSON))
+	})
+
+	t.Run("it rejects a data source of another type", func(t *testing.T) {
+		tc := setupOverride()
+
+		_, err := tc.queryService.QueryData(context.Background(), nil, true, overrideRequest("loki",
+			`{"refId": "A", "datasource": {"uid": "prom-dev", "type": "prometheus"}, "expr": "up"}`,
+		), false)
+
+		var badQuery *query.ErrBadQuery
+		require.True(t, errors.As(err, &badQuery))
+		require.Equal(t, "data source loki of type loki can't replace data source prom-dev of type prometheus in query A", badQuery.Message)
+		require.Nil(t, tc.pluginContext.req)
+	})
+
+	t.Run("it rejects an unknown data source", func(t *testing.T) {
+		tc := setupOverride()
+
+		_, err := tc.queryService.QueryData(context.Background(), nil, true, overrideRequest("missing",
+			`{"refId": "A", "datasource": {"uid": "prom-dev", "type": "prometheus"}, "expr": "up"}`,
+		), false)
+
+		var badQuery *query.ErrBadQuery
+		require.True(t, errors.As(err, &badQuery))
+		require.Nil(t, tc.pluginContext.req)
+	})
+}
+
+func TestQueryDataPluginContextAttrs(t *testing.T) {
+	setupAttrs := func() *testContext {
+		return setupWithDataSources(
+			&models.DataSource{Uid: "internal", Type: "internal", JsonData: simplejson.NewFromAny(map[string]interface{}{
+				"allowedPluginContextAttrs": []interface{}{"samplingLevel", "costBudget"},
+			})},
+			&models.DataSource{Uid: "prom", Type: "prometheus"},
+		)
+	}
+
+	attrsRequest := func(attrs map[string]string, queries ...string) dtos.MetricRequest {
+		req := expressionRequest(queries...)
+		req.PluginContextAttrs = attrs
+		return req
+	}
+
+	t.Run("it forwards the allowed attributes in headers", func(t *testing.T) {
+		tc := setupAttrs()
+
+		_, err := tc.queryService.QueryData(context.Background(), nil, true, attrsRequest(
+			map[string]string{"samplingLevel": "low", "costBudget": "100"},
+			`{"refId": "A", "datasource": {"uid": "internal"}}`,
+		), false)
+		require.NoError(t, err)
+
+		require.Equal(t, "low", tc.pluginContext.req.Headers["X-Grafana-Ctx-samplingLevel"])
+		require.Equal(t, "100", tc.pluginContext.req.Headers["X-Grafana-Ctx-costBudget"])
+	})
+
+	t.Run("it only forwards the attributes to the data sources allowing them", func(t *testing.T) {
+		tc := setupAttrs()
+		var mu sync.Mutex
+		headers := map[string]map[string]string{}
+		tc.pluginContext.queryDataFn = func(ctx context.Context, req *backend.QueryDataRequest) (*backend.QueryDataResponse, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			headers[req.PluginContext.DataSourceInstanceSettings.UID] = req.Headers
+			return backend.NewQueryDataResponse(), nil
+		}
+
+		_, err := tc.queryService.QueryData(context.Background(), nil, true, attrsRequest(
+			map[string]string{"samplingLevel": "low"},
+			`{"refId": "A", "datasource": {"uid": "internal"}}`,
+			`{"refId": "B", "datasource": {"uid": "prom"}}`,
+		), false)
+		require.NoError(t, err)
+
+		require.Equal(t, "low", headers["internal"]["X-Grafana-Ctx-samplingLevel"])
+		require.NotContains(t, headers["prom"], "X-Grafana-Ctx-samplingLevel")
+	})
+
+	t.Run("it rejects attributes no data source allows", func(t *testing.T) {
+		tc := setupAttrs()
+
+		_, err := tc.queryService.QueryData(context.Background(), nil, true, attrsRequest(
+			map[string]string{"samplingLevel": "low", "Authorization": "Bearer smuggled"},
+			`{"refId": "A", "datasource": {"uid": "internal"}}`,
+		), false)
+
+		var badQuery *query.ErrBadQuery
+		require.True(t, errors.As(err, &badQuery))
+		require.Equal(t, `plugin context attribute "Authorization" is not allowed by the data sources of the queries`, badQuery.Message)
+		require.Nil(t, tc.pluginContext.req)
+	})
+
+	t.Run("it rejects oversized attribute sets", func(t *testing.T) {
+		tooMany := map[string]string{}
+		for i := 0; i < 17; i++ {
+			tooMany[fmt.Sprintf("attr%d", i)] = "value"
+		}
+
+		for _, attrs := range []map[string]string{
+			tooMany,
+			{"samplingLevel": strings.Repeat("x", 257)},
+			{strings.Repeat("x", 65): "value"},
+			{"sampling level": "low"},
+		} {
+			tc := setupAttrs()
+
+			_, err := tc.queryService.QueryData(context.Background(), nil, true, attrsRequest(attrs,
+				`{"refId": "A", "datasource": {"uid": "internal"}}`,
+			), false)
+
+			var badQuery *query.ErrBadQuery
+			require.True(t, errors.As(err, &badQuery))
+			require.Nil(t, tc.pluginContext.req)
+		}
+	})
+
+	t.Run("it rejects attribute values with control characters", func(t *testing.T) {
+		tc := setupAttrs()
+
+		_, err := tc.queryService.QueryData(context.Background(), nil, true, attrsRequest(
+			map[string]string{"samplingLevel": "a\r\nX-Evil: 1"},
+			`{"refId": "A", "datasource": {"uid": "internal"}}`,
+		), false)
+
+		var badQuery *query.ErrBadQuery
+		require.True(t, errors.As(err, &badQuery))
+		require.Equal(t, `plugin context attribute "samplingLevel" contains control characters`, badQuery.Message)
+		require.Nil(t, tc.pluginContext.req)
+	})
+}
+
+func TestQueryDataPluginRequestValidator(t *testing.T) {
+	setupValidator := func() *testContext {
+		return setupWithDataSources(
+			&models.DataSource{Uid: "ds-a", Type: "test", Url: "http://a.example.com"},
+			&models.DataSource{Uid: "ds-b", Type: "test", Url: "http://b.example.com"},
+		)
+	}
+	mixedRequest := func() dtos.MetricRequest {
+		return expressionRequest(
+			`{"refId": "A", "datasource": {"uid": "ds-a"}, "path": "/api/a"}`,
+			`{"refId": "B", "datasource": {"uid": "ds-b"}}`,
+			`{"refId": "C", "datasource": {"uid": "ds-a"}, "method": "POST"}`,
+		)
+	}
+
+	t.Run("it validates the data source URL with legacy validators", func(t *testing.T) {
+		tc := setupValidator()
+
+		_, err := tc.queryService.QueryData(context.Background(), nil, true, mixedRequest(), false)
+		require.NoError(t, err)
+		require.ElementsMatch(t, []string{"http://a.example.com", "http://b.example.com"}, tc.pluginRequestValidator.dsURLs)
+
+		tc = setupValidator()
+		tc.pluginRequestValidator.err = errors.New("not allowed")
+		resp, err := tc.queryService.QueryData(context.Background(), nil, true, mixedRequest(), false)
+		require.NoError(t, err)
+		for _, refID := range []string{"A", "B", "C"} {
+			require.True(t, errors.Is(resp.Responses[refID].Error, models.ErrDataSourceAccessDenied))
+		}
+		require.Nil(t, tc.pluginContext.req)
+	})
+
+	t.Run("it validates the queries of each data source before querying it", func(t *testing.T) {
+		tc := setupValidator()
+		qv := &fakeQueryRequestValidator{denied: map[string]bool{"ds-b": true}}
+		es := expr.ProvideService(&setting.Cfg{ExpressionsEnabled: true}, tc.pluginContext, tc.secretService)
+		qs := query.ProvideService(nil, tc.dataSourceCache, es, qv, tc.secretService, tc.pluginContext, tc.pluginStore, tc.pluginSettings, tc.dataSourcePermissions, tc.oauthTokenService, tc.tracer, featuremgmt.WithFeatures())
+
+		resp, err := qs.QueryData(context.Background(), nil, true, mixedRequest(), false)
+		require.NoError(t, err)
+
+		require.Equal(t, map[string][]string{"ds-a": {"A", "C"}, "ds-b": {"B"}}, qv.refIDs)
+		require.NoError(t, resp.Responses["A"].Error)
+		require.True(t, errors.Is(resp.Responses["B"].Error, models.ErrDataSourceAccessDenied))
+		require.Equal(t, "ds-a", tc.pluginContext.req.PluginContext.DataSourceInstanceSettings.UID)
+	})
+
+	t.Run("it denies the access to a single data source", func(t *testing.T) {
+		tc := setupValidator()
+		qv := &fakeQueryRequestValidator{denied: map[string]bool{"ds-a": true}}
+		es := expr.ProvideService(&setting.Cfg{ExpressionsEnabled: true}, tc.pluginContext, tc.secretService)
+		qs := query.ProvideService(nil, tc.dataSourceCache, es, qv, tc.secretService, tc.pluginContext, tc.pluginStore, tc.pluginSettings, tc.dataSourcePermissions, tc.oauthTokenService, tc.tracer, featuremgmt.WithFeatures())
+
+		_, err := qs.QueryData(context.Background(), nil, true, expressionRequest(`{"refId": "A", "datasource": {"uid": "ds-a"}}`), false)
+		require.True(t, errors.Is(err, models.ErrDataSourceAccessDenied))
+		require.Nil(t, tc.pluginContext.req)
+	})
+}
+
+func TestQueryDataQuota(t *testing.T) {
+	t.Run("it caps the number of concurrent queries per data source", func(t *testing.T) {
+		cfg := setting.NewCfg()
+		cfg.QueryDataSourceMaxConcurrent = 2
+		tc := setupWithConfig(cfg)
+
+		unblock := make(chan struct{})
+		var mu sync.Mutex
+		inFlight, maxInFlight := 0, 0
+		tc.pluginContext.queryDataFn = func(ctx context.Context, req *backend.QueryDataRequest) (*backend.QueryDataResponse, error) {
+			mu.Lock()
+			inFlight++
+			if inFlight > maxInFlight {
+				maxInFlight = inFlight
+			}
+			mu.Unlock()
+
+			<-unblock
+
+			mu.Lock()
+			inFlight--
+			mu.Unlock()
+			return &backend.QueryDataResponse{}, nil
+		}
+
+		const requests = 5
+		errs := make(chan error, requests)
+		for i := 0; i < requests; i++ {
+			go func() {
+				_, err := tc.queryService.QueryData(context.Background(), nil, true, metricRequest(), false)
+				errs <- err
+			}()
+		}
+
+		for i := 0; i < requests-2; i++ {
+			err := <-errs
+			var quotaErr *query.ErrQuotaExceeded
+			require.True(t, errors.As(err, &quotaErr))
+			require.Equal(t, time.Second, quotaErr.RetryAfter)
+		}
+		close(unblock)
+		for i := 0; i < 2; i++ {
+			require.NoError(t, <-errs)
+		}
+		require.Equal(t, 2, maxInFlight)
+
+		_, err := tc.queryService.QueryData(context.Background(), nil, true, metricRequest(), false)
+		require.NoError(t, err)
+	})
+
+	t.Run("it releases the quota when the plugin call panics", func(t *testing.T) {
+		cfg := setting.NewCfg()
+		cfg.QueryDataSourceMaxConcurrent = 1
+		tc := setupWithConfig(cfg)
+
+		tc.pluginContext.queryDataFn = func(ctx context.Context, req *backend.QueryDataRequest) (*backend.QueryDataResponse, error) {
+			panic("plugin crashed")
+		}
+		require.Panics(t, func() {
+			_, _ = tc.queryService.QueryData(context.Background(), nil, true, metricRequest(), false)
+		})
+
+		tc.pluginContext.queryDataFn = nil
+		_, err := tc.queryService.QueryData(context.Background(), nil, true, metricRequest(), false)
+		require.NoError(t, err)
+	})
+
+	t.Run("it limits the number of queries per minute", func(t *testing.T) {
+		cfg := setting.NewCfg()
+		cfg.QueryDataSourceMaxPerMinute = 2
+		tc := setupWithConfig(cfg)
+
+		for i := 0; i < 2; i++ {
+			_, err := tc.queryService.QueryData(context.Background(), nil, true, metricRequest(), false)
+			require.NoError(t, err)
+		}
+
+		_, err := tc.queryService.QueryData(context.Background(), nil, true, metricRequest(), false)
+		var quotaErr *query.ErrQuotaExceeded
+		require.True(t, errors.As(err, &quotaErr))
+		require.True(t, quotaErr.RetryAfter > 0)
+	})
+
+	t.Run("it does not limit queries when quotas are zero", func(t *testing.T) {
+		tc := setupWithConfig(setting.NewCfg())
+
+		for i := 0; i < 10; i++ {
+			_, err := tc.queryService.QueryData(context.Background(), nil, true, metricRequest(), false)
+			require.NoError(t, err)
+		}
+	})
+}
+
+func TestQueryDataRateLimit(t *testing.T) {
+	setupRateLimited := func(uid string, jsonData map[string]interface{}) *testContext {
+		tc := setup()
+		tc.dataSourceCache.ds.Uid = uid
+		tc.dataSourceCache.ds.JsonData = simplejson.NewFromAny(jsonData)
+		return tc
+	}
+
+	requireRateLimited := func(t *testing.T, resp *backend.QueryDataResponse) {
+		t.Helper()
+		var rateLimited *query.ErrRateLimited
+		require.True(t, errors.As(resp.Responses["A"].Error, &rateLimited))
+		require.Equal(t, "A", rateLimited.RefID)
+		require.True(t, rateLimited.RetryAfter > 0)
+	}
+
+	t.Run("it limits concurrent queries per data source", func(t *testing.T) {
+		tc := setupRateLimited("rate-limit-concurrent", map[string]interface{}{"maxConcurrentQueries": 1})
+
+		started := make(chan struct{})
+		unblock := make(chan struct{})
+		tc.pluginContext.queryDataFn = func(ctx context.Context, req *backend.QueryDataRequest) (*backend.QueryDataResponse, error) {
+			close(started)
+			<-unblock
+			return backend.NewQueryDataResponse(), nil
+		}
+
+		done := make(chan error)
+		go func() {
+			_, err := tc.queryService.QueryData(context.Background(), nil, true, metricRequest(), false)
+			done <- err
+		}()
+		<-started
+
+		before := counterValue(t, "grafana_query_throttled_total", "datasource_uid", "rate-limit-concurrent")
+		resp, err := tc.queryService.QueryData(context.Background(), nil, true, metricRequest(), false)
+		require.NoError(t, err)
+		requireRateLimited(t, resp)
+		require.Equal(t, 1.0, counterValue(t, "grafana_query_throttled_total", "datasource_uid", "rate-limit-concurrent")-before)
+
+		close(unblock)
+		require.NoError(t, <-done)
+	})
+
+	t.Run("it limits queries per minute per data source", func(t *testing.T) {
+		tc := setupRateLimited("rate-limit-per-minute", map[string]interface{}{"maxQueriesPerMinute": 2})
+		tc.pluginContext.queryDataFn = func(ctx context.Context, req *backend.QueryDataRequest) (*backend.QueryDataResponse, error) {
+			return backend.NewQueryDataResponse(), nil
+		}
+
+		for i := 0; i < 2; i++ {
+			resp, err := tc.queryService.QueryData(context.Background(), nil, true, metricRequest(), false)
+			require.NoError(t, err)
+			require.NotContains(t, resp.Responses, "A")
+		}
+
+		resp, err := tc.queryService.QueryData(context.Background(), nil, true, metricRequest(), false)
+		require.NoError(t, err)
+		requireRateLimited(t, resp)
+	})
+
+	t.Run("it limits each data source separately", func(t *testing.T) {
+		tc := setupRateLimited("rate-limit-a", map[string]interface{}{"maxQueriesPerMinute": 1})
+
+		_, err := tc.queryService.QueryData(context.Background(), nil, true, metricRequest(), false)
+		require.NoError(t, err)
+
+		tc.dataSourceCache.ds.Uid = "rate-limit-b"
+		tc.pluginContext.req = nil
+		_, err = tc.queryService.QueryData(context.Background(), nil, true, metricRequest(), false)
+		require.NoError(t, err)
+		require.NotNil(t, tc.pluginContext.req)
+	})
+}
+
+func TestQueryDataTimeout(t *testing.T) {
+	sleepingClient := func(d time.Duration) func(ctx context.Context, req *backend.QueryDataRequest) (*backend.QueryDataResponse, error) {
+		return func(ctx context.Context, req *backend.QueryDataRequest) (*backend.QueryDataResponse, error) {
+			select {
+			case <-time.After(d):
+				return &backend.QueryDataResponse{Responses: backend.Responses{"A": {}}}, nil
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		}
+	}
+
+	t.Run("it returns a timeout error per query when the deadline is reached", func(t *testing.T) {
+		cfg := setting.NewCfg()
+		cfg.QueryTimeout = 50 * time.Millisecond
+		tc := setupWithConfig(cfg)
+		tc.pluginContext.queryDataFn = sleepingClient(5 * time.Second)
+
+		start := time.Now()
+		res, err := tc.queryService.QueryData(context.Background(), nil, true, metricRequest(), false)
+		require.NoError(t, err)
+		require.True(t, time.Since(start) < time.Second)
+
+		var timeoutErr *query.ErrQueryTimeout
+		require.True(t, errors.As(res.Responses["A"].Error, &timeoutErr))
+		require.Equal(t, "A", timeoutErr.RefID)
+		require.Equal(t, 50*time.Millisecond, timeoutErr.Timeout)
+	})
+
+	t.Run("it uses the data source timeout over the default", func(t *testing.T) {
+		cfg := setting.NewCfg()
+		cfg.QueryTimeout = 50 * time.Millisecond
+		tc := setupWithConfig(cfg)
+		tc.dataSourceCache.ds.JsonData = simplejson.NewFromAny(map[string]interface{}{"queryTimeout": 5})
+		tc.pluginContext.queryDataFn = sleepingClient(100 * time.Millisecond)
+
+		res, err := tc.queryService.QueryData(context.Background(), nil, true, metricRequest(), false)
+		require.NoError(t, err)
+		require.NoError(t, res.Responses["A"].Error)
+	})
+
+	t.Run("it returns the error when the request context is cancelled", func(t *testing.T) {
+		cfg := setting.NewCfg()
+		cfg.QueryTimeout = time.Second
+		tc := setupWithConfig(cfg)
+		tc.pluginContext.queryDataFn = sleepingClient(5 * time.Second)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		_, err := tc.queryService.QueryData(ctx, nil, true, metricRequest(), false)
+		require.True(t, errors.Is(err, context.DeadlineExceeded))
+	})
+}
+
+func TestQueryDataCancellation(t *testing.T) {
+	t.Run("it cancels the plugin query when the client goes away", func(t *testing.T) {
+		tc := setup()
+		tc.dataSourceCache.ds.Type = "cancel-test"
+		observed := make(chan error, 1)
+		tc.pluginContext.queryDataFn = func(ctx context.Context, req *backend.QueryDataRequest) (*backend.QueryDataResponse, error) {
+			select {
+			case <-time.After(5 * time.Second):
+				observed <- nil
+				return &backend.QueryDataResponse{Responses: backend.Responses{"A": {}}}, nil
+			case <-ctx.Done():
+				observed <- ctx.Err()
+				// Plugins report cancellation with errors of their own, e.g. gRPC statuses.
+				return nil, errors.New("rpc error: code = Canceled desc = context canceled")
+			}
+		}
+		before := counterValue(t, "grafana_query_cancelled_total", "datasource_type", "cancel-test")
+
+		ctx, cancel := context.WithCancel(context.Background())
+		go func() {
+			time.Sleep(50 * time.Millisecond)
+			cancel()
+		}()
+
+		start := time.Now()
+		_, err := tc.queryService.QueryData(ctx, nil, true, metricRequest(), false)
+		require.True(t, errors.Is(err, context.Canceled))
+		require.True(t, time.Since(start) < time.Second)
+		require.True(t, errors.Is(<-observed, context.Canceled))
+		require.Equal(t, 1.0, counterValue(t, "grafana_query_cancelled_total", "datasource_type", "cancel-test")-before)
+	})
+}
+
+func TestQueryDataSecretsDecryption(t *testing.T) {
+	t.Run("it does not query the data source when its secrets cannot be decrypted", func(t *testing.T) {
+		tc := setup()
+		tc.dataSourceCache.ds.Uid = "decrypt-test"
+		tc.dataSourceCache.ds.Name = "Broken"
+		tc.dataSourceCache.ds.SecureJsonData = map[string][]byte{"password": []byte("encrypted")}
+		ss := fakes.NewFakeSecretsServiceWithDecryptError(errors.New("wrong secret key"))
+		es := expr.ProvideService(&setting.Cfg{ExpressionsEnabled: true}, tc.pluginContext, ss)
+		qs := query.ProvideService(nil, tc.dataSourceCache, es, tc.pluginRequestValidator, ss, tc.pluginContext, tc.pluginStore, tc.pluginSettings, tc.dataSourcePermissions, tc.oauthTokenService, tc.tracer, featuremgmt.WithFeatures())
+		before := counterValue(t, "grafana_query_secrets_decryption_failures_total", "datasource_uid", "decrypt-test")
+
+		_, err := qs.QueryData(context.Background(), nil, true, metricRequest(), false)
+
+		var decryptionErr *query.ErrDatasourceSecretsDecryption
+		require.True(t, errors.As(err, &decryptionErr))
+		require.Equal(t, "decrypt-test", decryptionErr.DatasourceUID)
+		require.Equal(t, "Broken", decryptionErr.DatasourceName)
+		require.EqualError(t, err, "failed to decrypt the secrets of data source Broken (decrypt-test): wrong secret key")
+		require.Nil(t, tc.pluginContext.req)
+		require.Equal(t, 1.0, counterValue(t, "grafana_query_secrets_decryption_failures_total", "datasource_uid", "decrypt-test")-before)
+	})
+}
+
+func TestValidateQueries(t *testing.T) {
+	setupValidate := func() *testContext {
+		tc := setup()
+		tc.dataSourceCache.ds.Uid = "prom"
+		tc.dataSourceCache.ds.Type = "prometheus"
+		tc.pluginStore.plugins = map[string]plugins.PluginDTO{
+			"prometheus": {JSONData: plugins.JSONData{ID: "prometheus"}},
+		}
+		return tc
+	}
+
+	t.Run("it reports the resolved data source without querying it", func(t *testing.T) {
+		tc := setupValidate()
+
+		report, err := tc.queryService.ValidateQueries(context.Background(), nil, true, metricRequest())
+		require.NoError(t, err)
+
+		require.Equal(t, query.QueryValidationOK, report.Status)
+		require.Equal(t, []query.QueryValidation{{
+			RefID:          "A",
+			DatasourceUID:  "prom",
+			DatasourceType: "prometheus",
+			Status:         query.QueryValidationOK,
+			Warnings:       []string{},
+			Errors:         []string{},
+		}}, report.Queries)
+		require.Nil(t, tc.pluginContext.req)
+	})
+
+	t.Run("it reports plugins that are not installed", func(t *testing.T) {
+		tc := setupValidate()
+		tc.pluginStore.plugins = nil
+
+		report, err := tc.queryService.ValidateQueries(context.Background(), nil, true, metricRequest())
+		require.NoError(t, err)
+
+		require.Equal(t, query.QueryValidationError, report.Status)
+		require.Equal(t, []string{`Plugin "prometheus" of the data source is not installed`}, report.Queries[0].Errors)
+		require.Nil(t, tc.pluginContext.req)
+	})
+
+	t.Run("it reports plugins of apps that are not enabled", func(t *testing.T) {
+		tc := setupValidate()
+		tc.pluginStore.plugins["prometheus"] = plugins.PluginDTO{
+			JSONData:        plugins.JSONData{ID: "prometheus"},
+			IncludedInAppID: "monitoring-app",
+		}
+		tc.pluginSettings.settings = map[string]*models.PluginSetting{
+			"monitoring-app": {PluginId: "monitoring-app", Enabled: false},
+		}
+
+		report, err := tc.queryService.ValidateQueries(context.Background(), nil, true, metricRequest())
+		require.NoError(t, err)
+
+		require.Equal(t, []string{`Plugin "prometheus" of the data source is not enabled`}, report.Queries[0].Errors)
+	})
+
+	t.Run("it reports secrets that cannot be decrypted", func(t *testing.T) {
+		tc := setupValidate()
+		ss := fakes.NewFakeSecretsServiceWithDecryptError(errors.New("wrong secret key"))
+		es := expr.ProvideService(&setting.Cfg{ExpressionsEnabled: true}, tc.pluginContext, ss)
+		qs := query.ProvideService(nil, tc.dataSourceCache, es, tc.pluginRequestValidator, ss, tc.pluginContext, tc.pluginStore, tc.pluginSettings, tc.dataSourcePermissions, tc.oauthTokenService, tc.tracer, featuremgmt.WithFeatures())
+
+		report, err := qs.ValidateQueries(context.Background(), nil, true, metricRequest())
+		require.NoError(t, err)
+
+		require.Equal(t, query.QueryValidationError, report.Queries[0].Status)
+		require.Len(t, report.Queries[0].Errors, 1)
+		require.Contains(t, report.Queries[0].Errors[0], "wrong secret key")
+		require.Nil(t, tc.pluginContext.req)
+	})
+
+	t.Run("it warns when there is no OAuth token to forward", func(t *testing.T) {
+		tc := setupValidate()
+		tc.oauthTokenService.passThruEnabled = true
+
+		report, err := tc.queryService.ValidateQueries(context.Background(), nil, true, metricRequest())
+		require.NoError(t, err)
+
+		require.Equal(t, query.QueryValidationWarning, report.Status)
+		require.Equal(t, query.QueryValidationWarning, report.Queries[0].Status)
+		require.Len(t, report.Queries[0].Warnings, 1)
+		require.Empty(t, report.Queries[0].Errors)
+	})
+
+	t.Run("it reports OAuth tokens that cannot be refreshed", func(t *testing.T) {
+		tc := setupValidate()
+		tc.oauthTokenService.passThruEnabled = true
+		tc.oauthTokenService.err = oauthtoken.ErrTokenRefreshFailed
+
+		report, err := tc.queryService.ValidateQueries(context.Background(), nil, true, metricRequest())
+		require.NoError(t, err)
+
+		require.Equal(t, []string{"OAuth token could not be refreshed, please sign out and sign in again"}, report.Queries[0].Errors)
+		require.Nil(t, tc.pluginContext.req)
+	})
 
-		require.Equal(t, map[string]string{"foo": "test-header", "bar": "test-header2"}, tc.pluginContext.req.Headers)
+	t.Run("it rejects requests QueryData rejects", func(t *testing.T) {
+		tc := setupValidate()
+		req := expressionRequest(`{"refId":"A","datasourceId":1}`, `{"refId":"A","datasourceId":1}`)
+
+		_, err := tc.queryService.ValidateQueries(context.Background(), nil, true, req)
+		var badQuery *query.ErrBadQuery
+		require.True(t, errors.As(err, &badQuery))
+		require.Nil(t, tc.pluginContext.req)
 	})
+}
 
-	t.Run("it auth custom headers to the request", func(t *testing.T) {
-		token := &oauth2.Token{
-			TokenType:   "bearer",
-			AccessToken: "access-token",
+func TestValidateDashboard(t *testing.T) {
+	raw, err := os.ReadFile("testdata/validate-dashboard.json")
+	require.NoError(t, err)
+	dashboard, err := simplejson.NewJson(raw)
+	require.NoError(t, err)
+
+	tc := setupWithDataSources(&models.DataSource{Uid: "prom", Type: "prometheus"})
+	tc.dataSourceCache.missing = map[string]bool{"deleted": true}
+	tc.pluginStore.plugins = map[string]plugins.PluginDTO{
+		"prometheus": {JSONData: plugins.JSONData{ID: "prometheus"}},
+	}
+
+	report := tc.queryService.ValidateDashboard(context.Background(), nil, true, dashboard)
+	require.False(t, report.Queryable)
+	require.Nil(t, tc.pluginContext.req)
+
+	type panelResult struct {
+		id        int64
+		status    query.PanelValidationStatus
+		queryable bool
+		reasons   []string
+	}
+	var results []panelResult
+	for _, pv := range report.Panels {
+		results = append(results, panelResult{id: pv.PanelID, status: pv.Status, queryable: pv.Queryable, reasons: pv.Reasons})
+	}
+	require.Equal(t, []panelResult{
+		{id: 1, status: query.PanelValidationQueryable, queryable: true, reasons: []string{}},
+		{id: 2, status: query.PanelValidationNotApplicable, queryable: false, reasons: []string{}},
+		{id: 3, status: query.PanelValidationNotQueryable, queryable: false, reasons: []string{"data source not found"}},
+		{id: 5, status: query.PanelValidationQueryable, queryable: true, reasons: []string{}},
+	}, results)
+
+	require.Equal(t, "prom", report.Panels[3].Queries[0].DatasourceUID)
+	require.Equal(t, "prometheus", report.Panels[3].Queries[0].DatasourceType)
+
+	t.Run("it does not take the panels without queries into account", func(t *testing.T) {
+		dashboard, err := simplejson.NewJson(raw)
+		require.NoError(t, err)
+		panels := dashboard.Get("panels").MustArray()
+		dashboard.Set("panels", []interface{}{panels[0], panels[1]})
+
+		report := tc.queryService.ValidateDashboard(context.Background(), nil, true, dashboard)
+		require.True(t, report.Queryable)
+		require.Equal(t, query.PanelValidationNotApplicable, report.Panels[1].Status)
+	})
+
+	t.Run("it reports data sources the user may not query", func(t *testing.T) {
+		tc.dataSourcePermissions.denied = map[string]bool{"prom": true}
+		t.Cleanup(func() { tc.dataSourcePermissions.denied = nil })
+
+		report := tc.queryService.ValidateDashboard(context.Background(), nil, true, dashboard)
+		require.False(t, report.Panels[0].Queryable)
+		require.Equal(t, []string{"Query A: data source access denied"}, report.Panels[0].Reasons)
+	})
+}
+
+func TestQueryDataAudit(t *testing.T) {
+	auditConfig := func() *setting.Cfg {
+		cfg := setting.NewCfg()
+		cfg.QueryAuditEnabled = true
+		return cfg
+	}
+
+	auditRequest := func() dtos.MetricRequest {
+		q, _ := simplejson.NewJson([]byte(`{"refId":"A","datasourceId":1,"rawSql":"SELECT *\nFROM dblink('password=s3cr3t', 'SELECT 1')"}`))
+		return dtos.MetricRequest{From: "1600000000000", To: "1600003600000", Queries: []*simplejson.Json{q}}
+	}
+
+	user := &models.SignedInUser{UserId: 2, Login: "alice", OrgId: 1}
+
+	t.Run("it records the request with the secrets of the queries masked", func(t *testing.T) {
+		tc := setupWithConfig(auditConfig())
+		tc.dataSourceCache.ds.Uid = "mysql"
+		tc.dataSourceCache.ds.Type = "mysql"
+		sink := &fakeAuditSink{}
+		tc.queryService.SetAuditSink(sink)
+
+		_, err := tc.queryService.QueryData(context.Background(), user, true, auditRequest(), false)
+		require.NoError(t, err)
+
+		require.Len(t, sink.records, 1)
+		record := sink.records[0]
+		require.Equal(t, int64(2), record.UserID)
+		require.Equal(t, "alice", record.UserLogin)
+		require.Equal(t, int64(1), record.OrgID)
+		require.Equal(t, "mysql", record.DatasourceUID)
+		require.Equal(t, "mysql", record.DatasourceType)
+		require.Equal(t, []string{"A"}, record.RefIDs)
+		require.True(t, time.UnixMilli(1600000000000).Equal(record.From))
+		require.True(t, time.UnixMilli(1600003600000).Equal(record.To))
+		require.Equal(t, query.AuditOutcomeSuccess, record.Outcome)
+		require.Len(t, record.Queries, 1)
+		require.Contains(t, record.Queries[0], "password=***")
+		require.NotContains(t, record.Queries[0], "s3cr3t")
+	})
+
+	t.Run("it records failed queries", func(t *testing.T) {
+		tc := setupWithConfig(auditConfig())
+		tc.pluginContext.queryDataFn = func(ctx context.Context, req *backend.QueryDataRequest) (*backend.QueryDataResponse, error) {
+			return &backend.QueryDataResponse{Responses: backend.Responses{"A": {Error: errors.New("syntax error")}}}, nil
 		}
-		token = token.WithExtra(map[string]interface{}{"id_token": "id-token"})
+		sink := &fakeAuditSink{}
+		tc.queryService.SetAuditSink(sink)
+
+		_, err := tc.queryService.QueryData(context.Background(), user, true, auditRequest(), false)
+		require.NoError(t, err)
 
+		require.Len(t, sink.records, 1)
+		require.Equal(t, query.AuditOutcomeError, sink.records[0].Outcome)
+		require.Equal(t, []string{"A"}, sink.records[0].FailedRefIDs)
+	})
+
+	t.Run("it does not record requests when auditing is disabled", func(t *testing.T) {
 		tc := setup()
+		sink := &fakeAuditSink{}
+		tc.queryService.SetAuditSink(sink)
+
+		_, err := tc.queryService.QueryData(context.Background(), user, true, auditRequest(), false)
+		require.NoError(t, err)
+		require.Empty(t, sink.records)
+	})
+}
+
+func TestQueryDataOAuthPassThruAudit(t *testing.T) {
+	auditConfig := func() *setting.Cfg {
+		cfg := setting.NewCfg()
+		cfg.QueryAuditEnabled = true
+		return cfg
+	}
+	user := &models.SignedInUser{UserId: 2, Login: "alice", OrgId: 1}
+	expiry := time.Now().Add(time.Hour).Truncate(time.Second)
+
+	setupAudit := func(cfg *setting.Cfg) (*testContext, *fakeAuditSink) {
+		tc := setupWithConfig(cfg)
+		tc.dataSourceCache.ds.Uid = "loki"
+		tc.dataSourceCache.ds.Type = "loki"
 		tc.oauthTokenService.passThruEnabled = true
-		tc.oauthTokenService.token = token
+		tc.oauthTokenService.token = (&oauth2.Token{TokenType: "Bearer", AccessToken: "s3cr3t-access-token", Expiry: expiry}).
+			WithExtra(map[string]interface{}{"id_token": "s3cr3t-id-token"})
+		sink := &fakeAuditSink{}
+		tc.queryService.SetAuditSink(sink)
+		return tc, sink
+	}
+
+	t.Run("it records the forwarded token without its value", func(t *testing.T) {
+		tc, sink := setupAudit(auditConfig())
+
+		ctx := query.WithRequestID(context.Background(), "request-1")
+		_, err := tc.queryService.QueryData(ctx, user, true, metricRequest(), false)
+		require.NoError(t, err)
+
+		require.Equal(t, []query.OAuthPassThruAuditRecord{{
+			RequestID:      "request-1",
+			UserID:         2,
+			UserLogin:      "alice",
+			OrgID:          1,
+			DatasourceUID:  "loki",
+			DatasourceType: "loki",
+			Endpoint:       query.OAuthPassThruEndpointQuery,
+			TokenExpiry:    expiry,
+		}}, sink.oauthPassThruRecords)
+		require.NotContains(t, fmt.Sprintf("%+v", sink.oauthPassThruRecords), "s3cr3t")
+	})
+
+	t.Run("it records the endpoint the token is forwarded to", func(t *testing.T) {
+		tc, sink := setupAudit(auditConfig())
+
+		_, err := tc.queryService.OAuthPassThruHeaders(context.Background(), user, tc.dataSourceCache.ds, query.OAuthPassThruEndpointResource)
+		require.NoError(t, err)
+
+		require.Len(t, sink.oauthPassThruRecords, 1)
+		require.Equal(t, query.OAuthPassThruEndpointResource, sink.oauthPassThruRecords[0].Endpoint)
+	})
+
+	t.Run("it does not record requests without token", func(t *testing.T) {
+		tc, sink := setupAudit(auditConfig())
+		tc.oauthTokenService.token = nil
+
+		_, err := tc.queryService.QueryData(context.Background(), user, true, metricRequest(), false)
+		require.NoError(t, err)
+		require.Empty(t, sink.oauthPassThruRecords)
+	})
+
+	t.Run("it counts the forwarded tokens when auditing is disabled", func(t *testing.T) {
+		tc, sink := setupAudit(setting.NewCfg())
+		tc.dataSourceCache.ds.Type = "audit-disabled"
+
+		_, err := tc.queryService.QueryData(context.Background(), user, true, metricRequest(), false)
+		require.NoError(t, err)
+		require.Empty(t, sink.oauthPassThruRecords)
+		require.Equal(t, float64(1), counterValue(t, "grafana_query_oauth_pass_thru_total", "datasource_type", "audit-disabled"))
+	})
+}
+
+func TestQueryDataRetry(t *testing.T) {
+	retryConfig := func() *setting.Cfg {
+		cfg := setting.NewCfg()
+		cfg.QueryMaxRetries = 2
+		cfg.QueryRetryBackoff = time.Millisecond
+		return cfg
+	}
+
+	failingClient := func(failures int, err error) (func(context.Context, *backend.QueryDataRequest) (*backend.QueryDataResponse, error), *int) {
+		calls := 0
+		return func(ctx context.Context, req *backend.QueryDataRequest) (*backend.QueryDataResponse, error) {
+			calls++
+			if calls <= failures {
+				return nil, err
+			}
+			resp := backend.NewQueryDataResponse()
+			resp.Responses["A"] = backend.DataResponse{}
+			return resp, nil
+		}, &calls
+	}
+
+	t.Run("it retries transient plugin errors", func(t *testing.T) {
+		tc := setupWithConfig(retryConfig())
+		tc.dataSourceCache.ds.Type = "retry-test"
+		queryDataFn, calls := failingClient(2, backendplugin.ErrPluginUnavailable)
+		tc.pluginContext.queryDataFn = queryDataFn
+		before := counterValue(t, "grafana_query_plugin_retries_total", "plugin_id", "retry-test")
+
+		resp, err := tc.queryService.QueryData(context.Background(), nil, true, metricRequest(), false)
+		require.NoError(t, err)
+
+		require.Equal(t, 3, *calls)
+		require.Equal(t, 2.0, counterValue(t, "grafana_query_plugin_retries_total", "plugin_id", "retry-test")-before)
+		require.Equal(t, "Query succeeded after 2 retries", resp.Responses["A"].Frames[0].Meta.Notices[0].Text)
+	})
+
+	t.Run("it gives up after the maximum number of retries", func(t *testing.T) {
+		tc := setupWithConfig(retryConfig())
+		queryDataFn, calls := failingClient(3, backendplugin.ErrPluginUnavailable)
+		tc.pluginContext.queryDataFn = queryDataFn
 
 		_, err := tc.queryService.QueryData(context.Background(), nil, true, metricRequest(), false)
-		require.Nil(t, err)
+		require.True(t, errors.Is(err, backendplugin.ErrPluginUnavailable))
+		require.Equal(t, 3, *calls)
+	})
 
-		expected := map[string]string{
-			"Authorization": "Bearer access-token",
-			"X-ID-Token":    "id-token",
+	t.Run("it does not retry other errors", func(t *testing.T) {
+		tc := setupWithConfig(retryConfig())
+		queryDataFn, calls := failingClient(1, errors.New("bad request"))
+		tc.pluginContext.queryDataFn = queryDataFn
+
+		_, err := tc.queryService.QueryData(context.Background(), nil, true, metricRequest(), false)
+		require.EqualError(t, err, "bad request")
+		require.Equal(t, 1, *calls)
+	})
+
+	t.Run("it does not retry when the context expires before the backoff", func(t *testing.T) {
+		cfg := retryConfig()
+		cfg.QueryRetryBackoff = time.Minute
+		tc := setupWithConfig(cfg)
+		queryDataFn, calls := failingClient(1, backendplugin.ErrPluginUnavailable)
+		tc.pluginContext.queryDataFn = queryDataFn
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+
+		_, err := tc.queryService.QueryData(ctx, nil, true, metricRequest(), false)
+		require.True(t, errors.Is(err, backendplugin.ErrPluginUnavailable))
+		require.Equal(t, 1, *calls)
+	})
+}
+
+func TestQueryDataCache(t *testing.T) {
+	setupCache := func() (*testContext, *int) {
+		cfg := setting.NewCfg()
+		cfg.QueryCacheEnabled = true
+		cfg.QueryCacheTTL = time.Minute
+		cfg.QueryCacheMaxEntries = 10
+		cfg.QueryCacheTimeResolution = time.Minute
+		tc := setupWithConfig(cfg)
+
+		calls := 0
+		tc.pluginContext.queryDataFn = func(ctx context.Context, req *backend.QueryDataRequest) (*backend.QueryDataResponse, error) {
+			calls++
+			frame := data.NewFrame("test", data.NewField("value", nil, []float64{1}))
+			frame.RefID = "A"
+			return &backend.QueryDataResponse{Responses: backend.Responses{"A": {Frames: data.Frames{frame}}}}, nil
 		}
-		require.Equal(t, expected, tc.pluginContext.req.Headers)
+		return tc, &calls
+	}
+	user := func(id int64) *models.SignedInUser {
+		return &models.SignedInUser{UserId: id, OrgId: 1}
+	}
+
+	t.Run("it serves repeated queries from the cache", func(t *testing.T) {
+		tc, calls := setupCache()
+		hits := counterValue(t, "grafana_query_cache_requests_total", "result", "hit")
+		misses := counterValue(t, "grafana_query_cache_requests_total", "result", "miss")
+
+		first, err := tc.queryService.QueryData(context.Background(), user(1), true, metricRequest(), false)
+		require.NoError(t, err)
+		second, err := tc.queryService.QueryData(context.Background(), user(1), true, metricRequest(), false)
+		require.NoError(t, err)
+
+		require.Equal(t, 1, *calls)
+		require.Nil(t, first.Responses["A"].Frames[0].Meta)
+		require.Equal(t, "Served from cache", second.Responses["A"].Frames[0].Meta.Notices[0].Text)
+		require.Equal(t, hits+1, counterValue(t, "grafana_query_cache_requests_total", "result", "hit"))
+		require.Equal(t, misses+1, counterValue(t, "grafana_query_cache_requests_total", "result", "miss"))
+
+		third, err := tc.queryService.QueryData(context.Background(), user(1), true, metricRequest(), false)
+		require.NoError(t, err)
+		require.Len(t, third.Responses["A"].Frames[0].Meta.Notices, 1)
+	})
+
+	t.Run("it shares cached responses between users without OAuth pass-thru", func(t *testing.T) {
+		tc, calls := setupCache()
+
+		_, err := tc.queryService.QueryData(context.Background(), user(1), true, metricRequest(), false)
+		require.NoError(t, err)
+		_, err = tc.queryService.QueryData(context.Background(), user(2), true, metricRequest(), false)
+		require.NoError(t, err)
+
+		require.Equal(t, 1, *calls)
+	})
+
+	t.Run("it isolates cached responses per user with OAuth pass-thru", func(t *testing.T) {
+		tc, calls := setupCache()
+		tc.oauthTokenService.passThruEnabled = true
+
+		_, err := tc.queryService.QueryData(context.Background(), user(1), true, metricRequest(), false)
+		require.NoError(t, err)
+		_, err = tc.queryService.QueryData(context.Background(), user(2), true, metricRequest(), false)
+		require.NoError(t, err)
+		require.Equal(t, 2, *calls)
+
+		res, err := tc.queryService.QueryData(context.Background(), user(1), true, metricRequest(), false)
+		require.NoError(t, err)
+		require.Equal(t, 2, *calls)
+		require.Equal(t, "Served from cache", res.Responses["A"].Frames[0].Meta.Notices[0].Text)
+	})
+
+	t.Run("it does not cache queries of data sources that opt out", func(t *testing.T) {
+		tc, calls := setupCache()
+		tc.dataSourceCache.ds.JsonData = simplejson.NewFromAny(map[string]interface{}{"disableQueryCache": true})
+
+		for i := 0; i < 2; i++ {
+			_, err := tc.queryService.QueryData(context.Background(), user(1), true, metricRequest(), false)
+			require.NoError(t, err)
+		}
+		require.Equal(t, 2, *calls)
+	})
+
+	t.Run("it isolates cached responses per plugin context attributes", func(t *testing.T) {
+		tc, calls := setupCache()
+		tc.dataSourceCache.ds.JsonData = simplejson.NewFromAny(map[string]interface{}{"allowedPluginContextAttrs": []interface{}{"samplingLevel"}})
+		withSampling := func(level string) dtos.MetricRequest {
+			req := metricRequest()
+			req.PluginContextAttrs = map[string]string{"samplingLevel": level}
+			return req
+		}
+
+		for _, level := range []string{"low", "high", "low"} {
+			_, err := tc.queryService.QueryData(context.Background(), user(1), true, withSampling(level), false)
+			require.NoError(t, err)
+		}
+		require.Equal(t, 2, *calls)
+	})
+}
+
+func TestQueryDataResponseSize(t *testing.T) {
+	twoQueries := func() dtos.MetricRequest {
+		return expressionRequest(`{"refId": "A", "datasourceId": 1}`, `{"refId": "B", "datasourceId": 1}`)
+	}
+
+	// respondWithRows answers query A with a large frame and query B with a small one.
+	respondWithRows := func(ctx context.Context, req *backend.QueryDataRequest) (*backend.QueryDataResponse, error) {
+		large := make([]float64, 100000)
+		return &backend.QueryDataResponse{Responses: backend.Responses{
+			"A": {Frames: data.Frames{data.NewFrame("large", data.NewField("value", nil, large))}},
+			"B": {Frames: data.Frames{data.NewFrame("small", data.NewField("value", nil, []float64{1}))}},
+		}}, nil
+	}
+
+	t.Run("it replaces the data of queries exceeding the limit", func(t *testing.T) {
+		cfg := setting.NewCfg()
+		cfg.QueryMaxResponseSize = 64 * 1024
+		tc := setupWithConfig(cfg)
+		tc.pluginContext.queryDataFn = respondWithRows
+
+		res, err := tc.queryService.QueryData(context.Background(), nil, true, twoQueries(), false)
+		require.NoError(t, err)
+
+		var tooLarge *query.ErrResponseTooLarge
+		require.True(t, errors.As(res.Responses["A"].Error, &tooLarge))
+		require.Equal(t, "A", tooLarge.RefID)
+		require.Equal(t, int64(64*1024), tooLarge.Limit)
+		require.Greater(t, tooLarge.Size, tooLarge.Limit)
+		require.Contains(t, tooLarge.Error(), "response of query A is too large")
+		require.Contains(t, tooLarge.Error(), "narrow the query")
+		require.Nil(t, res.Responses["A"].Frames)
+
+		require.NoError(t, res.Responses["B"].Error)
+		require.Len(t, res.Responses["B"].Frames, 1)
+		require.Equal(t, "small", res.Responses["B"].Frames[0].Name)
+	})
+
+	t.Run("it uses the data source limit over the default", func(t *testing.T) {
+		cfg := setting.NewCfg()
+		cfg.QueryMaxResponseSize = 64 * 1024
+		tc := setupWithConfig(cfg)
+		tc.dataSourceCache.ds.JsonData = simplejson.NewFromAny(map[string]interface{}{"maxResponseSize": 10 * 1024 * 1024})
+		tc.pluginContext.queryDataFn = respondWithRows
+
+		res, err := tc.queryService.QueryData(context.Background(), nil, true, twoQueries(), false)
+		require.NoError(t, err)
+		require.NoError(t, res.Responses["A"].Error)
+		require.Equal(t, "large", res.Responses["A"].Frames[0].Name)
+	})
+
+	t.Run("it does not limit responses by default", func(t *testing.T) {
+		tc := setup()
+		tc.pluginContext.queryDataFn = respondWithRows
+
+		res, err := tc.queryService.QueryData(context.Background(), nil, true, twoQueries(), false)
+		require.NoError(t, err)
+		require.NoError(t, res.Responses["A"].Error)
+		require.NoError(t, res.Responses["B"].Error)
+	})
+}
+
+func TestQueryDataMetrics(t *testing.T) {
+	labels := func(dsType string, cached bool, retried bool) map[string]string {
+		return map[string]string{
+			"datasource_type": dsType,
+			"cached":          fmt.Sprint(cached),
+			"retried":         fmt.Sprint(retried),
+		}
+	}
+	respond := func(err error) func(context.Context, *backend.QueryDataRequest) (*backend.QueryDataResponse, error) {
+		return func(ctx context.Context, req *backend.QueryDataRequest) (*backend.QueryDataResponse, error) {
+			return &backend.QueryDataResponse{Responses: backend.Responses{"A": {Error: err}}}, nil
+		}
+	}
+
+	t.Run("it reports the duration of successful queries", func(t *testing.T) {
+		tc := setup()
+		tc.dataSourceCache.ds.Type = "metrics-success"
+		tc.pluginContext.queryDataFn = respond(nil)
+
+		_, err := tc.queryService.QueryData(context.Background(), nil, true, metricRequest(), false)
+		require.NoError(t, err)
+
+		require.Equal(t, uint64(1), histogramCount(t, "grafana_query_duration_seconds", labels("metrics-success", false, false)))
+		require.Equal(t, 0.0, labeledCounterValue(t, "grafana_query_errors_total", labels("metrics-success", false, false)))
+	})
+
+	t.Run("it reports failed plugin calls and failed queries", func(t *testing.T) {
+		tc := setup()
+		tc.dataSourceCache.ds.Type = "metrics-failure"
+
+		tc.pluginContext.queryDataFn = func(ctx context.Context, req *backend.QueryDataRequest) (*backend.QueryDataResponse, error) {
+			return nil, errors.New("plugin failure")
+		}
+		_, err := tc.queryService.QueryData(context.Background(), nil, true, metricRequest(), false)
+		require.Error(t, err)
+
+		tc.pluginContext.queryDataFn = respond(errors.New("query failure"))
+		_, err = tc.queryService.QueryData(context.Background(), nil, true, metricRequest(), false)
+		require.NoError(t, err)
+
+		require.Equal(t, uint64(2), histogramCount(t, "grafana_query_duration_seconds", labels("metrics-failure", false, false)))
+		require.Equal(t, 2.0, labeledCounterValue(t, "grafana_query_errors_total", labels("metrics-failure", false, false)))
+	})
+
+	t.Run("it reports retried queries", func(t *testing.T) {
+		cfg := setting.NewCfg()
+		cfg.QueryMaxRetries = 1
+		cfg.QueryRetryBackoff = time.Millisecond
+		tc := setupWithConfig(cfg)
+		tc.dataSourceCache.ds.Type = "metrics-retried"
+		calls := 0
+		tc.pluginContext.queryDataFn = func(ctx context.Context, req *backend.QueryDataRequest) (*backend.QueryDataResponse, error) {
+			calls++
+			if calls == 1 {
+				return nil, backendplugin.ErrPluginUnavailable
+			}
+			return respond(nil)(ctx, req)
+		}
+
+		_, err := tc.queryService.QueryData(context.Background(), nil, true, metricRequest(), false)
+		require.NoError(t, err)
+		require.Equal(t, uint64(1), histogramCount(t, "grafana_query_duration_seconds", labels("metrics-retried", false, true)))
+	})
+
+	t.Run("it reports cached queries", func(t *testing.T) {
+		cfg := setting.NewCfg()
+		cfg.QueryCacheEnabled = true
+		cfg.QueryCacheTTL = time.Minute
+		cfg.QueryCacheMaxEntries = 10
+		cfg.QueryCacheTimeResolution = time.Minute
+		tc := setupWithConfig(cfg)
+		tc.dataSourceCache.ds.Type = "metrics-cached"
+		tc.pluginContext.queryDataFn = respond(nil)
+		user := &models.SignedInUser{UserId: 1, OrgId: 1}
+
+		for i := 0; i < 2; i++ {
+			_, err := tc.queryService.QueryData(context.Background(), user, true, metricRequest(), false)
+			require.NoError(t, err)
+		}
+		require.Equal(t, uint64(1), histogramCount(t, "grafana_query_duration_seconds", labels("metrics-cached", false, false)))
+		require.Equal(t, uint64(1), histogramCount(t, "grafana_query_duration_seconds", labels("metrics-cached", true, false)))
 	})
 }
 
+func counterValue(t *testing.T, name string, labelName string, labelValue string) float64 {
+	t.Helper()
+
+	mfs, err := prometheus.DefaultGatherer.Gather()
+	require.NoError(t, err)
+	for _, mf := range mfs {
+		if mf.GetName() != name {
+			continue
+		}
+		for _, m := range mf.GetMetric() {
+			for _, l := range m.GetLabel() {
+				if l.GetName() == labelName && l.GetValue() == labelValue {
+					return m.GetCounter().GetValue()
+				}
+			}
+		}
+	}
+	return 0
+}
+
+// labeledMetric returns the metric of the default registry with the given
+// name and exactly the given labels, or nil when there is none.
+func labeledMetric(t *testing.T, name string, labels map[string]string) *dto.Metric {
+	t.Helper()
+
+	mfs, err := prometheus.DefaultGatherer.Gather()
+	require.NoError(t, err)
+	for _, mf := range mfs {
+		if mf.GetName() != name {
+			continue
+		}
+		for _, m := range mf.GetMetric() {
+			matches := len(m.GetLabel()) == len(labels)
+			for _, l := range m.GetLabel() {
+				if labels[l.GetName()] != l.GetValue() {
+					matches = false
+				}
+			}
+			if matches {
+				return m
+			}
+		}
+	}
+	return nil
+}
+
+func labeledCounterValue(t *testing.T, name string, labels map[string]string) float64 {
+	t.Helper()
+	return labeledMetric(t, name, labels).GetCounter().GetValue()
+}
+
+func histogramCount(t *testing.T, name string, labels map[string]string) uint64 {
+	t.Helper()
+	return labeledMetric(t, name, labels).GetHistogram().GetSampleCount()
+}
+
 func setup() *testContext {
+	return setupWithConfig(nil)
+}
+
+func setupWithConfig(cfg *setting.Cfg) *testContext {
+	return setupWithFeatures(cfg, featuremgmt.WithFeatures())
+}
+
+// setupWithDataSources returns a test context whose data sources are found by
+// their UID.
+func setupWithDataSources(dataSources ...*models.DataSource) *testContext {
+	tc := setup()
+	tc.dataSourceCache.byUID = make(map[string]*models.DataSource, len(dataSources))
+	for _, ds := range dataSources {
+		tc.dataSourceCache.byUID[ds.Uid] = ds
+	}
+	return tc
+}
+
+// setupEcho returns a test context whose plugin answers every query with an
+// empty frame named after its refId.
+func setupEcho() *testContext {
+	tc := setup()
+	tc.pluginContext.queryDataFn = echoRefIDs
+	return tc
+}
+
+// echoRefIDs answers every query with an empty frame named after its refId.
+func echoRefIDs(_ context.Context, req *backend.QueryDataRequest) (*backend.QueryDataResponse, error) {
+	resp := backend.NewQueryDataResponse()
+	for _, q := range req.Queries {
+		resp.Responses[q.RefID] = backend.DataResponse{Frames: data.Frames{data.NewFrame(q.RefID)}}
+	}
+	return resp, nil
+}
+
+// echoDataSourceUIDs answers every query with an empty frame named after its
+// data source.
+func echoDataSourceUIDs(_ context.Context, req *backend.QueryDataRequest) (*backend.QueryDataResponse, error) {
+	resp := backend.NewQueryDataResponse()
+	for _, q := range req.Queries {
+		resp.Responses[q.RefID] = backend.DataResponse{
+			Frames: data.Frames{data.NewFrame(req.PluginContext.DataSourceInstanceSettings.UID)},
+		}
+	}
+	return resp, nil
+}
+
+func setupWithFeatures(cfg *setting.Cfg, features featuremgmt.FeatureToggles) *testContext {
 	pc := &fakePluginClient{}
+	ps := &fakePluginStore{}
+	pss := &fakePluginSettings{}
+	dp := &fakeDataSourcePermissions{}
 	sc := &fakeSecretsService{}
 	dc := &fakeDataSourceCache{ds: &models.DataSource{}}
 	tc := &fakeOAuthTokenService{}
 	rv := &fakePluginRequestValidator{}
+	tr := &fakeTracer{}
+	es := expr.ProvideService(&setting.Cfg{ExpressionsEnabled: true}, pc, sc)
 
 	return &testContext{
 		pluginContext:          pc,
+		pluginStore:            ps,
+		pluginSettings:         pss,
+		dataSourcePermissions:  dp,
 		secretService:          sc,
 		dataSourceCache:        dc,
 		oauthTokenService:      tc,
 		pluginRequestValidator: rv,
-		queryService:           query.ProvideService(nil, dc, nil, rv, sc, pc, tc),
+		tracer:                 tr,
+		queryService:           query.ProvideService(cfg, dc, es, rv, sc, pc, ps, pss, dp, tc, tr, features),
 	}
 }
 
 type testContext struct {
 	pluginContext          *fakePluginClient
+	pluginStore            *fakePluginStore
+	pluginSettings         *fakePluginSettings
+	dataSourcePermissions  *fakeDataSourcePermissions
 	secretService          *fakeSecretsService
 	dataSourceCache        *fakeDataSourceCache
 	oauthTokenService      *fakeOAuthTokenService
 	pluginRequestValidator *fakePluginRequestValidator
+	tracer                 *fakeTracer
 	queryService           *query.Service
 }
 
 func metricRequest() dtos.MetricRequest {
-	q, _ := simplejson.NewJson([]byte(`{"datasourceId":1}`))
+	q, _ := simplejson.NewJson([]byte(`{"refId":"A","datasourceId":1}`))
 	return dtos.MetricRequest{
 		From:    "",
 		To:      "",
@@ -87,56 +2376,270 @@ func metricRequest() dtos.MetricRequest {
 	}
 }
 
+func expressionRequest(queries ...string) dtos.MetricRequest {
+	req := dtos.MetricRequest{}
+	for _, q := range queries {
+		j, _ := simplejson.NewJson([]byte(q))
+		req.Queries = append(req.Queries, j)
+	}
+	return req
+}
+
+// numberValue returns the single value of a number expression result.
+func numberValue(t *testing.T, res backend.DataResponse) float64 {
+	t.Helper()
+	require.NoError(t, res.Error)
+	require.Len(t, res.Frames, 1)
+	val, ok := res.Frames[0].At(0, 0).(*float64)
+	require.True(t, ok)
+	require.NotNil(t, val)
+	return *val
+}
+
 type fakePluginRequestValidator struct {
-	err error
+	mu     sync.Mutex
+	err    error
+	dsURLs []string
 }
 
 func (rv *fakePluginRequestValidator) Validate(dsURL string, req *http.Request) error {
+	rv.mu.Lock()
+	defer rv.mu.Unlock()
+	rv.dsURLs = append(rv.dsURLs, dsURL)
 	return rv.err
 }
 
+// fakeQueryRequestValidator records the refIds of the queries validated per
+// data source and denies the data sources in denied.
+type fakeQueryRequestValidator struct {
+	fakePluginRequestValidator
+	denied map[string]bool
+	refIDs map[string][]string
+}
+
+func (rv *fakeQueryRequestValidator) ValidateQueries(_ context.Context, ds *models.DataSource, queries []backend.DataQuery) error {
+	rv.mu.Lock()
+	defer rv.mu.Unlock()
+	if rv.refIDs == nil {
+		rv.refIDs = map[string][]string{}
+	}
+	for _, q := range queries {
+		rv.refIDs[ds.Uid] = append(rv.refIDs[ds.Uid], q.RefID)
+	}
+	if rv.denied[ds.Uid] {
+		return errors.New("denied")
+	}
+	return nil
+}
+
 type fakeOAuthTokenService struct {
 	passThruEnabled bool
 	token           *oauth2.Token
+	err             error
 }
 
 func (ts *fakeOAuthTokenService) GetCurrentOAuthToken(context.Context, *models.SignedInUser) *oauth2.Token {
 	return ts.token
 }
 
-func (ts *fakeOAuthTokenService) IsOAuthPassThruEnabled(*models.DataSource) bool {
-	return ts.passThruEnabled
+func (ts *fakeOAuthTokenService) GetValidOAuthToken(context.Context, *models.SignedInUser) (*oauth2.Token, error) {
+	return ts.token, ts.err
+}
+
+func (ts *fakeOAuthTokenService) TryTokenRefresh(context.Context, *models.SignedInUser) (*oauth2.Token, error) {
+	return ts.token, ts.err
+}
+
+func (ts *fakeOAuthTokenService) HasExpired(token *oauth2.Token) bool {
+	return token != nil && !token.Expiry.IsZero() && token.Expiry.Before(time.Now())
+}
+
+func (ts *fakeOAuthTokenService) IsOAuthPassThruEnabled(ds *models.DataSource) bool {
+	return ts.passThruEnabled || (ds.JsonData != nil && ds.JsonData.Get("oauthPassThru").MustBool())
 }
 
 type fakeSecretsService struct {
 	secrets.Service
 
 	decryptedJson map[string]string
+
+	mu          sync.Mutex
+	decryptions int
 }
 
 func (s *fakeSecretsService) DecryptJsonData(ctx context.Context, sjd map[string][]byte) (map[string]string, error) {
+	s.mu.Lock()
+	s.decryptions++
+	s.mu.Unlock()
 	return s.decryptedJson, nil
 }
 
 type fakeDataSourceCache struct {
-	ds *models.DataSource
+	ds        *models.DataSource
+	byUID     map[string]*models.DataSource
+	byName    map[string]*models.DataSource
+	defaultDS *models.DataSource
+	ambiguous map[string]bool
+	missing   map[string]bool
+
+	// lookups counts the lookups by ID, UID and name.
+	lookups map[string]int
+}
+
+func (c *fakeDataSourceCache) countLookup(key string) {
+	if c.lookups == nil {
+		c.lookups = map[string]int{}
+	}
+	c.lookups[key]++
 }
 
 func (c *fakeDataSourceCache) GetDatasource(ctx context.Context, datasourceID int64, user *models.SignedInUser, skipCache bool) (*models.DataSource, error) {
+	c.countLookup(fmt.Sprintf("id:%d", datasourceID))
 	return c.ds, nil
 }
 
 func (c *fakeDataSourceCache) GetDatasourceByUID(ctx context.Context, datasourceUID string, user *models.SignedInUser, skipCache bool) (*models.DataSource, error) {
+	c.countLookup("uid:" + datasourceUID)
+	if ds, ok := c.byUID[datasourceUID]; ok {
+		return ds, nil
+	}
+	if _, ok := c.byName[datasourceUID]; ok || c.ambiguous[datasourceUID] || c.missing[datasourceUID] {
+		return nil, models.ErrDataSourceNotFound
+	}
 	return c.ds, nil
 }
 
+func (c *fakeDataSourceCache) GetDatasourceByName(ctx context.Context, name string, user *models.SignedInUser, skipCache bool) (*models.DataSource, error) {
+	c.countLookup("name:" + name)
+	if c.ambiguous[name] {
+		return nil, models.ErrDataSourceNameAmbiguous
+	}
+	if ds, ok := c.byName[name]; ok {
+		return ds, nil
+	}
+	return nil, models.ErrDataSourceNotFound
+}
+
+func (c *fakeDataSourceCache) GetDefaultDatasource(ctx context.Context, user *models.SignedInUser, skipCache bool) (*models.DataSource, error) {
+	if c.defaultDS == nil {
+		return nil, models.ErrDataSourceNotFound
+	}
+	return c.defaultDS, nil
+}
+
 type fakePluginClient struct {
 	plugins.Client
 
-	req *backend.QueryDataRequest
+	mu          sync.Mutex
+	req         *backend.QueryDataRequest
+	queryDataFn func(ctx context.Context, req *backend.QueryDataRequest) (*backend.QueryDataResponse, error)
 }
 
 func (c *fakePluginClient) QueryData(ctx context.Context, req *backend.QueryDataRequest) (*backend.QueryDataResponse, error) {
+	c.mu.Lock()
 	c.req = req
+	c.mu.Unlock()
+
+	if c.queryDataFn != nil {
+		return c.queryDataFn(ctx, req)
+	}
 	return nil, nil
 }
+
+type fakePluginStore struct {
+	plugins.Store
+
+	plugins map[string]plugins.PluginDTO
+}
+
+func (s *fakePluginStore) Plugin(_ context.Context, pluginID string) (plugins.PluginDTO, bool) {
+	p, exists := s.plugins[pluginID]
+	return p, exists
+}
+
+type fakePluginSettings struct {
+	pluginsettings.Service
+
+	settings map[string]*models.PluginSetting
+}
+
+func (s *fakePluginSettings) GetPluginSettingById(_ context.Context, query *models.GetPluginSettingByIdQuery) error {
+	setting, exists := s.settings[query.PluginId]
+	if !exists {
+		return models.ErrPluginSettingNotFound
+	}
+	query.Result = setting
+	return nil
+}
+
+// fakeDataSourcePermissions denies queries to the data sources in denied and
+// allows all others.
+type fakeDataSourcePermissions struct {
+	denied map[string]bool
+}
+
+func (p *fakeDataSourcePermissions) FilterDatasourcesBasedOnQueryPermissions(_ context.Context, cmd *models.DatasourcesPermissionFilterQuery) error {
+	if p.denied == nil {
+		return permissions.ErrNotImplemented
+	}
+	cmd.Result = []*models.DataSource{}
+	for _, ds := range cmd.Datasources {
+		if !p.denied[ds.Uid] {
+			cmd.Result = append(cmd.Result, ds)
+		}
+	}
+	return nil
+}
+
+type fakeAuditSink struct {
+	mu                   sync.Mutex
+	records              []query.AuditRecord
+	oauthPassThruRecords []query.OAuthPassThruAuditRecord
+}
+
+func (s *fakeAuditSink) Record(_ context.Context, record query.AuditRecord) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.records = append(s.records, record)
+}
+
+func (s *fakeAuditSink) RecordOAuthPassThru(_ context.Context, record query.OAuthPassThruAuditRecord) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.oauthPassThruRecords = append(s.oauthPassThruRecords, record)
+}
+
+type fakeTracer struct {
+	tracing.Tracer
+
+	mu    sync.Mutex
+	spans []*fakeSpan
+}
+
+func (t *fakeTracer) Start(ctx context.Context, spanName string, opts ...trace.SpanStartOption) (context.Context, tracing.Span) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	span := &fakeSpan{name: spanName, attributes: map[string]interface{}{}}
+	t.spans = append(t.spans, span)
+	return ctx, span
+}
+
+func (t *fakeTracer) Inject(ctx context.Context, header http.Header, span tracing.Span) {
+	header.Set("Traceparent", "fake-trace")
+}
+
+type fakeSpan struct {
+	tracing.Span
+
+	name       string
+	ended      bool
+	attributes map[string]interface{}
+}
+
+func (s *fakeSpan) End() {
+	s.ended = true
+}
+
+func (s *fakeSpan) SetAttributes(key string, value interface{}, kv attribute.KeyValue) {
+	s.attributes[key] = value
+}
@@ -0,0 +1,111 @@
+package query
+
+import (
+	"sync"
+	"time"
+
+	"github.com/grafana/grafana/pkg/models"
+	"github.com/grafana/grafana/pkg/setting"
+)
+
+type quotaKey struct {
+	orgID         int64
+	datasourceUID string
+}
+
+// quotaLimits are the limits applied to the queries of a data source. A limit
+// of zero means unlimited.
+type quotaLimits struct {
+	maxConcurrent int
+	maxPerMinute  int
+}
+
+func (l quotaLimits) unlimited() bool {
+	return l.maxConcurrent <= 0 && l.maxPerMinute <= 0
+}
+
+// configQuotaLimits returns the instance wide limits from the configuration.
+func configQuotaLimits(cfg *setting.Cfg) quotaLimits {
+	if cfg == nil {
+		return quotaLimits{}
+	}
+	return quotaLimits{
+		maxConcurrent: cfg.QueryDataSourceMaxConcurrent,
+		maxPerMinute:  cfg.QueryDataSourceMaxPerMinute,
+	}
+}
+
+// dataSourceQuotaLimits returns the limits configured in the json data of the
+// data source with the maxConcurrentQueries and maxQueriesPerMinute options.
+func dataSourceQuotaLimits(ds *models.DataSource) quotaLimits {
+	if ds.JsonData == nil {
+		return quotaLimits{}
+	}
+	return quotaLimits{
+		maxConcurrent: ds.JsonData.Get("maxConcurrentQueries").MustInt(0),
+		maxPerMinute:  ds.JsonData.Get("maxQueriesPerMinute").MustInt(0),
+	}
+}
+
+// quotaTracker keeps in-memory accounting of in-flight and recently started
+// queries per organization and data source.
+type quotaTracker struct {
+	mu       sync.Mutex
+	inFlight map[quotaKey]int
+	started  map[quotaKey][]time.Time
+	now      func() time.Time
+}
+
+func newQuotaTracker() *quotaTracker {
+	return &quotaTracker{
+		inFlight: map[quotaKey]int{},
+		started:  map[quotaKey][]time.Time{},
+		now:      time.Now,
+	}
+}
+
+// acquire reserves a query slot for the data source within the given limits.
+// The returned release function must be called once the query finished, it is
+// safe to call it more than once.
+func (t *quotaTracker) acquire(orgID int64, datasourceUID string, limits quotaLimits) (func(), error) {
+	if limits.unlimited() {
+		return func() {}, nil
+	}
+
+	key := quotaKey{orgID: orgID, datasourceUID: datasourceUID}
+	now := t.now()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if limits.maxConcurrent > 0 && t.inFlight[key] >= limits.maxConcurrent {
+		return nil, &ErrQuotaExceeded{DatasourceUID: datasourceUID, RetryAfter: time.Second}
+	}
+
+	if limits.maxPerMinute > 0 {
+		started := t.started[key]
+		windowStart := now.Add(-time.Minute)
+		for len(started) > 0 && !started[0].After(windowStart) {
+			started = started[1:]
+		}
+		if len(started) >= limits.maxPerMinute {
+			t.started[key] = started
+			return nil, &ErrQuotaExceeded{DatasourceUID: datasourceUID, RetryAfter: started[0].Sub(windowStart)}
+		}
+		t.started[key] = append(started, now)
+	}
+
+	t.inFlight[key]++
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			t.inFlight[key]--
+			if t.inFlight[key] <= 0 {
+				delete(t.inFlight, key)
+			}
+		})
+	}, nil
+}
@@ -0,0 +1,32 @@
+package query
+
+import (
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+// withNotice returns a copy of the data response with the notice added to the
+// metadata of every frame. Frames are copied so that responses shared with
+// other requests, e.g. through the query cache, are never modified.
+func withNotice(dr backend.DataResponse, refID string, notice data.Notice) backend.DataResponse {
+	frames := make(data.Frames, 0, len(dr.Frames))
+	for _, f := range dr.Frames {
+		frame := *f
+		meta := data.FrameMeta{}
+		if f.Meta != nil {
+			meta = *f.Meta
+		}
+		meta.Notices = append(append([]data.Notice{}, meta.Notices...), notice)
+		frame.Meta = &meta
+		frames = append(frames, &frame)
+	}
+
+	if len(frames) == 0 {
+		frame := data.NewFrame("").SetMeta(&data.FrameMeta{Notices: []data.Notice{notice}})
+		frame.RefID = refID
+		frames = append(frames, frame)
+	}
+
+	dr.Frames = frames
+	return dr
+}
@@ -0,0 +1,89 @@
+package query
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"syscall"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/grafana/grafana/pkg/plugins/backendplugin"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// isTransientError reports whether a failed plugin call is likely to succeed
+// when retried, e.g. while the plugin process is restarting.
+func isTransientError(err error) bool {
+	if errors.Is(err, backendplugin.ErrPluginUnavailable) || errors.Is(err, syscall.ECONNREFUSED) {
+		return true
+	}
+
+	var grpcErr interface{ GRPCStatus() *status.Status }
+	if errors.As(err, &grpcErr) {
+		return grpcErr.GRPCStatus().Code() == codes.Unavailable
+	}
+	return false
+}
+
+// retryBackoff returns the jittered exponential delay before the given retry,
+// starting at one.
+func retryBackoff(initial time.Duration, retry int) time.Duration {
+	backoff := initial << (retry - 1)
+	// nolint:gosec
+	// The jitter only spreads retries over time and does not need a secure source.
+	return backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+}
+
+// queryDataWithRetry calls the plugin, retrying transient errors with a
+// jittered exponential backoff. Retries are given up when the context would
+// expire before the next attempt.
+func (s *Service) queryDataWithRetry(ctx context.Context, req *backend.QueryDataRequest) (*backend.QueryDataResponse, error) {
+	maxRetries, initialBackoff := 0, time.Duration(0)
+	if s.cfg != nil {
+		maxRetries, initialBackoff = s.cfg.QueryMaxRetries, s.cfg.QueryRetryBackoff
+	}
+
+	for retry := 0; ; retry++ {
+		resp, err := s.pluginClient.QueryData(ctx, req)
+		if err == nil {
+			if retry > 0 && resp != nil {
+				markRetried(resp, retry)
+			}
+			return resp, nil
+		}
+		if retry >= maxRetries || !isTransientError(err) {
+			return nil, err
+		}
+
+		wait := retryBackoff(initialBackoff, retry+1)
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < wait {
+			return nil, err
+		}
+
+		s.log.Warn("Retrying data source query after transient error", "plugin", req.PluginContext.PluginID, "retry", retry+1, "error", err)
+		queryRetries.WithLabelValues(req.PluginContext.PluginID).Inc()
+		queryStatsFromContext(ctx).retried = true
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, err
+		case <-timer.C:
+		}
+	}
+}
+
+func markRetried(resp *backend.QueryDataResponse, retries int) {
+	notice := data.Notice{
+		Severity: data.NoticeSeverityInfo,
+		Text:     fmt.Sprintf("Query succeeded after %d retries", retries),
+	}
+	for refID, res := range resp.Responses {
+		resp.Responses[refID] = withNotice(res, refID, notice)
+	}
+}
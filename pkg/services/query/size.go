@@ -0,0 +1,63 @@
+package query
+
+import (
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana/pkg/models"
+)
+
+// maxResponseSize returns the maximum serialized size in bytes of the data
+// returned for a single query. The maxResponseSize json data option takes
+// precedence over the configured default. Zero means unlimited.
+func (s *Service) maxResponseSize(ds *models.DataSource) int64 {
+	if ds.JsonData != nil {
+		if size := ds.JsonData.Get("maxResponseSize").MustInt64(0); size > 0 {
+			return size
+		}
+	}
+	if s.cfg == nil {
+		return 0
+	}
+	return s.cfg.QueryMaxResponseSize
+}
+
+// limitResponseSize replaces the data of every query whose frames exceed the
+// data source response size limit with an ErrResponseTooLarge. The responses
+// of the other queries are left untouched.
+func (s *Service) limitResponseSize(ds *models.DataSource, resp *backend.QueryDataResponse) *backend.QueryDataResponse {
+	limit := s.maxResponseSize(ds)
+	if limit <= 0 || resp == nil {
+		return resp
+	}
+
+	for refID, dr := range resp.Responses {
+		if dr.Error != nil {
+			continue
+		}
+		size, err := responseSize(dr)
+		if err != nil {
+			s.log.Warn("Failed to compute the size of a query response", "datasource", ds.Uid, "refId", refID, "error", err)
+			continue
+		}
+		if size > limit {
+			s.log.Warn("Query response too large", "datasource", ds.Uid, "refId", refID, "size", size, "limit", limit)
+			resp.Responses[refID] = backend.DataResponse{
+				Error: &ErrResponseTooLarge{RefID: refID, Size: size, Limit: limit},
+			}
+		}
+	}
+	return resp
+}
+
+// responseSize returns the size of the frames of the response once encoded
+// to Arrow, the format used to send them to the frontend.
+func responseSize(dr backend.DataResponse) (int64, error) {
+	var size int64
+	for _, f := range dr.Frames {
+		b, err := f.MarshalArrow()
+		if err != nil {
+			return 0, err
+		}
+		size += int64(len(b))
+	}
+	return size, nil
+}
@@ -0,0 +1,51 @@
+package query
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana/pkg/models"
+)
+
+// queryTimeout returns how long a query against the data source may run.
+// The queryTimeout json data option (in seconds) takes precedence over the
+// configured default. Zero means no timeout.
+func (s *Service) queryTimeout(ds *models.DataSource) time.Duration {
+	if ds.JsonData != nil {
+		if seconds := ds.JsonData.Get("queryTimeout").MustInt(0); seconds > 0 {
+			return time.Duration(seconds) * time.Second
+		}
+	}
+	if s.cfg == nil {
+		return 0
+	}
+	return s.cfg.QueryTimeout
+}
+
+// queryDataWithTimeout calls the plugin with a context bound to the data
+// source query timeout. When the timeout is reached every query in the
+// request gets an ErrQueryTimeout instead of failing the whole request.
+func (s *Service) queryDataWithTimeout(ctx context.Context, ds *models.DataSource, req *backend.QueryDataRequest) (*backend.QueryDataResponse, error) {
+	timeout := s.queryTimeout(ds)
+	if timeout <= 0 {
+		return s.queryDataWithRetry(ctx, req)
+	}
+
+	queryCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	resp, err := s.queryDataWithRetry(queryCtx, req)
+	if err != nil && ctx.Err() == nil && errors.Is(queryCtx.Err(), context.DeadlineExceeded) {
+		s.log.Warn("Data source query timed out", "datasource", ds.Uid, "timeout", timeout)
+		resp = backend.NewQueryDataResponse()
+		for _, q := range req.Queries {
+			resp.Responses[q.RefID] = backend.DataResponse{
+				Error: &ErrQueryTimeout{RefID: q.RefID, Timeout: timeout},
+			}
+		}
+		return resp, nil
+	}
+	return resp, err
+}
@@ -0,0 +1,52 @@
+package query
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/google/uuid"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana/pkg/models"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+const requestIDHeader = "X-Request-Id"
+
+type requestIDKey struct{}
+
+// WithRequestID returns a copy of ctx carrying the ID of the incoming request.
+// The ID is forwarded to data source plugins in the X-Request-Id header.
+func WithRequestID(ctx context.Context, requestID string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, requestID)
+}
+
+func requestIDFromContext(ctx context.Context) string {
+	requestID, _ := ctx.Value(requestIDKey{}).(string)
+	return requestID
+}
+
+// ensureRequestID makes sure a request ID is available in the context,
+// generating one when the incoming request did not provide any.
+func ensureRequestID(ctx context.Context) context.Context {
+	if requestIDFromContext(ctx) != "" {
+		return ctx
+	}
+	return WithRequestID(ctx, uuid.NewString())
+}
+
+// startQuerySpan opens a span for a data source call and propagates the trace
+// context and request ID to the plugin through the request headers.
+func (s *Service) startQuerySpan(ctx context.Context, ds *models.DataSource, req *backend.QueryDataRequest) (context.Context, func()) {
+	ctx, span := s.tracer.Start(ctx, "query.QueryData")
+	span.SetAttributes("datasource.uid", ds.Uid, attribute.String("datasource.uid", ds.Uid))
+	span.SetAttributes("datasource.type", ds.Type, attribute.String("datasource.type", ds.Type))
+
+	header := http.Header{}
+	s.tracer.Inject(ctx, header, span)
+	for k := range header {
+		req.Headers[k] = header.Get(k)
+	}
+	req.Headers[requestIDHeader] = requestIDFromContext(ctx)
+
+	return ctx, span.End
+}
@@ -0,0 +1,215 @@
+package query
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/grafana/grafana/pkg/api/dtos"
+	"github.com/grafana/grafana/pkg/expr"
+	"github.com/grafana/grafana/pkg/models"
+	"github.com/grafana/grafana/pkg/services/datasources/permissions"
+	"github.com/grafana/grafana/pkg/services/oauthtoken"
+	"github.com/grafana/grafana/pkg/tsdb/grafanads"
+)
+
+// QueryValidationStatus is the outcome of validating a query.
+type QueryValidationStatus string
+
+const (
+	QueryValidationOK      QueryValidationStatus = "ok"
+	QueryValidationWarning QueryValidationStatus = "warning"
+	QueryValidationError   QueryValidationStatus = "error"
+)
+
+// QueryValidation reports whether a query of a request could be sent to its
+// data source, and which data source it was resolved to.
+type QueryValidation struct {
+	RefID          string                `json:"refId"`
+	DatasourceUID  string                `json:"datasourceUid"`
+	DatasourceType string                `json:"datasourceType"`
+	Status         QueryValidationStatus `json:"status"`
+	Warnings       []string              `json:"warnings"`
+	Errors         []string              `json:"errors"`
+}
+
+// ValidationReport is the result of validating a query request, with the
+// queries in the order of the request.
+type ValidationReport struct {
+	Status  QueryValidationStatus `json:"status"`
+	Queries []QueryValidation     `json:"queries"`
+}
+
+// dataSourceValidation holds the problems found with a data source, shared by
+// all the queries of the request using it.
+type dataSourceValidation struct {
+	warnings []string
+	errors   []string
+}
+
+// ValidateQueries resolves the queries of the request like QueryData does,
+// without querying the data sources. Requests QueryData would reject are
+// rejected with the same error, problems of single queries and their data
+// sources are reported per query.
+func (s *Service) ValidateQueries(ctx context.Context, user *models.SignedInUser, skipCache bool, reqDTO dtos.MetricRequest) (*ValidationReport, error) {
+	ctx = withRequestMemo(ctx)
+	parsedReq, err := s.parseMetricRequest(ctx, user, skipCache, reqDTO)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &ValidationReport{
+		Status:  QueryValidationOK,
+		Queries: make([]QueryValidation, 0, len(parsedReq.parsedQueries)),
+	}
+	groups := map[string]*parsedRequest{}
+	for _, group := range groupByDataSource(parsedReq) {
+		groups[group.parsedQueries[0].datasource.Uid] = group
+	}
+	validated := map[string]*dataSourceValidation{}
+	for _, pq := range parsedReq.parsedQueries {
+		dsv, ok := validated[pq.datasource.Uid]
+		if !ok {
+			dsv = s.validateDataSource(ctx, user, pq.datasource, groups[pq.datasource.Uid])
+			validated[pq.datasource.Uid] = dsv
+		}
+
+		qv := QueryValidation{
+			RefID:          pq.query.RefID,
+			DatasourceUID:  pq.datasource.Uid,
+			DatasourceType: pq.datasource.Type,
+			Status:         QueryValidationOK,
+			Warnings:       []string{},
+			Errors:         append([]string{}, dsv.errors...),
+		}
+		for _, notice := range pq.notices {
+			qv.Warnings = append(qv.Warnings, notice.Text)
+		}
+		qv.Warnings = append(qv.Warnings, dsv.warnings...)
+
+		switch {
+		case len(qv.Errors) > 0:
+			qv.Status = QueryValidationError
+			report.Status = QueryValidationError
+		case len(qv.Warnings) > 0:
+			qv.Status = QueryValidationWarning
+			if report.Status == QueryValidationOK {
+				report.Status = QueryValidationWarning
+			}
+		}
+		report.Queries = append(report.Queries, qv)
+	}
+	return report, nil
+}
+
+// validateDataSource runs the checks handleQueryData does before sending a
+// request to the data source with the queries of the group.
+func (s *Service) validateDataSource(ctx context.Context, user *models.SignedInUser, ds *models.DataSource, group *parsedRequest) *dataSourceValidation {
+	dsv := &dataSourceValidation{}
+
+	// Expressions and the built-in Grafana data source are handled by Grafana
+	// itself rather than by a data source plugin.
+	if expr.IsDataSource(ds.Uid) || ds.Uid == grafanads.DatasourceUID {
+		return dsv
+	}
+
+	if err := s.validateRequest(ctx, ds, group); err != nil {
+		dsv.errors = append(dsv.errors, err.Error())
+	}
+
+	if msg := s.validatePermission(ctx, user, ds); msg != "" {
+		dsv.errors = append(dsv.errors, msg)
+	}
+
+	if msg := s.validatePlugin(ctx, ds); msg != "" {
+		dsv.errors = append(dsv.errors, msg)
+	}
+
+	if _, err := s.decryptSecureJsonData(ctx, ds); err != nil {
+		dsv.errors = append(dsv.errors, err.Error())
+	}
+
+	if s.oAuthTokenService.IsOAuthPassThruEnabled(ds) {
+		if err := ValidateOAuthPassThruHeader(ds); err != nil {
+			dsv.errors = append(dsv.errors, err.Error())
+		}
+		if err := oauthIdentityRequired(ds, user); err != nil {
+			dsv.errors = append(dsv.errors, err.Error())
+			return dsv
+		}
+		token, err := s.oAuthTokenService.GetValidOAuthToken(ctx, user)
+		switch {
+		case errors.Is(err, oauthtoken.ErrTokenRefreshFailed):
+			dsv.errors = append(dsv.errors, (&ErrOAuthTokenRefresh{Err: err}).Error())
+		case token == nil:
+			dsv.warnings = append(dsv.warnings, "The data source forwards OAuth identity, but there is no OAuth token to forward for the signed in user")
+		default:
+			if missing := oauthtoken.MissingScopes(token, requiredScopes(ds)); len(missing) > 0 {
+				dsv.errors = append(dsv.errors, (&ErrOAuthScopesMissing{DatasourceName: ds.Name, MissingScopes: missing}).Error())
+			}
+			if header := idTokenHeader(ds); header != "" {
+				if _, ok := oauthtoken.IDToken(token); !ok {
+					dsv.warnings = append(dsv.warnings, fmt.Sprintf("There is no ID token to forward in the %s header", header))
+				}
+			}
+		}
+	}
+	return dsv
+}
+
+// validatePermission returns why the user may not query the data source, or
+// an empty string when they may.
+func (s *Service) validatePermission(ctx context.Context, user *models.SignedInUser, ds *models.DataSource) string {
+	query := models.DatasourcesPermissionFilterQuery{
+		User:        user,
+		Datasources: []*models.DataSource{ds},
+	}
+	if err := s.dataSourcePermissions.FilterDatasourcesBasedOnQueryPermissions(ctx, &query); err != nil {
+		if errors.Is(err, permissions.ErrNotImplemented) {
+			return ""
+		}
+		s.log.Error("Failed to check data source permissions", "datasource", ds.Uid, "error", err)
+		return "Failed to check the permissions of the data source"
+	}
+	if len(query.Result) == 0 {
+		return models.ErrDataSourceAccessDenied.Error()
+	}
+	return ""
+}
+
+// validatePlugin returns why the plugin of the data source can't be queried,
+// or an empty string when it can. Plugins included in an app are disabled
+// unless the app is enabled, like in the frontend settings.
+func (s *Service) validatePlugin(ctx context.Context, ds *models.DataSource) string {
+	plugin, exists := s.pluginStore.Plugin(ctx, ds.Type)
+	if !exists {
+		return fmt.Sprintf("Plugin %q of the data source is not installed", ds.Type)
+	}
+
+	enabled, err := s.pluginEnabled(ctx, ds.OrgId, plugin.ID)
+	if errors.Is(err, models.ErrPluginSettingNotFound) {
+		enabled, err = true, nil
+		if plugin.IncludedInAppID != "" {
+			enabled, err = s.pluginEnabled(ctx, ds.OrgId, plugin.IncludedInAppID)
+			if errors.Is(err, models.ErrPluginSettingNotFound) {
+				enabled, err = false, nil
+			}
+		}
+	}
+	if err != nil {
+		s.log.Error("Failed to get plugin settings", "pluginId", plugin.ID, "error", err)
+		return fmt.Sprintf("Failed to get the settings of plugin %q", plugin.ID)
+	}
+	if !enabled {
+		return fmt.Sprintf("Plugin %q of the data source is not enabled", plugin.ID)
+	}
+	return ""
+}
+
+func (s *Service) pluginEnabled(ctx context.Context, orgID int64, pluginID string) (bool, error) {
+	query := &models.GetPluginSettingByIdQuery{PluginId: pluginID, OrgId: orgID}
+	if err := s.pluginSettings.GetPluginSettingById(ctx, query); err != nil {
+		return false, err
+	}
+	return query.Result.Enabled, nil
+}
@@ -0,0 +1,171 @@
+package query
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/grafana/grafana/pkg/api/dtos"
+	"github.com/grafana/grafana/pkg/components/simplejson"
+	"github.com/grafana/grafana/pkg/models"
+)
+
+const (
+	// mixedDataSourceUID is the data source of panels whose queries reference
+	// their data sources themselves.
+	mixedDataSourceUID = "-- Mixed --"
+
+	// The panel queries are validated with a fixed time range, which is only
+	// needed to build the requests.
+	validationFrom = "now-6h"
+	validationTo   = "now"
+)
+
+// PanelValidationStatus is the outcome of validating a dashboard panel.
+type PanelValidationStatus string
+
+const (
+	PanelValidationQueryable    PanelValidationStatus = "queryable"
+	PanelValidationNotQueryable PanelValidationStatus = "notQueryable"
+	// PanelValidationNotApplicable is the status of the panels without
+	// queries, e.g. text panels, which have nothing to validate.
+	PanelValidationNotApplicable PanelValidationStatus = "notApplicable"
+)
+
+// PanelValidation reports whether the queries of a dashboard panel can be run.
+type PanelValidation struct {
+	PanelID   int64                 `json:"panelId"`
+	Title     string                `json:"title"`
+	Type      string                `json:"type"`
+	Status    PanelValidationStatus `json:"status"`
+	Queryable bool                  `json:"queryable"`
+	Reasons   []string              `json:"reasons"`
+	Warnings  []string              `json:"warnings"`
+	Queries   []QueryValidation     `json:"queries"`
+}
+
+// DashboardValidationReport is the result of validating the panels of a
+// dashboard, including the panels of collapsed rows. The dashboard is
+// queryable when none of its panels is not queryable, the panels without
+// queries are not taken into account.
+type DashboardValidationReport struct {
+	Queryable bool              `json:"queryable"`
+	Panels    []PanelValidation `json:"panels"`
+}
+
+// ValidateDashboard validates the queries of every panel of the dashboard like
+// ValidateQueries does, without querying the data sources. Rows are not
+// reported themselves, the panels of collapsed rows are.
+func (s *Service) ValidateDashboard(ctx context.Context, user *models.SignedInUser, skipCache bool, dashboard *simplejson.Json) *DashboardValidationReport {
+	report := &DashboardValidationReport{Queryable: true, Panels: []PanelValidation{}}
+	for _, panel := range dashboardPanels(dashboard) {
+		pv := s.validatePanel(ctx, user, skipCache, panel)
+		if pv.Status == PanelValidationNotQueryable {
+			report.Queryable = false
+		}
+		report.Panels = append(report.Panels, pv)
+	}
+	return report
+}
+
+func (s *Service) validatePanel(ctx context.Context, user *models.SignedInUser, skipCache bool, panel *simplejson.Json) PanelValidation {
+	pv := PanelValidation{
+		PanelID:  panel.Get("id").MustInt64(),
+		Title:    panel.Get("title").MustString(),
+		Type:     panel.Get("type").MustString(),
+		Status:   PanelValidationNotQueryable,
+		Reasons:  []string{},
+		Warnings: []string{},
+		Queries:  []QueryValidation{},
+	}
+
+	targets := panel.Get("targets").MustArray()
+	if len(targets) == 0 {
+		pv.Status = PanelValidationNotApplicable
+		return pv
+	}
+
+	reqDTO := dtos.MetricRequest{From: validationFrom, To: validationTo}
+	panelDataSource, hasPanelDataSource := panel.CheckGet("datasource")
+	for _, t := range targets {
+		target, ok := t.(map[string]interface{})
+		if !ok {
+			pv.Reasons = append(pv.Reasons, "Panel has an invalid query")
+			return pv
+		}
+
+		// Copy the target so that setting the data source and refId while
+		// validating leaves the dashboard unchanged.
+		query := simplejson.New()
+		for k, v := range target {
+			query.Set(k, v)
+		}
+		if target["datasource"] == nil {
+			switch {
+			case !hasPanelDataSource || panelDataSource.Interface() == nil:
+				query.Set("datasource", defaultDataSourceRef)
+			case dataSourceRefUID(panelDataSource) == mixedDataSourceUID:
+				pv.Reasons = append(pv.Reasons, fmt.Sprintf("Query %s of a panel with mixed data sources has no data source", query.Get("refId").MustString()))
+				return pv
+			default:
+				query.Set("datasource", panelDataSource.Interface())
+			}
+		}
+		reqDTO.Queries = append(reqDTO.Queries, query)
+	}
+
+	report, err := s.ValidateQueries(ctx, user, skipCache, reqDTO)
+	if err != nil {
+		pv.Reasons = append(pv.Reasons, validationErrorReason(err))
+		return pv
+	}
+
+	pv.Queries = report.Queries
+	for _, qv := range report.Queries {
+		for _, msg := range qv.Errors {
+			pv.Reasons = append(pv.Reasons, fmt.Sprintf("Query %s: %s", qv.RefID, msg))
+		}
+		for _, msg := range qv.Warnings {
+			pv.Warnings = append(pv.Warnings, fmt.Sprintf("Query %s: %s", qv.RefID, msg))
+		}
+	}
+	if report.Status != QueryValidationError {
+		pv.Status = PanelValidationQueryable
+		pv.Queryable = true
+	}
+	return pv
+}
+
+// dashboardPanels returns the panels of the dashboard in order, with the rows
+// replaced by the panels they contain when collapsed.
+func dashboardPanels(dashboard *simplejson.Json) []*simplejson.Json {
+	var panels []*simplejson.Json
+	for _, p := range dashboard.Get("panels").MustArray() {
+		panel := simplejson.NewFromAny(p)
+		if panel.Get("type").MustString() == "row" {
+			for _, nested := range panel.Get("panels").MustArray() {
+				panels = append(panels, simplejson.NewFromAny(nested))
+			}
+			continue
+		}
+		panels = append(panels, panel)
+	}
+	return panels
+}
+
+// dataSourceRefUID returns the uid of a data source reference, which is either
+// an object with the uid or, in the deprecated form, a plain string.
+func dataSourceRefUID(ref *simplejson.Json) string {
+	if uid, err := ref.Get("uid").String(); err == nil {
+		return uid
+	}
+	return ref.MustString()
+}
+
+func validationErrorReason(err error) string {
+	var badQuery *ErrBadQuery
+	if errors.As(err, &badQuery) {
+		return badQuery.Message
+	}
+	return err.Error()
+}
@@ -1,7 +1,15 @@
 package queryhistory
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/grafana/grafana/pkg/api/response"
 	"github.com/grafana/grafana/pkg/api/routing"
@@ -14,36 +22,192 @@ import (
 func (s *QueryHistoryService) registerAPIEndpoints() {
 	s.RouteRegister.Group("/api/query-history", func(entities routing.RouteRegister) {
 		entities.Post("/", middleware.ReqSignedIn, routing.Wrap(s.createHandler))
+		entities.Get("/", middleware.ReqSignedIn, routing.Wrap(s.searchHandler))
+		entities.Get("/activity", middleware.ReqSignedIn, routing.Wrap(s.activityHandler))
+		entities.Get("/settings", middleware.ReqSignedIn, routing.Wrap(s.getSettingsHandler))
+		entities.Put("/settings", middleware.ReqOrgAdmin, routing.Wrap(s.updateSettingsHandler))
+		entities.Get("/:uid", middleware.ReqSignedIn, routing.Wrap(s.getHandler))
+		entities.Get("/:uid/raw", middleware.ReqSignedIn, routing.Wrap(s.getRawHandler))
 		entities.Delete("/:uid", middleware.ReqSignedIn, routing.Wrap(s.deleteHandler))
 		entities.Post("/star/:uid", middleware.ReqSignedIn, routing.Wrap(s.starHandler))
 		entities.Delete("/star/:uid", middleware.ReqSignedIn, routing.Wrap(s.unstarHandler))
+		entities.Post("/:uid/duplicate", middleware.ReqSignedIn, routing.Wrap(s.duplicateHandler))
 		entities.Patch("/:uid", middleware.ReqSignedIn, routing.Wrap(s.patchCommentHandler))
+		entities.Post("/reassign", middleware.ReqOrgAdmin, routing.Wrap(s.reassignHandler))
+		entities.Post("/merge", middleware.ReqOrgAdmin, routing.Wrap(s.mergeHandler))
+		entities.Put("/star/:uid/folder", middleware.ReqSignedIn, routing.Wrap(s.assignFolderHandler))
+		entities.Get("/folders", middleware.ReqSignedIn, routing.Wrap(s.getFoldersHandler))
+		entities.Post("/folders", middleware.ReqSignedIn, routing.Wrap(s.createFolderHandler))
+		entities.Patch("/folders/:uid", middleware.ReqSignedIn, routing.Wrap(s.updateFolderHandler))
+		entities.Delete("/folders/:uid", middleware.ReqSignedIn, routing.Wrap(s.deleteFolderHandler))
 	})
 }
 
 func (s *QueryHistoryService) createHandler(c *models.ReqContext) response.Response {
 	cmd := CreateQueryInQueryHistoryCommand{}
 	if err := web.Bind(c.Req, &cmd); err != nil {
-		return response.Error(http.StatusBadRequest, "bad request data", err)
+		return badRequestResponse(err)
 	}
 
 	query, err := s.CreateQueryInQueryHistory(c.Req.Context(), c.SignedInUser, cmd)
 	if err != nil {
-		return response.Error(http.StatusInternalServerError, "Failed to create query history", err)
+		return errorResponse(err, "Failed to create query history")
 	}
 
 	return response.JSON(http.StatusOK, QueryHistoryResponse{Result: query})
 }
 
+func (s *QueryHistoryService) searchHandler(c *models.ReqContext) response.Response {
+	query := SearchInQueryHistoryQuery{
+		DatasourceUIDs:    c.QueryStrings("datasourceUid"),
+		AllDatasources:    c.QueryBoolWithDefault("allDatasources", false),
+		SearchString:      c.Query("searchString"),
+		SearchTerms:       c.QueryStrings("searchTerms"),
+		SearchOperator:    c.Query("searchOperator"),
+		OnlyStarred:       c.QueryBoolWithDefault("onlyStarred", false),
+		FolderUID:         c.Query("folderUid"),
+		QueryType:         c.Query("queryType"),
+		UIDPrefix:         c.Query("uidPrefix"),
+		Sort:              c.Query("sort"),
+		Page:              c.QueryInt("page"),
+		Limit:             c.QueryInt("limit"),
+		UIDsOnly:          c.QueryBoolWithDefault("uidsOnly", false),
+		GroupByDatasource: c.QueryBoolWithDefault("groupByDatasource", false),
+		WithPreview:       c.QueryBoolWithDefault("withPreview", false),
+		IncludeMixed:      c.QueryBoolWithDefault("includeMixed", false),
+	}
+
+	result, err := s.SearchInQueryHistory(c.Req.Context(), c.SignedInUser, query)
+	if err != nil {
+		return errorResponse(err, "Failed to get query history")
+	}
+
+	query.setDefaultPagination()
+	resp := response.JSON(http.StatusOK, QueryHistorySearchResponse{Result: result})
+	resp.SetHeader("X-Total-Count", strconv.FormatInt(result.TotalCount, 10))
+	resp.SetHeader("Link", s.paginationLinks(c.Req.Form, query.Page, query.Limit, result.TotalCount))
+	return resp
+}
+
+// paginationLinks returns the RFC 5988 Link header value pointing to the
+// first, previous, next and last pages of a search with the given parameters.
+func (s *QueryHistoryService) paginationLinks(params url.Values, page, limit int, total int64) string {
+	lastPage := int((total + int64(limit) - 1) / int64(limit))
+	if lastPage < 1 {
+		lastPage = 1
+	}
+
+	link := func(page int, rel string) string {
+		values := url.Values{}
+		for key, value := range params {
+			values[key] = value
+		}
+		values.Set("page", strconv.Itoa(page))
+		values.Set("limit", strconv.Itoa(limit))
+		return fmt.Sprintf(`<%s/api/query-history?%s>; rel="%s"`, s.Cfg.AppSubURL, values.Encode(), rel)
+	}
+
+	links := []string{link(1, "first")}
+	if page > 1 {
+		links = append(links, link(page-1, "prev"))
+	}
+	if page < lastPage {
+		links = append(links, link(page+1, "next"))
+	}
+	links = append(links, link(lastPage, "last"))
+	return strings.Join(links, ", ")
+}
+
+// activityHandler returns the number of queries added per bucket. The from and
+// to query parameters are in seconds since epoch and default to the last 30
+// days, the bucket parameter is a duration and defaults to one day.
+func (s *QueryHistoryService) activityHandler(c *models.ReqContext) response.Response {
+	to := time.Now()
+	if c.Query("to") != "" {
+		to = time.Unix(c.QueryInt64("to"), 0)
+	}
+	from := to.AddDate(0, 0, -30)
+	if c.Query("from") != "" {
+		from = time.Unix(c.QueryInt64("from"), 0)
+	}
+	bucket := 24 * time.Hour
+	if c.Query("bucket") != "" {
+		var err error
+		if bucket, err = time.ParseDuration(c.Query("bucket")); err != nil {
+			return errorResponse(ErrInvalidActivityRange, "")
+		}
+	}
+
+	buckets, err := s.GetActivityInQueryHistory(c.Req.Context(), c.SignedInUser, from, to, bucket)
+	if err != nil {
+		return errorResponse(err, "Failed to get query history activity")
+	}
+
+	return response.JSON(http.StatusOK, QueryHistoryActivityResponse{Result: buckets})
+}
+
+func (s *QueryHistoryService) getHandler(c *models.ReqContext) response.Response {
+	queryUID := web.Params(c.Req)[":uid"]
+	if len(queryUID) > 0 && !util.IsValidShortUID(queryUID) {
+		return errorResponse(ErrQueryNotFound, "")
+	}
+
+	query, err := s.GetQueryInQueryHistory(c.Req.Context(), c.SignedInUser, queryUID)
+	if err != nil {
+		return errorResponse(err, "Failed to get query from query history")
+	}
+
+	resp := response.JSON(http.StatusOK, QueryHistoryResponse{Result: query})
+	etag := entityTag(resp.Body())
+	if etagMatches(c.Req.Header.Get("If-None-Match"), etag) {
+		return response.Respond(http.StatusNotModified, []byte{}).SetHeader("ETag", etag)
+	}
+	return resp.SetHeader("ETag", etag)
+}
+
+// entityTag returns the ETag of a response body, which changes whenever the
+// query, its comment or its starred state change.
+func entityTag(body []byte) string {
+	sum := sha256.Sum256(body)
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// etagMatches tells whether the If-None-Match header value lists the ETag.
+// Weak tags match their strong counterpart, as If-None-Match uses the weak
+// comparison.
+func etagMatches(ifNoneMatch, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *QueryHistoryService) getRawHandler(c *models.ReqContext) response.Response {
+	queryUID := web.Params(c.Req)[":uid"]
+	if len(queryUID) > 0 && !util.IsValidShortUID(queryUID) {
+		return errorResponse(ErrQueryNotFound, "")
+	}
+
+	raw, err := s.GetRawQueryInQueryHistory(c.Req.Context(), c.SignedInUser, queryUID)
+	if err != nil {
+		return errorResponse(err, "Failed to get query from query history")
+	}
+
+	return response.Respond(http.StatusOK, raw).SetHeader("Content-Type", "application/json")
+}
+
 func (s *QueryHistoryService) deleteHandler(c *models.ReqContext) response.Response {
 	queryUID := web.Params(c.Req)[":uid"]
 	if len(queryUID) > 0 && !util.IsValidShortUID(queryUID) {
-		return response.Error(http.StatusNotFound, "Query in query history not found", nil)
+		return errorResponse(ErrQueryNotFound, "")
 	}
 
 	id, err := s.DeleteQueryFromQueryHistory(c.Req.Context(), c.SignedInUser, queryUID)
 	if err != nil {
-		return response.Error(http.StatusInternalServerError, "Failed to delete query from query history", err)
+		return errorResponse(err, "Failed to delete query from query history")
 	}
 
 	return response.JSON(http.StatusOK, DeleteQueryFromQueryHistoryResponse{
@@ -55,17 +219,17 @@ func (s *QueryHistoryService) deleteHandler(c *models.ReqContext) response.Respo
 func (s *QueryHistoryService) patchCommentHandler(c *models.ReqContext) response.Response {
 	queryUID := web.Params(c.Req)[":uid"]
 	if len(queryUID) > 0 && !util.IsValidShortUID(queryUID) {
-		return response.Error(http.StatusNotFound, "Query in query history not found", nil)
+		return errorResponse(ErrQueryNotFound, "")
 	}
 
 	cmd := PatchQueryCommentInQueryHistoryCommand{}
 	if err := web.Bind(c.Req, &cmd); err != nil {
-		return response.Error(http.StatusBadRequest, "bad request data", err)
+		return badRequestResponse(err)
 	}
 
 	query, err := s.PatchQueryCommentInQueryHistory(c.Req.Context(), c.SignedInUser, queryUID, cmd)
 	if err != nil {
-		return response.Error(http.StatusInternalServerError, "Failed to update comment of query in query history", err)
+		return errorResponse(err, "Failed to update comment of query in query history")
 	}
 
 	return response.JSON(http.StatusOK, QueryHistoryResponse{Result: query})
@@ -74,12 +238,34 @@ func (s *QueryHistoryService) patchCommentHandler(c *models.ReqContext) response
 func (s *QueryHistoryService) starHandler(c *models.ReqContext) response.Response {
 	queryUID := web.Params(c.Req)[":uid"]
 	if len(queryUID) > 0 && !util.IsValidShortUID(queryUID) {
-		return response.Error(http.StatusNotFound, "Query in query history not found", nil)
+		return errorResponse(ErrQueryNotFound, "")
+	}
+
+	// The body is optional, queries are starred without comment by default.
+	cmd := StarQueryInQueryHistoryCommand{}
+	if c.Req.Body != nil && c.Req.Body != http.NoBody {
+		if err := web.Bind(c.Req, &cmd); err != nil {
+			return badRequestResponse(err)
+		}
 	}
 
-	query, err := s.StarQueryInQueryHistory(c.Req.Context(), c.SignedInUser, queryUID)
+	query, err := s.StarQueryInQueryHistory(c.Req.Context(), c.SignedInUser, queryUID, cmd)
 	if err != nil {
-		return response.Error(http.StatusInternalServerError, "Failed to star query in query history", err)
+		return errorResponse(err, "Failed to star query in query history")
+	}
+
+	return response.JSON(http.StatusOK, QueryHistoryResponse{Result: query})
+}
+
+func (s *QueryHistoryService) duplicateHandler(c *models.ReqContext) response.Response {
+	queryUID := web.Params(c.Req)[":uid"]
+	if len(queryUID) > 0 && !util.IsValidShortUID(queryUID) {
+		return errorResponse(ErrQueryNotFound, "")
+	}
+
+	query, err := s.DuplicateQueryInQueryHistory(c.Req.Context(), c.SignedInUser, queryUID)
+	if err != nil {
+		return errorResponse(err, "Failed to duplicate query in query history")
 	}
 
 	return response.JSON(http.StatusOK, QueryHistoryResponse{Result: query})
@@ -88,13 +274,192 @@ func (s *QueryHistoryService) starHandler(c *models.ReqContext) response.Respons
 func (s *QueryHistoryService) unstarHandler(c *models.ReqContext) response.Response {
 	queryUID := web.Params(c.Req)[":uid"]
 	if len(queryUID) > 0 && !util.IsValidShortUID(queryUID) {
-		return response.Error(http.StatusNotFound, "Query in query history not found", nil)
+		return errorResponse(ErrQueryNotFound, "")
 	}
 
 	query, err := s.UnstarQueryInQueryHistory(c.Req.Context(), c.SignedInUser, queryUID)
 	if err != nil {
-		return response.Error(http.StatusInternalServerError, "Failed to unstar query in query history", err)
+		return errorResponse(err, "Failed to unstar query in query history")
 	}
 
 	return response.JSON(http.StatusOK, QueryHistoryResponse{Result: query})
 }
+
+func (s *QueryHistoryService) reassignHandler(c *models.ReqContext) response.Response {
+	cmd := ReassignQueriesInQueryHistoryCommand{}
+	if err := web.Bind(c.Req, &cmd); err != nil {
+		return badRequestResponse(err)
+	}
+	if cmd.FromUserID <= 0 || cmd.ToUserID <= 0 || cmd.FromUserID == cmd.ToUserID {
+		return errorResponse(ErrInvalidReassignUsers, "")
+	}
+
+	count, err := s.ReassignQueriesInQueryHistory(c.Req.Context(), c.OrgId, cmd.FromUserID, cmd.ToUserID)
+	if err != nil {
+		return errorResponse(err, "Failed to reassign queries in query history")
+	}
+
+	return response.JSON(http.StatusOK, ReassignQueriesInQueryHistoryResponse{
+		Message: "Queries reassigned",
+		Count:   count,
+	})
+}
+
+func (s *QueryHistoryService) mergeHandler(c *models.ReqContext) response.Response {
+	cmd := MergeUserHistoryCommand{}
+	if err := web.Bind(c.Req, &cmd); err != nil {
+		return badRequestResponse(err)
+	}
+	if cmd.SourceUserID <= 0 || cmd.TargetUserID <= 0 || cmd.SourceUserID == cmd.TargetUserID {
+		return errorResponse(ErrInvalidReassignUsers, "")
+	}
+
+	result, err := s.MergeUserHistoryInQueryHistory(c.Req.Context(), c.OrgId, cmd.SourceUserID, cmd.TargetUserID)
+	if err != nil {
+		return errorResponse(err, "Failed to merge query history")
+	}
+
+	return response.JSON(http.StatusOK, MergeUserHistoryResponse{
+		Result:  result,
+		Message: "Query history merged",
+	})
+}
+
+func (s *QueryHistoryService) getSettingsHandler(c *models.ReqContext) response.Response {
+	return response.JSON(http.StatusOK, QueryHistorySettingsResponse{Result: s.GetSettingsInQueryHistory(c.Req.Context(), c.OrgId)})
+}
+
+func (s *QueryHistoryService) updateSettingsHandler(c *models.ReqContext) response.Response {
+	cmd := QueryHistorySettings{}
+	if err := web.Bind(c.Req, &cmd); err != nil {
+		return badRequestResponse(err)
+	}
+
+	settings, err := s.UpdateSettingsInQueryHistory(c.Req.Context(), c.OrgId, cmd)
+	if err != nil {
+		return errorResponse(err, "Failed to update query history settings")
+	}
+
+	return response.JSON(http.StatusOK, QueryHistorySettingsResponse{Result: settings})
+}
+
+func (s *QueryHistoryService) assignFolderHandler(c *models.ReqContext) response.Response {
+	queryUID := web.Params(c.Req)[":uid"]
+	if len(queryUID) > 0 && !util.IsValidShortUID(queryUID) {
+		return errorResponse(ErrStarredQueryNotFound, "")
+	}
+
+	cmd := AssignStarredQueryToFolderCommand{}
+	if err := web.Bind(c.Req, &cmd); err != nil {
+		return badRequestResponse(err)
+	}
+
+	query, err := s.AssignStarredQueryToFolderInQueryHistory(c.Req.Context(), c.SignedInUser, queryUID, cmd)
+	if err != nil {
+		return errorResponse(err, "Failed to move starred query to folder")
+	}
+
+	return response.JSON(http.StatusOK, QueryHistoryResponse{Result: query})
+}
+
+func (s *QueryHistoryService) getFoldersHandler(c *models.ReqContext) response.Response {
+	folders, err := s.GetFoldersInQueryHistory(c.Req.Context(), c.SignedInUser)
+	if err != nil {
+		return errorResponse(err, "Failed to get query history folders")
+	}
+
+	return response.JSON(http.StatusOK, QueryHistoryFoldersResponse{Result: folders})
+}
+
+func (s *QueryHistoryService) createFolderHandler(c *models.ReqContext) response.Response {
+	cmd := SaveQueryHistoryFolderCommand{}
+	if err := web.Bind(c.Req, &cmd); err != nil {
+		return badRequestResponse(err)
+	}
+
+	folder, err := s.CreateFolderInQueryHistory(c.Req.Context(), c.SignedInUser, cmd)
+	if err != nil {
+		return errorResponse(err, "Failed to create query history folder")
+	}
+
+	return response.JSON(http.StatusOK, QueryHistoryFolderResponse{Result: folder})
+}
+
+func (s *QueryHistoryService) updateFolderHandler(c *models.ReqContext) response.Response {
+	folderUID := web.Params(c.Req)[":uid"]
+	if len(folderUID) > 0 && !util.IsValidShortUID(folderUID) {
+		return errorResponse(ErrFolderNotFound, "")
+	}
+
+	cmd := SaveQueryHistoryFolderCommand{}
+	if err := web.Bind(c.Req, &cmd); err != nil {
+		return badRequestResponse(err)
+	}
+
+	folder, err := s.UpdateFolderInQueryHistory(c.Req.Context(), c.SignedInUser, folderUID, cmd)
+	if err != nil {
+		return errorResponse(err, "Failed to update query history folder")
+	}
+
+	return response.JSON(http.StatusOK, QueryHistoryFolderResponse{Result: folder})
+}
+
+func (s *QueryHistoryService) deleteFolderHandler(c *models.ReqContext) response.Response {
+	folderUID := web.Params(c.Req)[":uid"]
+	if len(folderUID) > 0 && !util.IsValidShortUID(folderUID) {
+		return errorResponse(ErrFolderNotFound, "")
+	}
+
+	if err := s.DeleteFolderFromQueryHistory(c.Req.Context(), c.SignedInUser, folderUID); err != nil {
+		return errorResponse(err, "Failed to delete query history folder")
+	}
+
+	return response.JSON(http.StatusOK, DeleteQueryHistoryFolderResponse{Message: "Folder deleted"})
+}
+
+// apiError describes how an error is reported by the query history API.
+type apiError struct {
+	err       error
+	status    int
+	messageID string
+	message   string
+}
+
+var apiErrors = []apiError{
+	{err: ErrQueryNotFound, status: http.StatusNotFound, messageID: "queryhistory.notFound", message: "Query in query history not found"},
+	{err: ErrStarredQueryNotFound, status: http.StatusNotFound, messageID: "queryhistory.starredNotFound", message: "Starred query in query history not found"},
+	{err: ErrQueryAlreadyStarred, status: http.StatusBadRequest, messageID: "queryhistory.alreadyStarred", message: "Query in query history was already starred"},
+	{err: ErrNoDatasourceSpecified, status: http.StatusBadRequest, messageID: "queryhistory.noDatasource", message: "No datasource specified"},
+	{err: ErrQueryHistoryInvalidDatasource, status: http.StatusBadRequest, messageID: "queryhistory.invalidDatasource", message: "Datasource uid is not valid"},
+	{err: ErrInvalidActivityRange, status: http.StatusBadRequest, messageID: "queryhistory.invalidActivityRange", message: "Activity range must end after it starts and contain at most 1000 buckets of at least one minute"},
+	{err: ErrQueryConcurrentModification, status: http.StatusConflict, messageID: "queryhistory.concurrentModification", message: "Query in query history was modified since it was read"},
+	{err: ErrInvalidTimeRange, status: http.StatusBadRequest, messageID: "queryhistory.invalidTimeRange", message: "Time range must have both from and to"},
+	{err: ErrInvalidSearchOperator, status: http.StatusBadRequest, messageID: "queryhistory.invalidSearchOperator", message: "Search operator must be either and or or"},
+	{err: ErrInvalidUIDPrefix, status: http.StatusBadRequest, messageID: "queryhistory.invalidUidPrefix", message: "UID prefix is not valid"},
+	{err: ErrInvalidSort, status: http.StatusBadRequest, messageID: "queryhistory.invalidSort", message: "Sort must be either time-desc, time-asc or commented-first"},
+	{err: ErrInvalidDeletedUsersPolicy, status: http.StatusBadRequest, messageID: "queryhistory.invalidDeletedUsersPolicy", message: "Deleted users policy must be either delete or anonymize"},
+	{err: ErrSettingsUnavailable, status: http.StatusNotImplemented, messageID: "queryhistory.settingsUnavailable", message: "Query history settings can not be stored"},
+	{err: ErrFolderNotFound, status: http.StatusNotFound, messageID: "queryhistory.folderNotFound", message: "Query history folder not found"},
+	{err: ErrFolderAlreadyExists, status: http.StatusConflict, messageID: "queryhistory.folderAlreadyExists", message: "Query history folder with the same name already exists"},
+	{err: ErrInvalidFolderName, status: http.StatusBadRequest, messageID: "queryhistory.invalidFolderName", message: "Query history folder name must not be empty"},
+	{err: ErrInvalidReassignUsers, status: http.StatusBadRequest, messageID: "queryhistory.invalidReassignUsers", message: "Source and target users must be different existing users"},
+	{err: ErrUserNotInOrg, status: http.StatusNotFound, messageID: "queryhistory.userNotInOrg", message: "User is not a member of the organization"},
+	{err: ErrCommentTooLong, status: http.StatusBadRequest, messageID: "queryhistory.commentTooLong", message: "Query history comment must be at most 2000 characters"},
+	{err: ErrQueryHistoryQuotaReached, status: http.StatusForbidden, messageID: "queryhistory.quotaReached", message: "Query history quota reached"},
+	{err: ErrDatabaseTimeout, status: http.StatusGatewayTimeout, messageID: "queryhistory.databaseTimeout", message: "Query history database request timed out"},
+}
+
+// errorResponse returns the error envelope for err. Errors without a known
+// mapping are reported as internal errors with the given message.
+func errorResponse(err error, message string) response.Response {
+	for _, e := range apiErrors {
+		if errors.Is(err, e.err) {
+			return response.ErrorWithMessageID(e.status, e.messageID, e.message, err)
+		}
+	}
+	return response.ErrorWithMessageID(http.StatusInternalServerError, "queryhistory.internalError", message, err)
+}
+
+func badRequestResponse(err error) response.Response {
+	return response.ErrorWithMessageID(http.StatusBadRequest, "queryhistory.badRequest", "bad request data", err)
+}
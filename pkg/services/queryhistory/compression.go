@@ -0,0 +1,188 @@
+package queryhistory
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/grafana/grafana/pkg/components/simplejson"
+	"github.com/grafana/grafana/pkg/models"
+	"github.com/grafana/grafana/pkg/services/sqlstore"
+)
+
+// compressQueries returns the queries to store, gzipped and encoded in base64
+// in a JSON string when their JSON is larger than threshold. The queries are
+// returned untouched when they are smaller or when threshold is zero. Storing
+// the compressed queries as a JSON string keeps the column valid JSON for the
+// database functions used by the search filters.
+func compressQueries(queries *simplejson.Json, threshold int) (*simplejson.Json, bool, error) {
+	if threshold <= 0 || queries == nil {
+		return queries, false, nil
+	}
+	raw, err := queries.MarshalJSON()
+	if err != nil {
+		return nil, false, err
+	}
+	if len(raw) <= threshold {
+		return queries, false, nil
+	}
+
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(raw); err != nil {
+		return nil, false, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, false, err
+	}
+	return simplejson.NewFromAny(base64.StdEncoding.EncodeToString(buf.Bytes())), true, nil
+}
+
+// decompressRawQueries returns the JSON of compressed queries.
+func decompressRawQueries(encoded string) ([]byte, error) {
+	compressed, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode compressed queries: %w", err)
+	}
+	r, err := gzip.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress queries: %w", err)
+	}
+	defer func() { _ = r.Close() }()
+	raw, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress queries: %w", err)
+	}
+	return raw, nil
+}
+
+// decompressQueries returns the queries stored compressed.
+func decompressQueries(queries *simplejson.Json) (*simplejson.Json, error) {
+	raw, err := decompressRawQueries(queries.MustString())
+	if err != nil {
+		return nil, err
+	}
+	return simplejson.NewJson(raw)
+}
+
+// decompress replaces the queries read from the database with their
+// uncompressed form when they were stored compressed.
+func (queryHistory *QueryHistory) decompress() error {
+	if !queryHistory.Compressed {
+		return nil
+	}
+	queries, err := decompressQueries(queryHistory.Queries)
+	if err != nil {
+		return err
+	}
+	queryHistory.Queries = queries
+	queryHistory.Compressed = false
+	return nil
+}
+
+// decompress replaces the queries read from the database with their
+// uncompressed form when they were stored compressed.
+func (dto *QueryHistoryDTO) decompress() error {
+	if !dto.Compressed {
+		return nil
+	}
+	queries, err := decompressQueries(dto.Queries)
+	if err != nil {
+		return err
+	}
+	dto.Queries = queries
+	dto.Compressed = false
+	return nil
+}
+
+// matchCompressedQueries returns the UIDs of the compressed queries matching
+// the search terms and query type of the search, along with its other filters.
+// The database can't match the content of the compressed queries, they are
+// decompressed and matched here instead.
+func (s QueryHistoryService) matchCompressedQueries(ctx context.Context, user *models.SignedInUser, query SearchInQueryHistoryQuery) ([]string, error) {
+	candidatesQuery := query
+	candidatesQuery.SearchString = ""
+	candidatesQuery.SearchTerms = nil
+	candidatesQuery.QueryType = ""
+
+	var candidates []struct {
+		UID     string `xorm:"uid"`
+		Comment string
+		Queries string
+	}
+	err := s.withDbSession(ctx, func(session *sqlstore.DBSession) error {
+		builder := sqlstore.SQLBuilder{}
+		builder.Write(`SELECT query_history.uid, query_history.comment, query_history.queries`)
+		writeUIDsFromSQL(candidatesQuery, &builder)
+		writeFiltersSQL(candidatesQuery, user, s.SQLStore, &builder)
+		builder.Write(` AND query_history.compressed = ?`, true)
+
+		return session.SQL(builder.GetSQLString(), builder.GetParams()...).Find(&candidates)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	matches := []string{}
+	for _, candidate := range candidates {
+		// The stored queries are a JSON string of the compressed queries.
+		var encoded string
+		if err := json.Unmarshal([]byte(candidate.Queries), &encoded); err != nil {
+			return nil, fmt.Errorf("failed to read compressed queries: %w", err)
+		}
+		raw, err := decompressRawQueries(encoded)
+		if err != nil {
+			return nil, err
+		}
+		if matchesContent(query, candidate.Comment, raw) {
+			matches = append(matches, candidate.UID)
+		}
+	}
+	return matches, nil
+}
+
+// matchesContent reports whether the queries or their comment match the search
+// terms and the query type, as the database matches the uncompressed queries.
+func matchesContent(query SearchInQueryHistoryQuery, comment string, raw []byte) bool {
+	if terms := searchTerms(query); len(terms) > 0 {
+		text, comment := strings.ToLower(string(raw)), strings.ToLower(comment)
+		found := 0
+		for _, term := range terms {
+			term = strings.ToLower(term)
+			if strings.Contains(text, term) || strings.Contains(comment, term) {
+				found++
+			}
+		}
+		if found == 0 || (query.SearchOperator != SearchOperatorOr && found < len(terms)) {
+			return false
+		}
+	}
+	if query.QueryType != "" {
+		return hasQueryType(raw, query.QueryType)
+	}
+	return true
+}
+
+// hasQueryType reports whether one of the queries, a list of query objects or
+// a single query object, has the given queryType field.
+func hasQueryType(raw []byte, queryType string) bool {
+	var queries interface{}
+	if err := json.Unmarshal(raw, &queries); err != nil {
+		return false
+	}
+	objects, ok := queries.([]interface{})
+	if !ok {
+		objects = []interface{}{queries}
+	}
+	for _, object := range objects {
+		if fields, ok := object.(map[string]interface{}); ok && fields["queryType"] == queryType {
+			return true
+		}
+	}
+	return false
+}
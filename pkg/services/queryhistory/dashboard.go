@@ -0,0 +1,156 @@
+package queryhistory
+
+import (
+	"context"
+
+	"github.com/grafana/grafana/pkg/components/simplejson"
+	"github.com/grafana/grafana/pkg/models"
+	"github.com/grafana/grafana/pkg/services/dashboards"
+	"github.com/grafana/grafana/pkg/services/guardian"
+	"github.com/grafana/grafana/pkg/services/sqlstore"
+)
+
+const (
+	promotedPanelType   = "timeseries"
+	promotedPanelWidth  = 12
+	promotedPanelHeight = 8
+)
+
+func (s QueryHistoryService) promoteQueryToDashboard(ctx context.Context, user *models.SignedInUser, UID string, cmd PromoteQueryToDashboardCommand) (*models.Dashboard, error) {
+	var queryHistory QueryHistory
+	err := s.withDbSession(ctx, func(session *sqlstore.DBSession) error {
+		exists, err := session.Where("org_id = ? AND created_by = ? AND uid = ?", user.OrgId, user.UserId, UID).Get(&queryHistory)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return ErrQueryNotFound
+		}
+		if err := queryHistory.decompress(); err != nil {
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	query := models.GetDashboardQuery{Uid: cmd.DashboardUID, OrgId: user.OrgId}
+	if err := s.SQLStore.GetDashboard(ctx, &query); err != nil {
+		return nil, err
+	}
+	dashboard := query.Result
+	if dashboard.IsFolder {
+		return nil, models.ErrDashboardNotFound
+	}
+
+	guard := guardian.New(ctx, dashboard.Id, user.OrgId, user)
+	if canSave, err := guard.CanSave(); err != nil || !canSave {
+		if err != nil {
+			return nil, err
+		}
+		return nil, models.ErrDashboardUpdateAccessDenied
+	}
+
+	panels := dashboard.Data.Get("panels").MustArray()
+	gridPos := cmd.GridPos
+	if gridPos == nil {
+		gridPos = &PanelGridPos{Y: panelsBottom(panels)}
+	}
+	if gridPos.W <= 0 {
+		gridPos.W = promotedPanelWidth
+	}
+	if gridPos.H <= 0 {
+		gridPos.H = promotedPanelHeight
+	}
+
+	title := queryHistory.Comment
+	if title == "" {
+		title = "Query from query history"
+	}
+
+	panel := map[string]interface{}{
+		"id":         nextPanelID(panels),
+		"type":       promotedPanelType,
+		"title":      title,
+		"datasource": map[string]interface{}{"uid": queryHistory.DatasourceUID},
+		"targets":    panelTargets(queryHistory.Queries),
+		"gridPos": map[string]interface{}{
+			"x": gridPos.X,
+			"y": gridPos.Y,
+			"w": gridPos.W,
+			"h": gridPos.H,
+		},
+	}
+	dashboard.Data.Set("panels", append(panels, panel))
+
+	return s.DashboardService.SaveDashboard(ctx, &dashboards.SaveDashboardDTO{
+		OrgId:     user.OrgId,
+		User:      user,
+		Message:   "Added query from query history",
+		Dashboard: dashboard,
+	}, false)
+}
+
+// panelTargets returns the stored queries as panel targets. Queries are
+// usually stored as a list, a single query object is used as the only target.
+// Targets without a refId get one in the order of the list.
+func panelTargets(queries *simplejson.Json) []interface{} {
+	var targets []interface{}
+	if list, err := queries.Array(); err == nil {
+		targets = list
+	} else if _, err := queries.Map(); err == nil {
+		targets = []interface{}{queries.Interface()}
+	}
+
+	for i, t := range targets {
+		target, ok := t.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if refID, _ := target["refId"].(string); refID == "" {
+			target["refId"] = refIDForIndex(i)
+		}
+	}
+	return targets
+}
+
+// refIDForIndex returns the refId the frontend gives to the query at the given
+// index: A to Z, then AA, AB and so on.
+func refIDForIndex(i int) string {
+	refID := ""
+	for ; i >= 0; i = i/26 - 1 {
+		refID = string(rune('A'+i%26)) + refID
+	}
+	return refID
+}
+
+// nextPanelID returns an id not used by any panel of the dashboard, including
+// the panels of collapsed rows.
+func nextPanelID(panels []interface{}) int64 {
+	var maxID int64
+	for _, p := range panels {
+		panel := simplejson.NewFromAny(p)
+		if id := panel.Get("id").MustInt64(); id > maxID {
+			maxID = id
+		}
+		for _, nested := range panel.Get("panels").MustArray() {
+			if id := simplejson.NewFromAny(nested).Get("id").MustInt64(); id > maxID {
+				maxID = id
+			}
+		}
+	}
+	return maxID + 1
+}
+
+// panelsBottom returns the first grid row below all the panels of the dashboard.
+func panelsBottom(panels []interface{}) int {
+	bottom := 0
+	for _, p := range panels {
+		gridPos := simplejson.NewFromAny(p).Get("gridPos")
+		if y := gridPos.Get("y").MustInt() + gridPos.Get("h").MustInt(); y > bottom {
+			bottom = y
+		}
+	}
+	return bottom
+}
@@ -2,27 +2,76 @@ package queryhistory
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
 	"time"
+	"unicode/utf8"
 
 	"github.com/grafana/grafana/pkg/models"
+	"github.com/grafana/grafana/pkg/services/quota"
 	"github.com/grafana/grafana/pkg/services/sqlstore"
+	"github.com/grafana/grafana/pkg/setting"
 	"github.com/grafana/grafana/pkg/util"
 )
 
+// Pseudo data sources of the frontend, whose UIDs do not follow the UID format.
+const (
+	grafanaDatasourceUID = "grafana"
+	mixedDatasourceUID   = "-- Mixed --"
+)
+
+// isValidDatasourceUID reports whether uid looks like a data source UID rather
+// than, for instance, a data source name or numeric ID.
+func isValidDatasourceUID(uid string) bool {
+	if uid == grafanaDatasourceUID || uid == mixedDatasourceUID {
+		return true
+	}
+	if uid == "" || util.IsShortUIDTooLong(uid) || !util.IsValidShortUID(uid) {
+		return false
+	}
+	_, err := strconv.ParseInt(uid, 10, 64)
+	return err != nil
+}
+
 func (s QueryHistoryService) createQuery(ctx context.Context, user *models.SignedInUser, cmd CreateQueryInQueryHistoryCommand) (QueryHistoryDTO, error) {
+	if !isValidDatasourceUID(cmd.DatasourceUID) {
+		return QueryHistoryDTO{}, ErrQueryHistoryInvalidDatasource
+	}
+	if (cmd.From == "") != (cmd.To == "") {
+		return QueryHistoryDTO{}, ErrInvalidTimeRange
+	}
+	if err := s.checkQuota(ctx, user); err != nil {
+		return QueryHistoryDTO{}, err
+	}
+
+	storedQueries, compressed, err := compressQueries(cmd.Queries, s.Cfg.QueryHistoryCompressThreshold)
+	if err != nil {
+		return QueryHistoryDTO{}, err
+	}
+
+	now := time.Now()
+
 	queryHistory := QueryHistory{
 		OrgID:         user.OrgId,
 		UID:           util.GenerateShortUID(),
-		Queries:       cmd.Queries,
+		Queries:       storedQueries,
 		DatasourceUID: cmd.DatasourceUID,
 		CreatedBy:     user.UserId,
-		CreatedAt:     time.Now().Unix(),
+		CreatedAt:     now.Unix(),
+		UpdatedAt:     now.UnixMilli(),
 		Comment:       "",
+		TimeFrom:      cmd.From,
+		TimeTo:        cmd.To,
+		Compressed:    compressed,
 	}
 
-	err := s.SQLStore.WithDbSession(ctx, func(session *sqlstore.DBSession) error {
-		_, err := session.Insert(&queryHistory)
-		return err
+	err = s.withTransactionalDbSession(ctx, func(session *sqlstore.DBSession) error {
+		if _, err := session.Insert(&queryHistory); err != nil {
+			return err
+		}
+		return s.pruneDatasourceQueries(session, user, queryHistory.DatasourceUID)
 	})
 	if err != nil {
 		return QueryHistoryDTO{}, err
@@ -34,20 +83,133 @@ func (s QueryHistoryService) createQuery(ctx context.Context, user *models.Signe
 		CreatedBy:     queryHistory.CreatedBy,
 		CreatedAt:     queryHistory.CreatedAt,
 		Comment:       queryHistory.Comment,
-		Queries:       queryHistory.Queries,
+		Queries:       cmd.Queries,
+		From:          queryHistory.TimeFrom,
+		To:            queryHistory.TimeTo,
+		UpdatedAt:     queryHistory.UpdatedAt,
 		Starred:       false,
 	}
+	dto.setDefaultTimeRange()
+	dto.setTargetDatasources()
 
 	return dto, nil
 }
 
+// checkQuota returns ErrQueryHistoryQuotaReached when the user reached their
+// query_history quota.
+func (s QueryHistoryService) checkQuota(ctx context.Context, user *models.SignedInUser) error {
+	if s.QuotaService == nil {
+		return nil
+	}
+	reached, err := s.QuotaService.CheckQuotaReached(ctx, "query_history", &quota.ScopeParameters{
+		OrgId:  user.OrgId,
+		UserId: user.UserId,
+	})
+	if err != nil {
+		return err
+	}
+	if reached {
+		return ErrQueryHistoryQuotaReached
+	}
+	return nil
+}
+
+// duplicateQuery inserts a copy of a query of the user with a new UID and
+// creation time. The copy is not starred, even when the original is.
+func (s QueryHistoryService) duplicateQuery(ctx context.Context, user *models.SignedInUser, UID string) (QueryHistoryDTO, error) {
+	if err := s.checkQuota(ctx, user); err != nil {
+		return QueryHistoryDTO{}, err
+	}
+
+	var original QueryHistory
+	var duplicate QueryHistory
+
+	err := s.withTransactionalDbSession(ctx, func(session *sqlstore.DBSession) error {
+		exists, err := session.Where("org_id = ? AND created_by = ? AND uid = ?", user.OrgId, user.UserId, UID).Get(&original)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return ErrQueryNotFound
+		}
+
+		now := time.Now()
+		// The queries are copied as stored, compressed or not.
+		duplicate = QueryHistory{
+			OrgID:         original.OrgID,
+			UID:           util.GenerateShortUID(),
+			Queries:       original.Queries,
+			DatasourceUID: original.DatasourceUID,
+			CreatedBy:     user.UserId,
+			CreatedAt:     now.Unix(),
+			UpdatedAt:     now.UnixMilli(),
+			Comment:       original.Comment,
+			TimeFrom:      original.TimeFrom,
+			TimeTo:        original.TimeTo,
+			Compressed:    original.Compressed,
+		}
+		if _, err := session.Insert(&duplicate); err != nil {
+			return err
+		}
+		return s.pruneDatasourceQueries(session, user, duplicate.DatasourceUID)
+	})
+	if err != nil {
+		return QueryHistoryDTO{}, err
+	}
+	if err := duplicate.decompress(); err != nil {
+		return QueryHistoryDTO{}, err
+	}
+
+	dto := QueryHistoryDTO{
+		UID:           duplicate.UID,
+		DatasourceUID: duplicate.DatasourceUID,
+		CreatedBy:     duplicate.CreatedBy,
+		CreatedAt:     duplicate.CreatedAt,
+		Comment:       duplicate.Comment,
+		Queries:       duplicate.Queries,
+		From:          duplicate.TimeFrom,
+		To:            duplicate.TimeTo,
+		UpdatedAt:     duplicate.UpdatedAt,
+		Starred:       false,
+	}
+	dto.setDefaultTimeRange()
+	dto.setTargetDatasources()
+
+	return dto, nil
+}
+
+// pruneDatasourceQueries deletes the oldest non-starred queries of the user for the data
+// source, keeping at most the configured number of them.
+func (s QueryHistoryService) pruneDatasourceQueries(session *sqlstore.DBSession, user *models.SignedInUser, datasourceUID string) error {
+	limit := s.Cfg.QueryHistoryMaxQueriesPerDatasource
+	if limit <= 0 {
+		return nil
+	}
+
+	var ids []int64
+	err := session.SQL(`SELECT query_history.id FROM query_history
+		LEFT JOIN query_history_star ON query_history_star.query_uid = query_history.uid AND query_history_star.user_id = query_history.created_by
+		WHERE query_history.org_id = ? AND query_history.created_by = ? AND query_history.datasource_uid = ? AND query_history_star.id IS NULL
+		ORDER BY query_history.created_at DESC, query_history.id DESC`,
+		user.OrgId, user.UserId, datasourceUID).Find(&ids)
+	if err != nil {
+		return err
+	}
+	if len(ids) <= limit {
+		return nil
+	}
+
+	_, err = session.In("id", ids[limit:]).Delete(QueryHistory{})
+	return err
+}
+
 func (s QueryHistoryService) deleteQuery(ctx context.Context, user *models.SignedInUser, UID string) (int64, error) {
 	var queryID int64
-	err := s.SQLStore.WithTransactionalDbSession(ctx, func(session *sqlstore.DBSession) error {
+	err := s.withTransactionalDbSession(ctx, func(session *sqlstore.DBSession) error {
 		// Try to unstar the query first
 		_, err := session.Table("query_history_star").Where("user_id = ? AND query_uid = ?", user.UserId, UID).Delete(QueryHistoryStar{})
 		if err != nil {
-			s.log.Error("Failed to unstar query while deleting it from query history", "query", UID, "user", user.UserId, "error", err)
+			s.logger(ctx).Error("Failed to unstar query while deleting it from query history", "query", UID, "user", user.UserId, "error", err)
 		}
 
 		// Then delete it
@@ -66,11 +228,26 @@ func (s QueryHistoryService) deleteQuery(ctx context.Context, user *models.Signe
 	return queryID, err
 }
 
+// maxCommentLength is the maximum number of characters of the comment of a
+// query.
+const maxCommentLength = 2000
+
+func validateComment(comment string) error {
+	if utf8.RuneCountInString(comment) > maxCommentLength {
+		return ErrCommentTooLong
+	}
+	return nil
+}
+
 func (s QueryHistoryService) patchQueryComment(ctx context.Context, user *models.SignedInUser, UID string, cmd PatchQueryCommentInQueryHistoryCommand) (QueryHistoryDTO, error) {
 	var queryHistory QueryHistory
 	var isStarred bool
 
-	err := s.SQLStore.WithTransactionalDbSession(ctx, func(session *sqlstore.DBSession) error {
+	if err := validateComment(cmd.Comment); err != nil {
+		return QueryHistoryDTO{}, err
+	}
+
+	err := s.withTransactionalDbSession(ctx, func(session *sqlstore.DBSession) error {
 		exists, err := session.Where("org_id = ? AND created_by = ? AND uid = ?", user.OrgId, user.UserId, UID).Get(&queryHistory)
 		if err != nil {
 			return err
@@ -78,12 +255,25 @@ func (s QueryHistoryService) patchQueryComment(ctx context.Context, user *models
 		if !exists {
 			return ErrQueryNotFound
 		}
+		if err := queryHistory.decompress(); err != nil {
+			return err
+		}
+		if cmd.UpdatedAt != nil && *cmd.UpdatedAt != queryHistory.UpdatedAt {
+			return ErrQueryConcurrentModification
+		}
 
+		previousUpdatedAt := queryHistory.UpdatedAt
 		queryHistory.Comment = cmd.Comment
-		_, err = session.ID(queryHistory.ID).Update(queryHistory)
+		queryHistory.UpdatedAt = nextUpdatedAt(previousUpdatedAt)
+		// The precondition is checked again by the update, in case the query
+		// was modified since it was read.
+		affected, err := session.ID(queryHistory.ID).Where("updated_at = ?", previousUpdatedAt).Cols("comment", "updated_at").Update(&queryHistory)
 		if err != nil {
 			return err
 		}
+		if affected == 0 {
+			return ErrQueryConcurrentModification
+		}
 
 		starred, err := session.Table("query_history_star").Where("user_id = ? AND query_uid = ?", user.UserId, UID).Exist()
 		if err != nil {
@@ -104,17 +294,40 @@ func (s QueryHistoryService) patchQueryComment(ctx context.Context, user *models
 		CreatedAt:     queryHistory.CreatedAt,
 		Comment:       queryHistory.Comment,
 		Queries:       queryHistory.Queries,
+		From:          queryHistory.TimeFrom,
+		To:            queryHistory.TimeTo,
+		UpdatedAt:     queryHistory.UpdatedAt,
 		Starred:       isStarred,
 	}
+	dto.setDefaultTimeRange()
+	dto.setTargetDatasources()
 
 	return dto, nil
 }
 
-func (s QueryHistoryService) starQuery(ctx context.Context, user *models.SignedInUser, UID string) (QueryHistoryDTO, error) {
+// nextUpdatedAt returns the modification time of a query, in milliseconds since
+// epoch, making sure it changes on every update so that it can be used as a
+// precondition even when updates happen within the same millisecond.
+func nextUpdatedAt(previous int64) int64 {
+	if now := time.Now().UnixMilli(); now > previous {
+		return now
+	}
+	return previous + 1
+}
+
+// starQuery stars the query, and sets its comment when the command has one in
+// the same transaction.
+func (s QueryHistoryService) starQuery(ctx context.Context, user *models.SignedInUser, UID string, cmd StarQueryInQueryHistoryCommand) (QueryHistoryDTO, error) {
 	var queryHistory QueryHistory
 	var isStarred bool
 
-	err := s.SQLStore.WithTransactionalDbSession(ctx, func(session *sqlstore.DBSession) error {
+	if cmd.Comment != nil {
+		if err := validateComment(*cmd.Comment); err != nil {
+			return QueryHistoryDTO{}, err
+		}
+	}
+
+	err := s.withTransactionalDbSession(ctx, func(session *sqlstore.DBSession) error {
 		// Check if query exists as we want to star only existing queries
 		exists, err := session.Table("query_history").Where("org_id = ? AND created_by = ? AND uid = ?", user.OrgId, user.UserId, UID).Get(&queryHistory)
 		if err != nil {
@@ -123,6 +336,9 @@ func (s QueryHistoryService) starQuery(ctx context.Context, user *models.SignedI
 		if !exists {
 			return ErrQueryNotFound
 		}
+		if err := queryHistory.decompress(); err != nil {
+			return err
+		}
 
 		// If query exists then star it
 		queryHistoryStar := QueryHistoryStar{
@@ -138,6 +354,14 @@ func (s QueryHistoryService) starQuery(ctx context.Context, user *models.SignedI
 			return err
 		}
 
+		if cmd.Comment != nil {
+			queryHistory.Comment = *cmd.Comment
+			queryHistory.UpdatedAt = nextUpdatedAt(queryHistory.UpdatedAt)
+			if _, err := session.ID(queryHistory.ID).Cols("comment", "updated_at").Update(&queryHistory); err != nil {
+				return err
+			}
+		}
+
 		isStarred = true
 		return nil
 	})
@@ -153,8 +377,13 @@ func (s QueryHistoryService) starQuery(ctx context.Context, user *models.SignedI
 		CreatedAt:     queryHistory.CreatedAt,
 		Comment:       queryHistory.Comment,
 		Queries:       queryHistory.Queries,
+		From:          queryHistory.TimeFrom,
+		To:            queryHistory.TimeTo,
+		UpdatedAt:     queryHistory.UpdatedAt,
 		Starred:       isStarred,
 	}
+	dto.setDefaultTimeRange()
+	dto.setTargetDatasources()
 
 	return dto, nil
 }
@@ -163,7 +392,7 @@ func (s QueryHistoryService) unstarQuery(ctx context.Context, user *models.Signe
 	var queryHistory QueryHistory
 	var isStarred bool
 
-	err := s.SQLStore.WithTransactionalDbSession(ctx, func(session *sqlstore.DBSession) error {
+	err := s.withTransactionalDbSession(ctx, func(session *sqlstore.DBSession) error {
 		exists, err := session.Table("query_history").Where("org_id = ? AND created_by = ? AND uid = ?", user.OrgId, user.UserId, UID).Get(&queryHistory)
 		if err != nil {
 			return err
@@ -171,6 +400,9 @@ func (s QueryHistoryService) unstarQuery(ctx context.Context, user *models.Signe
 		if !exists {
 			return ErrQueryNotFound
 		}
+		if err := queryHistory.decompress(); err != nil {
+			return err
+		}
 
 		id, err := session.Table("query_history_star").Where("user_id = ? AND query_uid = ?", user.UserId, UID).Delete(QueryHistoryStar{})
 		if id == 0 {
@@ -195,8 +427,644 @@ func (s QueryHistoryService) unstarQuery(ctx context.Context, user *models.Signe
 		CreatedAt:     queryHistory.CreatedAt,
 		Comment:       queryHistory.Comment,
 		Queries:       queryHistory.Queries,
+		From:          queryHistory.TimeFrom,
+		To:            queryHistory.TimeTo,
+		UpdatedAt:     queryHistory.UpdatedAt,
 		Starred:       isStarred,
 	}
+	dto.setDefaultTimeRange()
+	dto.setTargetDatasources()
 
 	return dto, nil
 }
+
+// searchQueries returns the queries matching the search, from the search cache
+// when it's enabled and the user ran the same search recently.
+func (s QueryHistoryService) searchQueries(ctx context.Context, user *models.SignedInUser, query SearchInQueryHistoryQuery) (QueryHistorySearchResult, error) {
+	if !query.AllDatasources && len(query.DatasourceUIDs) == 0 {
+		uid, err := s.defaultDatasourceUID(ctx, user)
+		if err != nil {
+			return QueryHistorySearchResult{}, err
+		}
+		query.DatasourceUIDs = []string{uid}
+	}
+	query.setDefaultPagination()
+	if query.Sort == "" {
+		query.Sort = s.orgDefaultSort(ctx, user.OrgId)
+	}
+	switch query.SearchOperator {
+	case "":
+		query.SearchOperator = SearchOperatorAnd
+	case SearchOperatorAnd, SearchOperatorOr:
+	default:
+		return QueryHistorySearchResult{}, ErrInvalidSearchOperator
+	}
+	if !util.IsValidShortUID(query.UIDPrefix) || util.IsShortUIDTooLong(query.UIDPrefix) {
+		return QueryHistorySearchResult{}, ErrInvalidUIDPrefix
+	}
+
+	key, err := searchCacheKey(user, query)
+	if err != nil {
+		return QueryHistorySearchResult{}, err
+	}
+	result, generation, ok := s.searchCache.get(key)
+	if ok {
+		return result, nil
+	}
+
+	if hasContentFilters(query) {
+		if query.compressedMatches, err = s.matchCompressedQueries(ctx, user, query); err != nil {
+			return QueryHistorySearchResult{}, err
+		}
+	}
+
+	switch {
+	case query.GroupByDatasource:
+		result, err = s.searchQueryGroups(ctx, user, query)
+	case query.UIDsOnly:
+		result, err = s.searchQueryUIDs(ctx, user, query)
+	default:
+		result, err = s.searchQueryDTOs(ctx, user, query)
+	}
+	if err != nil {
+		return QueryHistorySearchResult{}, err
+	}
+	if result.QueryHistory == nil {
+		result.QueryHistory = []QueryHistoryDTO{}
+	}
+	result.Page = query.Page
+	result.PerPage = query.Limit
+	s.searchCache.set(key, generation, result)
+	return result, nil
+}
+
+// defaultDatasourceUID returns the UID of the default data source of the
+// org of the user, for the searches without data source. It returns
+// ErrNoDatasourceSpecified when the fallback is disabled or the org has no
+// default data source.
+func (s QueryHistoryService) defaultDatasourceUID(ctx context.Context, user *models.SignedInUser) (string, error) {
+	if !s.Cfg.QueryHistoryDefaultDatasourceFallback {
+		return "", ErrNoDatasourceSpecified
+	}
+	query := models.GetDefaultDataSourceQuery{OrgId: user.OrgId}
+	if err := s.SQLStore.GetDefaultDataSource(ctx, &query); err != nil {
+		if errors.Is(err, models.ErrDataSourceNotFound) {
+			return "", ErrNoDatasourceSpecified
+		}
+		return "", err
+	}
+	return query.Result.Uid, nil
+}
+
+// searchQueryGroups runs the search for each data source, in the order of the
+// requested data sources or sorted by UID when searching all data sources.
+func (s QueryHistoryService) searchQueryGroups(ctx context.Context, user *models.SignedInUser, query SearchInQueryHistoryQuery) (QueryHistorySearchResult, error) {
+	datasourceUIDs := query.DatasourceUIDs
+	if query.AllDatasources {
+		var err error
+		if datasourceUIDs, err = s.searchDatasourceUIDs(ctx, user, query); err != nil {
+			return QueryHistorySearchResult{}, err
+		}
+	} else if query.IncludeMixed {
+		// The mixed queries are grouped on their own.
+		datasourceUIDs = append(append([]string{}, datasourceUIDs...), mixedDatasourceUID)
+	}
+
+	result := QueryHistorySearchResult{Groups: []QueryHistoryDatasourceGroup{}}
+	seen := make(map[string]bool, len(datasourceUIDs))
+	for _, uid := range datasourceUIDs {
+		if seen[uid] {
+			continue
+		}
+		seen[uid] = true
+
+		groupQuery := query
+		groupQuery.AllDatasources = false
+		groupQuery.DatasourceUIDs = []string{uid}
+		groupQuery.IncludeMixed = false
+
+		var groupResult QueryHistorySearchResult
+		var err error
+		if query.UIDsOnly {
+			groupResult, err = s.searchQueryUIDs(ctx, user, groupQuery)
+		} else {
+			groupResult, err = s.searchQueryDTOs(ctx, user, groupQuery)
+		}
+		if err != nil {
+			return QueryHistorySearchResult{}, err
+		}
+
+		result.TotalCount += groupResult.TotalCount
+		result.Groups = append(result.Groups, QueryHistoryDatasourceGroup{
+			DatasourceUID: uid,
+			TotalCount:    groupResult.TotalCount,
+			QueryHistory:  groupResult.QueryHistory,
+			UIDs:          groupResult.UIDs,
+		})
+	}
+	return result, nil
+}
+
+// searchDatasourceUIDs returns the sorted UIDs of the data sources of the
+// queries matching the search.
+func (s QueryHistoryService) searchDatasourceUIDs(ctx context.Context, user *models.SignedInUser, query SearchInQueryHistoryQuery) ([]string, error) {
+	uids := []string{}
+	err := s.withDbSession(ctx, func(session *sqlstore.DBSession) error {
+		builder := sqlstore.SQLBuilder{}
+		builder.Write(`SELECT DISTINCT query_history.datasource_uid`)
+		writeUIDsFromSQL(query, &builder)
+		writeFiltersSQL(query, user, s.SQLStore, &builder)
+		builder.Write(` ORDER BY query_history.datasource_uid`)
+
+		return session.SQL(builder.GetSQLString(), builder.GetParams()...).Find(&uids)
+	})
+	return uids, err
+}
+
+// searchQueryDTOs returns the queries matching the search with their stars.
+func (s QueryHistoryService) searchQueryDTOs(ctx context.Context, user *models.SignedInUser, query SearchInQueryHistoryQuery) (QueryHistorySearchResult, error) {
+	dtos := []QueryHistoryDTO{}
+	var count queryHistoryCount
+
+	err := s.withDbSession(ctx, func(session *sqlstore.DBSession) error {
+		dtosBuilder := sqlstore.SQLBuilder{}
+		dtosBuilder.Write(`SELECT
+			query_history.uid,
+			query_history.datasource_uid,
+			query_history.created_by,
+			query_history.created_at,
+			query_history.comment,
+			query_history.queries,
+			query_history.time_from,
+			query_history.time_to,
+			query_history.updated_at,
+			query_history.compressed,
+		`)
+		writeStarredSQL(query, s.SQLStore, &dtosBuilder)
+		writeFiltersSQL(query, user, s.SQLStore, &dtosBuilder)
+		writeSortSQL(query, &dtosBuilder)
+		writeLimitSQL(query, s.SQLStore, &dtosBuilder)
+
+		if err := session.SQL(dtosBuilder.GetSQLString(), dtosBuilder.GetParams()...).Find(&dtos); err != nil {
+			return err
+		}
+
+		countBuilder := sqlstore.SQLBuilder{}
+		countBuilder.Write(`SELECT COUNT(*) AS total FROM (SELECT `)
+		writeStarredSQL(query, s.SQLStore, &countBuilder)
+		writeFiltersSQL(query, user, s.SQLStore, &countBuilder)
+		countBuilder.Write(`) AS matches`)
+
+		_, err := session.SQL(countBuilder.GetSQLString(), countBuilder.GetParams()...).Get(&count)
+		return err
+	})
+
+	if err != nil {
+		return QueryHistorySearchResult{}, err
+	}
+
+	for i := range dtos {
+		if err := dtos[i].decompress(); err != nil {
+			return QueryHistorySearchResult{}, err
+		}
+		dtos[i].setDefaultTimeRange()
+		dtos[i].setTargetDatasources()
+		if query.WithPreview {
+			dtos[i].Preview = queryPreview(dtos[i].Queries)
+		}
+	}
+
+	return QueryHistorySearchResult{
+		TotalCount:   count.Total,
+		QueryHistory: dtos,
+	}, nil
+}
+
+// searchQueryUIDs returns the UIDs of the queries matching the search, without
+// reading the queries nor joining the stars unless filtering on them.
+func (s QueryHistoryService) searchQueryUIDs(ctx context.Context, user *models.SignedInUser, query SearchInQueryHistoryQuery) (QueryHistorySearchResult, error) {
+	uids := []string{}
+	var count queryHistoryCount
+
+	err := s.withDbSession(ctx, func(session *sqlstore.DBSession) error {
+		uidsBuilder := sqlstore.SQLBuilder{}
+		uidsBuilder.Write(`SELECT query_history.uid`)
+		writeUIDsFromSQL(query, &uidsBuilder)
+		writeFiltersSQL(query, user, s.SQLStore, &uidsBuilder)
+		writeSortSQL(query, &uidsBuilder)
+		writeLimitSQL(query, s.SQLStore, &uidsBuilder)
+
+		if err := session.SQL(uidsBuilder.GetSQLString(), uidsBuilder.GetParams()...).Find(&uids); err != nil {
+			return err
+		}
+
+		countBuilder := sqlstore.SQLBuilder{}
+		countBuilder.Write(`SELECT COUNT(*) AS total`)
+		writeUIDsFromSQL(query, &countBuilder)
+		writeFiltersSQL(query, user, s.SQLStore, &countBuilder)
+
+		_, err := session.SQL(countBuilder.GetSQLString(), countBuilder.GetParams()...).Get(&count)
+		return err
+	})
+	if err != nil {
+		return QueryHistorySearchResult{}, err
+	}
+
+	return QueryHistorySearchResult{
+		TotalCount: count.Total,
+		UIDs:       uids,
+	}, nil
+}
+
+func (s QueryHistoryService) getQuery(ctx context.Context, user *models.SignedInUser, UID string) (QueryHistoryDTO, error) {
+	var queryHistory QueryHistory
+	var isStarred bool
+
+	err := s.withDbSession(ctx, func(session *sqlstore.DBSession) error {
+		exists, err := session.Where("org_id = ? AND created_by = ? AND uid = ?", user.OrgId, user.UserId, UID).Get(&queryHistory)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return ErrQueryNotFound
+		}
+		if err := queryHistory.decompress(); err != nil {
+			return err
+		}
+
+		starred, err := session.Table("query_history_star").Where("user_id = ? AND query_uid = ?", user.UserId, UID).Exist()
+		if err != nil {
+			return err
+		}
+		isStarred = starred
+		return nil
+	})
+
+	if err != nil {
+		return QueryHistoryDTO{}, err
+	}
+
+	dto := QueryHistoryDTO{
+		UID:           queryHistory.UID,
+		DatasourceUID: queryHistory.DatasourceUID,
+		CreatedBy:     queryHistory.CreatedBy,
+		CreatedAt:     queryHistory.CreatedAt,
+		Comment:       queryHistory.Comment,
+		Queries:       queryHistory.Queries,
+		From:          queryHistory.TimeFrom,
+		To:            queryHistory.TimeTo,
+		UpdatedAt:     queryHistory.UpdatedAt,
+		Starred:       isStarred,
+	}
+	dto.setDefaultTimeRange()
+	dto.setTargetDatasources()
+
+	return dto, nil
+}
+
+func (s QueryHistoryService) getRawQuery(ctx context.Context, user *models.SignedInUser, UID string) ([]byte, error) {
+	var stored struct {
+		Queries    string
+		Compressed bool
+	}
+
+	err := s.withDbSession(ctx, func(session *sqlstore.DBSession) error {
+		exists, err := session.Table("query_history").Cols("queries", "compressed").
+			Where("org_id = ? AND created_by = ? AND uid = ?", user.OrgId, user.UserId, UID).Get(&stored)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return ErrQueryNotFound
+		}
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	if stored.Compressed {
+		// The stored queries are a JSON string of the compressed queries.
+		var encoded string
+		if err := json.Unmarshal([]byte(stored.Queries), &encoded); err != nil {
+			return nil, err
+		}
+		return decompressRawQueries(encoded)
+	}
+	return []byte(stored.Queries), nil
+}
+
+func (s QueryHistoryService) reassignQueries(ctx context.Context, orgID int64, fromUserID int64, toUserID int64) (int64, error) {
+	var count int64
+	err := s.withTransactionalDbSession(ctx, func(session *sqlstore.DBSession) error {
+		if err := checkOrgMembers(session, orgID, fromUserID, toUserID); err != nil {
+			return err
+		}
+		var err error
+		count, _, err = moveUserQueries(session, orgID, fromUserID, toUserID)
+		return err
+	})
+
+	return count, err
+}
+
+// mergeUserHistory moves the queries of the source user, and their stars, to
+// the target user, e.g. when a user ends up with two accounts. The source
+// stars of the queries already starred by the target user are removed, the
+// target stars are kept along with their folder.
+func (s QueryHistoryService) mergeUserHistory(ctx context.Context, sourceUserID int64, targetUserID int64, orgID int64) (MergeUserHistoryResult, error) {
+	var result MergeUserHistoryResult
+	err := s.withTransactionalDbSession(ctx, func(session *sqlstore.DBSession) error {
+		if err := checkOrgMembers(session, orgID, sourceUserID, targetUserID); err != nil {
+			return err
+		}
+
+		// MySQL can't delete from a table selected in a subquery, the
+		// duplicate stars are read first.
+		var duplicates []int64
+		err := session.SQL(`SELECT source.id FROM query_history_star source
+			INNER JOIN query_history_star target ON target.query_uid = source.query_uid AND target.user_id = ?
+			WHERE source.user_id = ? AND source.query_uid IN (SELECT uid FROM query_history WHERE org_id = ? AND created_by = ?)`,
+			targetUserID, sourceUserID, orgID, sourceUserID).Find(&duplicates)
+		if err != nil {
+			return err
+		}
+		if len(duplicates) > 0 {
+			if result.DedupedStars, err = session.In("id", duplicates).Delete(&QueryHistoryStar{}); err != nil {
+				return err
+			}
+		}
+
+		result.MovedQueries, result.MovedStars, err = moveUserQueries(session, orgID, sourceUserID, targetUserID)
+		return err
+	})
+
+	return result, err
+}
+
+// checkOrgMembers returns ErrUserNotInOrg unless every user is a member of
+// the organization, so that queries are never moved to a user who can't read
+// them.
+func checkOrgMembers(session *sqlstore.DBSession, orgID int64, userIDs ...int64) error {
+	members, err := session.Table("org_user").Where("org_id = ?", orgID).In("user_id", userIDs).Count()
+	if err != nil {
+		return err
+	}
+	if members != int64(len(userIDs)) {
+		return ErrUserNotInOrg
+	}
+	return nil
+}
+
+// moveUserQueries transfers the queries of the organization, and their stars,
+// from one user to another. It returns the number of moved queries and stars.
+func moveUserQueries(session *sqlstore.DBSession, orgID int64, fromUserID int64, toUserID int64) (int64, int64, error) {
+	// Move the stars first as they are matched through the current owner of the queries.
+	// Folders belong to the previous owner, so the moved stars are removed from them.
+	res, err := session.Exec("UPDATE query_history_star SET user_id = ?, folder_id = NULL WHERE user_id = ? AND query_uid IN (SELECT uid FROM query_history WHERE org_id = ? AND created_by = ?)",
+		toUserID, fromUserID, orgID, fromUserID)
+	if err != nil {
+		return 0, 0, err
+	}
+	stars, err := res.RowsAffected()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	res, err = session.Exec("UPDATE query_history SET created_by = ? WHERE org_id = ? AND created_by = ?", toUserID, orgID, fromUserID)
+	if err != nil {
+		return 0, 0, err
+	}
+	queries, err := res.RowsAffected()
+	return queries, stars, err
+}
+
+// deleteUserQueries removes the query history of a user in every organization.
+// The queries are deleted, or kept without owner in the organizations whose
+// deleted users policy is anonymize.
+func (s QueryHistoryService) deleteUserQueries(ctx context.Context, userID int64) (int64, error) {
+	var orgIDs []int64
+	err := s.withDbSession(ctx, func(session *sqlstore.DBSession) error {
+		return session.Table("query_history").Where("created_by = ?", userID).Distinct("org_id").Find(&orgIDs)
+	})
+	if err != nil {
+		return 0, err
+	}
+	anonymized := make([]int64, 0, len(orgIDs))
+	for _, orgID := range orgIDs {
+		if s.orgDeletedUsersPolicy(ctx, orgID) == setting.QueryHistoryDeletedUsersAnonymize {
+			anonymized = append(anonymized, orgID)
+		}
+	}
+
+	var count int64
+	err = s.withTransactionalDbSession(ctx, func(session *sqlstore.DBSession) error {
+		if _, err := session.Exec("DELETE FROM query_history_star WHERE user_id = ?", userID); err != nil {
+			return err
+		}
+		if _, err := session.Exec("DELETE FROM query_history_folder WHERE user_id = ?", userID); err != nil {
+			return err
+		}
+
+		if len(anonymized) > 0 {
+			updated, err := session.Table("query_history").Where("created_by = ?", userID).In("org_id", anonymized).
+				Update(map[string]interface{}{"created_by": 0})
+			if err != nil {
+				return err
+			}
+			count += updated
+		}
+
+		// The queries of the organizations created since they were listed are
+		// deleted too.
+		res, err := session.Exec("DELETE FROM query_history WHERE created_by = ?", userID)
+		if err != nil {
+			return err
+		}
+		deleted, err := res.RowsAffected()
+		count += deleted
+		return err
+	})
+
+	return count, err
+}
+
+func (s QueryHistoryService) createFolder(ctx context.Context, user *models.SignedInUser, cmd SaveQueryHistoryFolderCommand) (QueryHistoryFolderDTO, error) {
+	name := strings.TrimSpace(cmd.Name)
+	if name == "" {
+		return QueryHistoryFolderDTO{}, ErrInvalidFolderName
+	}
+
+	folder := QueryHistoryFolder{
+		UID:       util.GenerateShortUID(),
+		OrgID:     user.OrgId,
+		UserID:    user.UserId,
+		Name:      name,
+		CreatedAt: time.Now().Unix(),
+	}
+
+	err := s.withDbSession(ctx, func(session *sqlstore.DBSession) error {
+		if _, err := session.Insert(&folder); err != nil {
+			if s.SQLStore.Dialect.IsUniqueConstraintViolation(err) {
+				return ErrFolderAlreadyExists
+			}
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		return QueryHistoryFolderDTO{}, err
+	}
+
+	return folderDTO(folder), nil
+}
+
+func (s QueryHistoryService) getFolders(ctx context.Context, user *models.SignedInUser) ([]QueryHistoryFolderDTO, error) {
+	folders := make([]QueryHistoryFolderDTO, 0)
+	err := s.withDbSession(ctx, func(session *sqlstore.DBSession) error {
+		return session.Table("query_history_folder").Where("org_id = ? AND user_id = ?", user.OrgId, user.UserId).Asc("name").Find(&folders)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return folders, nil
+}
+
+func (s QueryHistoryService) updateFolder(ctx context.Context, user *models.SignedInUser, UID string, cmd SaveQueryHistoryFolderCommand) (QueryHistoryFolderDTO, error) {
+	name := strings.TrimSpace(cmd.Name)
+	if name == "" {
+		return QueryHistoryFolderDTO{}, ErrInvalidFolderName
+	}
+
+	var folder QueryHistoryFolder
+	err := s.withTransactionalDbSession(ctx, func(session *sqlstore.DBSession) error {
+		if err := getFolder(session, user, UID, &folder); err != nil {
+			return err
+		}
+
+		folder.Name = name
+		if _, err := session.ID(folder.ID).Cols("name").Update(&folder); err != nil {
+			if s.SQLStore.Dialect.IsUniqueConstraintViolation(err) {
+				return ErrFolderAlreadyExists
+			}
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		return QueryHistoryFolderDTO{}, err
+	}
+
+	return folderDTO(folder), nil
+}
+
+// deleteFolder deletes the folder and removes its starred queries from it,
+// the queries themselves are kept.
+func (s QueryHistoryService) deleteFolder(ctx context.Context, user *models.SignedInUser, UID string) error {
+	return s.withTransactionalDbSession(ctx, func(session *sqlstore.DBSession) error {
+		var folder QueryHistoryFolder
+		if err := getFolder(session, user, UID, &folder); err != nil {
+			return err
+		}
+
+		if _, err := session.Exec("UPDATE query_history_star SET folder_id = NULL WHERE folder_id = ?", folder.ID); err != nil {
+			return err
+		}
+
+		_, err := session.ID(folder.ID).Delete(&QueryHistoryFolder{})
+		return err
+	})
+}
+
+// assignStarredQueryToFolder moves a starred query to a folder, or out of
+// its folder when no folder is given.
+func (s QueryHistoryService) assignStarredQueryToFolder(ctx context.Context, user *models.SignedInUser, UID string, cmd AssignStarredQueryToFolderCommand) (QueryHistoryDTO, error) {
+	err := s.withTransactionalDbSession(ctx, func(session *sqlstore.DBSession) error {
+		var star QueryHistoryStar
+		exists, err := session.Table("query_history_star").Where("user_id = ? AND query_uid = ?", user.UserId, UID).Get(&star)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return ErrStarredQueryNotFound
+		}
+
+		if cmd.FolderUID == "" {
+			_, err = session.Exec("UPDATE query_history_star SET folder_id = NULL WHERE id = ?", star.ID)
+			return err
+		}
+
+		var folder QueryHistoryFolder
+		if err := getFolder(session, user, cmd.FolderUID, &folder); err != nil {
+			return err
+		}
+		_, err = session.Exec("UPDATE query_history_star SET folder_id = ? WHERE id = ?", folder.ID, star.ID)
+		return err
+	})
+	if err != nil {
+		return QueryHistoryDTO{}, err
+	}
+
+	return s.getQuery(ctx, user, UID)
+}
+
+func getFolder(session *sqlstore.DBSession, user *models.SignedInUser, UID string, folder *QueryHistoryFolder) error {
+	exists, err := session.Where("org_id = ? AND user_id = ? AND uid = ?", user.OrgId, user.UserId, UID).Get(folder)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return ErrFolderNotFound
+	}
+	return nil
+}
+
+func folderDTO(folder QueryHistoryFolder) QueryHistoryFolderDTO {
+	return QueryHistoryFolderDTO{
+		UID:       folder.UID,
+		Name:      folder.Name,
+		CreatedAt: folder.CreatedAt,
+	}
+}
+
+const maxActivityBuckets = 1000
+
+// getActivity returns the number of queries the user added to query history
+// per bucket between from and to. Buckets are aligned on multiples of the
+// bucket size since epoch and buckets without queries are returned as zero.
+func (s QueryHistoryService) getActivity(ctx context.Context, user *models.SignedInUser, from, to time.Time, bucket time.Duration) ([]QueryHistoryActivityBucket, error) {
+	size := int64(bucket / time.Second)
+	if size < 60 || !to.After(from) {
+		return nil, ErrInvalidActivityRange
+	}
+	start := from.Unix() - from.Unix()%size
+	end := to.Unix()
+	if (end-start)/size >= maxActivityBuckets {
+		return nil, ErrInvalidActivityRange
+	}
+
+	var counts []QueryHistoryActivityBucket
+	err := s.withDbSession(ctx, func(session *sqlstore.DBSession) error {
+		builder := sqlstore.SQLBuilder{}
+		builder.Write(`SELECT (`+integerDivision(s.SQLStore.Dialect.DriverName(), "created_at", "?")+`) * ? AS bucket, COUNT(*) AS count
+			FROM query_history
+			WHERE org_id = ? AND created_by = ? AND created_at >= ? AND created_at <= ?
+			GROUP BY bucket`, size, size, user.OrgId, user.UserId, from.Unix(), end)
+		return session.SQL(builder.GetSQLString(), builder.GetParams()...).Find(&counts)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	byBucket := make(map[int64]int64, len(counts))
+	for _, c := range counts {
+		byBucket[c.Time] = c.Count
+	}
+
+	buckets := make([]QueryHistoryActivityBucket, 0, (end-start)/size+1)
+	for t := start; t <= end; t += size {
+		buckets = append(buckets, QueryHistoryActivityBucket{Time: t, Count: byBucket[t]})
+	}
+	return buckets, nil
+}
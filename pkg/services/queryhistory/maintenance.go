@@ -0,0 +1,98 @@
+package queryhistory
+
+import (
+	"context"
+	"time"
+
+	"github.com/grafana/grafana/pkg/services/sqlstore"
+	"github.com/grafana/grafana/pkg/services/sqlstore/migrator"
+)
+
+// maintenanceTables are the tables maintained by the maintenance routine.
+var maintenanceTables = []string{"query_history", "query_history_star"}
+
+// Run refreshes the statistics of the query history tables at the
+// maintenance_interval setting, so that the searches keep efficient plans.
+func (s QueryHistoryService) Run(ctx context.Context) error {
+	ticker := time.NewTicker(s.Cfg.QueryHistoryMaintenanceInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.runMaintenance(ctx)
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// IsDisabled returns whether the maintenance routine is disabled.
+func (s QueryHistoryService) IsDisabled() bool {
+	return !s.Cfg.QueryHistoryEnabled || s.Cfg.QueryHistoryMaintenanceInterval <= 0
+}
+
+// runMaintenance maintains the tables on a single instance when several
+// instances share the database.
+func (s QueryHistoryService) runMaintenance(ctx context.Context) {
+	if s.ServerLockService == nil {
+		s.maintainTables(ctx)
+		return
+	}
+	err := s.ServerLockService.LockAndExecute(ctx, "query history maintenance", s.Cfg.QueryHistoryMaintenanceInterval,
+		func(ctx context.Context) {
+			s.maintainTables(ctx)
+		})
+	if err != nil {
+		s.log.Error("Failed to lock the query history maintenance", "error", err)
+	}
+}
+
+// maintainTables runs the maintenance statements of the dialect, the
+// maintenance is skipped on the databases without statements.
+func (s QueryHistoryService) maintainTables(ctx context.Context) {
+	statements := maintenanceStatements(s.SQLStore.Dialect)
+	if len(statements) == 0 {
+		s.log.Debug("Skipping the query history maintenance, it's not supported by the database", "dialect", s.SQLStore.Dialect.DriverName())
+		return
+	}
+
+	start := time.Now()
+	for _, statement := range statements {
+		// The statements can take longer than the db_timeout on large tables,
+		// they only run in the session of the maintenance.
+		err := s.sessionStore().WithDbSession(ctx, func(session *sqlstore.DBSession) error {
+			_, err := session.Exec(statement)
+			return err
+		})
+		if err != nil {
+			s.log.Error("Query history maintenance failed", "statement", statement, "error", err, "duration", time.Since(start))
+			return
+		}
+	}
+	s.log.Info("Query history maintenance done", "duration", time.Since(start))
+}
+
+// maintenanceStatements returns the statements refreshing the statistics of
+// the query history tables for the dialect, and on PostgreSQL reclaiming the
+// space of the deleted queries. None of them blocks the reads and writes, so
+// VACUUM FULL, OPTIMIZE TABLE and REINDEX are left out. It returns nil for
+// unsupported dialects.
+func maintenanceStatements(dialect migrator.Dialect) []string {
+	var command string
+	switch dialect.DriverName() {
+	case migrator.SQLite:
+		command = "ANALYZE "
+	case migrator.MySQL:
+		command = "ANALYZE TABLE "
+	case migrator.Postgres:
+		command = "VACUUM ANALYZE "
+	default:
+		return nil
+	}
+
+	statements := make([]string, 0, len(maintenanceTables))
+	for _, table := range maintenanceTables {
+		statements = append(statements, command+dialect.Quote(table))
+	}
+	return statements
+}
@@ -0,0 +1,49 @@
+package queryhistory
+
+import (
+	"github.com/grafana/grafana/pkg/components/simplejson"
+)
+
+// setTargetDatasources sets the data sources of the targets of the queries
+// saved from the mixed data source, whose datasource_uid is the pseudo UID of
+// the mixed data source.
+func (dto *QueryHistoryDTO) setTargetDatasources() {
+	if dto.DatasourceUID == mixedDatasourceUID {
+		dto.TargetDatasourceUIDs = targetDatasourceUIDs(dto.Queries)
+	}
+}
+
+// targetDatasourceUIDs returns the UIDs of the data sources referenced by the
+// targets of the queries, in the order of the targets. The datasource property
+// of a target holds either the UID or an object with the UID.
+func targetDatasourceUIDs(queries *simplejson.Json) []string {
+	if queries == nil {
+		return nil
+	}
+	targets, err := queries.Array()
+	if err != nil {
+		targets = []interface{}{queries.Interface()}
+	}
+
+	var uids []string
+	seen := map[string]bool{}
+	for _, target := range targets {
+		properties, ok := target.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		var uid string
+		switch ref := properties["datasource"].(type) {
+		case string:
+			uid = ref
+		case map[string]interface{}:
+			uid, _ = ref["uid"].(string)
+		}
+		if uid == "" || uid == mixedDatasourceUID || seen[uid] {
+			continue
+		}
+		seen[uid] = true
+		uids = append(uids, uid)
+	}
+	return uids
+}
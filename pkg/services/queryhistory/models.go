@@ -7,9 +7,40 @@ import (
 )
 
 var (
-	ErrQueryNotFound        = errors.New("query in query history not found")
-	ErrStarredQueryNotFound = errors.New("starred query not found")
-	ErrQueryAlreadyStarred  = errors.New("query was already starred")
+	ErrQueryNotFound         = errors.New("query in query history not found")
+	ErrStarredQueryNotFound  = errors.New("starred query not found")
+	ErrQueryAlreadyStarred   = errors.New("query was already starred")
+	ErrNoDatasourceSpecified = errors.New("no datasource specified")
+	ErrInvalidReassignUsers  = errors.New("source and target users must be different existing users")
+	ErrUserNotInOrg          = errors.New("user is not a member of the organization")
+	ErrInvalidSearchOperator = errors.New("search operator must be either and or or")
+	ErrFolderNotFound        = errors.New("query history folder not found")
+	ErrFolderAlreadyExists   = errors.New("query history folder with the same name already exists")
+	ErrInvalidFolderName     = errors.New("query history folder name must not be empty")
+
+	ErrQueryHistoryInvalidDatasource = errors.New("datasource uid is not valid")
+	ErrInvalidActivityRange          = errors.New("activity range must end after it starts and contain at most 1000 buckets of at least one minute")
+	ErrInvalidTimeRange              = errors.New("time range must have both from and to")
+	ErrQueryConcurrentModification   = errors.New("query in query history was modified since it was read")
+	ErrDatabaseTimeout               = errors.New("query history database request timed out")
+	ErrCommentTooLong                = errors.New("query history comment must be at most 2000 characters")
+	ErrQueryHistoryQuotaReached      = errors.New("query history quota reached")
+	ErrInvalidUIDPrefix              = errors.New("query history uid prefix is not valid")
+	ErrInvalidSort                   = errors.New("sort must be either time-desc, time-asc or commented-first")
+	ErrSettingsUnavailable           = errors.New("query history settings can not be stored")
+	ErrInvalidDeletedUsersPolicy     = errors.New("deleted users policy must be either delete or anonymize")
+)
+
+const (
+	SearchOperatorAnd = "and"
+	SearchOperatorOr  = "or"
+)
+
+// The time range of queries stored without one, which is the default time
+// range of Explore.
+const (
+	DefaultTimeFrom = "now-1h"
+	DefaultTimeTo   = "now"
 )
 
 type QueryHistory struct {
@@ -21,31 +52,196 @@ type QueryHistory struct {
 	CreatedAt     int64
 	Comment       string
 	Queries       *simplejson.Json
+	TimeFrom      string `xorm:"time_from"`
+	TimeTo        string `xorm:"time_to"`
+	// UpdatedAt is when the query was last modified, in milliseconds since
+	// epoch.
+	UpdatedAt int64 `xorm:"updated_at"`
+	// Compressed tells that Queries holds the gzipped queries encoded in
+	// base64, see compressQueries.
+	Compressed bool `xorm:"compressed"`
 }
 
 type QueryHistoryStar struct {
 	ID       int64  `xorm:"pk autoincr 'id'"`
 	QueryUID string `xorm:"query_uid"`
 	UserID   int64  `xorm:"user_id"`
+	FolderID *int64 `xorm:"folder_id"`
+}
+
+// QueryHistoryFolder groups the starred queries of a user.
+type QueryHistoryFolder struct {
+	ID        int64  `xorm:"pk autoincr 'id'"`
+	UID       string `xorm:"uid"`
+	OrgID     int64  `xorm:"org_id"`
+	UserID    int64  `xorm:"user_id"`
+	Name      string
+	CreatedAt int64
 }
 
 type CreateQueryInQueryHistoryCommand struct {
 	DatasourceUID string           `json:"datasourceUid"`
 	Queries       *simplejson.Json `json:"queries"`
+	// From and To are the optional time range the queries were run with,
+	// either relative like now-1h or in milliseconds since epoch.
+	From string `json:"from"`
+	To   string `json:"to"`
 }
 
 type PatchQueryCommentInQueryHistoryCommand struct {
 	Comment string `json:"comment"`
+	// UpdatedAt is the optional modification time of the query the comment
+	// was edited from, the comment is only updated when the query was not
+	// modified since.
+	UpdatedAt *int64 `json:"updatedAt"`
+}
+
+type StarQueryInQueryHistoryCommand struct {
+	// Comment is the optional comment to set on the query along with the star.
+	Comment *string `json:"comment"`
+}
+
+type SearchInQueryHistoryQuery struct {
+	DatasourceUIDs []string `json:"datasourceUids"`
+	// AllDatasources searches the queries of all data sources, DatasourceUIDs
+	// is ignored then.
+	AllDatasources bool     `json:"allDatasources"`
+	SearchString   string   `json:"searchString"`
+	SearchTerms    []string `json:"searchTerms"`
+	SearchOperator string   `json:"searchOperator"`
+	OnlyStarred    bool     `json:"onlyStarred"`
+	FolderUID      string   `json:"folderUid"`
+	QueryType      string   `json:"queryType"`
+	Sort           string   `json:"sort"`
+	Page           int      `json:"page"`
+	Limit          int      `json:"limit"`
+	// UIDPrefix only matches the queries whose UID starts with the prefix,
+	// e.g. the queries created programmatically with prefixed UIDs.
+	UIDPrefix string `json:"uidPrefix"`
+	// UIDsOnly returns the UIDs of the matching queries instead of the
+	// queries, e.g. to sync the query history.
+	UIDsOnly bool `json:"uidsOnly"`
+	// GroupByDatasource returns the matching queries grouped by data source,
+	// the pagination applies to each group.
+	GroupByDatasource bool `json:"groupByDatasource"`
+	// WithPreview sets a one-line preview of the matching queries.
+	WithPreview bool `json:"withPreview"`
+	// IncludeMixed also matches the queries saved from the mixed data source,
+	// whatever the data sources of their targets.
+	IncludeMixed bool `json:"includeMixed"`
+
+	// compressedMatches are the UIDs of the compressed queries matching the
+	// search terms and query type, see matchCompressedQueries.
+	compressedMatches []string
+}
+
+// setDefaultPagination sets the first page and the default limit on searches
+// without one.
+func (query *SearchInQueryHistoryQuery) setDefaultPagination() {
+	if query.Page <= 0 {
+		query.Page = 1
+	}
+	if query.Limit <= 0 {
+		query.Limit = 100
+	}
+}
+
+type SaveQueryHistoryFolderCommand struct {
+	Name string `json:"name"`
+}
+
+type AssignStarredQueryToFolderCommand struct {
+	// FolderUID is the folder to move the starred query to, or empty to
+	// remove the query from its folder.
+	FolderUID string `json:"folderUid"`
+}
+
+// PromoteQueryToDashboardCommand adds the queries of a query history entry to
+// a new panel of a dashboard.
+type PromoteQueryToDashboardCommand struct {
+	DashboardUID string `json:"dashboardUid"`
+	// GridPos is the position of the new panel, the panel is added below the
+	// existing panels when it is not set.
+	GridPos *PanelGridPos `json:"gridPos"`
+}
+
+type PanelGridPos struct {
+	X int `json:"x"`
+	Y int `json:"y"`
+	W int `json:"w"`
+	H int `json:"h"`
+}
+
+type ReassignQueriesInQueryHistoryCommand struct {
+	FromUserID int64 `json:"fromUserId"`
+	ToUserID   int64 `json:"toUserId"`
+}
+
+type MergeUserHistoryCommand struct {
+	SourceUserID int64 `json:"sourceUserId"`
+	TargetUserID int64 `json:"targetUserId"`
+}
+
+// MergeUserHistoryResult is the number of queries and stars moved to the
+// target user, and of the duplicate stars removed.
+type MergeUserHistoryResult struct {
+	MovedQueries int64 `json:"movedQueries"`
+	MovedStars   int64 `json:"movedStars"`
+	DedupedStars int64 `json:"dedupedStars"`
+}
+
+// QueryHistorySettings are the query history settings of an organization.
+type QueryHistorySettings struct {
+	// DefaultSort is the sort of the searches without one.
+	DefaultSort string `json:"defaultSort"`
+	// DeletedUsers is what happens to the queries of the deleted users,
+	// either delete or anonymize.
+	DeletedUsers string `json:"deletedUsers"`
 }
 
 type QueryHistoryDTO struct {
-	UID           string           `json:"uid"`
-	DatasourceUID string           `json:"datasourceUid"`
+	UID           string           `json:"uid" xorm:"uid"`
+	DatasourceUID string           `json:"datasourceUid" xorm:"datasource_uid"`
 	CreatedBy     int64            `json:"createdBy"`
 	CreatedAt     int64            `json:"createdAt"`
 	Comment       string           `json:"comment"`
 	Queries       *simplejson.Json `json:"queries"`
+	From          string           `json:"from" xorm:"time_from"`
+	To            string           `json:"to" xorm:"time_to"`
+	UpdatedAt     int64            `json:"updatedAt" xorm:"updated_at"`
 	Starred       bool             `json:"starred"`
+	Compressed    bool             `json:"-" xorm:"compressed"`
+	// Preview is set on the searches with a preview only.
+	Preview string `json:"preview,omitempty" xorm:"-"`
+	// TargetDatasourceUIDs are the data sources of the targets of the queries
+	// saved from the mixed data source.
+	TargetDatasourceUIDs []string `json:"targetDatasourceUids,omitempty" xorm:"-"`
+}
+
+// setDefaultTimeRange sets the default time range on queries stored without
+// one, so that they can always be replayed.
+func (dto *QueryHistoryDTO) setDefaultTimeRange() {
+	if dto.From == "" || dto.To == "" {
+		dto.From = DefaultTimeFrom
+		dto.To = DefaultTimeTo
+	}
+}
+
+type QueryHistoryFolderDTO struct {
+	UID       string `json:"uid" xorm:"uid"`
+	Name      string `json:"name"`
+	CreatedAt int64  `json:"createdAt"`
+}
+
+// QueryHistoryActivityBucket is the number of queries added to query history
+// in the bucket starting at Time, in seconds since epoch.
+type QueryHistoryActivityBucket struct {
+	Time  int64 `json:"time" xorm:"bucket"`
+	Count int64 `json:"count"`
+}
+
+type queryHistoryCount struct {
+	Total int64
 }
 
 // QueryHistoryResponse is a response struct for QueryHistoryDTO
@@ -53,8 +249,75 @@ type QueryHistoryResponse struct {
 	Result QueryHistoryDTO `json:"result"`
 }
 
+type QueryHistorySearchResult struct {
+	TotalCount int64 `json:"totalCount"`
+	// Page and PerPage are the pagination of the search, PerPage applies to
+	// each group of searches grouped by data source.
+	Page    int `json:"page"`
+	PerPage int `json:"perPage"`
+	// QueryHistory is empty, never nil, when no query matches or only the UIDs
+	// or groups are returned.
+	QueryHistory []QueryHistoryDTO `json:"queryHistory"`
+	// UIDs are the UIDs of the matching queries of searches for UIDs only.
+	UIDs []string `json:"uids,omitempty"`
+	// Groups are the matching queries of searches grouped by data source.
+	Groups []QueryHistoryDatasourceGroup `json:"groups,omitempty"`
+}
+
+// QueryHistoryDatasourceGroup is the page of the matching queries of a data
+// source in a search grouped by data source.
+type QueryHistoryDatasourceGroup struct {
+	DatasourceUID string            `json:"datasourceUid"`
+	TotalCount    int64             `json:"totalCount"`
+	QueryHistory  []QueryHistoryDTO `json:"queryHistory,omitempty"`
+	UIDs          []string          `json:"uids,omitempty"`
+}
+
+// QueryHistorySearchResponse is a response struct for QueryHistorySearchResult
+type QueryHistorySearchResponse struct {
+	Result QueryHistorySearchResult `json:"result"`
+}
+
 // DeleteQueryFromQueryHistoryResponse is the response struct for deleting a query from query history
 type DeleteQueryFromQueryHistoryResponse struct {
 	ID      int64  `json:"id"`
 	Message string `json:"message"`
 }
+
+// ReassignQueriesInQueryHistoryResponse is the response struct for reassigning queries to another user
+type ReassignQueriesInQueryHistoryResponse struct {
+	Count   int64  `json:"count"`
+	Message string `json:"message"`
+}
+
+// MergeUserHistoryResponse is the response struct for merging the query
+// history of two users
+type MergeUserHistoryResponse struct {
+	Result  MergeUserHistoryResult `json:"result"`
+	Message string                 `json:"message"`
+}
+
+// QueryHistorySettingsResponse is the response struct for QueryHistorySettings
+type QueryHistorySettingsResponse struct {
+	Result QueryHistorySettings `json:"result"`
+}
+
+// QueryHistoryFolderResponse is the response struct for QueryHistoryFolderDTO
+type QueryHistoryFolderResponse struct {
+	Result QueryHistoryFolderDTO `json:"result"`
+}
+
+// QueryHistoryFoldersResponse is the response struct for a list of QueryHistoryFolderDTO
+type QueryHistoryFoldersResponse struct {
+	Result []QueryHistoryFolderDTO `json:"result"`
+}
+
+// DeleteQueryHistoryFolderResponse is the response struct for deleting a folder of starred queries
+type DeleteQueryHistoryFolderResponse struct {
+	Message string `json:"message"`
+}
+
+// QueryHistoryActivityResponse is the response struct for the query history activity of a user
+type QueryHistoryActivityResponse struct {
+	Result []QueryHistoryActivityBucket `json:"result"`
+}
@@ -0,0 +1,54 @@
+package queryhistory
+
+import (
+	"strings"
+
+	"github.com/grafana/grafana/pkg/components/simplejson"
+)
+
+// maxPreviewLength is the number of characters of a query kept in its preview.
+const maxPreviewLength = 100
+
+// previewProperties are the properties holding the query text of a target, in
+// the order they're looked up: expr for Prometheus and Loki, rawSql for the
+// SQL data sources and query for most of the others.
+var previewProperties = []string{"expr", "rawSql", "query"}
+
+// queryPreview returns a one-line preview of the queries: the text of the
+// first target with one, with its whitespaces collapsed and truncated to
+// maxPreviewLength characters. It returns an empty string when no target has a
+// known query text.
+func queryPreview(queries *simplejson.Json) string {
+	if queries == nil {
+		return ""
+	}
+	targets, err := queries.Array()
+	if err != nil {
+		targets = []interface{}{queries.Interface()}
+	}
+
+	for _, target := range targets {
+		properties, ok := target.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		for _, property := range previewProperties {
+			text, ok := properties[property].(string)
+			if !ok {
+				continue
+			}
+			if preview := strings.Join(strings.Fields(text), " "); preview != "" {
+				return truncatePreview(preview)
+			}
+		}
+	}
+	return ""
+}
+
+func truncatePreview(preview string) string {
+	runes := []rune(preview)
+	if len(runes) <= maxPreviewLength {
+		return preview
+	}
+	return string(runes[:maxPreviewLength-1]) + "…"
+}
@@ -2,61 +2,318 @@ package queryhistory
 
 import (
 	"context"
+	"time"
 
 	"github.com/grafana/grafana/pkg/api/routing"
+	"github.com/grafana/grafana/pkg/bus"
+	"github.com/grafana/grafana/pkg/events"
+	"github.com/grafana/grafana/pkg/infra/kvstore"
 	"github.com/grafana/grafana/pkg/infra/log"
+	"github.com/grafana/grafana/pkg/infra/serverlock"
 	"github.com/grafana/grafana/pkg/models"
+	"github.com/grafana/grafana/pkg/services/dashboards"
+	"github.com/grafana/grafana/pkg/services/quota"
 	"github.com/grafana/grafana/pkg/services/sqlstore"
 	"github.com/grafana/grafana/pkg/setting"
+	cw "github.com/weaveworks/common/tracing"
 )
 
-func ProvideService(cfg *setting.Cfg, sqlStore *sqlstore.SQLStore, routeRegister routing.RouteRegister) *QueryHistoryService {
+func ProvideService(cfg *setting.Cfg, sqlStore *sqlstore.SQLStore, routeRegister routing.RouteRegister, dashboardService dashboards.DashboardService, quotaService *quota.QuotaService, serverLockService *serverlock.ServerLockService, kvStore kvstore.KVStore, bus bus.Bus) *QueryHistoryService {
 	s := &QueryHistoryService{
-		SQLStore:      sqlStore,
-		Cfg:           cfg,
-		RouteRegister: routeRegister,
-		log:           log.New("query-history"),
+		SQLStore:          sqlStore,
+		Cfg:               cfg,
+		RouteRegister:     routeRegister,
+		DashboardService:  dashboardService,
+		QuotaService:      quotaService,
+		ServerLockService: serverLockService,
+		KVStore:           kvStore,
+		log:               log.New("query-history"),
 	}
 
+	searchCache, err := newSearchCache(cfg.QueryHistorySearchCacheTTL, cfg.QueryHistorySearchCacheMaxEntries)
+	if err != nil {
+		s.log.Error("Failed to create the query history search cache, searches are not cached", "error", err)
+	}
+	s.searchCache = searchCache
+
 	// Register routes only when query history is enabled
 	if s.Cfg.QueryHistoryEnabled {
 		s.registerAPIEndpoints()
 	}
 
+	bus.AddEventListener(s.handleUserDeleted)
+
 	return s
 }
 
+// Service is the query history API used by the HTTP handlers and by other
+// backend services that need programmatic access to saved queries.
 type Service interface {
 	CreateQueryInQueryHistory(ctx context.Context, user *models.SignedInUser, cmd CreateQueryInQueryHistoryCommand) (QueryHistoryDTO, error)
+	SearchInQueryHistory(ctx context.Context, user *models.SignedInUser, query SearchInQueryHistoryQuery) (QueryHistorySearchResult, error)
+	GetQueryInQueryHistory(ctx context.Context, user *models.SignedInUser, UID string) (QueryHistoryDTO, error)
+	GetRawQueryInQueryHistory(ctx context.Context, user *models.SignedInUser, UID string) ([]byte, error)
 	DeleteQueryFromQueryHistory(ctx context.Context, user *models.SignedInUser, UID string) (int64, error)
 	PatchQueryCommentInQueryHistory(ctx context.Context, user *models.SignedInUser, UID string, cmd PatchQueryCommentInQueryHistoryCommand) (QueryHistoryDTO, error)
-	StarQueryInQueryHistory(ctx context.Context, user *models.SignedInUser, UID string) (QueryHistoryDTO, error)
+	StarQueryInQueryHistory(ctx context.Context, user *models.SignedInUser, UID string, cmd StarQueryInQueryHistoryCommand) (QueryHistoryDTO, error)
 	UnstarQueryInQueryHistory(ctx context.Context, user *models.SignedInUser, UID string) (QueryHistoryDTO, error)
+	DuplicateQueryInQueryHistory(ctx context.Context, user *models.SignedInUser, UID string) (QueryHistoryDTO, error)
+	ReassignQueriesInQueryHistory(ctx context.Context, orgID int64, fromUserID int64, toUserID int64) (int64, error)
+	MergeUserHistoryInQueryHistory(ctx context.Context, orgID int64, sourceUserID int64, targetUserID int64) (MergeUserHistoryResult, error)
+	RemapDatasourceInQueryHistory(ctx context.Context, orgID int64, oldUID, newUID string) (int64, error)
+	CreateFolderInQueryHistory(ctx context.Context, user *models.SignedInUser, cmd SaveQueryHistoryFolderCommand) (QueryHistoryFolderDTO, error)
+	GetFoldersInQueryHistory(ctx context.Context, user *models.SignedInUser) ([]QueryHistoryFolderDTO, error)
+	UpdateFolderInQueryHistory(ctx context.Context, user *models.SignedInUser, UID string, cmd SaveQueryHistoryFolderCommand) (QueryHistoryFolderDTO, error)
+	DeleteFolderFromQueryHistory(ctx context.Context, user *models.SignedInUser, UID string) error
+	AssignStarredQueryToFolderInQueryHistory(ctx context.Context, user *models.SignedInUser, UID string, cmd AssignStarredQueryToFolderCommand) (QueryHistoryDTO, error)
+	GetActivityInQueryHistory(ctx context.Context, user *models.SignedInUser, from, to time.Time, bucket time.Duration) ([]QueryHistoryActivityBucket, error)
+	PromoteQueryToDashboard(ctx context.Context, user *models.SignedInUser, UID string, cmd PromoteQueryToDashboardCommand) (*models.Dashboard, error)
+	GetSettingsInQueryHistory(ctx context.Context, orgID int64) QueryHistorySettings
+	UpdateSettingsInQueryHistory(ctx context.Context, orgID int64, cmd QueryHistorySettings) (QueryHistorySettings, error)
 }
 
+var _ Service = (*QueryHistoryService)(nil)
+
 type QueryHistoryService struct {
-	SQLStore      *sqlstore.SQLStore
-	Cfg           *setting.Cfg
-	RouteRegister routing.RouteRegister
-	log           log.Logger
+	SQLStore         *sqlstore.SQLStore
+	Cfg              *setting.Cfg
+	RouteRegister    routing.RouteRegister
+	DashboardService dashboards.DashboardService
+	// QuotaService checks the query_history quota of the users, the quota
+	// isn't checked when it's nil.
+	QuotaService quota.Service
+	// ServerLockService runs the maintenance on a single instance, it runs on
+	// each instance when it's nil.
+	ServerLockService *serverlock.ServerLockService
+	// KVStore stores the settings of the organizations, the default settings
+	// apply when it's nil.
+	KVStore kvstore.KVStore
+	log     log.Logger
+	// searchCache caches the search results per user, it's nil when the
+	// cache is disabled. Writes must invalidate the cache of their users.
+	searchCache *searchCache
+	// sessions overrides the SQL store running the database sessions in tests.
+	sessions sessionStore
 }
 
 func (s QueryHistoryService) CreateQueryInQueryHistory(ctx context.Context, user *models.SignedInUser, cmd CreateQueryInQueryHistoryCommand) (QueryHistoryDTO, error) {
-	return s.createQuery(ctx, user, cmd)
+	done := s.startOperation(ctx, "create", "user", user.UserId, "datasource", cmd.DatasourceUID)
+	query, err := s.createQuery(ctx, user, cmd)
+	s.searchCache.invalidate(user.UserId)
+	done(err, "uid", query.UID)
+	return query, err
+}
+
+func (s QueryHistoryService) SearchInQueryHistory(ctx context.Context, user *models.SignedInUser, query SearchInQueryHistoryQuery) (QueryHistorySearchResult, error) {
+	done := s.startOperation(ctx, "search", "user", user.UserId, "datasources", query.DatasourceUIDs)
+	result, err := s.searchQueries(ctx, user, query)
+	done(err, "count", len(result.QueryHistory))
+	return result, err
+}
+
+func (s QueryHistoryService) GetQueryInQueryHistory(ctx context.Context, user *models.SignedInUser, UID string) (QueryHistoryDTO, error) {
+	done := s.startOperation(ctx, "get", "user", user.UserId, "uid", UID)
+	query, err := s.getQuery(ctx, user, UID)
+	done(err)
+	return query, err
+}
+
+// GetRawQueryInQueryHistory returns the queries of a query history entry exactly as they are stored.
+func (s QueryHistoryService) GetRawQueryInQueryHistory(ctx context.Context, user *models.SignedInUser, UID string) ([]byte, error) {
+	done := s.startOperation(ctx, "get raw", "user", user.UserId, "uid", UID)
+	raw, err := s.getRawQuery(ctx, user, UID)
+	done(err)
+	return raw, err
 }
 
 func (s QueryHistoryService) DeleteQueryFromQueryHistory(ctx context.Context, user *models.SignedInUser, UID string) (int64, error) {
-	return s.deleteQuery(ctx, user, UID)
+	done := s.startOperation(ctx, "delete", "user", user.UserId, "uid", UID)
+	id, err := s.deleteQuery(ctx, user, UID)
+	s.searchCache.invalidate(user.UserId)
+	done(err)
+	return id, err
 }
 
 func (s QueryHistoryService) PatchQueryCommentInQueryHistory(ctx context.Context, user *models.SignedInUser, UID string, cmd PatchQueryCommentInQueryHistoryCommand) (QueryHistoryDTO, error) {
-	return s.patchQueryComment(ctx, user, UID, cmd)
+	done := s.startOperation(ctx, "patch comment", "user", user.UserId, "uid", UID)
+	query, err := s.patchQueryComment(ctx, user, UID, cmd)
+	s.searchCache.invalidate(user.UserId)
+	done(err)
+	return query, err
 }
 
-func (s QueryHistoryService) StarQueryInQueryHistory(ctx context.Context, user *models.SignedInUser, UID string) (QueryHistoryDTO, error) {
-	return s.starQuery(ctx, user, UID)
+func (s QueryHistoryService) StarQueryInQueryHistory(ctx context.Context, user *models.SignedInUser, UID string, cmd StarQueryInQueryHistoryCommand) (QueryHistoryDTO, error) {
+	done := s.startOperation(ctx, "star", "user", user.UserId, "uid", UID)
+	query, err := s.starQuery(ctx, user, UID, cmd)
+	s.searchCache.invalidate(user.UserId)
+	done(err)
+	return query, err
 }
 
 func (s QueryHistoryService) UnstarQueryInQueryHistory(ctx context.Context, user *models.SignedInUser, UID string) (QueryHistoryDTO, error) {
-	return s.unstarQuery(ctx, user, UID)
+	done := s.startOperation(ctx, "unstar", "user", user.UserId, "uid", UID)
+	query, err := s.unstarQuery(ctx, user, UID)
+	s.searchCache.invalidate(user.UserId)
+	done(err)
+	return query, err
+}
+
+// DuplicateQueryInQueryHistory copies a query history entry of the user into a
+// new unstarred entry, so that it can be edited while keeping the original.
+func (s QueryHistoryService) DuplicateQueryInQueryHistory(ctx context.Context, user *models.SignedInUser, UID string) (QueryHistoryDTO, error) {
+	done := s.startOperation(ctx, "duplicate", "user", user.UserId, "uid", UID)
+	query, err := s.duplicateQuery(ctx, user, UID)
+	s.searchCache.invalidate(user.UserId)
+	done(err, "newUid", query.UID)
+	return query, err
+}
+
+// ReassignQueriesInQueryHistory transfers ownership of all queries, and their stars, from one user
+// to another within the organization. It returns the number of transferred queries.
+func (s QueryHistoryService) ReassignQueriesInQueryHistory(ctx context.Context, orgID int64, fromUserID int64, toUserID int64) (int64, error) {
+	done := s.startOperation(ctx, "reassign", "org", orgID, "fromUser", fromUserID, "toUser", toUserID)
+	count, err := s.reassignQueries(ctx, orgID, fromUserID, toUserID)
+	s.searchCache.invalidate(fromUserID, toUserID)
+	done(err, "count", count)
+	return count, err
+}
+
+// MergeUserHistoryInQueryHistory moves the queries, and their stars, of the
+// source user to the target user within the organization, e.g. after an SSO
+// migration left a user with two accounts. The stars of the queries starred by
+// both users are deduplicated.
+func (s QueryHistoryService) MergeUserHistoryInQueryHistory(ctx context.Context, orgID int64, sourceUserID int64, targetUserID int64) (MergeUserHistoryResult, error) {
+	done := s.startOperation(ctx, "merge users", "org", orgID, "sourceUser", sourceUserID, "targetUser", targetUserID)
+	result, err := s.mergeUserHistory(ctx, sourceUserID, targetUserID, orgID)
+	s.searchCache.invalidate(sourceUserID, targetUserID)
+	done(err, "movedQueries", result.MovedQueries, "movedStars", result.MovedStars, "dedupedStars", result.DedupedStars)
+	return result, err
+}
+
+// RemapDatasourceInQueryHistory points the queries of the organization from
+// the data source with oldUID to the one with newUID, for instance after a
+// data source was imported with a new UID. It returns the number of updated
+// queries.
+func (s QueryHistoryService) RemapDatasourceInQueryHistory(ctx context.Context, orgID int64, oldUID, newUID string) (int64, error) {
+	done := s.startOperation(ctx, "remap datasource", "org", orgID, "oldDatasource", oldUID, "newDatasource", newUID)
+	count, owners, err := s.remapDatasource(ctx, orgID, oldUID, newUID)
+	s.searchCache.invalidate(owners...)
+	done(err, "count", count)
+	return count, err
+}
+
+// handleUserDeleted deletes or anonymizes the queries of deleted users,
+// depending on the deleted users policy of each of their organizations, which
+// defaults to the deleted_users setting. Their stars and folders are always
+// deleted.
+func (s QueryHistoryService) handleUserDeleted(ctx context.Context, evt *events.UserDeleted) error {
+	done := s.startOperation(ctx, "deleteUser", "user", evt.Id)
+	count, err := s.deleteUserQueries(ctx, evt.Id)
+	s.searchCache.invalidate(evt.Id)
+	done(err, "count", count)
+	if err != nil {
+		s.logger(ctx).Error("Failed to remove the query history of deleted user", "user", evt.Id, "error", err)
+	}
+	return err
+}
+
+// CreateFolderInQueryHistory creates a folder to group the starred queries of the user.
+func (s QueryHistoryService) CreateFolderInQueryHistory(ctx context.Context, user *models.SignedInUser, cmd SaveQueryHistoryFolderCommand) (QueryHistoryFolderDTO, error) {
+	done := s.startOperation(ctx, "create folder", "user", user.UserId)
+	folder, err := s.createFolder(ctx, user, cmd)
+	done(err, "folder", folder.UID)
+	return folder, err
+}
+
+// GetFoldersInQueryHistory returns the folders of the user sorted by name.
+func (s QueryHistoryService) GetFoldersInQueryHistory(ctx context.Context, user *models.SignedInUser) ([]QueryHistoryFolderDTO, error) {
+	done := s.startOperation(ctx, "get folders", "user", user.UserId)
+	folders, err := s.getFolders(ctx, user)
+	done(err, "count", len(folders))
+	return folders, err
+}
+
+func (s QueryHistoryService) UpdateFolderInQueryHistory(ctx context.Context, user *models.SignedInUser, UID string, cmd SaveQueryHistoryFolderCommand) (QueryHistoryFolderDTO, error) {
+	done := s.startOperation(ctx, "update folder", "user", user.UserId, "folder", UID)
+	folder, err := s.updateFolder(ctx, user, UID, cmd)
+	done(err)
+	return folder, err
+}
+
+// DeleteFolderFromQueryHistory deletes a folder. Its starred queries are kept
+// and are no longer in any folder.
+func (s QueryHistoryService) DeleteFolderFromQueryHistory(ctx context.Context, user *models.SignedInUser, UID string) error {
+	done := s.startOperation(ctx, "delete folder", "user", user.UserId, "folder", UID)
+	err := s.deleteFolder(ctx, user, UID)
+	s.searchCache.invalidate(user.UserId)
+	done(err)
+	return err
+}
+
+// AssignStarredQueryToFolderInQueryHistory moves a starred query to a folder,
+// or out of its folder when the command has no folder UID.
+func (s QueryHistoryService) AssignStarredQueryToFolderInQueryHistory(ctx context.Context, user *models.SignedInUser, UID string, cmd AssignStarredQueryToFolderCommand) (QueryHistoryDTO, error) {
+	done := s.startOperation(ctx, "assign folder", "user", user.UserId, "uid", UID, "folder", cmd.FolderUID)
+	query, err := s.assignStarredQueryToFolder(ctx, user, UID, cmd)
+	s.searchCache.invalidate(user.UserId)
+	done(err)
+	return query, err
+}
+
+// GetActivityInQueryHistory returns the number of queries added by the user per
+// bucket of the given size between from and to.
+func (s QueryHistoryService) GetActivityInQueryHistory(ctx context.Context, user *models.SignedInUser, from, to time.Time, bucket time.Duration) ([]QueryHistoryActivityBucket, error) {
+	done := s.startOperation(ctx, "get activity", "user", user.UserId, "from", from, "to", to, "bucket", bucket)
+	buckets, err := s.getActivity(ctx, user, from, to, bucket)
+	done(err, "buckets", len(buckets))
+	return buckets, err
+}
+
+// PromoteQueryToDashboard adds a time series panel with the queries of a query
+// history entry to a dashboard the user can edit and returns the saved dashboard.
+func (s QueryHistoryService) PromoteQueryToDashboard(ctx context.Context, user *models.SignedInUser, UID string, cmd PromoteQueryToDashboardCommand) (*models.Dashboard, error) {
+	done := s.startOperation(ctx, "promote", "user", user.UserId, "uid", UID, "dashboard", cmd.DashboardUID)
+	dashboard, err := s.promoteQueryToDashboard(ctx, user, UID, cmd)
+	done(err)
+	return dashboard, err
+}
+
+// GetSettingsInQueryHistory returns the query history settings of the
+// organization.
+func (s QueryHistoryService) GetSettingsInQueryHistory(ctx context.Context, orgID int64) QueryHistorySettings {
+	return s.getSettings(ctx, orgID)
+}
+
+// UpdateSettingsInQueryHistory stores the query history settings of the
+// organization, e.g. the sort of the searches without one.
+func (s QueryHistoryService) UpdateSettingsInQueryHistory(ctx context.Context, orgID int64, cmd QueryHistorySettings) (QueryHistorySettings, error) {
+	done := s.startOperation(ctx, "update settings", "org", orgID, "defaultSort", cmd.DefaultSort)
+	settings, err := s.updateSettings(ctx, orgID, cmd)
+	done(err)
+	return settings, err
+}
+
+// logger returns the service logger with the trace ID of the request, when
+// there is one, so that the log lines of a request can be correlated.
+func (s QueryHistoryService) logger(ctx context.Context) log.Logger {
+	if traceID, ok := cw.ExtractTraceID(ctx); ok {
+		return s.log.New("traceID", traceID)
+	}
+	return s.log
+}
+
+// startOperation logs the start of a query history operation at debug level and
+// returns a function logging its outcome. Query bodies and comments must not be
+// passed as context as they may contain sensitive data.
+func (s QueryHistoryService) startOperation(ctx context.Context, operation string, logCtx ...interface{}) func(err error, result ...interface{}) {
+	logger := s.logger(ctx).New(append([]interface{}{"operation", operation}, logCtx...)...)
+	logger.Debug("Query history operation started")
+
+	return func(err error, result ...interface{}) {
+		if err != nil {
+			logger.Debug("Query history operation failed", "error", err)
+			return
+		}
+		logger.Debug("Query history operation finished", result...)
+	}
 }
@@ -0,0 +1,92 @@
+package queryhistory
+
+import (
+	"context"
+	"encoding/json"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana/pkg/components/simplejson"
+	"github.com/grafana/grafana/pkg/services/sqlstore"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetActivityInQueryHistory(t *testing.T) {
+	day := time.Date(2022, 3, 1, 0, 0, 0, 0, time.UTC)
+
+	createAt := func(t *testing.T, sc scenarioContext, createdAt time.Time) {
+		t.Helper()
+
+		dto, err := sc.service.createQuery(context.Background(), sc.reqContext.SignedInUser, CreateQueryInQueryHistoryCommand{
+			DatasourceUID: "NCzh67i",
+			Queries: simplejson.NewFromAny(map[string]interface{}{
+				"expr": "test",
+			}),
+		})
+		require.NoError(t, err)
+		err = sc.sqlStore.WithDbSession(context.Background(), func(session *sqlstore.DBSession) error {
+			_, err := session.Exec("UPDATE query_history SET created_at = ? WHERE uid = ?", createdAt.Unix(), dto.UID)
+			return err
+		})
+		require.NoError(t, err)
+	}
+
+	activity := func(t *testing.T, sc scenarioContext, from, to time.Time, bucket string) []QueryHistoryActivityBucket {
+		t.Helper()
+
+		sc.reqContext.Req.Form = url.Values{
+			"from":   []string{strconv.FormatInt(from.Unix(), 10)},
+			"to":     []string{strconv.FormatInt(to.Unix(), 10)},
+			"bucket": []string{bucket},
+		}
+		resp := sc.service.activityHandler(sc.reqContext)
+		require.Equal(t, 200, resp.Status())
+
+		var result QueryHistoryActivityResponse
+		require.NoError(t, json.Unmarshal(resp.Body(), &result))
+		return result.Result
+	}
+
+	testScenario(t, "When users get their activity, it should count queries per day including empty days",
+		func(t *testing.T, sc scenarioContext) {
+			createAt(t, sc, day.Add(10*time.Hour))
+			createAt(t, sc, day.Add(12*time.Hour))
+			createAt(t, sc, day.Add(56*time.Hour))
+			createAt(t, sc, day.Add(-time.Hour))
+
+			buckets := activity(t, sc, day, day.Add(71*time.Hour), "24h")
+			require.Equal(t, []QueryHistoryActivityBucket{
+				{Time: day.Unix(), Count: 2},
+				{Time: day.Add(24 * time.Hour).Unix(), Count: 0},
+				{Time: day.Add(48 * time.Hour).Unix(), Count: 1},
+			}, buckets)
+		})
+
+	testScenario(t, "When users get their activity per hour, it should align buckets on hours",
+		func(t *testing.T, sc scenarioContext) {
+			createAt(t, sc, day.Add(90*time.Minute))
+
+			buckets := activity(t, sc, day.Add(30*time.Minute), day.Add(150*time.Minute), "1h")
+			require.Equal(t, []QueryHistoryActivityBucket{
+				{Time: day.Unix(), Count: 0},
+				{Time: day.Add(time.Hour).Unix(), Count: 1},
+				{Time: day.Add(2 * time.Hour).Unix(), Count: 0},
+			}, buckets)
+		})
+
+	testScenario(t, "When users get their activity with an invalid range, it should fail",
+		func(t *testing.T, sc scenarioContext) {
+			for _, form := range []url.Values{
+				{"bucket": []string{"1s"}},
+				{"bucket": []string{"one day"}},
+				{"from": []string{"100"}, "to": []string{"50"}},
+				{"from": []string{"0"}, "to": []string{strconv.FormatInt(day.Unix(), 10)}},
+			} {
+				sc.reqContext.Req.Form = form
+				resp := sc.service.activityHandler(sc.reqContext)
+				require.Equal(t, 400, resp.Status())
+			}
+		})
+}
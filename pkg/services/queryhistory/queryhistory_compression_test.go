@@ -0,0 +1,147 @@
+package queryhistory
+
+import (
+	"context"
+	"encoding/json"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/grafana/grafana/pkg/components/simplejson"
+	"github.com/grafana/grafana/pkg/services/sqlstore"
+	"github.com/grafana/grafana/pkg/web"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompressedQueryHistory(t *testing.T) {
+	largeQueries := func() *simplejson.Json {
+		return simplejson.NewFromAny([]interface{}{
+			map[string]interface{}{"refId": "A", "expr": strings.Repeat("sum(rate(http_requests_total[5m])) + ", 200) + "1"},
+			map[string]interface{}{"refId": "B", "expr": "up"},
+		})
+	}
+
+	storedRow := func(t *testing.T, sc scenarioContext, uid string) QueryHistory {
+		t.Helper()
+		var stored QueryHistory
+		err := sc.sqlStore.WithDbSession(context.Background(), func(session *sqlstore.DBSession) error {
+			_, err := session.Where("uid = ?", uid).Get(&stored)
+			return err
+		})
+		require.NoError(t, err)
+		return stored
+	}
+
+	testScenario(t, "When queries larger than the threshold are added, they should be stored compressed and read back uncompressed",
+		func(t *testing.T, sc scenarioContext) {
+			sc.service.Cfg.QueryHistoryCompressThreshold = 1024
+			queries := largeQueries()
+			expected, err := queries.MarshalJSON()
+			require.NoError(t, err)
+
+			dto, err := sc.service.createQuery(context.Background(), sc.reqContext.SignedInUser, CreateQueryInQueryHistoryCommand{
+				DatasourceUID: "NCzh67i",
+				Queries:       queries,
+			})
+			require.NoError(t, err)
+			actual, err := dto.Queries.MarshalJSON()
+			require.NoError(t, err)
+			require.JSONEq(t, string(expected), string(actual))
+
+			stored := storedRow(t, sc, dto.UID)
+			require.True(t, stored.Compressed)
+			storedJSON, err := stored.Queries.MarshalJSON()
+			require.NoError(t, err)
+			require.Less(t, len(storedJSON), len(expected)/4)
+
+			got, err := sc.service.getQuery(context.Background(), sc.reqContext.SignedInUser, dto.UID)
+			require.NoError(t, err)
+			actual, err = got.Queries.MarshalJSON()
+			require.NoError(t, err)
+			require.JSONEq(t, string(expected), string(actual))
+
+			sc.reqContext.Req.Form = url.Values{"datasourceUid": []string{"NCzh67i"}}
+			resp := sc.service.searchHandler(sc.reqContext)
+			result := validateAndUnMarshalSearchResponse(t, resp.Status(), resp.Body())
+			require.Len(t, result.Result.QueryHistory, 1)
+			actual, err = result.Result.QueryHistory[0].Queries.MarshalJSON()
+			require.NoError(t, err)
+			require.JSONEq(t, string(expected), string(actual))
+
+			raw, err := sc.service.getRawQuery(context.Background(), sc.reqContext.SignedInUser, dto.UID)
+			require.NoError(t, err)
+			require.JSONEq(t, string(expected), string(raw))
+		})
+
+	testScenario(t, "When queries smaller than the threshold are added, they should be stored as is",
+		func(t *testing.T, sc scenarioContext) {
+			sc.service.Cfg.QueryHistoryCompressThreshold = 1024 * 1024
+
+			dto, err := sc.service.createQuery(context.Background(), sc.reqContext.SignedInUser, CreateQueryInQueryHistoryCommand{
+				DatasourceUID: "NCzh67i",
+				Queries:       largeQueries(),
+			})
+			require.NoError(t, err)
+
+			stored := storedRow(t, sc, dto.UID)
+			require.False(t, stored.Compressed)
+			require.Equal(t, "B", stored.Queries.GetIndex(1).Get("refId").MustString())
+		})
+
+	testScenario(t, "When compressed queries are starred, they should be returned uncompressed",
+		func(t *testing.T, sc scenarioContext) {
+			sc.service.Cfg.QueryHistoryCompressThreshold = 1
+
+			dto, err := sc.service.createQuery(context.Background(), sc.reqContext.SignedInUser, CreateQueryInQueryHistoryCommand{
+				DatasourceUID: "NCzh67i",
+				Queries:       simplejson.NewFromAny(map[string]interface{}{"expr": "up"}),
+			})
+			require.NoError(t, err)
+
+			sc.ctx.Req = web.SetURLParams(sc.ctx.Req, map[string]string{":uid": dto.UID})
+			resp := sc.service.starHandler(sc.reqContext)
+			require.Equal(t, 200, resp.Status())
+			var starred QueryHistoryResponse
+			require.NoError(t, json.Unmarshal(resp.Body(), &starred))
+			require.Equal(t, "up", starred.Result.Queries.Get("expr").MustString())
+		})
+	testScenario(t, "When users search the content of compressed queries, they should be matched as uncompressed queries",
+		func(t *testing.T, sc scenarioContext) {
+			sc.service.Cfg.QueryHistoryCompressThreshold = 1024
+			user := sc.reqContext.SignedInUser
+
+			compressed, err := sc.service.createQuery(context.Background(), user, CreateQueryInQueryHistoryCommand{
+				DatasourceUID: "NCzh67i",
+				Queries: simplejson.NewFromAny([]interface{}{
+					map[string]interface{}{"refId": "A", "queryType": "range", "expr": strings.Repeat("sum(rate(http_requests_total[5m])) + ", 200) + "1"},
+				}),
+			})
+			require.NoError(t, err)
+			require.True(t, storedRow(t, sc, compressed.UID).Compressed)
+			uncompressed, err := sc.service.createQuery(context.Background(), user, CreateQueryInQueryHistoryCommand{
+				DatasourceUID: "NCzh67i",
+				Queries:       simplejson.NewFromAny([]interface{}{map[string]interface{}{"refId": "A", "queryType": "instant", "expr": "http_requests_total"}}),
+			})
+			require.NoError(t, err)
+
+			for desc, tc := range map[string]struct {
+				form     url.Values
+				expected []string
+			}{
+				"search string":          {url.Values{"searchString": []string{"HTTP_REQUESTS"}}, []string{compressed.UID, uncompressed.UID}},
+				"terms matched together": {url.Values{"searchTerms": []string{"rate", "http_requests"}}, []string{compressed.UID}},
+				"terms matched by any":   {url.Values{"searchTerms": []string{"rate", "missing"}, "searchOperator": []string{"or"}}, []string{compressed.UID}},
+				"missing term":           {url.Values{"searchString": []string{"missing"}}, []string{}},
+				"query type":             {url.Values{"queryType": []string{"range"}}, []string{compressed.UID}},
+				"query type and term":    {url.Values{"queryType": []string{"instant"}, "searchString": []string{"http_requests"}}, []string{uncompressed.UID}},
+			} {
+				tc.form.Set("datasourceUid", "NCzh67i")
+				tc.form.Set("uidsOnly", "true")
+				sc.reqContext.Req.Form = tc.form
+				resp := sc.service.searchHandler(sc.reqContext)
+				result := validateAndUnMarshalSearchResponse(t, resp.Status(), resp.Body())
+				require.ElementsMatch(t, tc.expected, result.Result.UIDs, desc)
+				require.Equal(t, int64(len(tc.expected)), result.Result.TotalCount, desc)
+			}
+		})
+}
@@ -1,9 +1,17 @@
 package queryhistory
 
 import (
+	"context"
+	"strconv"
 	"testing"
 
 	"github.com/grafana/grafana/pkg/components/simplejson"
+	"github.com/grafana/grafana/pkg/infra/log"
+	"github.com/grafana/grafana/pkg/models"
+	"github.com/grafana/grafana/pkg/services/quota"
+	"github.com/grafana/grafana/pkg/services/sqlstore"
+	"github.com/grafana/grafana/pkg/setting"
+	"github.com/grafana/grafana/pkg/web"
 	"github.com/stretchr/testify/require"
 )
 
@@ -21,3 +29,138 @@ func TestCreateQueryInQueryHistory(t *testing.T) {
 			require.Equal(t, 200, resp.Status())
 		})
 }
+
+func TestCreateQueryInQueryHistoryDatasourceValidation(t *testing.T) {
+	tests := []struct {
+		desc          string
+		datasourceUID string
+		status        int
+	}{
+		{desc: "a valid uid", datasourceUID: "P8zM2I1nz", status: 200},
+		{desc: "the grafana data source", datasourceUID: "grafana", status: 200},
+		{desc: "the mixed data source", datasourceUID: "-- Mixed --", status: 200},
+		{desc: "a numeric id", datasourceUID: "42", status: 400},
+		{desc: "a data source name", datasourceUID: "My Prometheus", status: 400},
+		{desc: "no uid", datasourceUID: "", status: 400},
+	}
+
+	for _, tt := range tests {
+		testScenario(t, "When users create a query for "+tt.desc+", it should respond with "+strconv.Itoa(tt.status),
+			func(t *testing.T, sc scenarioContext) {
+				sc.reqContext.Req.Body = mockRequestBody(CreateQueryInQueryHistoryCommand{
+					DatasourceUID: tt.datasourceUID,
+					Queries: simplejson.NewFromAny(map[string]interface{}{
+						"expr": "test",
+					}),
+				})
+				resp := sc.service.createHandler(sc.reqContext)
+				require.Equal(t, tt.status, resp.Status())
+			})
+	}
+}
+
+func TestCreateQueryInQueryHistoryWithQuota(t *testing.T) {
+	testScenario(t, "When users reach their query history quota, creating a query should fail",
+		func(t *testing.T, sc scenarioContext) {
+			sc.service.Cfg.Quota = setting.QuotaSettings{
+				Enabled: true,
+				User:    &setting.UserQuota{QueryHistory: 2},
+			}
+			sc.service.QuotaService = &quota.QuotaService{
+				Cfg:      sc.service.Cfg,
+				SQLStore: sc.sqlStore,
+				Logger:   log.New("quota_service"),
+			}
+			user := sc.reqContext.SignedInUser
+			command := CreateQueryInQueryHistoryCommand{
+				DatasourceUID: "NCzh67i",
+				Queries: simplejson.NewFromAny(map[string]interface{}{
+					"expr": "test",
+				}),
+			}
+
+			for i := 0; i < 2; i++ {
+				_, err := sc.service.createQuery(context.Background(), user, command)
+				require.NoError(t, err)
+			}
+
+			_, err := sc.service.createQuery(context.Background(), user, command)
+			require.ErrorIs(t, err, ErrQueryHistoryQuotaReached)
+
+			sc.reqContext.Req.Body = mockRequestBody(command)
+			resp := sc.service.createHandler(sc.reqContext)
+			require.Equal(t, 403, resp.Status())
+
+			otherUser := &models.SignedInUser{UserId: testUserID + 1, OrgId: testOrgID}
+			_, err = sc.service.createQuery(context.Background(), otherUser, command)
+			require.NoError(t, err)
+		})
+}
+
+func TestDuplicateQueryInQueryHistoryWithQuota(t *testing.T) {
+	testScenarioWithQueryInQueryHistory(t, "When users reach their query history quota, duplicating a query should fail",
+		func(t *testing.T, sc scenarioContext) {
+			sc.service.Cfg.Quota = setting.QuotaSettings{
+				Enabled: true,
+				User:    &setting.UserQuota{QueryHistory: 2},
+			}
+			sc.service.QuotaService = &quota.QuotaService{
+				Cfg:      sc.service.Cfg,
+				SQLStore: sc.sqlStore,
+				Logger:   log.New("quota_service"),
+			}
+			user := sc.reqContext.SignedInUser
+			original := sc.initialResult.Result.UID
+
+			_, err := sc.service.duplicateQuery(context.Background(), user, original)
+			require.NoError(t, err)
+
+			_, err = sc.service.duplicateQuery(context.Background(), user, original)
+			require.ErrorIs(t, err, ErrQueryHistoryQuotaReached)
+
+			sc.ctx.Req = web.SetURLParams(sc.ctx.Req, map[string]string{":uid": original})
+			resp := sc.service.duplicateHandler(sc.reqContext)
+			require.Equal(t, 403, resp.Status())
+		})
+}
+
+func TestCreateQueryInQueryHistoryWithDatasourceLimit(t *testing.T) {
+	testScenario(t, "When users create more queries than allowed per data source, the oldest non-starred ones should be removed",
+		func(t *testing.T, sc scenarioContext) {
+			sc.service.Cfg.QueryHistoryMaxQueriesPerDatasource = 2
+			user := sc.reqContext.SignedInUser
+
+			create := func(datasourceUID string) string {
+				dto, err := sc.service.createQuery(context.Background(), user, CreateQueryInQueryHistoryCommand{
+					DatasourceUID: datasourceUID,
+					Queries: simplejson.NewFromAny(map[string]interface{}{
+						"expr": "test",
+					}),
+				})
+				require.NoError(t, err)
+				return dto.UID
+			}
+
+			starred := create("NCzh67i")
+			_, err := sc.service.starQuery(context.Background(), user, starred, StarQueryInQueryHistoryCommand{})
+			require.NoError(t, err)
+
+			other := create("ABCDEFG")
+			oldest := create("NCzh67i")
+			second := create("NCzh67i")
+			third := create("NCzh67i")
+
+			var queries []QueryHistory
+			err = sc.sqlStore.WithDbSession(context.Background(), func(session *sqlstore.DBSession) error {
+				return session.Where("org_id = ? AND created_by = ?", user.OrgId, user.UserId).Find(&queries)
+			})
+			require.NoError(t, err)
+
+			uids := make([]string, 0, len(queries))
+			for _, q := range queries {
+				uids = append(uids, q.UID)
+			}
+			require.ElementsMatch(t, []string{starred, other, second, third}, uids)
+			require.NotContains(t, uids, oldest)
+		})
+}
@@ -0,0 +1,106 @@
+package queryhistory
+
+import (
+	"context"
+	"testing"
+
+	"github.com/grafana/grafana/pkg/bus"
+	"github.com/grafana/grafana/pkg/components/simplejson"
+	"github.com/grafana/grafana/pkg/events"
+	"github.com/grafana/grafana/pkg/infra/kvstore"
+	"github.com/grafana/grafana/pkg/models"
+	"github.com/grafana/grafana/pkg/services/sqlstore"
+	"github.com/grafana/grafana/pkg/setting"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDeletedUsersQueryHistory(t *testing.T) {
+	otherUser := &models.SignedInUser{UserId: testUserID + 1, OrgId: testOrgID}
+
+	setupDeletedUser := func(t *testing.T, sc scenarioContext) *bus.InProcBus {
+		t.Helper()
+
+		_, err := sc.service.StarQueryInQueryHistory(context.Background(), sc.reqContext.SignedInUser, sc.initialResult.Result.UID, StarQueryInQueryHistoryCommand{})
+		require.NoError(t, err)
+		_, err = sc.service.CreateFolderInQueryHistory(context.Background(), sc.reqContext.SignedInUser, SaveQueryHistoryFolderCommand{Name: "Debugging"})
+		require.NoError(t, err)
+
+		other, err := sc.service.createQuery(context.Background(), otherUser, CreateQueryInQueryHistoryCommand{
+			DatasourceUID: "NCzh67i",
+			Queries:       simplejson.NewFromAny(map[string]interface{}{"expr": "up"}),
+		})
+		require.NoError(t, err)
+		_, err = sc.service.StarQueryInQueryHistory(context.Background(), otherUser, other.UID, StarQueryInQueryHistoryCommand{})
+		require.NoError(t, err)
+
+		b := bus.New()
+		b.AddEventListener(sc.service.handleUserDeleted)
+		return b
+	}
+
+	count := func(t *testing.T, sc scenarioContext, table string, where string, args ...interface{}) int64 {
+		t.Helper()
+		var total int64
+		err := sc.sqlStore.WithDbSession(context.Background(), func(session *sqlstore.DBSession) error {
+			var err error
+			total, err = session.Table(table).Where(where, args...).Count()
+			return err
+		})
+		require.NoError(t, err)
+		return total
+	}
+
+	testScenarioWithQueryInQueryHistory(t, "When a user is deleted, their query history should be deleted",
+		func(t *testing.T, sc scenarioContext) {
+			b := setupDeletedUser(t, sc)
+
+			err := b.Publish(context.Background(), &events.UserDeleted{Id: testUserID})
+			require.NoError(t, err)
+
+			require.Zero(t, count(t, sc, "query_history", "created_by = ?", testUserID))
+			require.Zero(t, count(t, sc, "query_history_star", "user_id = ?", testUserID))
+			require.Zero(t, count(t, sc, "query_history_folder", "user_id = ?", testUserID))
+
+			// The query history of other users is kept.
+			require.Equal(t, int64(1), count(t, sc, "query_history", "created_by = ?", otherUser.UserId))
+			require.Equal(t, int64(1), count(t, sc, "query_history_star", "user_id = ?", otherUser.UserId))
+		})
+
+	testScenarioWithQueryInQueryHistory(t, "When a user is deleted and queries are anonymized, their queries should be kept without owner",
+		func(t *testing.T, sc scenarioContext) {
+			sc.service.Cfg.QueryHistoryDeletedUsers = setting.QueryHistoryDeletedUsersAnonymize
+			b := setupDeletedUser(t, sc)
+
+			err := b.Publish(context.Background(), &events.UserDeleted{Id: testUserID})
+			require.NoError(t, err)
+
+			require.Zero(t, count(t, sc, "query_history", "created_by = ?", testUserID))
+			require.Equal(t, int64(1), count(t, sc, "query_history", "created_by = ? AND uid = ?", 0, sc.initialResult.Result.UID))
+			require.Zero(t, count(t, sc, "query_history_star", "user_id = ?", testUserID))
+			require.Zero(t, count(t, sc, "query_history_folder", "user_id = ?", testUserID))
+			require.Equal(t, int64(1), count(t, sc, "query_history", "created_by = ?", otherUser.UserId))
+		})
+
+	testScenarioWithQueryInQueryHistory(t, "When a user is deleted, their queries should be handled according to the policy of each organization",
+		func(t *testing.T, sc scenarioContext) {
+			sc.service.KVStore = kvstore.ProvideService(sc.sqlStore)
+			_, err := sc.service.UpdateSettingsInQueryHistory(context.Background(), testOrgID, QueryHistorySettings{
+				DeletedUsers: setting.QueryHistoryDeletedUsersAnonymize,
+			})
+			require.NoError(t, err)
+			_, err = sc.service.createQuery(context.Background(), &models.SignedInUser{UserId: testUserID, OrgId: testOrgID + 1}, CreateQueryInQueryHistoryCommand{
+				DatasourceUID: "NCzh67i",
+				Queries:       simplejson.NewFromAny(map[string]interface{}{"expr": "up"}),
+			})
+			require.NoError(t, err)
+			b := setupDeletedUser(t, sc)
+
+			err = b.Publish(context.Background(), &events.UserDeleted{Id: testUserID})
+			require.NoError(t, err)
+
+			require.Zero(t, count(t, sc, "query_history", "created_by = ?", testUserID))
+			require.Equal(t, int64(1), count(t, sc, "query_history", "created_by = ? AND uid = ?", 0, sc.initialResult.Result.UID))
+			// The organization without policy uses the deleted_users setting.
+			require.Zero(t, count(t, sc, "query_history", "org_id = ?", testOrgID+1))
+		})
+}
@@ -0,0 +1,58 @@
+package queryhistory
+
+import (
+	"context"
+	"testing"
+
+	"github.com/grafana/grafana/pkg/models"
+	"github.com/grafana/grafana/pkg/web"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDuplicateQueryInQueryHistory(t *testing.T) {
+	testScenarioWithQueryInQueryHistory(t, "When users tries to duplicate query that does not exist, it should fail",
+		func(t *testing.T, sc scenarioContext) {
+			sc.ctx.Req = web.SetURLParams(sc.ctx.Req, map[string]string{":uid": "unknown"})
+			resp := sc.service.duplicateHandler(sc.reqContext)
+			require.Equal(t, 404, resp.Status())
+		})
+
+	testScenarioWithQueryInQueryHistory(t, "When users tries to duplicate query of another user, it should fail",
+		func(t *testing.T, sc scenarioContext) {
+			sc.ctx.Req = web.SetURLParams(sc.ctx.Req, map[string]string{":uid": sc.initialResult.Result.UID})
+			sc.reqContext.SignedInUser = &models.SignedInUser{UserId: testUserID + 1, OrgId: testOrgID}
+			resp := sc.service.duplicateHandler(sc.reqContext)
+			require.Equal(t, 404, resp.Status())
+		})
+
+	testScenarioWithQueryInQueryHistory(t, "When users duplicate a starred query, the copy should be independent from the original",
+		func(t *testing.T, sc scenarioContext) {
+			original := sc.initialResult.Result
+			_, err := sc.service.PatchQueryCommentInQueryHistory(context.Background(), sc.reqContext.SignedInUser, original.UID, PatchQueryCommentInQueryHistoryCommand{Comment: "Original comment"})
+			require.NoError(t, err)
+			_, err = sc.service.StarQueryInQueryHistory(context.Background(), sc.reqContext.SignedInUser, original.UID, StarQueryInQueryHistoryCommand{})
+			require.NoError(t, err)
+
+			sc.ctx.Req = web.SetURLParams(sc.ctx.Req, map[string]string{":uid": original.UID})
+			resp := sc.service.duplicateHandler(sc.reqContext)
+			duplicate := validateAndUnMarshalResponse(t, resp).Result
+
+			require.NotEqual(t, original.UID, duplicate.UID)
+			require.Equal(t, original.DatasourceUID, duplicate.DatasourceUID)
+			require.Equal(t, "Original comment", duplicate.Comment)
+			require.Equal(t, original.Queries, duplicate.Queries)
+			require.GreaterOrEqual(t, duplicate.CreatedAt, original.CreatedAt)
+			require.False(t, duplicate.Starred)
+
+			_, err = sc.service.PatchQueryCommentInQueryHistory(context.Background(), sc.reqContext.SignedInUser, duplicate.UID, PatchQueryCommentInQueryHistoryCommand{Comment: "Edited copy"})
+			require.NoError(t, err)
+			_, err = sc.service.DeleteQueryFromQueryHistory(context.Background(), sc.reqContext.SignedInUser, duplicate.UID)
+			require.NoError(t, err)
+
+			got, err := sc.service.GetQueryInQueryHistory(context.Background(), sc.reqContext.SignedInUser, original.UID)
+			require.NoError(t, err)
+			require.Equal(t, "Original comment", got.Comment)
+			require.True(t, got.Starred)
+			require.Equal(t, original.Queries, got.Queries)
+		})
+}
@@ -0,0 +1,80 @@
+package queryhistory
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/grafana/grafana/pkg/web"
+	"github.com/stretchr/testify/require"
+)
+
+type errorEnvelope struct {
+	Message    string `json:"message"`
+	Error      string `json:"error"`
+	StatusCode int    `json:"statusCode"`
+	MessageID  string `json:"messageId"`
+}
+
+func TestQueryHistoryErrorResponses(t *testing.T) {
+	tests := []struct {
+		err       error
+		status    int
+		messageID string
+		message   string
+	}{
+		{ErrQueryNotFound, 404, "queryhistory.notFound", "Query in query history not found"},
+		{ErrStarredQueryNotFound, 404, "queryhistory.starredNotFound", "Starred query in query history not found"},
+		{ErrQueryAlreadyStarred, 400, "queryhistory.alreadyStarred", "Query in query history was already starred"},
+		{ErrNoDatasourceSpecified, 400, "queryhistory.noDatasource", "No datasource specified"},
+		{ErrQueryHistoryInvalidDatasource, 400, "queryhistory.invalidDatasource", "Datasource uid is not valid"},
+		{ErrInvalidActivityRange, 400, "queryhistory.invalidActivityRange", "Activity range must end after it starts and contain at most 1000 buckets of at least one minute"},
+		{ErrQueryConcurrentModification, 409, "queryhistory.concurrentModification", "Query in query history was modified since it was read"},
+		{ErrInvalidSearchOperator, 400, "queryhistory.invalidSearchOperator", "Search operator must be either and or or"},
+		{ErrFolderNotFound, 404, "queryhistory.folderNotFound", "Query history folder not found"},
+		{ErrFolderAlreadyExists, 409, "queryhistory.folderAlreadyExists", "Query history folder with the same name already exists"},
+		{ErrInvalidFolderName, 400, "queryhistory.invalidFolderName", "Query history folder name must not be empty"},
+		{ErrInvalidReassignUsers, 400, "queryhistory.invalidReassignUsers", "Source and target users must be different existing users"},
+		{errors.New("database is locked"), 500, "queryhistory.internalError", "Failed to do something"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.messageID, func(t *testing.T) {
+			resp := errorResponse(tt.err, "Failed to do something")
+			envelope := validateAndUnMarshalErrorResponse(t, resp.Status(), resp.Body(), tt.status)
+			require.Equal(t, tt.messageID, envelope.MessageID)
+			require.Equal(t, tt.message, envelope.Message)
+			require.Equal(t, tt.err.Error(), envelope.Error)
+		})
+	}
+
+	testScenarioWithQueryInQueryHistory(t, "When users star a query twice, the handler should return the already starred envelope",
+		func(t *testing.T, sc scenarioContext) {
+			sc.ctx.Req = web.SetURLParams(sc.ctx.Req, map[string]string{":uid": sc.initialResult.Result.UID})
+			sc.service.starHandler(sc.reqContext)
+			resp := sc.service.starHandler(sc.reqContext)
+			envelope := validateAndUnMarshalErrorResponse(t, resp.Status(), resp.Body(), 400)
+			require.Equal(t, "queryhistory.alreadyStarred", envelope.MessageID)
+		})
+
+	testScenario(t, "When users get a query with an invalid uid, the handler should return the not found envelope",
+		func(t *testing.T, sc scenarioContext) {
+			sc.ctx.Req = web.SetURLParams(sc.ctx.Req, map[string]string{":uid": "not a valid uid!"})
+			resp := sc.service.getHandler(sc.reqContext)
+			envelope := validateAndUnMarshalErrorResponse(t, resp.Status(), resp.Body(), 404)
+			require.Equal(t, "queryhistory.notFound", envelope.MessageID)
+		})
+}
+
+func validateAndUnMarshalErrorResponse(t *testing.T, status int, body []byte, expectedStatus int) errorEnvelope {
+	t.Helper()
+
+	require.Equal(t, expectedStatus, status)
+
+	var envelope errorEnvelope
+	err := json.Unmarshal(body, &envelope)
+	require.NoError(t, err)
+	require.Equal(t, expectedStatus, envelope.StatusCode)
+
+	return envelope
+}
@@ -0,0 +1,162 @@
+package queryhistory
+
+import (
+	"context"
+	"encoding/json"
+	"net/url"
+	"testing"
+
+	"github.com/grafana/grafana/pkg/api/response"
+	"github.com/grafana/grafana/pkg/services/sqlstore"
+	"github.com/grafana/grafana/pkg/web"
+	"github.com/stretchr/testify/require"
+)
+
+func TestQueryHistoryFolders(t *testing.T) {
+	testScenario(t, "When users create folders, they should be listed by name",
+		func(t *testing.T, sc scenarioContext) {
+			createFolder(t, sc, "Prometheus")
+			createFolder(t, sc, "Loki")
+
+			resp := sc.service.getFoldersHandler(sc.reqContext)
+			require.Equal(t, 200, resp.Status())
+			var result QueryHistoryFoldersResponse
+			require.NoError(t, json.Unmarshal(resp.Body(), &result))
+			require.Len(t, result.Result, 2)
+			require.Equal(t, "Loki", result.Result[0].Name)
+			require.Equal(t, "Prometheus", result.Result[1].Name)
+		})
+
+	testScenario(t, "When users create a folder without a name or with an existing name, it should fail",
+		func(t *testing.T, sc scenarioContext) {
+			sc.reqContext.Req.Body = mockRequestBody(SaveQueryHistoryFolderCommand{Name: " "})
+			resp := sc.service.createFolderHandler(sc.reqContext)
+			require.Equal(t, 400, resp.Status())
+
+			createFolder(t, sc, "Loki")
+			sc.reqContext.Req.Body = mockRequestBody(SaveQueryHistoryFolderCommand{Name: "Loki"})
+			resp = sc.service.createFolderHandler(sc.reqContext)
+			require.Equal(t, 409, resp.Status())
+		})
+
+	testScenario(t, "When users rename a folder, it should succeed",
+		func(t *testing.T, sc scenarioContext) {
+			folder := createFolder(t, sc, "Loki")
+
+			sc.ctx.Req = web.SetURLParams(sc.ctx.Req, map[string]string{":uid": folder.UID})
+			sc.reqContext.Req.Body = mockRequestBody(SaveQueryHistoryFolderCommand{Name: "Logs"})
+			resp := sc.service.updateFolderHandler(sc.reqContext)
+			require.Equal(t, 200, resp.Status())
+			var result QueryHistoryFolderResponse
+			require.NoError(t, json.Unmarshal(resp.Body(), &result))
+			require.Equal(t, folder.UID, result.Result.UID)
+			require.Equal(t, "Logs", result.Result.Name)
+		})
+
+	testScenarioWithQueryInQueryHistory(t, "When users assign a query that is not starred to a folder, it should fail",
+		func(t *testing.T, sc scenarioContext) {
+			folder := createFolder(t, sc, "Loki")
+
+			resp := assignFolder(sc, sc.initialResult.Result.UID, folder.UID)
+			require.Equal(t, 404, resp.Status())
+		})
+
+	testScenarioWithQueryInQueryHistory(t, "When users assign a starred query to an unknown folder, it should fail",
+		func(t *testing.T, sc scenarioContext) {
+			starQuery(t, sc, sc.initialResult.Result.UID)
+
+			resp := assignFolder(sc, sc.initialResult.Result.UID, "unknown")
+			require.Equal(t, 404, resp.Status())
+		})
+
+	testScenarioWithQueryInQueryHistory(t, "When users assign a starred query to a folder, it should be found by folder",
+		func(t *testing.T, sc scenarioContext) {
+			folder := createFolder(t, sc, "Loki")
+			other := createFolder(t, sc, "Prometheus")
+			starQuery(t, sc, sc.initialResult.Result.UID)
+
+			resp := assignFolder(sc, sc.initialResult.Result.UID, folder.UID)
+			require.Equal(t, 200, resp.Status())
+
+			result := searchFolder(t, sc, folder.UID)
+			require.Len(t, result.Result.QueryHistory, 1)
+			require.Equal(t, sc.initialResult.Result.UID, result.Result.QueryHistory[0].UID)
+			require.True(t, result.Result.QueryHistory[0].Starred)
+
+			require.Len(t, searchFolder(t, sc, other.UID).Result.QueryHistory, 0)
+
+			resp = assignFolder(sc, sc.initialResult.Result.UID, "")
+			require.Equal(t, 200, resp.Status())
+			require.Len(t, searchFolder(t, sc, folder.UID).Result.QueryHistory, 0)
+		})
+
+	testScenarioWithQueryInQueryHistory(t, "When users delete a folder, its queries should stay starred",
+		func(t *testing.T, sc scenarioContext) {
+			folder := createFolder(t, sc, "Loki")
+			starQuery(t, sc, sc.initialResult.Result.UID)
+			require.Equal(t, 200, assignFolder(sc, sc.initialResult.Result.UID, folder.UID).Status())
+
+			sc.ctx.Req = web.SetURLParams(sc.ctx.Req, map[string]string{":uid": folder.UID})
+			resp := sc.service.deleteFolderHandler(sc.reqContext)
+			require.Equal(t, 200, resp.Status())
+
+			resp = sc.service.deleteFolderHandler(sc.reqContext)
+			require.Equal(t, 404, resp.Status())
+
+			sc.reqContext.Req.Form = url.Values{
+				"datasourceUid": []string{"NCzh67i"},
+				"onlyStarred":   []string{"true"},
+			}
+			resp = sc.service.searchHandler(sc.reqContext)
+			result := validateAndUnMarshalSearchResponse(t, resp.Status(), resp.Body())
+			require.Len(t, result.Result.QueryHistory, 1)
+			require.Equal(t, sc.initialResult.Result.UID, result.Result.QueryHistory[0].UID)
+
+			var star QueryHistoryStar
+			err := sc.sqlStore.WithDbSession(context.Background(), func(session *sqlstore.DBSession) error {
+				_, err := session.Where("query_uid = ?", sc.initialResult.Result.UID).Get(&star)
+				return err
+			})
+			require.NoError(t, err)
+			require.Equal(t, sc.initialResult.Result.UID, star.QueryUID)
+			require.Nil(t, star.FolderID)
+		})
+}
+
+func createFolder(t *testing.T, sc scenarioContext, name string) QueryHistoryFolderDTO {
+	t.Helper()
+
+	sc.reqContext.Req.Body = mockRequestBody(SaveQueryHistoryFolderCommand{Name: name})
+	resp := sc.service.createFolderHandler(sc.reqContext)
+	require.Equal(t, 200, resp.Status())
+
+	var result QueryHistoryFolderResponse
+	require.NoError(t, json.Unmarshal(resp.Body(), &result))
+	require.Equal(t, name, result.Result.Name)
+	return result.Result
+}
+
+func starQuery(t *testing.T, sc scenarioContext, queryUID string) {
+	t.Helper()
+
+	sc.ctx.Req = web.SetURLParams(sc.ctx.Req, map[string]string{":uid": queryUID})
+	resp := sc.service.starHandler(sc.reqContext)
+	require.Equal(t, 200, resp.Status())
+}
+
+func assignFolder(sc scenarioContext, queryUID string, folderUID string) response.Response {
+	sc.ctx.Req = web.SetURLParams(sc.ctx.Req, map[string]string{":uid": queryUID})
+	sc.reqContext.Req.Body = mockRequestBody(AssignStarredQueryToFolderCommand{FolderUID: folderUID})
+	return sc.service.assignFolderHandler(sc.reqContext)
+}
+
+func searchFolder(t *testing.T, sc scenarioContext, folderUID string) QueryHistorySearchResponse {
+	t.Helper()
+
+	sc.reqContext.Req.Form = url.Values{
+		"datasourceUid": []string{"NCzh67i"},
+		"folderUid":     []string{folderUID},
+	}
+	resp := sc.service.searchHandler(sc.reqContext)
+	return validateAndUnMarshalSearchResponse(t, resp.Status(), resp.Body())
+}
@@ -0,0 +1,87 @@
+package queryhistory
+
+import (
+	"context"
+	"testing"
+
+	"github.com/grafana/grafana/pkg/api/response"
+	"github.com/grafana/grafana/pkg/models"
+	"github.com/grafana/grafana/pkg/web"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetQueryInQueryHistory(t *testing.T) {
+	testScenarioWithQueryInQueryHistory(t, "When users tries to get query in query history that does not exist, it should fail",
+		func(t *testing.T, sc scenarioContext) {
+			sc.ctx.Req = web.SetURLParams(sc.ctx.Req, map[string]string{":uid": "unknown"})
+			resp := sc.service.getHandler(sc.reqContext)
+			require.Equal(t, 404, resp.Status())
+		})
+
+	testScenarioWithQueryInQueryHistory(t, "When users tries to get query in query history that exists, it should succeed",
+		func(t *testing.T, sc scenarioContext) {
+			sc.ctx.Req = web.SetURLParams(sc.ctx.Req, map[string]string{":uid": sc.initialResult.Result.UID})
+			resp := sc.service.getHandler(sc.reqContext)
+			result := validateAndUnMarshalResponse(t, resp)
+			require.Equal(t, sc.initialResult.Result.UID, result.Result.UID)
+			require.Equal(t, "NCzh67i", result.Result.DatasourceUID)
+			require.False(t, result.Result.Starred)
+		})
+
+	testScenarioWithQueryInQueryHistory(t, "When users get a query with the ETag of the current query, it should return not modified",
+		func(t *testing.T, sc scenarioContext) {
+			sc.ctx.Req = web.SetURLParams(sc.ctx.Req, map[string]string{":uid": sc.initialResult.Result.UID})
+			resp := sc.service.getHandler(sc.reqContext)
+			require.Equal(t, 200, resp.Status())
+			etag := resp.(*response.NormalResponse).Header().Get("ETag")
+			require.NotEmpty(t, etag)
+
+			sc.ctx.Req.Header.Set("If-None-Match", `"other", W/`+etag)
+			resp = sc.service.getHandler(sc.reqContext)
+			require.Equal(t, 304, resp.Status())
+			require.Empty(t, resp.Body())
+			require.Equal(t, etag, resp.(*response.NormalResponse).Header().Get("ETag"))
+		})
+
+	testScenarioWithQueryInQueryHistory(t, "When users get a query with the ETag of a previous version, it should return the query",
+		func(t *testing.T, sc scenarioContext) {
+			sc.ctx.Req = web.SetURLParams(sc.ctx.Req, map[string]string{":uid": sc.initialResult.Result.UID})
+			resp := sc.service.getHandler(sc.reqContext)
+			etag := resp.(*response.NormalResponse).Header().Get("ETag")
+
+			_, err := sc.service.PatchQueryCommentInQueryHistory(context.Background(), sc.reqContext.SignedInUser, sc.initialResult.Result.UID, PatchQueryCommentInQueryHistoryCommand{Comment: "Updated comment"})
+			require.NoError(t, err)
+
+			sc.ctx.Req.Header.Set("If-None-Match", etag)
+			resp = sc.service.getHandler(sc.reqContext)
+			result := validateAndUnMarshalResponse(t, resp)
+			require.Equal(t, "Updated comment", result.Result.Comment)
+			require.NotEqual(t, etag, resp.(*response.NormalResponse).Header().Get("ETag"))
+		})
+}
+
+func TestGetRawQueryInQueryHistory(t *testing.T) {
+	testScenarioWithQueryInQueryHistory(t, "When users tries to get raw query in query history that does not exist, it should fail",
+		func(t *testing.T, sc scenarioContext) {
+			sc.ctx.Req = web.SetURLParams(sc.ctx.Req, map[string]string{":uid": "unknown"})
+			resp := sc.service.getRawHandler(sc.reqContext)
+			require.Equal(t, 404, resp.Status())
+		})
+
+	testScenarioWithQueryInQueryHistory(t, "When users tries to get raw query of another user, it should fail",
+		func(t *testing.T, sc scenarioContext) {
+			sc.ctx.Req = web.SetURLParams(sc.ctx.Req, map[string]string{":uid": sc.initialResult.Result.UID})
+			sc.reqContext.SignedInUser = &models.SignedInUser{UserId: testUserID + 1, OrgId: testOrgID}
+			resp := sc.service.getRawHandler(sc.reqContext)
+			require.Equal(t, 404, resp.Status())
+		})
+
+	testScenarioWithQueryInQueryHistory(t, "When users tries to get raw query in query history that exists, it should return the stored queries",
+		func(t *testing.T, sc scenarioContext) {
+			sc.ctx.Req = web.SetURLParams(sc.ctx.Req, map[string]string{":uid": sc.initialResult.Result.UID})
+			resp := sc.service.getRawHandler(sc.reqContext)
+			require.Equal(t, 200, resp.Status())
+			require.Equal(t, "application/json", resp.(*response.NormalResponse).Header().Get("Content-Type"))
+			require.JSONEq(t, `{"expr":"test"}`, string(resp.Body()))
+		})
+}
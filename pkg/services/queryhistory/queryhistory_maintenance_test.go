@@ -0,0 +1,68 @@
+package queryhistory
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana/pkg/services/sqlstore"
+	"github.com/grafana/grafana/pkg/services/sqlstore/migrator"
+	"github.com/stretchr/testify/require"
+)
+
+func TestQueryHistoryMaintenance(t *testing.T) {
+	testScenarioWithQueryInQueryHistory(t, "When the maintenance runs on SQLite, it should analyze the query history tables",
+		func(t *testing.T, sc scenarioContext) {
+			if sc.sqlStore.Dialect.DriverName() != migrator.SQLite {
+				t.Skip("the statistics are checked on SQLite only")
+			}
+			sc.service.maintainTables(context.Background())
+
+			var count int64
+			err := sc.sqlStore.WithDbSession(context.Background(), func(session *sqlstore.DBSession) error {
+				_, err := session.SQL(`SELECT COUNT(*) FROM sqlite_stat1 WHERE tbl = ?`, "query_history").Get(&count)
+				return err
+			})
+			require.NoError(t, err)
+			require.NotZero(t, count)
+		})
+
+	testScenario(t, "When the maintenance interval is not set, it should be disabled",
+		func(t *testing.T, sc scenarioContext) {
+			require.True(t, sc.service.IsDisabled())
+
+			sc.service.Cfg.QueryHistoryMaintenanceInterval = time.Hour
+			require.False(t, sc.service.IsDisabled())
+
+			sc.service.Cfg.QueryHistoryEnabled = false
+			require.True(t, sc.service.IsDisabled())
+		})
+}
+
+// unsupportedDialect is a dialect without maintenance statements.
+type unsupportedDialect struct {
+	migrator.Dialect
+}
+
+func (unsupportedDialect) DriverName() string {
+	return "mssql"
+}
+
+func TestMaintenanceStatements(t *testing.T) {
+	require.Equal(t, []string{
+		"ANALYZE `query_history`",
+		"ANALYZE `query_history_star`",
+	}, maintenanceStatements(migrator.NewSQLite3Dialect(nil)))
+
+	require.Equal(t, []string{
+		`VACUUM ANALYZE "query_history"`,
+		`VACUUM ANALYZE "query_history_star"`,
+	}, maintenanceStatements(migrator.NewPostgresDialect(nil)))
+
+	require.Equal(t, []string{
+		"ANALYZE TABLE `query_history`",
+		"ANALYZE TABLE `query_history_star`",
+	}, maintenanceStatements(migrator.NewMysqlDialect(nil)))
+
+	require.Nil(t, maintenanceStatements(unsupportedDialect{}))
+}
@@ -0,0 +1,115 @@
+package queryhistory
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/grafana/grafana/pkg/components/simplejson"
+	"github.com/grafana/grafana/pkg/models"
+	"github.com/grafana/grafana/pkg/services/sqlstore"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMergeUserHistoryInQueryHistory(t *testing.T) {
+	testScenarioWithQueryInQueryHistory(t, "When admin tries to merge the query history of the same user, it should fail",
+		func(t *testing.T, sc scenarioContext) {
+			sc.reqContext.Req.Body = mockRequestBody(MergeUserHistoryCommand{SourceUserID: testUserID, TargetUserID: testUserID})
+			resp := sc.service.mergeHandler(sc.reqContext)
+			require.Equal(t, 400, resp.Status())
+		})
+
+	testScenarioWithQueryInQueryHistory(t, "When admin tries to merge the query history of users outside the organization, it should fail",
+		func(t *testing.T, sc scenarioContext) {
+			member := createOrgUser(t, sc, "member")
+			outsider, err := sc.sqlStore.CreateUser(context.Background(), models.CreateUserCommand{
+				Email: "outsider@test.com",
+				Login: "outsider",
+			})
+			require.NoError(t, err)
+
+			for _, cmd := range []MergeUserHistoryCommand{
+				{SourceUserID: testUserID, TargetUserID: outsider.Id},
+				{SourceUserID: outsider.Id, TargetUserID: member.Id},
+				{SourceUserID: testUserID, TargetUserID: outsider.Id + 1},
+			} {
+				sc.reqContext.Req.Body = mockRequestBody(cmd)
+				resp := sc.service.mergeHandler(sc.reqContext)
+				require.Equal(t, 404, resp.Status())
+				require.Contains(t, string(resp.Body()), "queryhistory.userNotInOrg")
+			}
+
+			search, err := sc.service.SearchInQueryHistory(context.Background(), sc.reqContext.SignedInUser, SearchInQueryHistoryQuery{AllDatasources: true})
+			require.NoError(t, err)
+			require.Len(t, search.QueryHistory, 1)
+		})
+
+	testScenarioWithQueryInQueryHistory(t, "When admin merges the query history of two users with overlapping stars, the stars should be deduplicated",
+		func(t *testing.T, sc scenarioContext) {
+			ctx := context.Background()
+			source := sc.reqContext.SignedInUser
+			target := createOrgUser(t, sc, "target_user")
+			targetUser := &models.SignedInUser{UserId: target.Id, OrgId: testOrgID}
+
+			// The initial query is starred by both users, the second one by the source user only.
+			overlapping := sc.initialResult.Result.UID
+			_, err := sc.service.StarQueryInQueryHistory(ctx, source, overlapping, StarQueryInQueryHistoryCommand{})
+			require.NoError(t, err)
+			created, err := sc.service.CreateFolderInQueryHistory(ctx, targetUser, SaveQueryHistoryFolderCommand{Name: "Migrated"})
+			require.NoError(t, err)
+			var folder QueryHistoryFolder
+			err = sc.sqlStore.WithDbSession(ctx, func(session *sqlstore.DBSession) error {
+				if _, err := session.Where("uid = ?", created.UID).Get(&folder); err != nil {
+					return err
+				}
+				_, err := session.Insert(&QueryHistoryStar{QueryUID: overlapping, UserID: target.Id, FolderID: &folder.ID})
+				return err
+			})
+			require.NoError(t, err)
+
+			second, err := sc.service.CreateQueryInQueryHistory(ctx, source, CreateQueryInQueryHistoryCommand{
+				DatasourceUID: "NCzh67i",
+				Queries:       simplejson.NewFromAny(map[string]interface{}{"expr": "second"}),
+			})
+			require.NoError(t, err)
+			_, err = sc.service.StarQueryInQueryHistory(ctx, source, second.UID, StarQueryInQueryHistoryCommand{})
+			require.NoError(t, err)
+
+			own, err := sc.service.CreateQueryInQueryHistory(ctx, targetUser, CreateQueryInQueryHistoryCommand{
+				DatasourceUID: "NCzh67i",
+				Queries:       simplejson.NewFromAny(map[string]interface{}{"expr": "own"}),
+			})
+			require.NoError(t, err)
+
+			sc.reqContext.Req.Body = mockRequestBody(MergeUserHistoryCommand{SourceUserID: testUserID, TargetUserID: target.Id})
+			resp := sc.service.mergeHandler(sc.reqContext)
+			require.Equal(t, 200, resp.Status())
+			var result MergeUserHistoryResponse
+			require.NoError(t, json.Unmarshal(resp.Body(), &result))
+			require.Equal(t, MergeUserHistoryResult{MovedQueries: 2, MovedStars: 1, DedupedStars: 1}, result.Result)
+
+			search, err := sc.service.SearchInQueryHistory(ctx, source, SearchInQueryHistoryQuery{AllDatasources: true})
+			require.NoError(t, err)
+			require.Empty(t, search.QueryHistory)
+
+			search, err = sc.service.SearchInQueryHistory(ctx, targetUser, SearchInQueryHistoryQuery{AllDatasources: true})
+			require.NoError(t, err)
+			require.Len(t, search.QueryHistory, 3)
+			starred := map[string]bool{}
+			for _, query := range search.QueryHistory {
+				require.Equal(t, target.Id, query.CreatedBy)
+				starred[query.UID] = query.Starred
+			}
+			require.Equal(t, map[string]bool{overlapping: true, second.UID: true, own.UID: false}, starred)
+
+			// The star of the target user is kept along with its folder.
+			var stars []QueryHistoryStar
+			err = sc.sqlStore.WithDbSession(ctx, func(session *sqlstore.DBSession) error {
+				return session.Where("query_uid = ?", overlapping).Find(&stars)
+			})
+			require.NoError(t, err)
+			require.Len(t, stars, 1)
+			require.Equal(t, target.Id, stars[0].UserID)
+			require.Equal(t, folder.ID, *stars[0].FolderID)
+		})
+}
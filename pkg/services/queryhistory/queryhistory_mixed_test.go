@@ -0,0 +1,70 @@
+package queryhistory
+
+import (
+	"context"
+	"net/url"
+	"testing"
+
+	"github.com/grafana/grafana/pkg/components/simplejson"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSearchInQueryHistoryMixedDatasource(t *testing.T) {
+	createMixed := func(t *testing.T, sc scenarioContext) QueryHistoryDTO {
+		t.Helper()
+		mixed, err := sc.service.CreateQueryInQueryHistory(context.Background(), sc.reqContext.SignedInUser, CreateQueryInQueryHistoryCommand{
+			DatasourceUID: "-- Mixed --",
+			Queries: simplejson.NewFromAny([]interface{}{
+				map[string]interface{}{"refId": "A", "expr": "up", "datasource": map[string]interface{}{"type": "prometheus", "uid": "prom-uid"}},
+				map[string]interface{}{"refId": "B", "expr": "{job=\"app\"}", "datasource": "loki-uid"},
+				map[string]interface{}{"refId": "C", "expr": "rate(up[5m])", "datasource": map[string]interface{}{"uid": "prom-uid"}},
+			}),
+		})
+		require.NoError(t, err)
+		return mixed
+	}
+
+	testScenarioWithQueryInQueryHistory(t, "When users search query history by datasource, the mixed queries should only be included on demand",
+		func(t *testing.T, sc scenarioContext) {
+			mixed := createMixed(t, sc)
+
+			sc.reqContext.Req.Form = url.Values{"datasourceUid": []string{"NCzh67i"}}
+			resp := sc.service.searchHandler(sc.reqContext)
+			result := validateAndUnMarshalSearchResponse(t, resp.Status(), resp.Body())
+			require.Equal(t, int64(1), result.Result.TotalCount)
+			require.Equal(t, sc.initialResult.Result.UID, result.Result.QueryHistory[0].UID)
+			require.Empty(t, result.Result.QueryHistory[0].TargetDatasourceUIDs)
+
+			sc.reqContext.Req.Form = url.Values{"datasourceUid": []string{"NCzh67i"}, "includeMixed": []string{"true"}}
+			resp = sc.service.searchHandler(sc.reqContext)
+			result = validateAndUnMarshalSearchResponse(t, resp.Status(), resp.Body())
+			require.Equal(t, int64(2), result.Result.TotalCount)
+			require.Equal(t, mixed.UID, result.Result.QueryHistory[0].UID)
+			require.Equal(t, []string{"prom-uid", "loki-uid"}, result.Result.QueryHistory[0].TargetDatasourceUIDs)
+		})
+
+	testScenarioWithQueryInQueryHistory(t, "When users get a mixed query, the datasources of its targets should be returned",
+		func(t *testing.T, sc scenarioContext) {
+			mixed := createMixed(t, sc)
+			require.Equal(t, []string{"prom-uid", "loki-uid"}, mixed.TargetDatasourceUIDs)
+
+			got, err := sc.service.GetQueryInQueryHistory(context.Background(), sc.reqContext.SignedInUser, mixed.UID)
+			require.NoError(t, err)
+			require.Equal(t, []string{"prom-uid", "loki-uid"}, got.TargetDatasourceUIDs)
+		})
+
+	testScenarioWithQueryInQueryHistory(t, "When users search query history grouped by datasource, the mixed queries should have their own group",
+		func(t *testing.T, sc scenarioContext) {
+			mixed := createMixed(t, sc)
+
+			sc.reqContext.Req.Form = url.Values{"datasourceUid": []string{"NCzh67i"}, "includeMixed": []string{"true"}, "groupByDatasource": []string{"true"}, "uidsOnly": []string{"true"}}
+			resp := sc.service.searchHandler(sc.reqContext)
+			result := validateAndUnMarshalSearchResponse(t, resp.Status(), resp.Body())
+			require.Equal(t, int64(2), result.Result.TotalCount)
+			require.Len(t, result.Result.Groups, 2)
+			require.Equal(t, "NCzh67i", result.Result.Groups[0].DatasourceUID)
+			require.Equal(t, []string{sc.initialResult.Result.UID}, result.Result.Groups[0].UIDs)
+			require.Equal(t, "-- Mixed --", result.Result.Groups[1].DatasourceUID)
+			require.Equal(t, []string{mixed.UID}, result.Result.Groups[1].UIDs)
+		})
+}
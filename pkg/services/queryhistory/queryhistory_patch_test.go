@@ -1,6 +1,9 @@
 package queryhistory
 
 import (
+	"context"
+	"errors"
+	"strings"
 	"testing"
 
 	"github.com/grafana/grafana/pkg/web"
@@ -11,7 +14,7 @@ func TestPatchQueryCommentInQueryHistory(t *testing.T) {
 	testScenarioWithQueryInQueryHistory(t, "When user tries to patch comment of query in query history that does not exist, it should fail",
 		func(t *testing.T, sc scenarioContext) {
 			resp := sc.service.patchCommentHandler(sc.reqContext)
-			require.Equal(t, 500, resp.Status())
+			require.Equal(t, 404, resp.Status())
 		})
 
 	testScenarioWithQueryInQueryHistory(t, "When user tries to patch comment of query in query history that exists, it should succeed",
@@ -22,4 +25,66 @@ func TestPatchQueryCommentInQueryHistory(t *testing.T) {
 			resp := sc.service.patchCommentHandler(sc.reqContext)
 			require.Equal(t, 200, resp.Status())
 		})
+
+	testScenarioWithQueryInQueryHistory(t, "When user patches comment of query in query history with a stale precondition, it should fail",
+		func(t *testing.T, sc scenarioContext) {
+			uid := sc.initialResult.Result.UID
+			readAt := sc.initialResult.Result.UpdatedAt
+			require.NotZero(t, readAt)
+
+			// The first tab updates the comment of the query it read.
+			first, err := sc.service.patchQueryComment(context.Background(), sc.reqContext.SignedInUser, uid,
+				PatchQueryCommentInQueryHistoryCommand{Comment: "first tab", UpdatedAt: &readAt})
+			require.NoError(t, err)
+			require.Greater(t, first.UpdatedAt, readAt)
+
+			// The second tab read the query before that update.
+			_, err = sc.service.patchQueryComment(context.Background(), sc.reqContext.SignedInUser, uid,
+				PatchQueryCommentInQueryHistoryCommand{Comment: "second tab", UpdatedAt: &readAt})
+			require.True(t, errors.Is(err, ErrQueryConcurrentModification))
+
+			sc.ctx.Req = web.SetURLParams(sc.ctx.Req, map[string]string{":uid": uid})
+			sc.reqContext.Req.Body = mockRequestBody(PatchQueryCommentInQueryHistoryCommand{Comment: "second tab", UpdatedAt: &readAt})
+			resp := sc.service.patchCommentHandler(sc.reqContext)
+			require.Equal(t, 409, resp.Status())
+
+			got, err := sc.service.getQuery(context.Background(), sc.reqContext.SignedInUser, uid)
+			require.NoError(t, err)
+			require.Equal(t, "first tab", got.Comment)
+			require.Equal(t, first.UpdatedAt, got.UpdatedAt)
+
+			// Reconciled with the current version, the update succeeds.
+			second, err := sc.service.patchQueryComment(context.Background(), sc.reqContext.SignedInUser, uid,
+				PatchQueryCommentInQueryHistoryCommand{Comment: "second tab", UpdatedAt: &got.UpdatedAt})
+			require.NoError(t, err)
+			require.Equal(t, "second tab", second.Comment)
+		})
+
+	testScenarioWithQueryInQueryHistory(t, "When user patches comment of query in query history without precondition, the last write should win",
+		func(t *testing.T, sc scenarioContext) {
+			uid := sc.initialResult.Result.UID
+			for _, comment := range []string{"first tab", "second tab"} {
+				_, err := sc.service.patchQueryComment(context.Background(), sc.reqContext.SignedInUser, uid,
+					PatchQueryCommentInQueryHistoryCommand{Comment: comment})
+				require.NoError(t, err)
+			}
+
+			got, err := sc.service.getQuery(context.Background(), sc.reqContext.SignedInUser, uid)
+			require.NoError(t, err)
+			require.Equal(t, "second tab", got.Comment)
+		})
+
+	testScenarioWithQueryInQueryHistory(t, "When user patches comment of query in query history with a comment that is too long, it should fail",
+		func(t *testing.T, sc scenarioContext) {
+			cmd := PatchQueryCommentInQueryHistoryCommand{Comment: strings.Repeat("ü", maxCommentLength+1)}
+			sc.ctx.Req = web.SetURLParams(sc.ctx.Req, map[string]string{":uid": sc.initialResult.Result.UID})
+			sc.reqContext.Req.Body = mockRequestBody(cmd)
+			resp := sc.service.patchCommentHandler(sc.reqContext)
+			require.Equal(t, 400, resp.Status())
+
+			cmd.Comment = strings.Repeat("ü", maxCommentLength)
+			sc.reqContext.Req.Body = mockRequestBody(cmd)
+			resp = sc.service.patchCommentHandler(sc.reqContext)
+			require.Equal(t, 200, resp.Status())
+		})
 }
@@ -0,0 +1,99 @@
+package queryhistory
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/grafana/grafana/pkg/components/simplejson"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSearchInQueryHistoryWithPreview(t *testing.T) {
+	testScenario(t, "When users search query history with previews, it should return the preview of each query",
+		func(t *testing.T, sc scenarioContext) {
+			for _, queries := range []interface{}{
+				[]interface{}{
+					map[string]interface{}{"refId": "A", "expr": "rate(http_requests_total{job=\"api\"}[5m])"},
+					map[string]interface{}{"refId": "B", "expr": "up"},
+				},
+				[]interface{}{
+					map[string]interface{}{"refId": "A", "rawSql": "SELECT time, value\n  FROM metrics\n  WHERE $__timeFilter(time)", "format": "time_series"},
+				},
+			} {
+				sc.reqContext.Req.Body = mockRequestBody(CreateQueryInQueryHistoryCommand{
+					DatasourceUID: "NCzh67i",
+					Queries:       simplejson.NewFromAny(queries),
+				})
+				validateAndUnMarshalResponse(t, sc.service.createHandler(sc.reqContext))
+			}
+
+			sc.reqContext.Req.Form = url.Values{"datasourceUid": []string{"NCzh67i"}, "sort": []string{"time-asc"}, "withPreview": []string{"true"}}
+			resp := sc.service.searchHandler(sc.reqContext)
+			result := validateAndUnMarshalSearchResponse(t, resp.Status(), resp.Body())
+			require.Len(t, result.Result.QueryHistory, 2)
+			require.Equal(t, `rate(http_requests_total{job="api"}[5m])`, result.Result.QueryHistory[0].Preview)
+			require.Equal(t, "SELECT time, value FROM metrics WHERE $__timeFilter(time)", result.Result.QueryHistory[1].Preview)
+		})
+
+	testScenarioWithQueryInQueryHistory(t, "When users search query history without previews, it should not return them",
+		func(t *testing.T, sc scenarioContext) {
+			sc.reqContext.Req.Form = url.Values{"datasourceUid": []string{"NCzh67i"}}
+			resp := sc.service.searchHandler(sc.reqContext)
+			result := validateAndUnMarshalSearchResponse(t, resp.Status(), resp.Body())
+			require.Len(t, result.Result.QueryHistory, 1)
+			require.Empty(t, result.Result.QueryHistory[0].Preview)
+			require.NotContains(t, string(resp.Body()), `"preview"`)
+		})
+}
+
+func TestQueryPreview(t *testing.T) {
+	tests := []struct {
+		desc     string
+		queries  interface{}
+		expected string
+	}{
+		{
+			desc:     "Prometheus query",
+			queries:  []interface{}{map[string]interface{}{"refId": "A", "expr": "sum by (job) (up)"}},
+			expected: "sum by (job) (up)",
+		},
+		{
+			desc:     "SQL query on several lines",
+			queries:  []interface{}{map[string]interface{}{"refId": "A", "rawSql": "SELECT *\n\tFROM logs\n\tLIMIT 10"}},
+			expected: "SELECT * FROM logs LIMIT 10",
+		},
+		{
+			desc: "first target with a query text",
+			queries: []interface{}{
+				map[string]interface{}{"refId": "A", "scenarioId": "random_walk"},
+				map[string]interface{}{"refId": "B", "expr": "   "},
+				map[string]interface{}{"refId": "C", "query": "from(bucket: \"db\")"},
+			},
+			expected: `from(bucket: "db")`,
+		},
+		{
+			desc:     "single query",
+			queries:  map[string]interface{}{"expr": "test"},
+			expected: "test",
+		},
+		{
+			desc:     "long query",
+			queries:  []interface{}{map[string]interface{}{"expr": strings.Repeat("é", maxPreviewLength+1)}},
+			expected: strings.Repeat("é", maxPreviewLength-1) + "…",
+		},
+		{
+			desc:     "query without text",
+			queries:  []interface{}{map[string]interface{}{"refId": "A", "scenarioId": "csv_content"}},
+			expected: "",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			require.Equal(t, test.expected, queryPreview(simplejson.NewFromAny(test.queries)))
+		})
+	}
+
+	require.Empty(t, queryPreview(nil))
+}
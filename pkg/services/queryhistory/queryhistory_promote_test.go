@@ -0,0 +1,132 @@
+package queryhistory
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/grafana/grafana/pkg/components/simplejson"
+	"github.com/grafana/grafana/pkg/models"
+	"github.com/grafana/grafana/pkg/services/dashboards"
+	dashdb "github.com/grafana/grafana/pkg/services/dashboards/database"
+	"github.com/grafana/grafana/pkg/services/guardian"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPromoteQueryToDashboard(t *testing.T) {
+	mockGuardian := func(t *testing.T, canSave bool) {
+		origNew := guardian.New
+		t.Cleanup(func() {
+			guardian.New = origNew
+		})
+		guardian.MockDashboardGuardian(&guardian.FakeDashboardGuardian{CanSaveValue: canSave})
+	}
+
+	saveDashboard := func(t *testing.T, sc scenarioContext, uid string, panels []interface{}) {
+		t.Helper()
+		_, err := dashdb.ProvideDashboardStore(sc.sqlStore).SaveDashboard(models.SaveDashboardCommand{
+			OrgId: testOrgID,
+			Dashboard: simplejson.NewFromAny(map[string]interface{}{
+				"uid":    uid,
+				"title":  "Dashboard " + uid,
+				"panels": panels,
+			}),
+		})
+		require.NoError(t, err)
+	}
+
+	testScenarioWithQueryInQueryHistory(t, "When user promotes query to an empty dashboard, panel should be added at the top",
+		func(t *testing.T, sc scenarioContext) {
+			mockGuardian(t, true)
+			dashboardService := &dashboards.FakeDashboardService{}
+			sc.service.DashboardService = dashboardService
+			saveDashboard(t, sc, "empty", []interface{}{})
+
+			dashboard, err := sc.service.PromoteQueryToDashboard(context.Background(), sc.reqContext.SignedInUser, sc.initialResult.Result.UID, PromoteQueryToDashboardCommand{
+				DashboardUID: "empty",
+			})
+			require.NoError(t, err)
+			require.Len(t, dashboardService.SavedDashboards, 1)
+
+			panels := dashboard.Data.Get("panels")
+			require.Len(t, panels.MustArray(), 1)
+
+			panel := panels.GetIndex(0)
+			require.Equal(t, int64(1), panel.Get("id").MustInt64())
+			require.Equal(t, "timeseries", panel.Get("type").MustString())
+			require.Equal(t, "NCzh67i", panel.Get("datasource").Get("uid").MustString())
+			require.Equal(t, "test", panel.Get("targets").GetIndex(0).Get("expr").MustString())
+			require.Equal(t, "A", panel.Get("targets").GetIndex(0).Get("refId").MustString())
+			require.Equal(t, 0, panel.Get("gridPos").Get("y").MustInt())
+			require.Equal(t, 12, panel.Get("gridPos").Get("w").MustInt())
+			require.Equal(t, 8, panel.Get("gridPos").Get("h").MustInt())
+		})
+
+	testScenarioWithQueryInQueryHistory(t, "When user promotes query to a dashboard with panels, panel should be added below them",
+		func(t *testing.T, sc scenarioContext) {
+			mockGuardian(t, true)
+			sc.service.DashboardService = &dashboards.FakeDashboardService{}
+			saveDashboard(t, sc, "existing", []interface{}{
+				map[string]interface{}{"id": 1, "type": "stat", "gridPos": map[string]interface{}{"x": 0, "y": 0, "w": 12, "h": 4}},
+				map[string]interface{}{"id": 4, "type": "row", "collapsed": true, "gridPos": map[string]interface{}{"x": 0, "y": 4, "w": 24, "h": 1},
+					"panels": []interface{}{map[string]interface{}{"id": 7, "type": "table"}}},
+			})
+
+			dashboard, err := sc.service.PromoteQueryToDashboard(context.Background(), sc.reqContext.SignedInUser, sc.initialResult.Result.UID, PromoteQueryToDashboardCommand{
+				DashboardUID: "existing",
+			})
+			require.NoError(t, err)
+
+			panels := dashboard.Data.Get("panels")
+			require.Len(t, panels.MustArray(), 3)
+			require.Equal(t, "stat", panels.GetIndex(0).Get("type").MustString())
+
+			panel := panels.GetIndex(2)
+			require.Equal(t, int64(8), panel.Get("id").MustInt64())
+			require.Equal(t, 5, panel.Get("gridPos").Get("y").MustInt())
+		})
+
+	testScenarioWithQueryInQueryHistory(t, "When user promotes query at a given position, panel should be added there",
+		func(t *testing.T, sc scenarioContext) {
+			mockGuardian(t, true)
+			sc.service.DashboardService = &dashboards.FakeDashboardService{}
+			saveDashboard(t, sc, "positioned", []interface{}{})
+
+			dashboard, err := sc.service.PromoteQueryToDashboard(context.Background(), sc.reqContext.SignedInUser, sc.initialResult.Result.UID, PromoteQueryToDashboardCommand{
+				DashboardUID: "positioned",
+				GridPos:      &PanelGridPos{X: 12, Y: 3, W: 6},
+			})
+			require.NoError(t, err)
+
+			gridPos := dashboard.Data.Get("panels").GetIndex(0).Get("gridPos")
+			require.Equal(t, 12, gridPos.Get("x").MustInt())
+			require.Equal(t, 3, gridPos.Get("y").MustInt())
+			require.Equal(t, 6, gridPos.Get("w").MustInt())
+			require.Equal(t, 8, gridPos.Get("h").MustInt())
+		})
+
+	testScenarioWithQueryInQueryHistory(t, "When user can not edit the dashboard, it should return access denied",
+		func(t *testing.T, sc scenarioContext) {
+			mockGuardian(t, false)
+			dashboardService := &dashboards.FakeDashboardService{}
+			sc.service.DashboardService = dashboardService
+			saveDashboard(t, sc, "readonly", []interface{}{})
+
+			_, err := sc.service.PromoteQueryToDashboard(context.Background(), sc.reqContext.SignedInUser, sc.initialResult.Result.UID, PromoteQueryToDashboardCommand{
+				DashboardUID: "readonly",
+			})
+			require.True(t, errors.Is(err, models.ErrDashboardUpdateAccessDenied))
+			require.Empty(t, dashboardService.SavedDashboards)
+		})
+
+	testScenarioWithQueryInQueryHistory(t, "When user promotes query to a dashboard that does not exist, it should return not found",
+		func(t *testing.T, sc scenarioContext) {
+			mockGuardian(t, true)
+			sc.service.DashboardService = &dashboards.FakeDashboardService{}
+
+			_, err := sc.service.PromoteQueryToDashboard(context.Background(), sc.reqContext.SignedInUser, sc.initialResult.Result.UID, PromoteQueryToDashboardCommand{
+				DashboardUID: "missing",
+			})
+			require.True(t, errors.Is(err, models.ErrDashboardNotFound))
+		})
+}
@@ -0,0 +1,67 @@
+package queryhistory
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/grafana/grafana/pkg/models"
+	"github.com/grafana/grafana/pkg/web"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReassignQueriesInQueryHistory(t *testing.T) {
+	testScenarioWithQueryInQueryHistory(t, "When admin tries to reassign queries to the same user, it should fail",
+		func(t *testing.T, sc scenarioContext) {
+			sc.reqContext.Req.Body = mockRequestBody(ReassignQueriesInQueryHistoryCommand{FromUserID: testUserID, ToUserID: testUserID})
+			resp := sc.service.reassignHandler(sc.reqContext)
+			require.Equal(t, 400, resp.Status())
+		})
+
+	testScenarioWithQueryInQueryHistory(t, "When admin tries to reassign queries to a user outside the organization, it should fail",
+		func(t *testing.T, sc scenarioContext) {
+			outsider, err := sc.sqlStore.CreateUser(context.Background(), models.CreateUserCommand{
+				Email: "outsider@test.com",
+				Login: "outsider",
+			})
+			require.NoError(t, err)
+
+			for _, toUserID := range []int64{outsider.Id, outsider.Id + 1} {
+				sc.reqContext.Req.Body = mockRequestBody(ReassignQueriesInQueryHistoryCommand{FromUserID: testUserID, ToUserID: toUserID})
+				resp := sc.service.reassignHandler(sc.reqContext)
+				require.Equal(t, 404, resp.Status())
+				require.Contains(t, string(resp.Body()), "queryhistory.userNotInOrg")
+			}
+
+			sc.ctx.Req = web.SetURLParams(sc.ctx.Req, map[string]string{":uid": sc.initialResult.Result.UID})
+			resp := sc.service.getHandler(sc.reqContext)
+			require.Equal(t, 200, resp.Status())
+		})
+
+	testScenarioWithQueryInQueryHistory(t, "When admin reassigns queries to another user, the target user should own them",
+		func(t *testing.T, sc scenarioContext) {
+			target := createOrgUser(t, sc, "target_user")
+
+			sc.ctx.Req = web.SetURLParams(sc.ctx.Req, map[string]string{":uid": sc.initialResult.Result.UID})
+			sc.service.starHandler(sc.reqContext)
+
+			sc.reqContext.Req.Body = mockRequestBody(ReassignQueriesInQueryHistoryCommand{FromUserID: testUserID, ToUserID: target.Id})
+			resp := sc.service.reassignHandler(sc.reqContext)
+			require.Equal(t, 200, resp.Status())
+			var result ReassignQueriesInQueryHistoryResponse
+			require.NoError(t, json.Unmarshal(resp.Body(), &result))
+			require.Equal(t, int64(1), result.Count)
+
+			resp = sc.service.getHandler(sc.reqContext)
+			require.Equal(t, 404, resp.Status())
+
+			sc.reqContext.SignedInUser.UserId = target.Id
+			resp = sc.service.getHandler(sc.reqContext)
+			query := validateAndUnMarshalResponse(t, resp)
+			require.Equal(t, target.Id, query.Result.CreatedBy)
+			require.True(t, query.Result.Starred)
+
+			resp = sc.service.deleteHandler(sc.reqContext)
+			require.Equal(t, 200, resp.Status())
+		})
+}
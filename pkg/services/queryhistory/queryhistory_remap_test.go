@@ -0,0 +1,113 @@
+package queryhistory
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/grafana/grafana/pkg/components/simplejson"
+	"github.com/grafana/grafana/pkg/models"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRemapDatasourceInQueryHistory(t *testing.T) {
+	queriesOf := func(refs ...interface{}) *simplejson.Json {
+		queries := make([]interface{}, 0, len(refs))
+		for _, ref := range refs {
+			queries = append(queries, map[string]interface{}{"refId": "A", "expr": "up", "datasource": ref})
+		}
+		return simplejson.NewFromAny(queries)
+	}
+	rawQueries := func(t *testing.T, sc scenarioContext, user *models.SignedInUser, uid string) string {
+		t.Helper()
+		raw, err := sc.service.GetRawQueryInQueryHistory(context.Background(), user, uid)
+		require.NoError(t, err)
+		return string(raw)
+	}
+
+	testScenario(t, "When a data source is remapped, it should rewrite the column and the references in the queries",
+		func(t *testing.T, sc scenarioContext) {
+			ctx := context.Background()
+			user := sc.reqContext.SignedInUser
+			create := func(datasourceUID string, queries *simplejson.Json) QueryHistoryDTO {
+				dto, err := sc.service.CreateQueryInQueryHistory(ctx, user, CreateQueryInQueryHistoryCommand{DatasourceUID: datasourceUID, Queries: queries})
+				require.NoError(t, err)
+				return dto
+			}
+
+			single := create("old-uid", queriesOf(map[string]interface{}{"uid": "old-uid", "type": "prometheus"}))
+			mixed := create("-- Mixed --", queriesOf(map[string]interface{}{"uid": "old-uid"}, "other-uid", map[string]interface{}{"uid": "other-uid"}))
+			legacy := create("old-uid", queriesOf("old-uid"))
+			// Compressed queries are rewritten too.
+			sc.service.Cfg.QueryHistoryCompressThreshold = 1
+			compressed := create("old-uid", queriesOf(map[string]interface{}{"uid": "old-uid"}))
+			sc.service.Cfg.QueryHistoryCompressThreshold = 0
+			unrelated := create("other-uid", queriesOf(map[string]interface{}{"uid": "other-uid"}))
+
+			otherOrgUser := &models.SignedInUser{UserId: testUserID, OrgId: testOrgID + 1}
+			otherOrg, err := sc.service.CreateQueryInQueryHistory(ctx, otherOrgUser, CreateQueryInQueryHistoryCommand{
+				DatasourceUID: "old-uid",
+				Queries:       queriesOf(map[string]interface{}{"uid": "old-uid"}),
+			})
+			require.NoError(t, err)
+
+			count, err := sc.service.RemapDatasourceInQueryHistory(ctx, testOrgID, "old-uid", "new-uid")
+			require.NoError(t, err)
+			require.Equal(t, int64(4), count)
+
+			got, err := sc.service.GetQueryInQueryHistory(ctx, user, single.UID)
+			require.NoError(t, err)
+			require.Equal(t, "new-uid", got.DatasourceUID)
+			require.JSONEq(t, `[{"refId": "A", "expr": "up", "datasource": {"uid": "new-uid", "type": "prometheus"}}]`, rawQueries(t, sc, user, single.UID))
+
+			got, err = sc.service.GetQueryInQueryHistory(ctx, user, mixed.UID)
+			require.NoError(t, err)
+			require.Equal(t, "-- Mixed --", got.DatasourceUID)
+			require.JSONEq(t, `[
+				{"refId": "A", "expr": "up", "datasource": {"uid": "new-uid"}},
+				{"refId": "A", "expr": "up", "datasource": "other-uid"},
+				{"refId": "A", "expr": "up", "datasource": {"uid": "other-uid"}}
+			]`, rawQueries(t, sc, user, mixed.UID))
+
+			require.JSONEq(t, `[{"refId": "A", "expr": "up", "datasource": "new-uid"}]`, rawQueries(t, sc, user, legacy.UID))
+			require.JSONEq(t, `[{"refId": "A", "expr": "up", "datasource": {"uid": "new-uid"}}]`, rawQueries(t, sc, user, compressed.UID))
+
+			got, err = sc.service.GetQueryInQueryHistory(ctx, user, unrelated.UID)
+			require.NoError(t, err)
+			require.Equal(t, "other-uid", got.DatasourceUID)
+
+			got, err = sc.service.GetQueryInQueryHistory(ctx, otherOrgUser, otherOrg.UID)
+			require.NoError(t, err)
+			require.Equal(t, "old-uid", got.DatasourceUID)
+
+			result, err := sc.service.SearchInQueryHistory(ctx, user, SearchInQueryHistoryQuery{DatasourceUIDs: []string{"new-uid"}})
+			require.NoError(t, err)
+			require.Equal(t, int64(3), result.TotalCount)
+		})
+
+	testScenario(t, "When a data source is remapped in more queries than a batch, it should update all of them",
+		func(t *testing.T, sc scenarioContext) {
+			ctx := context.Background()
+			for i := 0; i < remapBatchSize+2; i++ {
+				_, err := sc.service.createQuery(ctx, sc.reqContext.SignedInUser, CreateQueryInQueryHistoryCommand{
+					DatasourceUID: "old-uid",
+					Queries:       queriesOf(map[string]interface{}{"uid": "old-uid"}),
+				})
+				require.NoError(t, err)
+			}
+
+			count, err := sc.service.RemapDatasourceInQueryHistory(ctx, testOrgID, "old-uid", "new-uid")
+			require.NoError(t, err)
+			require.Equal(t, int64(remapBatchSize+2), count)
+
+			count, err = sc.service.RemapDatasourceInQueryHistory(ctx, testOrgID, "old-uid", "new-uid")
+			require.NoError(t, err)
+			require.Zero(t, count)
+		})
+
+	testScenario(t, "When a data source is remapped to an invalid UID, it should fail",
+		func(t *testing.T, sc scenarioContext) {
+			_, err := sc.service.RemapDatasourceInQueryHistory(context.Background(), testOrgID, "old-uid", "not a uid!")
+			require.True(t, errors.Is(err, ErrQueryHistoryInvalidDatasource))
+		})
+}
@@ -0,0 +1,151 @@
+package queryhistory
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana/pkg/components/simplejson"
+	"github.com/grafana/grafana/pkg/models"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSearchCacheInQueryHistory(t *testing.T) {
+	command := CreateQueryInQueryHistoryCommand{
+		DatasourceUID: "NCzh67i",
+		Queries:       simplejson.NewFromAny(map[string]interface{}{"expr": "test"}),
+	}
+
+	testScenarioWithQueryInQueryHistory(t, "When users search query history twice, it should return the cached result until they add a query",
+		func(t *testing.T, sc scenarioContext) {
+			cache, err := newSearchCache(time.Minute, 10)
+			require.NoError(t, err)
+			sc.service.searchCache = cache
+			user := sc.reqContext.SignedInUser
+
+			result, err := sc.service.SearchInQueryHistory(context.Background(), user, SearchInQueryHistoryQuery{DatasourceUIDs: []string{"NCzh67i"}})
+			require.NoError(t, err)
+			require.Equal(t, int64(1), result.TotalCount)
+
+			// Queries added without going through the service don't invalidate the cache.
+			_, err = sc.service.createQuery(context.Background(), user, command)
+			require.NoError(t, err)
+			result, err = sc.service.SearchInQueryHistory(context.Background(), user, SearchInQueryHistoryQuery{DatasourceUIDs: []string{"NCzh67i"}, Page: 1})
+			require.NoError(t, err)
+			require.Equal(t, int64(1), result.TotalCount)
+
+			_, err = sc.service.CreateQueryInQueryHistory(context.Background(), user, command)
+			require.NoError(t, err)
+			result, err = sc.service.SearchInQueryHistory(context.Background(), user, SearchInQueryHistoryQuery{DatasourceUIDs: []string{"NCzh67i"}})
+			require.NoError(t, err)
+			require.Equal(t, int64(3), result.TotalCount)
+			require.Len(t, result.QueryHistory, 3)
+		})
+
+	testScenarioWithQueryInQueryHistory(t, "When the search cache is disabled, it should always search the database",
+		func(t *testing.T, sc scenarioContext) {
+			user := sc.reqContext.SignedInUser
+
+			_, err := sc.service.SearchInQueryHistory(context.Background(), user, SearchInQueryHistoryQuery{DatasourceUIDs: []string{"NCzh67i"}})
+			require.NoError(t, err)
+			_, err = sc.service.createQuery(context.Background(), user, command)
+			require.NoError(t, err)
+
+			result, err := sc.service.SearchInQueryHistory(context.Background(), user, SearchInQueryHistoryQuery{DatasourceUIDs: []string{"NCzh67i"}})
+			require.NoError(t, err)
+			require.Equal(t, int64(2), result.TotalCount)
+		})
+}
+
+func TestSearchCache(t *testing.T) {
+	user := func(id int64) *models.SignedInUser {
+		return &models.SignedInUser{UserId: id, OrgId: 1}
+	}
+	key := func(t *testing.T, u *models.SignedInUser, query SearchInQueryHistoryQuery) string {
+		k, err := searchCacheKey(u, query)
+		require.NoError(t, err)
+		return k
+	}
+
+	t.Run("it is disabled without TTL", func(t *testing.T) {
+		c, err := newSearchCache(0, 10)
+		require.NoError(t, err)
+		require.Nil(t, c)
+
+		c.set("key", 0, QueryHistorySearchResult{TotalCount: 1})
+		_, _, ok := c.get("key")
+		require.False(t, ok)
+	})
+
+	t.Run("it normalizes the search parameters", func(t *testing.T) {
+		require.Equal(t,
+			key(t, user(1), SearchInQueryHistoryQuery{DatasourceUIDs: []string{"b", "a"}, SearchTerms: []string{"y", "x"}}),
+			key(t, user(1), SearchInQueryHistoryQuery{DatasourceUIDs: []string{"a", "b"}, SearchTerms: []string{"x", "y"}}))
+		require.Equal(t,
+			key(t, user(1), SearchInQueryHistoryQuery{AllDatasources: true, DatasourceUIDs: []string{"a"}}),
+			key(t, user(1), SearchInQueryHistoryQuery{AllDatasources: true}))
+		require.NotEqual(t,
+			key(t, user(1), SearchInQueryHistoryQuery{DatasourceUIDs: []string{"a"}}),
+			key(t, user(2), SearchInQueryHistoryQuery{DatasourceUIDs: []string{"a"}}))
+		require.NotEqual(t,
+			key(t, user(1), SearchInQueryHistoryQuery{DatasourceUIDs: []string{"a"}}),
+			key(t, &models.SignedInUser{UserId: 1, OrgId: 2}, SearchInQueryHistoryQuery{DatasourceUIDs: []string{"a"}}))
+	})
+
+	t.Run("it only invalidates the results of the given users", func(t *testing.T) {
+		c, err := newSearchCache(time.Minute, 10)
+		require.NoError(t, err)
+		k1 := key(t, user(1), SearchInQueryHistoryQuery{})
+		k11 := key(t, user(11), SearchInQueryHistoryQuery{})
+
+		for _, k := range []string{k1, k11} {
+			_, gen, ok := c.get(k)
+			require.False(t, ok)
+			c.set(k, gen, QueryHistorySearchResult{TotalCount: 1})
+		}
+
+		c.invalidate(1)
+		_, _, ok := c.get(k1)
+		require.False(t, ok)
+		result, _, ok := c.get(k11)
+		require.True(t, ok)
+		require.Equal(t, int64(1), result.TotalCount)
+	})
+
+	t.Run("it doesn't cache the results of searches running during an invalidation", func(t *testing.T) {
+		c, err := newSearchCache(time.Minute, 10)
+		require.NoError(t, err)
+		k := key(t, user(1), SearchInQueryHistoryQuery{})
+
+		_, gen, _ := c.get(k)
+		c.invalidate(1)
+		c.set(k, gen, QueryHistorySearchResult{TotalCount: 1})
+
+		_, _, ok := c.get(k)
+		require.False(t, ok)
+	})
+
+	t.Run("it expires and evicts results", func(t *testing.T) {
+		c, err := newSearchCache(time.Minute, 2)
+		require.NoError(t, err)
+		now := time.Now()
+		c.now = func() time.Time { return now }
+
+		keys := []string{
+			key(t, user(1), SearchInQueryHistoryQuery{Page: 1}),
+			key(t, user(1), SearchInQueryHistoryQuery{Page: 2}),
+			key(t, user(1), SearchInQueryHistoryQuery{Page: 3}),
+		}
+		for _, k := range keys {
+			c.set(k, 0, QueryHistorySearchResult{})
+		}
+		_, _, ok := c.get(keys[0])
+		require.False(t, ok)
+		_, _, ok = c.get(keys[2])
+		require.True(t, ok)
+
+		now = now.Add(time.Minute)
+		_, _, ok = c.get(keys[2])
+		require.False(t, ok)
+	})
+}
@@ -0,0 +1,458 @@
+package queryhistory
+
+import (
+	"context"
+	"encoding/json"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana/pkg/api/response"
+	"github.com/grafana/grafana/pkg/components/simplejson"
+	"github.com/grafana/grafana/pkg/models"
+	"github.com/grafana/grafana/pkg/services/sqlstore"
+	"github.com/grafana/grafana/pkg/services/sqlstore/migrator"
+	"github.com/grafana/grafana/pkg/web"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSearchInQueryHistory(t *testing.T) {
+	testScenarioWithQueryInQueryHistory(t, "When users tries to search query history without datasource, it should fail",
+		func(t *testing.T, sc scenarioContext) {
+			sc.reqContext.Req.Form = url.Values{}
+			resp := sc.service.searchHandler(sc.reqContext)
+			require.Equal(t, 400, resp.Status())
+		})
+
+	testScenarioWithQueryInQueryHistory(t, "When users tries to search query history by datasource, it should succeed",
+		func(t *testing.T, sc scenarioContext) {
+			sc.reqContext.Req.Form = url.Values{"datasourceUid": []string{"NCzh67i"}}
+			resp := sc.service.searchHandler(sc.reqContext)
+			result := validateAndUnMarshalSearchResponse(t, resp.Status(), resp.Body())
+			require.Equal(t, int64(1), result.Result.TotalCount)
+			require.Len(t, result.Result.QueryHistory, 1)
+			require.Equal(t, sc.initialResult.Result.UID, result.Result.QueryHistory[0].UID)
+		})
+
+	testScenarioWithQueryInQueryHistory(t, "When users tries to search query history by other datasource, it should return no queries",
+		func(t *testing.T, sc scenarioContext) {
+			sc.reqContext.Req.Form = url.Values{"datasourceUid": []string{"other"}}
+			resp := sc.service.searchHandler(sc.reqContext)
+			result := validateAndUnMarshalSearchResponse(t, resp.Status(), resp.Body())
+			require.Equal(t, int64(0), result.Result.TotalCount)
+			require.Len(t, result.Result.QueryHistory, 0)
+		})
+
+	testScenarioWithQueryInQueryHistory(t, "When users search query history without matches, it should return an empty list with the pagination",
+		func(t *testing.T, sc scenarioContext) {
+			cache, err := newSearchCache(time.Minute, 10)
+			require.NoError(t, err)
+			sc.service.searchCache = cache
+
+			for _, form := range []url.Values{
+				{"datasourceUid": []string{"other"}},
+				{"datasourceUid": []string{"other"}, "uidsOnly": []string{"true"}},
+			} {
+				// The second search of each form is read from the cache.
+				for i := 0; i < 2; i++ {
+					sc.reqContext.Req.Form = form
+					resp := sc.service.searchHandler(sc.reqContext)
+					require.Equal(t, 200, resp.Status())
+
+					var body map[string]map[string]json.RawMessage
+					require.NoError(t, json.Unmarshal(resp.Body(), &body))
+					require.JSONEq(t, `[]`, string(body["result"]["queryHistory"]))
+					require.JSONEq(t, `0`, string(body["result"]["totalCount"]))
+					require.JSONEq(t, `1`, string(body["result"]["page"]))
+					require.JSONEq(t, `100`, string(body["result"]["perPage"]))
+				}
+			}
+		})
+
+	testScenarioWithQueryInQueryHistory(t, "When users tries to search query history of all datasources, it should return queries of every datasource",
+		func(t *testing.T, sc scenarioContext) {
+			_, err := sc.service.createQuery(context.Background(), sc.reqContext.SignedInUser, CreateQueryInQueryHistoryCommand{
+				DatasourceUID: "other",
+				Queries:       simplejson.NewFromAny(map[string]interface{}{"expr": "test"}),
+			})
+			require.NoError(t, err)
+
+			sc.reqContext.Req.Form = url.Values{"allDatasources": []string{"true"}}
+			resp := sc.service.searchHandler(sc.reqContext)
+			result := validateAndUnMarshalSearchResponse(t, resp.Status(), resp.Body())
+			require.Equal(t, int64(2), result.Result.TotalCount)
+			require.Len(t, result.Result.QueryHistory, 2)
+
+			sc.reqContext.Req.Form = url.Values{"allDatasources": []string{"true"}, "datasourceUid": []string{"NCzh67i"}}
+			resp = sc.service.searchHandler(sc.reqContext)
+			result = validateAndUnMarshalSearchResponse(t, resp.Status(), resp.Body())
+			require.Equal(t, int64(2), result.Result.TotalCount)
+		})
+
+	testScenarioWithQueryInQueryHistory(t, "When users tries to search only starred queries, it should return only starred queries",
+		func(t *testing.T, sc scenarioContext) {
+			sc.reqContext.Req.Form = url.Values{"datasourceUid": []string{"NCzh67i"}, "onlyStarred": []string{"true"}}
+			resp := sc.service.searchHandler(sc.reqContext)
+			result := validateAndUnMarshalSearchResponse(t, resp.Status(), resp.Body())
+			require.Len(t, result.Result.QueryHistory, 0)
+
+			sc.ctx.Req = web.SetURLParams(sc.ctx.Req, map[string]string{":uid": sc.initialResult.Result.UID})
+			sc.service.starHandler(sc.reqContext)
+
+			resp = sc.service.searchHandler(sc.reqContext)
+			result = validateAndUnMarshalSearchResponse(t, resp.Status(), resp.Body())
+			require.Len(t, result.Result.QueryHistory, 1)
+			require.True(t, result.Result.QueryHistory[0].Starred)
+		})
+
+	testScenarioWithQueryInQueryHistory(t, "When users tries to search query history by search string, it should match queries and comments",
+		func(t *testing.T, sc scenarioContext) {
+			sc.reqContext.Req.Form = url.Values{"datasourceUid": []string{"NCzh67i"}, "searchString": []string{"test"}}
+			resp := sc.service.searchHandler(sc.reqContext)
+			result := validateAndUnMarshalSearchResponse(t, resp.Status(), resp.Body())
+			require.Len(t, result.Result.QueryHistory, 1)
+
+			sc.reqContext.Req.Form = url.Values{"datasourceUid": []string{"NCzh67i"}, "searchString": []string{"nothing"}}
+			resp = sc.service.searchHandler(sc.reqContext)
+			result = validateAndUnMarshalSearchResponse(t, resp.Status(), resp.Body())
+			require.Len(t, result.Result.QueryHistory, 0)
+		})
+}
+
+func TestSearchInQueryHistoryWithSearchTerms(t *testing.T) {
+	testScenarioWithQueryInQueryHistory(t, "When users search with several terms, the operator should combine them",
+		func(t *testing.T, sc scenarioContext) {
+			sc.reqContext.Req.Body = mockRequestBody(CreateQueryInQueryHistoryCommand{
+				DatasourceUID: "NCzh67i",
+				Queries: simplejson.NewFromAny(map[string]interface{}{
+					"expr": "rate(http_requests_total[5m])",
+				}),
+			})
+			created := validateAndUnMarshalResponse(t, sc.service.createHandler(sc.reqContext))
+
+			search := func(operator string, terms ...string) QueryHistorySearchResponse {
+				sc.reqContext.Req.Form = url.Values{
+					"datasourceUid":  []string{"NCzh67i"},
+					"searchTerms":    terms,
+					"searchOperator": []string{operator},
+				}
+				resp := sc.service.searchHandler(sc.reqContext)
+				return validateAndUnMarshalSearchResponse(t, resp.Status(), resp.Body())
+			}
+
+			result := search(SearchOperatorAnd, "rate", "http_requests")
+			require.Len(t, result.Result.QueryHistory, 1)
+			require.Equal(t, created.Result.UID, result.Result.QueryHistory[0].UID)
+
+			result = search(SearchOperatorAnd, "rate", "test")
+			require.Len(t, result.Result.QueryHistory, 0)
+
+			result = search(SearchOperatorOr, "rate", "test")
+			require.Len(t, result.Result.QueryHistory, 2)
+			require.Equal(t, int64(2), result.Result.TotalCount)
+		})
+
+	testScenarioWithQueryInQueryHistory(t, "When users search with an unknown operator, it should fail",
+		func(t *testing.T, sc scenarioContext) {
+			sc.reqContext.Req.Form = url.Values{
+				"datasourceUid":  []string{"NCzh67i"},
+				"searchTerms":    []string{"rate", "test"},
+				"searchOperator": []string{"xor"},
+			}
+			resp := sc.service.searchHandler(sc.reqContext)
+			require.Equal(t, 400, resp.Status())
+		})
+}
+
+func TestSearchInQueryHistoryWithQueryType(t *testing.T) {
+	testScenarioWithQueryInQueryHistory(t, "When users search by query type, it should return only queries of that type",
+		func(t *testing.T, sc scenarioContext) {
+			create := func(queries interface{}) string {
+				sc.reqContext.Req.Body = mockRequestBody(CreateQueryInQueryHistoryCommand{
+					DatasourceUID: "NCzh67i",
+					Queries:       simplejson.NewFromAny(queries),
+				})
+				return validateAndUnMarshalResponse(t, sc.service.createHandler(sc.reqContext)).Result.UID
+			}
+			rangeUID := create([]interface{}{
+				map[string]interface{}{"refId": "A", "expr": "up", "queryType": "range"},
+			})
+			instantUID := create(map[string]interface{}{"refId": "A", "expr": "up", "queryType": "instant"})
+
+			search := func(queryType string) []string {
+				sc.reqContext.Req.Form = url.Values{"datasourceUid": []string{"NCzh67i"}, "queryType": []string{queryType}}
+				resp := sc.service.searchHandler(sc.reqContext)
+				result := validateAndUnMarshalSearchResponse(t, resp.Status(), resp.Body())
+				uids := []string{}
+				for _, q := range result.Result.QueryHistory {
+					uids = append(uids, q.UID)
+				}
+				return uids
+			}
+
+			require.Equal(t, []string{rangeUID}, search("range"))
+			require.Equal(t, []string{instantUID}, search("instant"))
+			require.Empty(t, search("randomWalk"))
+			require.Len(t, search(""), 3)
+		})
+}
+
+func TestSearchInQueryHistoryCommentedFirst(t *testing.T) {
+	testScenarioWithQueryInQueryHistory(t, "When users sort by commented first, commented queries should come before the others",
+		func(t *testing.T, sc scenarioContext) {
+			create := func(comment string) string {
+				sc.reqContext.Req.Body = mockRequestBody(CreateQueryInQueryHistoryCommand{
+					DatasourceUID: "NCzh67i",
+					Queries:       simplejson.NewFromAny(map[string]interface{}{"expr": "up"}),
+				})
+				uid := validateAndUnMarshalResponse(t, sc.service.createHandler(sc.reqContext)).Result.UID
+				if comment != "" {
+					_, err := sc.service.PatchQueryCommentInQueryHistory(context.Background(), sc.reqContext.SignedInUser, uid,
+						PatchQueryCommentInQueryHistoryCommand{Comment: comment})
+					require.NoError(t, err)
+				}
+				return uid
+			}
+			commentedOld := create("old annotated query")
+			uncommented := create("")
+			commentedNew := create("new annotated query")
+
+			sc.reqContext.Req.Form = url.Values{"datasourceUid": []string{"NCzh67i"}, "sort": []string{"commented-first"}}
+			resp := sc.service.searchHandler(sc.reqContext)
+			result := validateAndUnMarshalSearchResponse(t, resp.Status(), resp.Body())
+
+			uids := []string{}
+			for _, q := range result.Result.QueryHistory {
+				uids = append(uids, q.UID)
+			}
+			require.Equal(t, []string{commentedNew, commentedOld, uncommented, sc.initialResult.Result.UID}, uids)
+		})
+}
+
+func TestSearchInQueryHistoryUIDsOnly(t *testing.T) {
+	testScenarioWithQueryInQueryHistory(t, "When users search only the UIDs, it should return the UIDs of the matching queries",
+		func(t *testing.T, sc scenarioContext) {
+			create := func(datasourceUID string) string {
+				dto, err := sc.service.createQuery(context.Background(), sc.reqContext.SignedInUser, CreateQueryInQueryHistoryCommand{
+					DatasourceUID: datasourceUID,
+					Queries:       simplejson.NewFromAny(map[string]interface{}{"expr": "up"}),
+				})
+				require.NoError(t, err)
+				return dto.UID
+			}
+			second := create("NCzh67i")
+			create("other")
+
+			sc.reqContext.Req.Form = url.Values{"datasourceUid": []string{"NCzh67i"}, "uidsOnly": []string{"true"}}
+			resp := sc.service.searchHandler(sc.reqContext)
+			require.Equal(t, 200, resp.Status())
+			require.JSONEq(t, `{"result": {"totalCount": 2, "page": 1, "perPage": 100, "queryHistory": [], "uids": ["`+second+`", "`+sc.initialResult.Result.UID+`"]}}`, string(resp.Body()))
+
+			_, err := sc.service.StarQueryInQueryHistory(context.Background(), sc.reqContext.SignedInUser, second, StarQueryInQueryHistoryCommand{})
+			require.NoError(t, err)
+
+			sc.reqContext.Req.Form = url.Values{"datasourceUid": []string{"NCzh67i"}, "uidsOnly": []string{"true"}, "onlyStarred": []string{"true"}}
+			resp = sc.service.searchHandler(sc.reqContext)
+			result := validateAndUnMarshalSearchResponse(t, resp.Status(), resp.Body())
+			require.Equal(t, int64(1), result.Result.TotalCount)
+			require.Equal(t, []string{second}, result.Result.UIDs)
+
+			sc.reqContext.Req.Form = url.Values{"allDatasources": []string{"true"}, "uidsOnly": []string{"true"}, "limit": []string{"2"}, "page": []string{"2"}}
+			resp = sc.service.searchHandler(sc.reqContext)
+			result = validateAndUnMarshalSearchResponse(t, resp.Status(), resp.Body())
+			require.Equal(t, int64(3), result.Result.TotalCount)
+			require.Equal(t, []string{sc.initialResult.Result.UID}, result.Result.UIDs)
+		})
+
+	t.Run("it only joins the stars when filtering on them", func(t *testing.T) {
+		builder := sqlstore.SQLBuilder{}
+		writeUIDsFromSQL(SearchInQueryHistoryQuery{}, &builder)
+		require.Equal(t, ` FROM query_history`, builder.GetSQLString())
+
+		builder = sqlstore.SQLBuilder{}
+		writeUIDsFromSQL(SearchInQueryHistoryQuery{FolderUID: "folder"}, &builder)
+		require.Contains(t, builder.GetSQLString(), `INNER JOIN query_history_star`)
+	})
+}
+
+func TestSearchInQueryHistoryGroupByDatasource(t *testing.T) {
+	testScenarioWithQueryInQueryHistory(t, "When users search grouped by data source, it should return a page of queries per data source",
+		func(t *testing.T, sc scenarioContext) {
+			create := func(datasourceUID string) string {
+				dto, err := sc.service.createQuery(context.Background(), sc.reqContext.SignedInUser, CreateQueryInQueryHistoryCommand{
+					DatasourceUID: datasourceUID,
+					Queries:       simplejson.NewFromAny(map[string]interface{}{"expr": "up"}),
+				})
+				require.NoError(t, err)
+				return dto.UID
+			}
+			otherOld := create("other")
+			second := create("NCzh67i")
+			otherNew := create("other")
+			create("unrequested")
+
+			groupUIDs := func(group QueryHistoryDatasourceGroup) []string {
+				uids := []string{}
+				for _, q := range group.QueryHistory {
+					require.Equal(t, group.DatasourceUID, q.DatasourceUID)
+					uids = append(uids, q.UID)
+				}
+				return uids
+			}
+
+			sc.reqContext.Req.Form = url.Values{"datasourceUid": []string{"other", "NCzh67i"}, "groupByDatasource": []string{"true"}}
+			resp := sc.service.searchHandler(sc.reqContext)
+			result := validateAndUnMarshalSearchResponse(t, resp.Status(), resp.Body())
+			require.Equal(t, int64(4), result.Result.TotalCount)
+			require.Empty(t, result.Result.QueryHistory)
+			require.Len(t, result.Result.Groups, 2)
+			require.Equal(t, "other", result.Result.Groups[0].DatasourceUID)
+			require.Equal(t, []string{otherNew, otherOld}, groupUIDs(result.Result.Groups[0]))
+			require.Equal(t, "NCzh67i", result.Result.Groups[1].DatasourceUID)
+			require.Equal(t, []string{second, sc.initialResult.Result.UID}, groupUIDs(result.Result.Groups[1]))
+
+			sc.reqContext.Req.Form = url.Values{"allDatasources": []string{"true"}, "groupByDatasource": []string{"true"}, "sort": []string{"time-asc"}, "limit": []string{"1"}}
+			resp = sc.service.searchHandler(sc.reqContext)
+			result = validateAndUnMarshalSearchResponse(t, resp.Status(), resp.Body())
+			require.Equal(t, int64(5), result.Result.TotalCount)
+			require.Len(t, result.Result.Groups, 3)
+			require.Equal(t, "NCzh67i", result.Result.Groups[0].DatasourceUID)
+			require.Equal(t, int64(2), result.Result.Groups[0].TotalCount)
+			require.Equal(t, []string{sc.initialResult.Result.UID}, groupUIDs(result.Result.Groups[0]))
+			require.Equal(t, "other", result.Result.Groups[1].DatasourceUID)
+			require.Equal(t, []string{otherOld}, groupUIDs(result.Result.Groups[1]))
+			require.Equal(t, "unrequested", result.Result.Groups[2].DatasourceUID)
+		})
+}
+
+func TestSearchInQueryHistoryPaginationHeaders(t *testing.T) {
+	testScenarioWithQueryInQueryHistory(t, "When users search a middle page, it should link to the other pages",
+		func(t *testing.T, sc scenarioContext) {
+			for i := 0; i < 4; i++ {
+				_, err := sc.service.createQuery(context.Background(), sc.reqContext.SignedInUser, CreateQueryInQueryHistoryCommand{
+					DatasourceUID: "NCzh67i",
+					Queries:       simplejson.NewFromAny(map[string]interface{}{"expr": "up"}),
+				})
+				require.NoError(t, err)
+			}
+
+			sc.reqContext.Req.Form = url.Values{"datasourceUid": []string{"NCzh67i"}, "limit": []string{"2"}, "page": []string{"2"}}
+			resp := sc.service.searchHandler(sc.reqContext)
+			require.Equal(t, 200, resp.Status())
+
+			header := resp.(*response.NormalResponse).Header()
+			require.Equal(t, "5", header.Get("X-Total-Count"))
+			require.Equal(t, strings.Join([]string{
+				`</api/query-history?datasourceUid=NCzh67i&limit=2&page=1>; rel="first"`,
+				`</api/query-history?datasourceUid=NCzh67i&limit=2&page=1>; rel="prev"`,
+				`</api/query-history?datasourceUid=NCzh67i&limit=2&page=3>; rel="next"`,
+				`</api/query-history?datasourceUid=NCzh67i&limit=2&page=3>; rel="last"`,
+			}, ", "), header.Get("Link"))
+		})
+
+	testScenarioWithQueryInQueryHistory(t, "When users search with the default pagination, it should only link to the first page",
+		func(t *testing.T, sc scenarioContext) {
+			sc.reqContext.Req.Form = url.Values{"datasourceUid": []string{"NCzh67i"}}
+			resp := sc.service.searchHandler(sc.reqContext)
+
+			header := resp.(*response.NormalResponse).Header()
+			require.Equal(t, "1", header.Get("X-Total-Count"))
+			require.Equal(t, `</api/query-history?datasourceUid=NCzh67i&limit=100&page=1>; rel="first", `+
+				`</api/query-history?datasourceUid=NCzh67i&limit=100&page=1>; rel="last"`, header.Get("Link"))
+		})
+}
+
+func TestQueryTypeFilter(t *testing.T) {
+	tests := []struct {
+		driverName string
+		condition  string
+		params     []interface{}
+	}{
+		{
+			driverName: migrator.MySQL,
+			condition:  `JSON_CONTAINS(query_history.queries, ?)`,
+			params:     []interface{}{`{"queryType":"range"}`},
+		},
+		{
+			driverName: migrator.Postgres,
+			condition:  `(query_history.queries::jsonb @> ?::jsonb OR query_history.queries::jsonb @> ?::jsonb)`,
+			params:     []interface{}{`[{"queryType":"range"}]`, `{"queryType":"range"}`},
+		},
+		{
+			driverName: migrator.SQLite,
+			condition:  `query_history.queries LIKE ?`,
+			params:     []interface{}{`%"queryType":"range"%`},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.driverName, func(t *testing.T) {
+			condition, params := queryTypeFilter(tt.driverName, "LIKE", "range")
+			require.Equal(t, tt.condition, condition)
+			require.Equal(t, tt.params, params)
+		})
+	}
+}
+
+func validateAndUnMarshalSearchResponse(t *testing.T, status int, body []byte) QueryHistorySearchResponse {
+	t.Helper()
+
+	require.Equal(t, 200, status)
+
+	var result = QueryHistorySearchResponse{}
+	err := json.Unmarshal(body, &result)
+	require.NoError(t, err)
+
+	return result
+}
+
+func TestSearchInQueryHistoryDefaultDatasourceFallback(t *testing.T) {
+	addDefaultDatasource := func(t *testing.T, sc scenarioContext) {
+		t.Helper()
+		err := sc.sqlStore.AddDataSource(context.Background(), &models.AddDataSourceCommand{
+			OrgId:     testOrgID,
+			Uid:       "NCzh67i",
+			Name:      "default",
+			Type:      models.DS_PROMETHEUS,
+			Access:    models.DS_ACCESS_PROXY,
+			Url:       "http://test",
+			IsDefault: true,
+		})
+		require.NoError(t, err)
+	}
+
+	testScenarioWithQueryInQueryHistory(t, "When users search query history without datasource and the fallback is enabled, it should search the default datasource",
+		func(t *testing.T, sc scenarioContext) {
+			sc.service.Cfg.QueryHistoryDefaultDatasourceFallback = true
+			addDefaultDatasource(t, sc)
+			_, err := sc.service.createQuery(context.Background(), sc.reqContext.SignedInUser, CreateQueryInQueryHistoryCommand{
+				DatasourceUID: "other",
+				Queries:       simplejson.NewFromAny(map[string]interface{}{"expr": "test"}),
+			})
+			require.NoError(t, err)
+
+			sc.reqContext.Req.Form = url.Values{}
+			resp := sc.service.searchHandler(sc.reqContext)
+			result := validateAndUnMarshalSearchResponse(t, resp.Status(), resp.Body())
+			require.Equal(t, int64(1), result.Result.TotalCount)
+			require.Equal(t, sc.initialResult.Result.UID, result.Result.QueryHistory[0].UID)
+		})
+
+	testScenarioWithQueryInQueryHistory(t, "When users search query history without datasource and the org has no default datasource, it should fail",
+		func(t *testing.T, sc scenarioContext) {
+			sc.service.Cfg.QueryHistoryDefaultDatasourceFallback = true
+
+			sc.reqContext.Req.Form = url.Values{}
+			resp := sc.service.searchHandler(sc.reqContext)
+			require.Equal(t, 400, resp.Status())
+		})
+
+	testScenarioWithQueryInQueryHistory(t, "When users search query history without datasource and the fallback is disabled, it should fail",
+		func(t *testing.T, sc scenarioContext) {
+			addDefaultDatasource(t, sc)
+
+			_, err := sc.service.searchQueries(context.Background(), sc.reqContext.SignedInUser, SearchInQueryHistoryQuery{})
+			require.ErrorIs(t, err, ErrNoDatasourceSpecified)
+		})
+}
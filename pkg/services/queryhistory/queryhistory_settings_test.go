@@ -0,0 +1,91 @@
+package queryhistory
+
+import (
+	"context"
+	"net/url"
+	"testing"
+
+	"github.com/grafana/grafana/pkg/components/simplejson"
+	"github.com/grafana/grafana/pkg/infra/kvstore"
+	"github.com/stretchr/testify/require"
+)
+
+func TestQueryHistoryDefaultSort(t *testing.T) {
+	setup := func(t *testing.T, sc scenarioContext) (string, string) {
+		t.Helper()
+		sc.service.KVStore = kvstore.ProvideService(sc.sqlStore)
+		second, err := sc.service.CreateQueryInQueryHistory(context.Background(), sc.reqContext.SignedInUser, CreateQueryInQueryHistoryCommand{
+			DatasourceUID: "NCzh67i",
+			Queries:       simplejson.NewFromAny(map[string]interface{}{"expr": "second"}),
+		})
+		require.NoError(t, err)
+		return sc.initialResult.Result.UID, second.UID
+	}
+
+	search := func(t *testing.T, sc scenarioContext, form url.Values) []string {
+		t.Helper()
+		form.Set("datasourceUid", "NCzh67i")
+		form.Set("uidsOnly", "true")
+		sc.reqContext.Req.Form = form
+		resp := sc.service.searchHandler(sc.reqContext)
+		return validateAndUnMarshalSearchResponse(t, resp.Status(), resp.Body()).Result.UIDs
+	}
+
+	testScenarioWithQueryInQueryHistory(t, "When the org has no default sort, the newest queries should be returned first",
+		func(t *testing.T, sc scenarioContext) {
+			first, second := setup(t, sc)
+			require.Equal(t, []string{second, first}, search(t, sc, url.Values{}))
+
+			resp := sc.service.getSettingsHandler(sc.reqContext)
+			require.Equal(t, 200, resp.Status())
+			require.JSONEq(t, `{"result": {"defaultSort": "time-desc", "deletedUsers": "delete"}}`, string(resp.Body()))
+		})
+
+	testScenarioWithQueryInQueryHistory(t, "When the org configured a default sort, it should apply to the searches without sort",
+		func(t *testing.T, sc scenarioContext) {
+			first, second := setup(t, sc)
+
+			sc.reqContext.Req.Body = mockRequestBody(QueryHistorySettings{DefaultSort: "time-asc"})
+			resp := sc.service.updateSettingsHandler(sc.reqContext)
+			require.Equal(t, 200, resp.Status())
+			require.JSONEq(t, `{"result": {"defaultSort": "time-asc", "deletedUsers": "delete"}}`, string(resp.Body()))
+
+			require.Equal(t, []string{first, second}, search(t, sc, url.Values{}))
+			require.Equal(t, []string{second, first}, search(t, sc, url.Values{"sort": []string{"time-desc"}}))
+
+			// The other organizations keep the default sort.
+			require.Equal(t, defaultSort, sc.service.GetSettingsInQueryHistory(context.Background(), testOrgID+1).DefaultSort)
+
+			sc.reqContext.Req.Body = mockRequestBody(QueryHistorySettings{})
+			resp = sc.service.updateSettingsHandler(sc.reqContext)
+			require.Equal(t, 200, resp.Status())
+			require.Equal(t, []string{second, first}, search(t, sc, url.Values{}))
+		})
+
+	testScenarioWithQueryInQueryHistory(t, "When the org configured an invalid default sort, the newest queries should be returned first",
+		func(t *testing.T, sc scenarioContext) {
+			first, second := setup(t, sc)
+			err := sc.service.KVStore.Set(context.Background(), testOrgID, settingsKVNamespace, defaultSortKey, "name-asc")
+			require.NoError(t, err)
+
+			require.Equal(t, []string{second, first}, search(t, sc, url.Values{}))
+		})
+
+	testScenarioWithQueryInQueryHistory(t, "When an admin configures an invalid default sort, it should fail",
+		func(t *testing.T, sc scenarioContext) {
+			setup(t, sc)
+			sc.reqContext.Req.Body = mockRequestBody(QueryHistorySettings{DefaultSort: "name-asc"})
+			resp := sc.service.updateSettingsHandler(sc.reqContext)
+			require.Equal(t, 400, resp.Status())
+			require.Contains(t, string(resp.Body()), "queryhistory.invalidSort")
+		})
+
+	testScenarioWithQueryInQueryHistory(t, "When an admin configures an invalid deleted users policy, it should fail",
+		func(t *testing.T, sc scenarioContext) {
+			setup(t, sc)
+			sc.reqContext.Req.Body = mockRequestBody(QueryHistorySettings{DeletedUsers: "archive"})
+			resp := sc.service.updateSettingsHandler(sc.reqContext)
+			require.Equal(t, 400, resp.Status())
+			require.Contains(t, string(resp.Body()), "queryhistory.invalidDeletedUsersPolicy")
+		})
+}
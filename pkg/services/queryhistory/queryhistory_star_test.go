@@ -1,6 +1,10 @@
 package queryhistory
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
 	"testing"
 
 	"github.com/grafana/grafana/pkg/web"
@@ -11,7 +15,7 @@ func TestStarQueryInQueryHistory(t *testing.T) {
 	testScenarioWithQueryInQueryHistory(t, "When users tries to star query in query history that does not exists, it should fail",
 		func(t *testing.T, sc scenarioContext) {
 			resp := sc.service.starHandler(sc.reqContext)
-			require.Equal(t, 500, resp.Status())
+			require.Equal(t, 404, resp.Status())
 		})
 
 	testScenarioWithQueryInQueryHistory(t, "When users tries to star query in query history that exists, it should succeed",
@@ -26,6 +30,54 @@ func TestStarQueryInQueryHistory(t *testing.T) {
 			sc.ctx.Req = web.SetURLParams(sc.ctx.Req, map[string]string{":uid": sc.initialResult.Result.UID})
 			sc.service.starHandler(sc.reqContext)
 			resp := sc.service.starHandler(sc.reqContext)
-			require.Equal(t, 500, resp.Status())
+			require.Equal(t, 400, resp.Status())
+		})
+}
+
+func TestStarQueryWithCommentInQueryHistory(t *testing.T) {
+	testScenarioWithQueryInQueryHistory(t, "When users star a query with a comment, it should persist both",
+		func(t *testing.T, sc scenarioContext) {
+			comment := "saved for the incident review"
+			sc.ctx.Req = web.SetURLParams(sc.ctx.Req, map[string]string{":uid": sc.initialResult.Result.UID})
+			sc.reqContext.Req.Body = mockRequestBody(StarQueryInQueryHistoryCommand{Comment: &comment})
+			resp := sc.service.starHandler(sc.reqContext)
+			require.Equal(t, 200, resp.Status())
+
+			var result QueryHistoryResponse
+			require.NoError(t, json.Unmarshal(resp.Body(), &result))
+			require.True(t, result.Result.Starred)
+			require.Equal(t, comment, result.Result.Comment)
+
+			query, err := sc.service.GetQueryInQueryHistory(context.Background(), sc.reqContext.SignedInUser, sc.initialResult.Result.UID)
+			require.NoError(t, err)
+			require.True(t, query.Starred)
+			require.Equal(t, comment, query.Comment)
+		})
+
+	testScenarioWithQueryInQueryHistory(t, "When users star an already starred query with a comment, it should not update the comment",
+		func(t *testing.T, sc scenarioContext) {
+			uid := sc.initialResult.Result.UID
+			_, err := sc.service.StarQueryInQueryHistory(context.Background(), sc.reqContext.SignedInUser, uid, StarQueryInQueryHistoryCommand{})
+			require.NoError(t, err)
+
+			comment := "too late"
+			_, err = sc.service.StarQueryInQueryHistory(context.Background(), sc.reqContext.SignedInUser, uid, StarQueryInQueryHistoryCommand{Comment: &comment})
+			require.True(t, errors.Is(err, ErrQueryAlreadyStarred))
+
+			query, err := sc.service.GetQueryInQueryHistory(context.Background(), sc.reqContext.SignedInUser, uid)
+			require.NoError(t, err)
+			require.Empty(t, query.Comment)
+		})
+
+	testScenarioWithQueryInQueryHistory(t, "When users star a query with a comment that is too long, it should fail without starring it",
+		func(t *testing.T, sc scenarioContext) {
+			uid := sc.initialResult.Result.UID
+			comment := strings.Repeat("a", maxCommentLength+1)
+			_, err := sc.service.StarQueryInQueryHistory(context.Background(), sc.reqContext.SignedInUser, uid, StarQueryInQueryHistoryCommand{Comment: &comment})
+			require.True(t, errors.Is(err, ErrCommentTooLong))
+
+			query, err := sc.service.GetQueryInQueryHistory(context.Background(), sc.reqContext.SignedInUser, uid)
+			require.NoError(t, err)
+			require.False(t, query.Starred)
 		})
 }
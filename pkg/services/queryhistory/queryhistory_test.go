@@ -11,6 +11,7 @@ import (
 
 	"github.com/grafana/grafana/pkg/api/response"
 	"github.com/grafana/grafana/pkg/components/simplejson"
+	"github.com/grafana/grafana/pkg/infra/log"
 	"github.com/grafana/grafana/pkg/models"
 	"github.com/grafana/grafana/pkg/services/sqlstore"
 	"github.com/grafana/grafana/pkg/setting"
@@ -43,9 +44,11 @@ func testScenario(t *testing.T, desc string, fn func(t *testing.T, sc scenarioCo
 		service := QueryHistoryService{
 			Cfg:      setting.NewCfg(),
 			SQLStore: sqlStore,
+			log:      log.New("query-history"),
 		}
 
 		service.Cfg.QueryHistoryEnabled = true
+		service.Cfg.QueryHistoryDeletedUsers = setting.QueryHistoryDeletedUsersDelete
 
 		user := models.SignedInUser{
 			UserId:     testUserID,
@@ -94,6 +97,24 @@ func testScenarioWithQueryInQueryHistory(t *testing.T, desc string, fn func(t *t
 	})
 }
 
+// createOrgUser creates a user who is a member of the organization of the
+// signed in user.
+func createOrgUser(t *testing.T, sc scenarioContext, login string) *models.User {
+	t.Helper()
+	user, err := sc.sqlStore.CreateUser(context.Background(), models.CreateUserCommand{
+		Email: login + "@test.com",
+		Login: login,
+	})
+	require.NoError(t, err)
+	err = sc.sqlStore.AddOrgUser(context.Background(), &models.AddOrgUserCommand{
+		OrgId:  testOrgID,
+		UserId: user.Id,
+		Role:   models.ROLE_VIEWER,
+	})
+	require.NoError(t, err)
+	return user
+}
+
 func mockRequestBody(v interface{}) io.ReadCloser {
 	b, _ := json.Marshal(v)
 	return io.NopCloser(bytes.NewReader(b))
@@ -0,0 +1,111 @@
+package queryhistory
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana/pkg/components/simplejson"
+	"github.com/grafana/grafana/pkg/services/sqlstore"
+	"github.com/stretchr/testify/require"
+)
+
+func TestQueryHistoryTimeRange(t *testing.T) {
+	createWithTimeRange := func(t *testing.T, sc scenarioContext, from, to string) (QueryHistoryDTO, error) {
+		t.Helper()
+		return sc.service.createQuery(context.Background(), sc.reqContext.SignedInUser, CreateQueryInQueryHistoryCommand{
+			DatasourceUID: "NCzh67i",
+			Queries: simplejson.NewFromAny(map[string]interface{}{
+				"expr": "rate(http_requests_total[5m])",
+			}),
+			From: from,
+			To:   to,
+		})
+	}
+
+	testScenario(t, "When users create a query with a time range, it should be stored and returned",
+		func(t *testing.T, sc scenarioContext) {
+			dto, err := createWithTimeRange(t, sc, "1650000000000", "1650003600000")
+			require.NoError(t, err)
+			require.Equal(t, "1650000000000", dto.From)
+			require.Equal(t, "1650003600000", dto.To)
+
+			var stored QueryHistory
+			err = sc.sqlStore.WithDbSession(context.Background(), func(session *sqlstore.DBSession) error {
+				_, err := session.Where("uid = ?", dto.UID).Get(&stored)
+				return err
+			})
+			require.NoError(t, err)
+			require.Equal(t, "1650000000000", stored.TimeFrom)
+			require.Equal(t, "1650003600000", stored.TimeTo)
+
+			got, err := sc.service.getQuery(context.Background(), sc.reqContext.SignedInUser, dto.UID)
+			require.NoError(t, err)
+			require.Equal(t, "1650000000000", got.From)
+			require.Equal(t, "1650003600000", got.To)
+
+			result, err := sc.service.searchQueries(context.Background(), sc.reqContext.SignedInUser, SearchInQueryHistoryQuery{
+				DatasourceUIDs: []string{"NCzh67i"},
+			})
+			require.NoError(t, err)
+			require.Len(t, result.QueryHistory, 1)
+			require.Equal(t, "1650000000000", result.QueryHistory[0].From)
+			require.Equal(t, "1650003600000", result.QueryHistory[0].To)
+		})
+
+	testScenario(t, "When users create a query with a relative time range, it should be returned unchanged",
+		func(t *testing.T, sc scenarioContext) {
+			dto, err := createWithTimeRange(t, sc, "now-24h", "now-1h")
+			require.NoError(t, err)
+
+			got, err := sc.service.getQuery(context.Background(), sc.reqContext.SignedInUser, dto.UID)
+			require.NoError(t, err)
+			require.Equal(t, "now-24h", got.From)
+			require.Equal(t, "now-1h", got.To)
+		})
+
+	testScenario(t, "When users create a query with only one end of a time range, it should fail",
+		func(t *testing.T, sc scenarioContext) {
+			_, err := createWithTimeRange(t, sc, "now-6h", "")
+			require.True(t, errors.Is(err, ErrInvalidTimeRange))
+
+			sc.reqContext.Req.Body = mockRequestBody(CreateQueryInQueryHistoryCommand{
+				DatasourceUID: "NCzh67i",
+				Queries:       simplejson.NewFromAny(map[string]interface{}{"expr": "test"}),
+				To:            "now",
+			})
+			resp := sc.service.createHandler(sc.reqContext)
+			require.Equal(t, 400, resp.Status())
+		})
+
+	testScenario(t, "When a query was stored without a time range, the default time range should be returned",
+		func(t *testing.T, sc scenarioContext) {
+			user := sc.reqContext.SignedInUser
+			err := sc.sqlStore.WithDbSession(context.Background(), func(session *sqlstore.DBSession) error {
+				_, err := session.Insert(&QueryHistory{
+					UID:           "legacy",
+					OrgID:         user.OrgId,
+					DatasourceUID: "NCzh67i",
+					CreatedBy:     user.UserId,
+					CreatedAt:     time.Now().Unix(),
+					Queries:       simplejson.NewFromAny(map[string]interface{}{"expr": "test"}),
+				})
+				return err
+			})
+			require.NoError(t, err)
+
+			got, err := sc.service.getQuery(context.Background(), user, "legacy")
+			require.NoError(t, err)
+			require.Equal(t, DefaultTimeFrom, got.From)
+			require.Equal(t, DefaultTimeTo, got.To)
+
+			result, err := sc.service.searchQueries(context.Background(), user, SearchInQueryHistoryQuery{
+				DatasourceUIDs: []string{"NCzh67i"},
+			})
+			require.NoError(t, err)
+			require.Len(t, result.QueryHistory, 1)
+			require.Equal(t, DefaultTimeFrom, result.QueryHistory[0].From)
+			require.Equal(t, DefaultTimeTo, result.QueryHistory[0].To)
+		})
+}
@@ -0,0 +1,71 @@
+package queryhistory
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana/pkg/services/sqlstore"
+	"github.com/stretchr/testify/require"
+)
+
+func TestQueryHistoryDatabaseTimeout(t *testing.T) {
+	testScenario(t, "When the database doesn't answer before the deadline, it should fail with a timeout",
+		func(t *testing.T, sc scenarioContext) {
+			sc.service.Cfg.QueryHistoryDBTimeout = 20 * time.Millisecond
+			sc.service.sessions = &sleepingStore{delay: time.Minute}
+
+			start := time.Now()
+			_, err := sc.service.SearchInQueryHistory(context.Background(), sc.reqContext.SignedInUser, SearchInQueryHistoryQuery{AllDatasources: true})
+			require.True(t, errors.Is(err, ErrDatabaseTimeout))
+			require.Less(t, time.Since(start), 10*time.Second)
+
+			_, err = sc.service.StarQueryInQueryHistory(context.Background(), sc.reqContext.SignedInUser, "uid", StarQueryInQueryHistoryCommand{})
+			require.True(t, errors.Is(err, ErrDatabaseTimeout))
+
+			sc.reqContext.Req.Form = url.Values{"allDatasources": []string{"true"}}
+			resp := sc.service.searchHandler(sc.reqContext)
+			require.Equal(t, 504, resp.Status())
+		})
+
+	testScenario(t, "When the database answers before the deadline, it should succeed",
+		func(t *testing.T, sc scenarioContext) {
+			sc.service.Cfg.QueryHistoryDBTimeout = time.Minute
+			sc.service.sessions = &sleepingStore{store: sc.sqlStore, delay: time.Millisecond}
+
+			_, err := sc.service.SearchInQueryHistory(context.Background(), sc.reqContext.SignedInUser, SearchInQueryHistoryQuery{AllDatasources: true})
+			require.NoError(t, err)
+		})
+}
+
+// sleepingStore delays the sessions of store, or fails them with the error of
+// their context when it's done first.
+type sleepingStore struct {
+	store *sqlstore.SQLStore
+	delay time.Duration
+}
+
+func (s *sleepingStore) sleep(ctx context.Context) error {
+	select {
+	case <-time.After(s.delay):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (s *sleepingStore) WithDbSession(ctx context.Context, callback sqlstore.DBTransactionFunc) error {
+	if err := s.sleep(ctx); err != nil {
+		return err
+	}
+	return s.store.WithDbSession(ctx, callback)
+}
+
+func (s *sleepingStore) WithTransactionalDbSession(ctx context.Context, callback sqlstore.DBTransactionFunc) error {
+	if err := s.sleep(ctx); err != nil {
+		return err
+	}
+	return s.store.WithTransactionalDbSession(ctx, callback)
+}
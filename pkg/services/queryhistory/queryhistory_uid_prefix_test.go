@@ -0,0 +1,112 @@
+package queryhistory
+
+import (
+	"context"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana/pkg/components/simplejson"
+	"github.com/grafana/grafana/pkg/services/sqlstore"
+	"github.com/grafana/grafana/pkg/services/sqlstore/migrator"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSearchInQueryHistoryByUIDPrefix(t *testing.T) {
+	seed := func(t *testing.T, sc scenarioContext, uids ...string) {
+		t.Helper()
+		user := sc.reqContext.SignedInUser
+		err := sc.sqlStore.WithDbSession(context.Background(), func(session *sqlstore.DBSession) error {
+			for _, uid := range uids {
+				_, err := session.Insert(&QueryHistory{
+					UID:           uid,
+					OrgID:         user.OrgId,
+					DatasourceUID: "NCzh67i",
+					CreatedBy:     user.UserId,
+					CreatedAt:     time.Now().Unix(),
+					Queries:       simplejson.NewFromAny(map[string]interface{}{"expr": "test"}),
+				})
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		require.NoError(t, err)
+	}
+
+	testScenarioWithQueryInQueryHistory(t, "When users search query history by UID prefix, it should only return the queries with the prefix",
+		func(t *testing.T, sc scenarioContext) {
+			seed(t, sc, "shard1-a", "shard1-b", "shard10-a", "shard2-a", "xshard1-a", "shard1_c", "Shard1-d")
+
+			for prefix, expected := range map[string][]string{
+				"shard1-": {"shard1-a", "shard1-b"},
+				"shard1":  {"shard1-a", "shard1-b", "shard10-a", "shard1_c"},
+				"shard1_": {"shard1_c"},
+				"Shard1":  {"Shard1-d"},
+				"SHARD1":  {},
+				"shard3":  {},
+			} {
+				sc.reqContext.Req.Form = url.Values{"datasourceUid": []string{"NCzh67i"}, "uidsOnly": []string{"true"}, "uidPrefix": []string{prefix}}
+				resp := sc.service.searchHandler(sc.reqContext)
+				result := validateAndUnMarshalSearchResponse(t, resp.Status(), resp.Body())
+				require.ElementsMatch(t, expected, result.Result.UIDs, prefix)
+				require.Equal(t, int64(len(expected)), result.Result.TotalCount, prefix)
+			}
+
+			sc.reqContext.Req.Form = url.Values{"datasourceUid": []string{"NCzh67i"}, "uidPrefix": []string{"shard2"}}
+			resp := sc.service.searchHandler(sc.reqContext)
+			result := validateAndUnMarshalSearchResponse(t, resp.Status(), resp.Body())
+			require.Len(t, result.Result.QueryHistory, 1)
+			require.Equal(t, "shard2-a", result.Result.QueryHistory[0].UID)
+		})
+
+	testScenarioWithQueryInQueryHistory(t, "When users search query history without UID prefix, it should return every query",
+		func(t *testing.T, sc scenarioContext) {
+			seed(t, sc, "shard1-a", "shard2-a")
+
+			sc.reqContext.Req.Form = url.Values{"datasourceUid": []string{"NCzh67i"}}
+			resp := sc.service.searchHandler(sc.reqContext)
+			result := validateAndUnMarshalSearchResponse(t, resp.Status(), resp.Body())
+			require.Equal(t, int64(3), result.Result.TotalCount)
+		})
+
+	testScenarioWithQueryInQueryHistory(t, "When users search query history by an invalid UID prefix, it should fail",
+		func(t *testing.T, sc scenarioContext) {
+			sc.reqContext.Req.Form = url.Values{"datasourceUid": []string{"NCzh67i"}, "uidPrefix": []string{"shard%"}}
+			resp := sc.service.searchHandler(sc.reqContext)
+			require.Equal(t, 400, resp.Status())
+		})
+}
+
+func TestUIDPrefixFilter(t *testing.T) {
+	tests := []struct {
+		driverName string
+		condition  string
+		params     []interface{}
+	}{
+		{
+			driverName: migrator.MySQL,
+			condition:  `query_history.uid LIKE CAST(? AS BINARY) ESCAPE '!'`,
+			params:     []interface{}{`a!!b!%c!_d[e*f?%`},
+		},
+		{
+			driverName: migrator.Postgres,
+			condition:  `query_history.uid LIKE ? ESCAPE '!'`,
+			params:     []interface{}{`a!!b!%c!_d[e*f?%`},
+		},
+		{
+			driverName: migrator.SQLite,
+			condition:  `query_history.uid GLOB ?`,
+			params:     []interface{}{`a!b%c_d[[]e[*]f[?]*`},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.driverName, func(t *testing.T) {
+			condition, params := uidPrefixFilter(tt.driverName, "a!b%c_d[e*f?")
+			require.Equal(t, tt.condition, condition)
+			require.Equal(t, tt.params, params)
+		})
+	}
+}
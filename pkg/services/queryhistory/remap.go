@@ -0,0 +1,134 @@
+package queryhistory
+
+import (
+	"context"
+
+	"github.com/grafana/grafana/pkg/services/sqlstore"
+)
+
+// remapBatchSize is the number of queries read and updated per transaction
+// when a data source is remapped.
+const remapBatchSize = 500
+
+// remapDatasource points the queries of the organization referencing the data
+// source with oldUID to newUID, both in their datasource_uid column and in the
+// data source references of their queries. The queries are updated in batches,
+// each in its own transaction, so that the whole query history is not locked.
+// It returns the number of updated queries and the users owning them.
+func (s QueryHistoryService) remapDatasource(ctx context.Context, orgID int64, oldUID, newUID string) (int64, []int64, error) {
+	if !isValidDatasourceUID(oldUID) || !isValidDatasourceUID(newUID) {
+		return 0, nil, ErrQueryHistoryInvalidDatasource
+	}
+	if oldUID == newUID {
+		return 0, nil, nil
+	}
+
+	var count int64
+	owners := map[int64]bool{}
+	var lastID int64
+	for {
+		var batch []QueryHistory
+		err := s.withTransactionalDbSession(ctx, func(session *sqlstore.DBSession) error {
+			// Compressed queries can't be matched in the database, they are
+			// always read.
+			err := session.Where("org_id = ? AND id > ?", orgID, lastID).
+				And("(datasource_uid = ? OR compressed = ? OR queries "+s.SQLStore.Dialect.LikeStr()+" ?)", oldUID, true, "%"+oldUID+"%").
+				Asc("id").Limit(remapBatchSize).Find(&batch)
+			if err != nil {
+				return err
+			}
+
+			for _, queryHistory := range batch {
+				updated, err := s.remapQueryDatasource(session, queryHistory, oldUID, newUID)
+				if err != nil {
+					return err
+				}
+				if updated {
+					count++
+					owners[queryHistory.CreatedBy] = true
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return count, ownerIDs(owners), err
+		}
+		if len(batch) < remapBatchSize {
+			return count, ownerIDs(owners), nil
+		}
+		lastID = batch[len(batch)-1].ID
+	}
+}
+
+// remapQueryDatasource updates a query referencing the data source with
+// oldUID, it returns whether the query was updated.
+func (s QueryHistoryService) remapQueryDatasource(session *sqlstore.DBSession, queryHistory QueryHistory, oldUID, newUID string) (bool, error) {
+	if err := queryHistory.decompress(); err != nil {
+		return false, err
+	}
+
+	updated := false
+	if queryHistory.DatasourceUID == oldUID {
+		queryHistory.DatasourceUID = newUID
+		updated = true
+	}
+	if queryHistory.Queries != nil && remapDatasourceRefs(queryHistory.Queries.Interface(), oldUID, newUID) {
+		updated = true
+	}
+	if !updated {
+		return false, nil
+	}
+
+	storedQueries, compressed, err := compressQueries(queryHistory.Queries, s.Cfg.QueryHistoryCompressThreshold)
+	if err != nil {
+		return false, err
+	}
+	queryHistory.Queries = storedQueries
+	queryHistory.Compressed = compressed
+	queryHistory.UpdatedAt = nextUpdatedAt(queryHistory.UpdatedAt)
+	_, err = session.ID(queryHistory.ID).Cols("datasource_uid", "queries", "compressed", "updated_at").Update(&queryHistory)
+	return err == nil, err
+}
+
+// remapDatasourceRefs replaces, in place, the references to the data source
+// with oldUID in the JSON value v: the datasource properties holding either
+// the UID or an object with the UID, and the datasourceUid properties. It
+// returns whether a reference was replaced.
+func remapDatasourceRefs(v interface{}, oldUID, newUID string) bool {
+	remapped := false
+	switch value := v.(type) {
+	case map[string]interface{}:
+		for key, child := range value {
+			switch ref := child.(type) {
+			case string:
+				if (key == "datasource" || key == "datasourceUid") && ref == oldUID {
+					value[key] = newUID
+					remapped = true
+				}
+			case map[string]interface{}:
+				if key == "datasource" && ref["uid"] == oldUID {
+					ref["uid"] = newUID
+					remapped = true
+				}
+			}
+			if remapDatasourceRefs(child, oldUID, newUID) {
+				remapped = true
+			}
+		}
+	case []interface{}:
+		for _, child := range value {
+			if remapDatasourceRefs(child, oldUID, newUID) {
+				remapped = true
+			}
+		}
+	}
+	return remapped
+}
+
+func ownerIDs(owners map[int64]bool) []int64 {
+	ids := make([]int64, 0, len(owners))
+	for id := range owners {
+		ids = append(ids, id)
+	}
+	return ids
+}
@@ -0,0 +1,151 @@
+package queryhistory
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/grafana/grafana/pkg/models"
+	lru "github.com/hashicorp/golang-lru"
+)
+
+type searchCacheEntry struct {
+	result  QueryHistorySearchResult
+	expires time.Time
+}
+
+// searchCache is an in-memory LRU cache of the search results, keyed by user.
+// A nil searchCache caches nothing.
+type searchCache struct {
+	mu    sync.Mutex
+	cache *lru.Cache
+	ttl   time.Duration
+	now   func() time.Time
+	// generation is incremented on every invalidation so that the results of
+	// searches that ran concurrently with a write are not cached.
+	generation uint64
+}
+
+// newSearchCache returns a cache of at most maxEntries search results, or nil
+// when ttl is zero.
+func newSearchCache(ttl time.Duration, maxEntries int) (*searchCache, error) {
+	if ttl <= 0 {
+		return nil, nil
+	}
+	cache, err := lru.New(maxEntries)
+	if err != nil {
+		return nil, err
+	}
+	return &searchCache{cache: cache, ttl: ttl, now: time.Now}, nil
+}
+
+// searchCacheKey returns the key of a search of the user. The query must have
+// its defaults set, the data sources and terms are sorted so that the same
+// search in a different order hits the cache.
+func searchCacheKey(user *models.SignedInUser, query SearchInQueryHistoryQuery) (string, error) {
+	if query.AllDatasources {
+		query.DatasourceUIDs = nil
+	} else {
+		query.DatasourceUIDs = sortedCopy(query.DatasourceUIDs)
+	}
+	query.SearchTerms = sortedCopy(query.SearchTerms)
+
+	b, err := json.Marshal(query)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s%d/%s", searchCacheUserPrefix(user.UserId), user.OrgId, b), nil
+}
+
+func searchCacheUserPrefix(userID int64) string {
+	return fmt.Sprintf("%d/", userID)
+}
+
+func sortedCopy(values []string) []string {
+	if len(values) == 0 {
+		return nil
+	}
+	sorted := append([]string(nil), values...)
+	sort.Strings(sorted)
+	return sorted
+}
+
+// get returns the cached result of a search, and the generation of the cache
+// to pass to set when there is none.
+func (c *searchCache) get(key string) (QueryHistorySearchResult, uint64, bool) {
+	if c == nil {
+		return QueryHistorySearchResult{}, 0, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	v, ok := c.cache.Get(key)
+	if !ok {
+		return QueryHistorySearchResult{}, c.generation, false
+	}
+	entry := v.(searchCacheEntry)
+	if !c.now().Before(entry.expires) {
+		c.cache.Remove(key)
+		return QueryHistorySearchResult{}, c.generation, false
+	}
+	return copySearchResult(entry.result), 0, true
+}
+
+// set caches the result of a search, unless the cache was invalidated since
+// the generation returned by get.
+func (c *searchCache) set(key string, generation uint64, result QueryHistorySearchResult) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if generation != c.generation {
+		return
+	}
+	c.cache.Add(key, searchCacheEntry{result: copySearchResult(result), expires: c.now().Add(c.ttl)})
+}
+
+// invalidate removes the cached search results of the users.
+func (c *searchCache) invalidate(userIDs ...int64) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.generation++
+	for _, k := range c.cache.Keys() {
+		key := k.(string)
+		for _, userID := range userIDs {
+			if strings.HasPrefix(key, searchCacheUserPrefix(userID)) {
+				c.cache.Remove(key)
+				break
+			}
+		}
+	}
+}
+
+// copySearchResult copies the slices of a search result, so that callers
+// can't modify the cached one.
+func copySearchResult(result QueryHistorySearchResult) QueryHistorySearchResult {
+	if result.QueryHistory != nil {
+		result.QueryHistory = append([]QueryHistoryDTO{}, result.QueryHistory...)
+	}
+	if result.UIDs != nil {
+		result.UIDs = append([]string(nil), result.UIDs...)
+	}
+	if result.Groups != nil {
+		groups := make([]QueryHistoryDatasourceGroup, len(result.Groups))
+		for i, group := range result.Groups {
+			copied := copySearchResult(QueryHistorySearchResult{QueryHistory: group.QueryHistory, UIDs: group.UIDs})
+			group.QueryHistory, group.UIDs = copied.QueryHistory, copied.UIDs
+			groups[i] = group
+		}
+		result.Groups = groups
+	}
+	return result
+}
@@ -0,0 +1,55 @@
+package queryhistory
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/grafana/grafana/pkg/services/sqlstore"
+)
+
+// sessionStore runs the database sessions of the service, it's the SQL store
+// outside of tests.
+type sessionStore interface {
+	WithDbSession(ctx context.Context, callback sqlstore.DBTransactionFunc) error
+	WithTransactionalDbSession(ctx context.Context, callback sqlstore.DBTransactionFunc) error
+}
+
+func (s QueryHistoryService) sessionStore() sessionStore {
+	if s.sessions != nil {
+		return s.sessions
+	}
+	return s.SQLStore
+}
+
+// withDbSession runs callback in a database session cancelled after the
+// db_timeout setting.
+func (s QueryHistoryService) withDbSession(ctx context.Context, callback sqlstore.DBTransactionFunc) error {
+	ctx, cancel := s.dbContext(ctx)
+	defer cancel()
+	return dbTimeoutError(ctx, s.sessionStore().WithDbSession(ctx, callback))
+}
+
+// withTransactionalDbSession runs callback in a database transaction rolled
+// back after the db_timeout setting.
+func (s QueryHistoryService) withTransactionalDbSession(ctx context.Context, callback sqlstore.DBTransactionFunc) error {
+	ctx, cancel := s.dbContext(ctx)
+	defer cancel()
+	return dbTimeoutError(ctx, s.sessionStore().WithTransactionalDbSession(ctx, callback))
+}
+
+func (s QueryHistoryService) dbContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if s.Cfg == nil || s.Cfg.QueryHistoryDBTimeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, s.Cfg.QueryHistoryDBTimeout)
+}
+
+// dbTimeoutError returns ErrDatabaseTimeout when the session failed because
+// its deadline was exceeded, the drivers don't all return the context error.
+func dbTimeoutError(ctx context.Context, err error) error {
+	if err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("%w: %v", ErrDatabaseTimeout, err)
+	}
+	return err
+}
@@ -0,0 +1,114 @@
+package queryhistory
+
+import (
+	"context"
+
+	"github.com/grafana/grafana/pkg/setting"
+)
+
+const (
+	// settingsKVNamespace is the namespace of the query history settings of
+	// the organizations in the key/value store.
+	settingsKVNamespace = "query_history"
+	defaultSortKey      = "default_sort"
+	defaultSort         = "time-desc"
+	deletedUsersKey     = "deleted_users"
+)
+
+// searchSorts are the supported orderings of the searches.
+var searchSorts = map[string]bool{
+	"time-desc":       true,
+	"time-asc":        true,
+	"commented-first": true,
+}
+
+// deletedUsersPolicies are the supported handlings of the queries of deleted
+// users.
+var deletedUsersPolicies = map[string]bool{
+	setting.QueryHistoryDeletedUsersDelete:    true,
+	setting.QueryHistoryDeletedUsersAnonymize: true,
+}
+
+// orgDefaultSort returns the sort of the searches of the organization without
+// one. It's time-desc unless the organization configured another one, invalid
+// configured values are ignored.
+func (s QueryHistoryService) orgDefaultSort(ctx context.Context, orgID int64) string {
+	if s.KVStore == nil {
+		return defaultSort
+	}
+	value, ok, err := s.KVStore.Get(ctx, orgID, settingsKVNamespace, defaultSortKey)
+	if err != nil {
+		s.log.Warn("Failed to read the default sort of the query history", "org", orgID, "error", err)
+		return defaultSort
+	}
+	if !ok || value == "" {
+		return defaultSort
+	}
+	if !searchSorts[value] {
+		s.log.Warn("Ignoring invalid default sort of the query history", "org", orgID, "sort", value)
+		return defaultSort
+	}
+	return value
+}
+
+// orgDeletedUsersPolicy returns what happens to the queries of the deleted
+// users in the organization. It's the deleted_users setting unless the
+// organization configured another policy, invalid configured values are
+// ignored.
+func (s QueryHistoryService) orgDeletedUsersPolicy(ctx context.Context, orgID int64) string {
+	if s.KVStore == nil {
+		return s.Cfg.QueryHistoryDeletedUsers
+	}
+	value, ok, err := s.KVStore.Get(ctx, orgID, settingsKVNamespace, deletedUsersKey)
+	if err != nil {
+		s.log.Warn("Failed to read the deleted users policy of the query history", "org", orgID, "error", err)
+		return s.Cfg.QueryHistoryDeletedUsers
+	}
+	if !ok || value == "" {
+		return s.Cfg.QueryHistoryDeletedUsers
+	}
+	if !deletedUsersPolicies[value] {
+		s.log.Warn("Ignoring invalid deleted users policy of the query history", "org", orgID, "policy", value)
+		return s.Cfg.QueryHistoryDeletedUsers
+	}
+	return value
+}
+
+func (s QueryHistoryService) getSettings(ctx context.Context, orgID int64) QueryHistorySettings {
+	return QueryHistorySettings{
+		DefaultSort:  s.orgDefaultSort(ctx, orgID),
+		DeletedUsers: s.orgDeletedUsersPolicy(ctx, orgID),
+	}
+}
+
+// updateSettings stores the settings of the organization, an empty default
+// sort restores time-desc and an empty deleted users policy restores the
+// deleted_users setting.
+func (s QueryHistoryService) updateSettings(ctx context.Context, orgID int64, cmd QueryHistorySettings) (QueryHistorySettings, error) {
+	if cmd.DefaultSort != "" && !searchSorts[cmd.DefaultSort] {
+		return QueryHistorySettings{}, ErrInvalidSort
+	}
+	if cmd.DeletedUsers != "" && !deletedUsersPolicies[cmd.DeletedUsers] {
+		return QueryHistorySettings{}, ErrInvalidDeletedUsersPolicy
+	}
+	if s.KVStore == nil {
+		return QueryHistorySettings{}, ErrSettingsUnavailable
+	}
+
+	if err := s.storeSetting(ctx, orgID, defaultSortKey, cmd.DefaultSort); err != nil {
+		return QueryHistorySettings{}, err
+	}
+	if err := s.storeSetting(ctx, orgID, deletedUsersKey, cmd.DeletedUsers); err != nil {
+		return QueryHistorySettings{}, err
+	}
+	return s.getSettings(ctx, orgID), nil
+}
+
+// storeSetting stores a setting of the organization, or removes it when value
+// is empty.
+func (s QueryHistoryService) storeSetting(ctx context.Context, orgID int64, key string, value string) error {
+	if value == "" {
+		return s.KVStore.Del(ctx, orgID, settingsKVNamespace, key)
+	}
+	return s.KVStore.Set(ctx, orgID, settingsKVNamespace, key, value)
+}
@@ -0,0 +1,180 @@
+package queryhistory
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/grafana/grafana/pkg/models"
+	"github.com/grafana/grafana/pkg/services/sqlstore"
+	"github.com/grafana/grafana/pkg/services/sqlstore/migrator"
+)
+
+func writeStarredSQL(query SearchInQueryHistoryQuery, sqlStore *sqlstore.SQLStore, builder *sqlstore.SQLBuilder) {
+	if query.OnlyStarred || query.FolderUID != "" {
+		builder.Write(sqlStore.Dialect.BooleanStr(true) + ` AS starred
+			FROM query_history
+			INNER JOIN query_history_star ON query_history_star.query_uid = query_history.uid AND query_history_star.user_id = query_history.created_by
+		`)
+	} else {
+		builder.Write(`CASE WHEN query_history_star.query_uid IS NULL THEN ` + sqlStore.Dialect.BooleanStr(false) + ` ELSE ` + sqlStore.Dialect.BooleanStr(true) + ` END AS starred
+			FROM query_history
+			LEFT JOIN query_history_star ON query_history_star.query_uid = query_history.uid AND query_history_star.user_id = query_history.created_by
+		`)
+	}
+}
+
+// writeUIDsFromSQL writes the FROM clause of a search returning only the UIDs
+// of the queries, which only joins the stars when filtering on them.
+func writeUIDsFromSQL(query SearchInQueryHistoryQuery, builder *sqlstore.SQLBuilder) {
+	builder.Write(` FROM query_history`)
+	if query.OnlyStarred || query.FolderUID != "" {
+		builder.Write(` INNER JOIN query_history_star ON query_history_star.query_uid = query_history.uid AND query_history_star.user_id = query_history.created_by`)
+	}
+}
+
+func writeFiltersSQL(query SearchInQueryHistoryQuery, user *models.SignedInUser, sqlStore *sqlstore.SQLStore, builder *sqlstore.SQLBuilder) {
+	builder.Write(` WHERE query_history.org_id = ? AND query_history.created_by = ?`, user.OrgId, user.UserId)
+
+	writeContentFiltersSQL(query, sqlStore, builder)
+
+	if query.FolderUID != "" {
+		builder.Write(` AND query_history_star.folder_id IN (SELECT id FROM query_history_folder WHERE org_id = ? AND user_id = ? AND uid = ?)`,
+			user.OrgId, user.UserId, query.FolderUID)
+	}
+
+	if query.UIDPrefix != "" {
+		condition, params := uidPrefixFilter(sqlStore.Dialect.DriverName(), query.UIDPrefix)
+		builder.Write(` AND `+condition, params...)
+	}
+
+	if !query.AllDatasources && len(query.DatasourceUIDs) > 0 {
+		uids := query.DatasourceUIDs
+		if query.IncludeMixed {
+			uids = append(append([]string{}, uids...), mixedDatasourceUID)
+		}
+		builder.Write(` AND query_history.datasource_uid IN (?` + strings.Repeat(",?", len(uids)-1) + `)`)
+		for _, uid := range uids {
+			builder.AddParams(uid)
+		}
+	}
+}
+
+// writeContentFiltersSQL writes the filters on the search terms and the query
+// type. The database can only match the content of the uncompressed queries,
+// the compressed ones are matched by UID once decompressed.
+func writeContentFiltersSQL(query SearchInQueryHistoryQuery, sqlStore *sqlstore.SQLStore, builder *sqlstore.SQLBuilder) {
+	if !hasContentFilters(query) {
+		return
+	}
+
+	builder.Write(` AND ((query_history.compressed = ?`, false)
+	if terms := searchTerms(query); len(terms) > 0 {
+		conditions := make([]string, 0, len(terms))
+		for _, term := range terms {
+			conditions = append(conditions, `(query_history.queries `+sqlStore.Dialect.LikeStr()+` ? OR query_history.comment `+sqlStore.Dialect.LikeStr()+` ?)`)
+			builder.AddParams("%"+term+"%", "%"+term+"%")
+		}
+		builder.Write(` AND (` + strings.Join(conditions, ` `+strings.ToUpper(query.SearchOperator)+` `) + `)`)
+	}
+	if query.QueryType != "" {
+		condition, params := queryTypeFilter(sqlStore.Dialect.DriverName(), sqlStore.Dialect.LikeStr(), query.QueryType)
+		builder.Write(` AND `+condition, params...)
+	}
+	builder.Write(`)`)
+
+	if len(query.compressedMatches) > 0 {
+		builder.Write(` OR query_history.uid IN (?` + strings.Repeat(",?", len(query.compressedMatches)-1) + `)`)
+		for _, uid := range query.compressedMatches {
+			builder.AddParams(uid)
+		}
+	}
+	builder.Write(`)`)
+}
+
+// hasContentFilters reports whether the search filters on the content of the
+// queries.
+func hasContentFilters(query SearchInQueryHistoryQuery) bool {
+	return len(searchTerms(query)) > 0 || query.QueryType != ""
+}
+
+var (
+	likeEscaper = strings.NewReplacer("!", "!!", "%", "!%", "_", "!_")
+	globEscaper = strings.NewReplacer("[", "[[]", "*", "[*]", "?", "[?]")
+)
+
+// uidPrefixFilter returns the condition matching the queries whose UID starts
+// with prefix. UIDs are case-sensitive, the match is made case-sensitive on
+// every database: LIKE is binary on MySQL and replaced by GLOB on SQLite, it's
+// already case-sensitive on Postgres. Every condition can use the org_id-uid
+// index, unlike the ILIKE of the Postgres dialect.
+func uidPrefixFilter(driverName string, prefix string) (string, []interface{}) {
+	switch driverName {
+	case migrator.MySQL:
+		return `query_history.uid LIKE CAST(? AS BINARY) ESCAPE '!'`, []interface{}{likeEscaper.Replace(prefix) + "%"}
+	case migrator.SQLite:
+		return `query_history.uid GLOB ?`, []interface{}{globEscaper.Replace(prefix) + "*"}
+	default:
+		return `query_history.uid LIKE ? ESCAPE '!'`, []interface{}{likeEscaper.Replace(prefix) + "%"}
+	}
+}
+
+// queryTypeFilter returns the condition matching the queries with the given
+// queryType field. The stored queries are a list of query objects, or a single
+// query object. The field is extracted from the JSON on MySQL and Postgres,
+// other databases match the serialized field with LIKE.
+func queryTypeFilter(driverName string, likeStr string, queryType string) (string, []interface{}) {
+	field, _ := json.Marshal(map[string]string{"queryType": queryType})
+
+	switch driverName {
+	case migrator.MySQL:
+		// A candidate object is contained in an array when one of its elements contains it.
+		return `JSON_CONTAINS(query_history.queries, ?)`, []interface{}{string(field)}
+	case migrator.Postgres:
+		return `(query_history.queries::jsonb @> ?::jsonb OR query_history.queries::jsonb @> ?::jsonb)`,
+			[]interface{}{"[" + string(field) + "]", string(field)}
+	default:
+		value, _ := json.Marshal(queryType)
+		return `query_history.queries ` + likeStr + ` ?`, []interface{}{`%"queryType":` + string(value) + `%`}
+	}
+}
+
+// searchTerms returns the non-empty search terms of the query, the search string
+// being a shorthand for a single term.
+func searchTerms(query SearchInQueryHistoryQuery) []string {
+	terms := make([]string, 0, len(query.SearchTerms)+1)
+	if query.SearchString != "" {
+		terms = append(terms, query.SearchString)
+	}
+	for _, term := range query.SearchTerms {
+		if term != "" {
+			terms = append(terms, term)
+		}
+	}
+	return terms
+}
+
+func writeSortSQL(query SearchInQueryHistoryQuery, builder *sqlstore.SQLBuilder) {
+	switch query.Sort {
+	case "time-asc":
+		builder.Write(` ORDER BY query_history.created_at ASC, query_history.id ASC`)
+	case "commented-first":
+		// Boolean expressions can't be sorted on every database, rank the rows with a CASE instead.
+		builder.Write(` ORDER BY CASE WHEN query_history.comment IS NULL OR query_history.comment = '' THEN 1 ELSE 0 END ASC,
+			query_history.created_at DESC, query_history.id DESC`)
+	default:
+		builder.Write(` ORDER BY query_history.created_at DESC, query_history.id DESC`)
+	}
+}
+
+func writeLimitSQL(query SearchInQueryHistoryQuery, sqlStore *sqlstore.SQLStore, builder *sqlstore.SQLBuilder) {
+	builder.Write(sqlStore.Dialect.LimitOffset(int64(query.Limit), int64(query.Limit*(query.Page-1))))
+}
+
+// integerDivision returns the SQL expression of the integer division of two
+// integer operands, as MySQL returns a decimal for the division operator.
+func integerDivision(driverName string, dividend string, divisor string) string {
+	if driverName == migrator.MySQL {
+		return dividend + " DIV " + divisor
+	}
+	return dividend + " / " + divisor
+}
@@ -196,6 +196,11 @@ func (qs *QuotaService) getQuotaScopes(target string) ([]models.QuotaScope, erro
 			models.QuotaScope{Name: "org", Target: target, DefaultLimit: qs.Cfg.Quota.Org.AlertRule},
 		)
 		return scopes, nil
+	case "query_history":
+		scopes = append(scopes,
+			models.QuotaScope{Name: "user", Target: target, DefaultLimit: qs.Cfg.Quota.User.QueryHistory},
+		)
+		return scopes, nil
 	default:
 		return scopes, ErrInvalidQuotaTarget
 	}
@@ -6,16 +6,27 @@ import (
 	"github.com/grafana/grafana/pkg/services/secrets"
 )
 
-type FakeSecretsService struct{}
+type FakeSecretsService struct {
+	decryptErr error
+}
 
 func NewFakeSecretsService() FakeSecretsService {
 	return FakeSecretsService{}
 }
 
+// NewFakeSecretsServiceWithDecryptError returns a fake secrets service failing
+// to decrypt any payload with err, as when the secret key has changed.
+func NewFakeSecretsServiceWithDecryptError(err error) FakeSecretsService {
+	return FakeSecretsService{decryptErr: err}
+}
+
 func (f FakeSecretsService) Encrypt(_ context.Context, payload []byte, _ secrets.EncryptionOptions) ([]byte, error) {
 	return payload, nil
 }
 func (f FakeSecretsService) Decrypt(_ context.Context, payload []byte) ([]byte, error) {
+	if f.decryptErr != nil {
+		return nil, f.decryptErr
+	}
 	return payload, nil
 }
 func (f FakeSecretsService) EncryptJsonData(_ context.Context, kv map[string]string, _ secrets.EncryptionOptions) (map[string][]byte, error) {
@@ -27,6 +38,9 @@ func (f FakeSecretsService) EncryptJsonData(_ context.Context, kv map[string]str
 }
 
 func (f FakeSecretsService) DecryptJsonData(_ context.Context, sjd map[string][]byte) (map[string]string, error) {
+	if f.decryptErr != nil {
+		return nil, f.decryptErr
+	}
 	result := make(map[string]string, len(sjd))
 	for key, value := range sjd {
 		result[key] = string(value)
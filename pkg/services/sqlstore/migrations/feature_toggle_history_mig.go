@@ -0,0 +1,29 @@
+package migrations
+
+import (
+	. "github.com/grafana/grafana/pkg/services/sqlstore/migrator"
+)
+
+func addFeatureToggleHistoryMigrations(mg *Migrator) {
+	featureToggleHistoryV1 := Table{
+		Name: "feature_toggle_history",
+		Columns: []*Column{
+			{Name: "id", Type: DB_BigInt, Nullable: false, IsPrimaryKey: true, IsAutoIncrement: true},
+			{Name: "org_id", Type: DB_BigInt, Nullable: false},
+			{Name: "scope", Type: DB_NVarchar, Length: 20, Nullable: false},
+			{Name: "flag", Type: DB_NVarchar, Length: 190, Nullable: false},
+			{Name: "user_id", Type: DB_BigInt, Nullable: false},
+			{Name: "actor", Type: DB_NVarchar, Length: 190, Nullable: false},
+			{Name: "old_value", Type: DB_Bool, Nullable: false},
+			{Name: "new_value", Type: DB_Bool, Nullable: false},
+			{Name: "created", Type: DB_DateTime, Nullable: false},
+		},
+		Indices: []*Index{
+			{Cols: []string{"flag"}},
+		},
+	}
+
+	mg.AddMigration("create feature_toggle_history table v1", NewAddTableMigration(featureToggleHistoryV1))
+
+	mg.AddMigration("add index feature_toggle_history.flag", NewAddIndexMigration(featureToggleHistoryV1, featureToggleHistoryV1.Indices[0]))
+}
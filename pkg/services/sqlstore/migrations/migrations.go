@@ -80,6 +80,8 @@ func (*OSSMigrations) AddMigration(mg *Migrator) {
 		}
 	}
 	addQueryHistoryStarMigrations(mg)
+	addQueryHistoryFolderMigrations(mg)
+	addFeatureToggleHistoryMigrations(mg)
 
 	if mg.Cfg != nil && mg.Cfg.IsFeatureToggleEnabled != nil {
 		if mg.Cfg.IsFeatureToggleEnabled(featuremgmt.FlagDashboardComments) || mg.Cfg.IsFeatureToggleEnabled(featuremgmt.FlagAnnotationComments) {
@@ -0,0 +1,28 @@
+package migrations
+
+import (
+	. "github.com/grafana/grafana/pkg/services/sqlstore/migrator"
+)
+
+func addQueryHistoryFolderMigrations(mg *Migrator) {
+	queryHistoryFolderV1 := Table{
+		Name: "query_history_folder",
+		Columns: []*Column{
+			{Name: "id", Type: DB_BigInt, Nullable: false, IsPrimaryKey: true, IsAutoIncrement: true},
+			{Name: "uid", Type: DB_NVarchar, Length: 40, Nullable: false},
+			{Name: "org_id", Type: DB_BigInt, Nullable: false},
+			{Name: "user_id", Type: DB_Int, Nullable: false},
+			{Name: "name", Type: DB_NVarchar, Length: 190, Nullable: false},
+			{Name: "created_at", Type: DB_Int, Nullable: false},
+		},
+		Indices: []*Index{
+			{Cols: []string{"org_id", "user_id", "name"}, Type: UniqueIndex},
+			{Cols: []string{"uid"}, Type: UniqueIndex},
+		},
+	}
+
+	mg.AddMigration("create query_history_folder table v1", NewAddTableMigration(queryHistoryFolderV1))
+
+	mg.AddMigration("add unique index query_history_folder.org_id-user_id-name", NewAddIndexMigration(queryHistoryFolderV1, queryHistoryFolderV1.Indices[0]))
+	mg.AddMigration("add unique index query_history_folder.uid", NewAddIndexMigration(queryHistoryFolderV1, queryHistoryFolderV1.Indices[1]))
+}
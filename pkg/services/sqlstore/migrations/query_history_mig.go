@@ -25,4 +25,24 @@ func addQueryHistoryMigrations(mg *Migrator) {
 	mg.AddMigration("create query_history table v1", NewAddTableMigration(queryHistoryV1))
 
 	mg.AddMigration("add index query_history.org_id-created_by-datasource_uid", NewAddIndexMigration(queryHistoryV1, queryHistoryV1.Indices[0]))
+
+	mg.AddMigration("add column time_from to query_history", NewAddColumnMigration(queryHistoryV1, &Column{
+		Name: "time_from", Type: DB_NVarchar, Length: 100, Nullable: true,
+	}))
+
+	mg.AddMigration("add column time_to to query_history", NewAddColumnMigration(queryHistoryV1, &Column{
+		Name: "time_to", Type: DB_NVarchar, Length: 100, Nullable: true,
+	}))
+
+	mg.AddMigration("add column updated_at to query_history", NewAddColumnMigration(queryHistoryV1, &Column{
+		Name: "updated_at", Type: DB_BigInt, Nullable: false, Default: "0",
+	}))
+
+	mg.AddMigration("add column compressed to query_history", NewAddColumnMigration(queryHistoryV1, &Column{
+		Name: "compressed", Type: DB_Bool, Nullable: false, Default: "0",
+	}))
+
+	mg.AddMigration("add index query_history.org_id-uid", NewAddIndexMigration(queryHistoryV1, &Index{
+		Cols: []string{"org_id", "uid"},
+	}))
 }
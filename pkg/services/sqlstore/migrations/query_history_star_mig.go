@@ -20,4 +20,8 @@ func addQueryHistoryStarMigrations(mg *Migrator) {
 	mg.AddMigration("create query_history_star table v1", NewAddTableMigration(queryHistoryStarV1))
 
 	mg.AddMigration("add index query_history.user_id-query_uid", NewAddIndexMigration(queryHistoryStarV1, queryHistoryStarV1.Indices[0]))
+
+	mg.AddMigration("add column folder_id to query_history_star", NewAddColumnMigration(queryHistoryStarV1, &Column{
+		Name: "folder_id", Type: DB_BigInt, Nullable: true,
+	}))
 }
@@ -11,8 +11,9 @@ import (
 )
 
 const (
-	alertRuleTarget = "alert_rule"
-	dashboardTarget = "dashboard"
+	alertRuleTarget    = "alert_rule"
+	dashboardTarget    = "dashboard"
+	queryHistoryTarget = "query_history"
 )
 
 func (ss *SQLStore) addQuotaQueryAndCommandHandlers() {
@@ -165,7 +166,7 @@ func (ss *SQLStore) GetUserQuotaByTarget(ctx context.Context, query *models.GetU
 		var used int64
 		if query.Target != alertRuleTarget || query.UnifiedAlertingEnabled {
 			// get quota used.
-			rawSQL := fmt.Sprintf("SELECT COUNT(*) as count from %s where user_id=?", dialect.Quote(query.Target))
+			rawSQL := userQuotaUsedSQL(query.Target)
 			resp := make([]*targetCount, 0)
 			if err := sess.SQL(rawSQL, query.UserId).Find(&resp); err != nil {
 				return err
@@ -213,7 +214,7 @@ func (ss *SQLStore) GetUserQuotas(ctx context.Context, query *models.GetUserQuot
 			var used int64
 			if q.Target != alertRuleTarget || query.UnifiedAlertingEnabled {
 				// get quota used.
-				rawSQL := fmt.Sprintf("SELECT COUNT(*) as count from %s where user_id=?", dialect.Quote(q.Target))
+				rawSQL := userQuotaUsedSQL(q.Target)
 				resp := make([]*targetCount, 0)
 				if err := sess.SQL(rawSQL, q.UserId).Find(&resp); err != nil {
 					return err
@@ -232,6 +233,16 @@ func (ss *SQLStore) GetUserQuotas(ctx context.Context, query *models.GetUserQuot
 	})
 }
 
+// userQuotaUsedSQL returns the query counting the rows of the target owned by
+// a user, the query history is owned by the user who created it.
+func userQuotaUsedSQL(target string) string {
+	userColumn := "user_id"
+	if target == queryHistoryTarget {
+		userColumn = "created_by"
+	}
+	return fmt.Sprintf("SELECT COUNT(*) as count from %s where %s=?", dialect.Quote(target), userColumn)
+}
+
 func (ss *SQLStore) UpdateUserQuota(ctx context.Context, cmd *models.UpdateUserQuotaCmd) error {
 	return ss.WithTransactionalDbSession(ctx, func(sess *DBSession) error {
 		// Check if quota is already defined in the DB
@@ -186,7 +186,7 @@ func TestQuotaCommandsAndQueries(t *testing.T) {
 			err = sqlStore.GetUserQuotas(context.Background(), &query)
 
 			require.NoError(t, err)
-			require.Len(t, query.Result, 1)
+			require.Len(t, query.Result, 2)
 			require.Equal(t, int64(10), query.Result[0].Limit)
 			require.Equal(t, int64(1), query.Result[0].Used)
 		})
@@ -571,6 +571,7 @@ func (ss *SQLStore) GetSignedInUser(ctx context.Context, query *models.GetSigned
 		u.name           as name,
 		u.help_flags1    as help_flags1,
 		u.last_seen_at   as last_seen_at,
+		u.is_service_account as is_service_account,
 		(SELECT COUNT(*) FROM org_user where org_user.user_id = u.id) as org_count,
 		org.name         as org_name,
 		org_user.role    as org_role,
@@ -791,6 +792,12 @@ func deleteUserInTransaction(sess *DBSession, cmd *models.DeleteUserCommand) err
 			return err
 		}
 	}
+
+	sess.publishAfterCommit(&events.UserDeleted{
+		Timestamp: time.Now(),
+		Id:        user.Id,
+		Login:     user.Login,
+	})
 	return nil
 }
 
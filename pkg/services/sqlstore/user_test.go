@@ -8,6 +8,8 @@ import (
 	"fmt"
 	"testing"
 
+	"github.com/grafana/grafana/pkg/bus"
+	"github.com/grafana/grafana/pkg/events"
 	"github.com/grafana/grafana/pkg/models"
 	"github.com/grafana/grafana/pkg/setting"
 	"github.com/stretchr/testify/require"
@@ -362,6 +364,24 @@ func TestUserDataAccess(t *testing.T) {
 
 	ss = InitTestDB(t)
 
+	t.Run("Testing DB - deleting a user fires an event", func(t *testing.T) {
+		user, err := ss.CreateUser(context.Background(), models.CreateUserCommand{Login: "deleted_user_event"})
+		require.NoError(t, err)
+
+		var deleted *events.UserDeleted
+		bus.AddEventListener(func(ctx context.Context, e *events.UserDeleted) error {
+			deleted = e
+			return nil
+		})
+
+		err = ss.DeleteUser(context.Background(), &models.DeleteUserCommand{UserId: user.Id})
+		require.NoError(t, err)
+
+		require.NotNil(t, deleted)
+		require.Equal(t, user.Id, deleted.Id)
+		require.Equal(t, "deleted_user_event", deleted.Login)
+	})
+
 	t.Run("Testing DB - enable all users", func(t *testing.T) {
 
 		users := createFiveTestUsers(t, ss, func(i int) *models.CreateUserCommand {
@@ -1,15 +1,34 @@
 package validations
 
 import (
+	"context"
 	"net/http"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana/pkg/models"
+	"github.com/grafana/grafana/pkg/setting"
 )
 
-type OSSPluginRequestValidator struct{}
+type OSSPluginRequestValidator struct {
+	queries *queryTargetValidator
+}
 
 func (*OSSPluginRequestValidator) Validate(string, *http.Request) error {
 	return nil
 }
 
-func ProvideValidator() *OSSPluginRequestValidator {
-	return &OSSPluginRequestValidator{}
+// ValidateQueries denies the queries whose target matches the URL scheme,
+// host and method deny-lists of the [query] settings, or resolves to a
+// private IP address when block_private_ips is enabled.
+func (v *OSSPluginRequestValidator) ValidateQueries(ctx context.Context, ds *models.DataSource, queries []backend.DataQuery) error {
+	if v.queries == nil {
+		return nil
+	}
+	return v.queries.validate(ctx, ds, queries)
+}
+
+func ProvideValidator(cfg *setting.Cfg) *OSSPluginRequestValidator {
+	return &OSSPluginRequestValidator{
+		queries: newQueryTargetValidator(cfg),
+	}
 }
@@ -0,0 +1,172 @@
+package validations
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana/pkg/models"
+	"github.com/grafana/grafana/pkg/setting"
+)
+
+// queryTargetValidator checks the targets of the queries sent to data
+// sources against the deny-lists of the [query] settings.
+type queryTargetValidator struct {
+	deniedSchemes   map[string]bool
+	deniedHosts     []string
+	deniedMethods   map[string]bool
+	blockPrivateIPs bool
+
+	// lookupIP resolves the host names of the targets when private IP
+	// addresses are blocked.
+	lookupIP func(ctx context.Context, host string) ([]net.IP, error)
+}
+
+func newQueryTargetValidator(cfg *setting.Cfg) *queryTargetValidator {
+	v := &queryTargetValidator{
+		deniedSchemes: map[string]bool{},
+		deniedMethods: map[string]bool{},
+		lookupIP: func(ctx context.Context, host string) ([]net.IP, error) {
+			return net.DefaultResolver.LookupIP(ctx, "ip", host)
+		},
+	}
+	if cfg == nil {
+		return v
+	}
+	for _, scheme := range cfg.QueryDeniedURLSchemes {
+		v.deniedSchemes[strings.ToLower(scheme)] = true
+	}
+	for _, host := range cfg.QueryDeniedHosts {
+		v.deniedHosts = append(v.deniedHosts, strings.TrimSuffix(strings.ToLower(host), "."))
+	}
+	for _, method := range cfg.QueryDeniedMethods {
+		v.deniedMethods[strings.ToUpper(method)] = true
+	}
+	v.blockPrivateIPs = cfg.QueryBlockPrivateIPs
+	return v
+}
+
+func (v *queryTargetValidator) enabled() bool {
+	return len(v.deniedSchemes) > 0 || len(v.deniedHosts) > 0 || len(v.deniedMethods) > 0 || v.blockPrivateIPs
+}
+
+// queryTargetModel holds the fields HTTP based data sources use to override
+// the URL, the path or the method of the request of a query.
+type queryTargetModel struct {
+	URL    string `json:"url"`
+	Path   string `json:"path"`
+	Method string `json:"method"`
+}
+
+func (v *queryTargetValidator) validate(ctx context.Context, ds *models.DataSource, queries []backend.DataQuery) error {
+	if !v.enabled() {
+		return nil
+	}
+
+	base, err := parseTargetURL(ds.Url)
+	if err != nil {
+		return fmt.Errorf("invalid data source URL: %w", err)
+	}
+	if err := v.check(ctx, base, ""); err != nil {
+		return err
+	}
+
+	for _, q := range queries {
+		var model queryTargetModel
+		if err := json.Unmarshal(q.JSON, &model); err != nil {
+			// Queries that aren't JSON objects can't override the target.
+			continue
+		}
+		target, err := resolveTarget(base, model)
+		if err != nil {
+			return fmt.Errorf("query %s: %w", q.RefID, err)
+		}
+		if err := v.check(ctx, target, model.Method); err != nil {
+			return fmt.Errorf("query %s: %w", q.RefID, err)
+		}
+	}
+	return nil
+}
+
+// check denies the target URL and method when they match the deny-lists.
+// target is nil when the target has no URL.
+func (v *queryTargetValidator) check(ctx context.Context, target *url.URL, method string) error {
+	if method != "" && v.deniedMethods[strings.ToUpper(method)] {
+		return fmt.Errorf("method %s is denied", strings.ToUpper(method))
+	}
+	if target == nil {
+		return nil
+	}
+
+	if scheme := strings.ToLower(target.Scheme); v.deniedSchemes[scheme] {
+		return fmt.Errorf("URL scheme %q is denied", scheme)
+	}
+
+	host := strings.TrimSuffix(strings.ToLower(target.Hostname()), ".")
+	if host == "" {
+		return nil
+	}
+	for _, denied := range v.deniedHosts {
+		if host == denied || strings.HasSuffix(host, "."+denied) {
+			return fmt.Errorf("host %q is denied", host)
+		}
+	}
+
+	if !v.blockPrivateIPs {
+		return nil
+	}
+	ips := []net.IP{net.ParseIP(host)}
+	if ips[0] == nil {
+		// Hosts that can't be resolved are let through, the data source can't
+		// reach them either.
+		ips, _ = v.lookupIP(ctx, host)
+	}
+	for _, ip := range ips {
+		if isPrivateIP(ip) {
+			return fmt.Errorf("host %q is a private IP address", host)
+		}
+	}
+	return nil
+}
+
+// parseTargetURL parses the URL of a data source, which may be a plain
+// host:port for data sources that don't use HTTP.
+func parseTargetURL(raw string) (*url.URL, error) {
+	if raw == "" {
+		return nil, nil
+	}
+	if !strings.Contains(raw, "://") {
+		raw = "//" + raw
+	}
+	return url.Parse(raw)
+}
+
+// resolveTarget returns the URL the query is sent to, resolving the URL and
+// the path of the query against the URL of the data source.
+func resolveTarget(base *url.URL, model queryTargetModel) (*url.URL, error) {
+	target := base
+	for _, ref := range []string{model.URL, model.Path} {
+		if ref == "" {
+			continue
+		}
+		u, err := url.Parse(ref)
+		if err != nil {
+			return nil, fmt.Errorf("invalid URL %q: %w", ref, err)
+		}
+		if target != nil {
+			u = target.ResolveReference(u)
+		}
+		target = u
+	}
+	return target, nil
+}
+
+// isPrivateIP tells whether the IP address is a loopback, link-local,
+// unspecified or private (RFC 1918, RFC 4193) address.
+func isPrivateIP(ip net.IP) bool {
+	return ip.IsPrivate() || ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsUnspecified()
+}
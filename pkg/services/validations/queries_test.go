@@ -0,0 +1,161 @@
+package validations
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana/pkg/models"
+	"github.com/grafana/grafana/pkg/setting"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidateQueries(t *testing.T) {
+	queries := func(jsonModels ...string) []backend.DataQuery {
+		var dqs []backend.DataQuery
+		for i, m := range jsonModels {
+			dqs = append(dqs, backend.DataQuery{RefID: string(rune('A' + i)), JSON: []byte(m)})
+		}
+		return dqs
+	}
+
+	validator := func(cfg *setting.Cfg) *OSSPluginRequestValidator {
+		v := ProvideValidator(cfg)
+		v.queries.lookupIP = func(_ context.Context, host string) ([]net.IP, error) {
+			switch host {
+			case "internal.example.com":
+				return []net.IP{net.ParseIP("10.1.2.3")}, nil
+			case "public.example.com":
+				return []net.IP{net.ParseIP("93.184.216.34")}, nil
+			}
+			return nil, errors.New("no such host")
+		}
+		return v
+	}
+
+	t.Run("it allows everything by default", func(t *testing.T) {
+		v := validator(&setting.Cfg{})
+		ds := &models.DataSource{Url: "http://127.0.0.1:9090"}
+
+		err := v.ValidateQueries(context.Background(), ds, queries(`{"url": "file:///etc/passwd", "method": "DELETE"}`))
+		require.NoError(t, err)
+	})
+
+	t.Run("it allows the hosts that are not denied", func(t *testing.T) {
+		v := validator(&setting.Cfg{
+			QueryDeniedHosts:     []string{"metadata.google.internal", "169.254.169.254"},
+			QueryBlockPrivateIPs: true,
+		})
+		ds := &models.DataSource{Url: "https://public.example.com/api"}
+
+		err := v.ValidateQueries(context.Background(), ds, queries(
+			`{"expr": "up"}`,
+			`{"path": "v1/query"}`,
+			`{"url": "https://93.184.216.34/other"}`,
+			`"not an object"`,
+		))
+		require.NoError(t, err)
+	})
+
+	t.Run("it denies the hosts of the deny-list and their subdomains", func(t *testing.T) {
+		v := validator(&setting.Cfg{QueryDeniedHosts: []string{"metadata.google.internal", "169.254.169.254"}})
+
+		err := v.ValidateQueries(context.Background(), &models.DataSource{Url: "http://169.254.169.254/latest"}, nil)
+		require.EqualError(t, err, `host "169.254.169.254" is denied`)
+
+		err = v.ValidateQueries(context.Background(), &models.DataSource{Url: "https://public.example.com"}, queries(
+			`{"path": "/ok"}`,
+			`{"url": "http://computeMetadata.Metadata.Google.Internal./v1"}`,
+		))
+		require.EqualError(t, err, `query B: host "computemetadata.metadata.google.internal" is denied`)
+	})
+
+	t.Run("it denies the schemes and methods of the deny-lists", func(t *testing.T) {
+		v := validator(&setting.Cfg{QueryDeniedURLSchemes: []string{"file"}, QueryDeniedMethods: []string{"DELETE"}})
+		ds := &models.DataSource{Url: "https://public.example.com"}
+
+		err := v.ValidateQueries(context.Background(), ds, queries(`{"url": "FILE:///etc/passwd"}`))
+		require.EqualError(t, err, `query A: URL scheme "file" is denied`)
+
+		err = v.ValidateQueries(context.Background(), ds, queries(`{"path": "/items/1", "method": "delete"}`))
+		require.EqualError(t, err, `query A: method DELETE is denied`)
+	})
+
+	t.Run("it blocks private IP addresses", func(t *testing.T) {
+		v := validator(&setting.Cfg{QueryBlockPrivateIPs: true})
+
+		for _, dsURL := range []string{
+			"http://10.0.0.1",
+			"http://172.16.5.4:8080",
+			"https://192.168.1.10/prometheus",
+			"http://127.0.0.1:9090",
+			"http://[fd00::1]:3000",
+			"http://169.254.169.254",
+			"192.168.0.5:3306",
+			"http://internal.example.com",
+		} {
+			err := v.ValidateQueries(context.Background(), &models.DataSource{Url: dsURL}, nil)
+			require.Error(t, err, dsURL)
+		}
+
+		for _, dsURL := range []string{"http://172.32.0.1", "http://11.0.0.1", "http://public.example.com", "http://unknown.example.com", ""} {
+			err := v.ValidateQueries(context.Background(), &models.DataSource{Url: dsURL}, nil)
+			require.NoError(t, err, dsURL)
+		}
+	})
+
+	t.Run("it blocks the private IP addresses queries override the target with", func(t *testing.T) {
+		v := validator(&setting.Cfg{QueryBlockPrivateIPs: true})
+		ds := &models.DataSource{Url: "https://public.example.com/api"}
+
+		err := v.ValidateQueries(context.Background(), ds, queries(`{"path": "//192.168.1.1/admin"}`))
+		require.EqualError(t, err, `query A: host "192.168.1.1" is a private IP address`)
+
+		err = v.ValidateQueries(context.Background(), ds, queries(`{"url": "http://internal.example.com/metrics"}`))
+		require.EqualError(t, err, `query A: host "internal.example.com" is a private IP address`)
+	})
+}
+
+// legacyValidator only implements the PluginRequestValidator interface.
+type legacyValidator struct {
+	dsURLs []string
+	err    error
+}
+
+func (v *legacyValidator) Validate(dsURL string, _ *http.Request) error {
+	v.dsURLs = append(v.dsURLs, dsURL)
+	return v.err
+}
+
+func TestAsQueryRequestValidator(t *testing.T) {
+	t.Run("it validates the data source URL with legacy validators", func(t *testing.T) {
+		legacy := &legacyValidator{}
+		v := models.AsQueryRequestValidator(legacy)
+
+		err := v.ValidateQueries(context.Background(), &models.DataSource{Url: "http://localhost:9090"}, []backend.DataQuery{{RefID: "A"}})
+		require.NoError(t, err)
+		require.Equal(t, []string{"http://localhost:9090"}, legacy.dsURLs)
+
+		legacy.err = errors.New("denied")
+		err = v.ValidateQueries(context.Background(), &models.DataSource{Url: "http://localhost:9090"}, nil)
+		require.EqualError(t, err, "denied")
+	})
+
+	t.Run("it uses the query validation of validators implementing it", func(t *testing.T) {
+		v := ProvideValidator(&setting.Cfg{QueryDeniedMethods: []string{"POST"}})
+
+		qv := models.AsQueryRequestValidator(v)
+		require.Same(t, v, qv)
+		err := qv.ValidateQueries(context.Background(), &models.DataSource{}, []backend.DataQuery{{RefID: "A", JSON: []byte(`{"method": "post"}`)}})
+		require.EqualError(t, err, "query A: method POST is denied")
+	})
+
+	t.Run("it allows everything with the zero validator", func(t *testing.T) {
+		qv := models.AsQueryRequestValidator(&OSSPluginRequestValidator{})
+		err := qv.ValidateQueries(context.Background(), &models.DataSource{}, []backend.DataQuery{{RefID: "A", JSON: []byte(`{"method": "post"}`)}})
+		require.NoError(t, err)
+	})
+}
@@ -48,6 +48,12 @@ const (
 	ApplicationName  = "Grafana"
 )
 
+// What happens to the query history of deleted users.
+const (
+	QueryHistoryDeletedUsersDelete    = "delete"
+	QueryHistoryDeletedUsersAnonymize = "anonymize"
+)
+
 // This constant corresponds to the default value for ldap_sync_ttl in .ini files
 // it is used for comparison and has to be kept in sync
 const (
@@ -310,7 +316,12 @@ type Cfg struct {
 	AuthProxySyncTTL          int
 
 	// OAuth
-	OAuthCookieMaxAge int
+	OAuthCookieMaxAge    int
+	OAuthTokenExpirySkew time.Duration
+	// OAuthTokenCacheTTL is how long the OAuth tokens forwarded to data
+	// sources are cached per user, zero disables the cache.
+	OAuthTokenCacheTTL        time.Duration
+	OAuthTokenCacheMaxEntries int
 
 	// JWT Auth
 	JWTAuthEnabled       bool
@@ -338,6 +349,33 @@ type Cfg struct {
 	ResponseLimit                  int64
 	DataProxyRowLimit              int64
 
+	// Query
+	QueryDataSourceMaxConcurrent  int
+	QueryDataSourceMaxPerMinute   int
+	QueryMaxConcurrentDataSources int
+	QueryTimeout                  time.Duration
+	QueryMaxRetries               int
+	QueryRetryBackoff             time.Duration
+	QueryCacheEnabled             bool
+	QueryCacheTTL                 time.Duration
+	QueryCacheMaxEntries          int
+	QueryCacheTimeResolution      time.Duration
+	QueryMaxResponseSize          int64
+	QueryForwardUserIdentity      bool
+	QueryCircuitBreakerFailures   int
+	QueryCircuitBreakerCooldown   time.Duration
+	QueryHealthCheckTTL           time.Duration
+	QueryMinInterval              time.Duration
+	QueryMaxConcurrentRequests    int
+	QueryMaxQueuedRequests        int
+	QueryMaxQueueTime             time.Duration
+	QueryAuditEnabled             bool
+	QueryAuditRedactPatterns      []string
+	QueryDeniedURLSchemes         []string
+	QueryDeniedHosts              []string
+	QueryDeniedMethods            []string
+	QueryBlockPrivateIPs          bool
+
 	// DistributedCache
 	RemoteCacheOptions *RemoteCacheOptions
 
@@ -429,7 +467,25 @@ type Cfg struct {
 	UnifiedAlerting UnifiedAlertingSettings
 
 	// Query history
-	QueryHistoryEnabled bool
+	QueryHistoryEnabled                 bool
+	QueryHistoryMaxQueriesPerDatasource int
+	QueryHistoryDeletedUsers            string
+	// QueryHistoryCompressThreshold is the size in bytes above which the
+	// queries are stored compressed, zero disables compression.
+	QueryHistoryCompressThreshold int
+	// QueryHistorySearchCacheTTL is how long the search results are cached
+	// per user, zero disables the cache.
+	QueryHistorySearchCacheTTL        time.Duration
+	QueryHistorySearchCacheMaxEntries int
+	// QueryHistoryDBTimeout is the deadline of the database requests of the
+	// query history, zero disables it.
+	QueryHistoryDBTimeout time.Duration
+	// QueryHistoryDefaultDatasourceFallback makes the searches without data
+	// source search the queries of the default data source of the org.
+	QueryHistoryDefaultDatasourceFallback bool
+	// QueryHistoryMaintenanceInterval is how often the statistics of the
+	// query history tables are refreshed, zero disables the maintenance.
+	QueryHistoryMaintenanceInterval time.Duration
 }
 
 type CommandLineArgs struct {
@@ -889,6 +945,10 @@ func (cfg *Cfg) Load(args CommandLineArgs) error {
 		return err
 	}
 
+	if err := readQuerySettings(iniFile, cfg); err != nil {
+		return err
+	}
+
 	if err := readSecuritySettings(iniFile, cfg); err != nil {
 		return err
 	}
@@ -945,6 +1005,15 @@ func (cfg *Cfg) Load(args CommandLineArgs) error {
 
 	queryHistory := iniFile.Section("query_history")
 	cfg.QueryHistoryEnabled = queryHistory.Key("enabled").MustBool(false)
+	cfg.QueryHistoryMaxQueriesPerDatasource = queryHistory.Key("max_queries_per_datasource").MustInt(0)
+	cfg.QueryHistoryDeletedUsers = queryHistory.Key("deleted_users").In(QueryHistoryDeletedUsersDelete,
+		[]string{QueryHistoryDeletedUsersDelete, QueryHistoryDeletedUsersAnonymize})
+	cfg.QueryHistoryCompressThreshold = queryHistory.Key("compress_threshold").MustInt(0)
+	cfg.QueryHistorySearchCacheTTL = queryHistory.Key("search_cache_ttl").MustDuration(0)
+	cfg.QueryHistorySearchCacheMaxEntries = queryHistory.Key("search_cache_max_entries").MustInt(1000)
+	cfg.QueryHistoryDBTimeout = queryHistory.Key("db_timeout").MustDuration(30 * time.Second)
+	cfg.QueryHistoryDefaultDatasourceFallback = queryHistory.Key("default_datasource_fallback").MustBool(false)
+	cfg.QueryHistoryMaintenanceInterval = queryHistory.Key("maintenance_interval").MustDuration(0)
 
 	panelsSection := iniFile.Section("panels")
 	cfg.DisableSanitizeHtml = panelsSection.Key("disable_sanitize_html").MustBool(false)
@@ -1253,6 +1322,9 @@ func readAuthSettings(iniFile *ini.File, cfg *Cfg) (err error) {
 	DisableSignoutMenu = auth.Key("disable_signout_menu").MustBool(false)
 	OAuthAutoLogin = auth.Key("oauth_auto_login").MustBool(false)
 	cfg.OAuthCookieMaxAge = auth.Key("oauth_state_cookie_max_age").MustInt(600)
+	cfg.OAuthTokenExpirySkew = auth.Key("oauth_token_expiry_skew").MustDuration(30 * time.Second)
+	cfg.OAuthTokenCacheTTL = auth.Key("oauth_token_cache_ttl").MustDuration(5 * time.Second)
+	cfg.OAuthTokenCacheMaxEntries = auth.Key("oauth_token_cache_max_entries").MustInt(10000)
 	SignoutRedirectUrl = valueAsString(auth, "signout_redirect_url", "")
 	cfg.OAuthSkipOrgRoleUpdateSync = auth.Key("oauth_skip_org_role_update_sync").MustBool(false)
 
@@ -7,6 +7,16 @@ import (
 	"gopkg.in/ini.v1"
 )
 
+// featureToggleOptions are the options of the feature management in the
+// [feature_toggles] section, which are not feature toggles.
+var featureToggleOptions = map[string]bool{
+	"enable":                      true,
+	"strict_validation":           true,
+	"auto_enable_dependencies":    true,
+	"evaluation_metrics":          true,
+	"evaluation_metrics_sampling": true,
+}
+
 // @deprecated -- should use `featuremgmt.FeatureToggles`
 func (cfg *Cfg) readFeatureToggles(iniFile *ini.File) error {
 	section := iniFile.Section("feature_toggles")
@@ -27,10 +37,11 @@ func ReadFeatureTogglesFromInitFile(featureTogglesSection *ini.Section) (map[str
 		featureToggles[feature] = true
 	}
 
-	// read all other settings under [feature_toggles]. If a toggle is
-	// present in both the value in `enable` is overridden.
+	// read all other settings under [feature_toggles], but the options of the
+	// feature management. If a toggle is present in both the value in `enable`
+	// is overridden.
 	for _, v := range featureTogglesSection.Keys() {
-		if v.Name() == "enable" {
+		if featureToggleOptions[v.Name()] {
 			continue
 		}
 
@@ -48,6 +48,19 @@ func TestFeatureToggles(t *testing.T) {
 				"feature2": false,
 			},
 		},
+		{
+			name: "the options of the feature management are not feature toggles",
+			conf: map[string]string{
+				"enable":                      "feature1",
+				"strict_validation":           "true",
+				"auto_enable_dependencies":    "true",
+				"evaluation_metrics":          "true",
+				"evaluation_metrics_sampling": "100",
+			},
+			expectedToggles: map[string]bool{
+				"feature1": true,
+			},
+		},
 		{
 			name: "invalid boolean value should return syntax error",
 			conf: map[string]string{
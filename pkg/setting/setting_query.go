@@ -0,0 +1,47 @@
+package setting
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/grafana/grafana/pkg/util"
+	"gopkg.in/ini.v1"
+)
+
+func readQuerySettings(iniFile *ini.File, cfg *Cfg) error {
+	query := iniFile.Section("query")
+	cfg.QueryDataSourceMaxConcurrent = query.Key("max_concurrent_queries_per_datasource").MustInt(0)
+	cfg.QueryDataSourceMaxPerMinute = query.Key("max_queries_per_minute_per_datasource").MustInt(0)
+	cfg.QueryMaxConcurrentDataSources = query.Key("max_concurrent_datasources").MustInt(10)
+	cfg.QueryTimeout = time.Duration(query.Key("timeout").MustInt(0)) * time.Second
+	cfg.QueryMaxRetries = query.Key("max_retries").MustInt(2)
+	cfg.QueryRetryBackoff = query.Key("retry_backoff").MustDuration(100 * time.Millisecond)
+	cfg.QueryCacheEnabled = query.Key("cache_enabled").MustBool(false)
+	cfg.QueryCacheTTL = query.Key("cache_ttl").MustDuration(time.Minute)
+	cfg.QueryCacheMaxEntries = query.Key("cache_max_entries").MustInt(1000)
+	cfg.QueryCacheTimeResolution = query.Key("cache_time_resolution").MustDuration(time.Minute)
+	cfg.QueryMaxResponseSize = query.Key("max_response_size").MustInt64(0)
+	cfg.QueryForwardUserIdentity = query.Key("forward_user_identity").MustBool(false)
+	cfg.QueryCircuitBreakerFailures = query.Key("circuit_breaker_failures").MustInt(0)
+	cfg.QueryCircuitBreakerCooldown = query.Key("circuit_breaker_cooldown").MustDuration(30 * time.Second)
+	cfg.QueryHealthCheckTTL = query.Key("health_check_ttl").MustDuration(0)
+	cfg.QueryMinInterval = query.Key("min_interval").MustDuration(0)
+	cfg.QueryMaxConcurrentRequests = query.Key("max_concurrent_requests").MustInt(0)
+	cfg.QueryMaxQueuedRequests = query.Key("max_queued_requests").MustInt(1000)
+	cfg.QueryMaxQueueTime = query.Key("max_queue_time").MustDuration(10 * time.Second)
+	cfg.QueryAuditEnabled = query.Key("audit_enabled").MustBool(false)
+	cfg.QueryAuditRedactPatterns = strings.Fields(query.Key("audit_redact_patterns").String())
+	for _, pattern := range cfg.QueryAuditRedactPatterns {
+		if _, err := regexp.Compile(pattern); err != nil {
+			return fmt.Errorf("invalid query audit redact pattern %q: %w", pattern, err)
+		}
+	}
+	cfg.QueryDeniedURLSchemes = util.SplitString(strings.ToLower(query.Key("denied_url_schemes").String()))
+	cfg.QueryDeniedHosts = util.SplitString(strings.ToLower(query.Key("denied_hosts").String()))
+	cfg.QueryDeniedMethods = util.SplitString(strings.ToUpper(query.Key("denied_methods").String()))
+	cfg.QueryBlockPrivateIPs = query.Key("block_private_ips").MustBool(false)
+
+	return nil
+}
@@ -13,7 +13,8 @@ type OrgQuota struct {
 }
 
 type UserQuota struct {
-	Org int64 `target:"org_user"`
+	Org          int64 `target:"org_user"`
+	QueryHistory int64 `target:"query_history"`
 }
 
 type GlobalQuota struct {
@@ -83,7 +84,8 @@ func (cfg *Cfg) readQuotaSettings() {
 
 	// per User limits
 	Quota.User = &UserQuota{
-		Org: quota.Key("user_org").MustInt64(10),
+		Org:          quota.Key("user_org").MustInt64(10),
+		QueryHistory: quota.Key("user_query_history").MustInt64(-1),
 	}
 
 	// Global Limits
@@ -29,8 +29,8 @@ func (tr DataTimeRange) GetFromAsSecondsEpoch() int64 {
 	return tr.GetFromAsMsEpoch() / 1000
 }
 
-func (tr DataTimeRange) GetFromAsTimeUTC() time.Time {
-	return tr.MustGetFrom().UTC()
+func (tr DataTimeRange) GetFromAsTimeUTC(options ...TimeRangeOption) time.Time {
+	return tr.MustGetFrom(options...).UTC()
 }
 
 func (tr DataTimeRange) GetToAsMsEpoch() int64 {
@@ -41,20 +41,20 @@ func (tr DataTimeRange) GetToAsSecondsEpoch() int64 {
 	return tr.GetToAsMsEpoch() / 1000
 }
 
-func (tr DataTimeRange) GetToAsTimeUTC() time.Time {
-	return tr.MustGetTo().UTC()
+func (tr DataTimeRange) GetToAsTimeUTC(options ...TimeRangeOption) time.Time {
+	return tr.MustGetTo(options...).UTC()
 }
 
-func (tr DataTimeRange) MustGetFrom() time.Time {
-	res, err := tr.ParseFrom()
+func (tr DataTimeRange) MustGetFrom(options ...TimeRangeOption) time.Time {
+	res, err := tr.ParseFrom(options...)
 	if err != nil {
 		return time.Unix(0, 0)
 	}
 	return res
 }
 
-func (tr DataTimeRange) MustGetTo() time.Time {
-	res, err := tr.ParseTo()
+func (tr DataTimeRange) MustGetTo(options ...TimeRangeOption) time.Time {
+	res, err := tr.ParseTo(options...)
 	if err != nil {
 		return time.Unix(0, 0)
 	}